@@ -17,29 +17,269 @@
 package config
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/alexflint/go-arg"
 )
 
 type Config struct {
-	Dir string `arg:"-D,--dir" default:"." placeholder:"ROOT_DIR" help:"base dir for scan and optimize (may be relative)"`
+	Dir           string            `arg:"-D,--dir" default:"." placeholder:"ROOT_DIR" help:"base dir for scan and optimize (may be relative)"`
+	Classify      bool              `arg:"--classify" help:"only list files with the optimizer that would handle them, do not optimize"`
+	Audit         bool              `arg:"--audit" help:"only count files and bytes of every format, and PNGs of every color type and bit depth (read from the header), do not optimize"`
+	CompareTools  bool              `arg:"--compare-tools" help:"only optimize every PNG in memory with each strategy (fast, default, max effort, exhaustive) and print the size each one gives and which wins, do not write anything"`
+	ExtMap        map[string]string `arg:"--ext-map" placeholder:"SUFFIX=EXT" help:"process files with nonstandard suffix as known format, e.g. .tex=png"`
+	Ext           []string          `arg:"--ext" placeholder:"EXT,..." help:"process only assets of the listed formats (case-insensitive), e.g. png,jpg; default - all known"`
+	Exclude       []string          `arg:"--exclude,separate" placeholder:"GLOB" help:"skip paths relative to --dir matching GLOB (repeatable): name pattern like *.min.png matches at any depth, pattern with / matches the whole path, ** - any number of dirs; matched dirs are not walked"`
+	Gitignore     bool              `arg:"--respect-gitignore" help:"also skip paths ignored by .gitignore files of --dir, its subdirs and parents up to the git work tree (and .git/info/exclude), as --exclude does"`
+	Strict        bool              `arg:"--strict" help:"abort on files locked by another process instead of skipping them"`
+	DryRun        bool              `arg:"-n,--dry-run" help:"only report how many bytes would be saved, do not write any file"`
+	KeepGoing     bool              `arg:"-k,--keep-going" help:"report files that failed to optimize and go on instead of aborting the run"`
+	Responsive    bool              `arg:"--responsive" help:"also write downscaled optimized foo.png for every foo@2x.png (foo@3x.png, ...) if absent"`
+	AllowWebP     bool              `arg:"--allow-webp" help:"also write lossless foo.webp next to every foo.png if it is smaller (foo.png is kept, existing foo.webp is never overwritten)"`
+	LenientDecode bool              `arg:"--lenient-decode" help:"repair and rewrite files with broken chunk CRC or missing IEND instead of failing on them"`
+	DumpPalette   string            `arg:"--dump-palette" placeholder:"FILE" help:"debug: only print palette (entries, frequencies, tRNS length) the optimizer would build for single image FILE, an error if it builds none (16-bit, more than 256 colors)"`
+	Exhaustive    bool              `arg:"--exhaustive" help:"try every PNG variant at every bit depth and row filter, ignores --effort, several times slower"`
+	PNGLevel      string            `arg:"--png-level" default:"best" placeholder:"LEVEL" help:"zlib level of written PNGs: best, default, speed or none; lower levels are much faster but give bigger files"`
+	LossyJPEG     bool              `arg:"--lossy-jpeg" help:"also re-encode JPEG files at --jpeg-quality, which is LOSSY (and always 4:2:0 chroma), the original is replaced only if the result is smaller"`
+	JPEGQuality   int               `arg:"--jpeg-quality" default:"100" placeholder:"1..100" help:"quality of JPEG re-encoded with --lossy-jpeg"`
+	ReportJSON    string            `arg:"--report-json" placeholder:"PATH" help:"also write JSON report (per file records and summary) to PATH, - for stdout (the log then goes to stderr)"`
+	IncludeNoop   bool              `arg:"--include-noop" help:"also list files left as is in --report-json, with sha256 of their unchanged data; by default the report lists only optimized and failed files"`
+	SummaryOnly   bool              `arg:"--summary-only" help:"write only the summary (totals, per format, duration) to --report-json, without a record per file"`
+	ReportLimit   int               `arg:"--report-max-files" default:"10000" placeholder:"N" help:"write --report-json summary only if it would have more than N file records, 0 - no limit"`
+	Events        string            `arg:"--events" placeholder:"NDJSON" help:"also append a JSON line per file event (start, then noop, saved or error with sizes and variant) to NDJSON as files go, - for stdout (the log then goes to stderr), /dev/fd/N for a file descriptor"`
+	NoCache       bool              `arg:"--no-cache" help:"process all files, ignoring and not updating the cache of files unchanged since the previous run (.sboptimizer-cache.json in --dir or --output-dir)"`
+	MinSize       int64             `arg:"--min-size" default:"0" placeholder:"BYTES" help:"skip files smaller than BYTES without reading them, 0 - no limit"`
+	MinSavedPct   float64           `arg:"--min-savings-pct" default:"0" placeholder:"PCT" help:"leave a file as is unless it shrinks by at least PCT percent, 0 - any saving"`
+	MinSavedBytes int64             `arg:"--min-savings-bytes" default:"0" placeholder:"BYTES" help:"leave a file as is unless it shrinks by at least BYTES, 0 - any saving"`
+	Workers       int               `arg:"-j,--workers" default:"0" placeholder:"N" help:"number of assets optimized in parallel, 0 - number of CPUs, 1 - sequential with deterministic output order"`
+	MinifyJSON    bool              `arg:"--minify-json" help:"also minify JSON assets (.config, .object, .item, .frames, standalone and in paks): whitespace, comments and trailing commas are dropped"`
+	ConvertBMP    bool              `arg:"--convert-bmp" help:"replace every foo.bmp with optimized foo.png if it is smaller and foo.png does not exist yet (asset references must be updated by hand)"`
+	KeepMetadata  bool              `arg:"--keep-metadata" help:"keep color space chunks (gAMA, cHRM, sRGB, iCCP) of optimized PNGs and leave TIFFs with a color profile as is, other metadata (text, time, ...) is always stripped"`
+	Backup        bool              `arg:"--backup" help:"copy every file to file + --backup-suffix before it is rewritten in place, an existing backup is kept (see --backup-strict)"`
+	BackupSuffix  string            `arg:"--backup-suffix" default:".bak" placeholder:"SUFFIX" help:"suffix of --backup copies"`
+	BackupStrict  bool              `arg:"--backup-strict" help:"with --backup fail a file whose backup already exists instead of keeping the existing backup"`
+	Plan          string            `arg:"--plan" placeholder:"FILE" help:"only write to FILE the plan of what would be optimized (every file with its size, mtime and expected optimized size), do not write anything else (implies --dry-run)"`
+	Apply         string            `arg:"--apply" placeholder:"FILE" help:"optimize exactly the files planned in FILE by --plan instead of walking --dir, a file changed since the plan or optimized to other size than planned is warned and left as is"`
+	OutputDir     string            `arg:"-o,--output-dir" placeholder:"DST" help:"leave --dir untouched and write optimized files to the same relative paths in DST, files that do not shrink are copied as is (DST must not overlap --dir)"`
+	CASOut        string            `arg:"--cas-out" placeholder:"DIR" help:"leave --dir untouched and store every file as DIR/<sha256><ext> (files that do not shrink as is, identical results once), DIR/manifest.json maps relative paths to those names; the cache is not used"`
+	FollowLinks   bool              `arg:"--follow-symlinks" help:"walk symlinked dirs and optimize symlinked files by rewriting their targets, every real dir and file is visited once (loops are cut); otherwise symlinks are logged and skipped"`
+	Serve         string            `arg:"--serve" placeholder:"ADDR" help:"instead of optimizing --dir serve POST /optimize?ext=png over HTTP at ADDR (e.g. :8080) until Ctrl-C: the body is optimized with the other settings, the response is the optimized data, or 204 if it is left as is (no TLS, for internal use)"`
+	Watch         bool              `arg:"--watch" help:"after the run keep watching --dir and optimize created and changed files (debounced) until Ctrl-C, which prints the stats of the whole session"`
+	FilesFrom     string            `arg:"--files-from" placeholder:"FILE" help:"process only files listed in FILE (one per line, relative to --dir or absolute), - for stdin, instead of walking the whole --dir"`
+	Quiet         bool              `arg:"-q,--quiet" help:"print only warnings, errors and the final stats, without a line per file (same as --log-level warn)"`
+	LogLevel      string            `arg:"--log-level" default:"info" placeholder:"LEVEL" help:"drop log messages below LEVEL: debug (also files skipped as small, cached or excluded), info, warn or error; the final stats are always printed"`
+	LogJSON       bool              `arg:"--log-json" help:"print the log as JSON lines (time, level, msg, and path, ext, orig, opt, saved, variant of a file), the final stats as one summary line"`
+	Progress      bool              `arg:"--progress" help:"count files first, then show processed N/M, saved bytes and ETA (in place on a terminal, a plain line every 10s otherwise)"`
+	LargestFirst  bool              `arg:"--largest-first" help:"count files first, then optimize them from the biggest to the smallest, so with several workers a huge file does not finish the run alone"`
+	Verify        bool              `arg:"--verify" default:"true" help:"decode every optimized PNG back and keep the original if any pixel differs, --verify=false to skip"`
+	Effort        int               `arg:"--effort" default:"1" placeholder:"0..3" help:"0 - only re-encode, 1 - also try every lossless variant (gray, paletted), 2..3 - also try every png row filter on the best variant"`
 }
 
 var (
 	description = "StarBound assets optimizer (lossless obfuscate) util"
+
+	examples = `Examples:
+  # optimize all assets of the mod in-place
+  sboptimizer --dir "/starbound/mods/my_cool_mod"
+
+  # preview savings without touching any file
+  sboptimizer --dir "my_cool_mod" --dry-run
+
+  # only list which files would be optimized and by which optimizer
+  sboptimizer --dir "my_cool_mod" --classify
+
+  # quick overview of the mod before a full run: how many PNGs are RGBA, paletted, gray
+  sboptimizer --dir "my_cool_mod" --audit
+
+  # which effort is worth it for this mod: sizes every strategy gives, per PNG and in total
+  sboptimizer --dir "my_cool_mod" --compare-tools
+
+  # also minify JSON configs (their comments are dropped!)
+  sboptimizer --dir "my_cool_mod" --minify-json
+
+  # also process PNG data stored with a nonstandard extension
+  sboptimizer --dir "my_cool_mod" --ext-map .tex=png
+
+  # optimize only PNG and GIF files, leave the rest alone
+  sboptimizer --dir "my_cool_mod" --ext png,gif
+
+  # also re-encode JPEG files, with some loss of quality
+  sboptimizer --dir "my_cool_mod" --lossy-jpeg --jpeg-quality 95
+
+  # leave vendored and pre-minified files alone
+  sboptimizer --dir "my_cool_mod" --exclude vendor --exclude "*.min.png"
+
+  # skip generated and vendored art listed in .gitignore
+  sboptimizer --dir "my_cool_mod" --respect-gitignore
+
+  # also write smaller lossless WebP copies of PNGs (Starbound itself loads only PNG)
+  sboptimizer --dir "my_cool_mod" --allow-webp
+
+  # keep a copy of every rewritten file as foo.png.orig
+  sboptimizer --dir "my_cool_mod" --backup --backup-suffix .orig
+
+  # review what would change first, then optimize exactly that
+  sboptimizer --dir "my_cool_mod" --plan plan.json
+  sboptimizer --dir "my_cool_mod" --apply plan.json
+
+  # keep the originals, write the optimized mod to a separate dir
+  sboptimizer --dir "my_cool_mod" --output-dir "my_cool_mod_optimized"
+
+  # content-addressed build cache: identical results of all mods are stored once
+  sboptimizer --dir "my_cool_mod" --cas-out "/var/cache/sbassets"
+
+  # optimize only assets changed since the last release tag
+  git diff --name-only v1.0 -- my_cool_mod | sboptimizer --dir . --files-from -
+
+  # optimize sprites on every save while working on the mod, Ctrl-C prints the stats
+  sboptimizer --dir "my_cool_mod" --watch
+
+  # optimization service for a build farm: curl --data-binary @icon.png "localhost:8080/optimize?ext=png"
+  sboptimizer --serve :8080 --effort 3
+
+  # convert uncompressed BMP tilesets to optimized PNG
+  sboptimizer --dir "my_cool_mod" --convert-bmp
+
+  # repair and optimize PNGs with broken chunk checksums
+  sboptimizer --dir "my_cool_mod" --lenient-decode
+
+  # do not stop on broken files, report them and count in the final stats
+  sboptimizer --dir "my_cool_mod" --keep-going
+
+  # show how far along a big run is
+  sboptimizer --dir "my_cool_mod" --progress
+
+  # start big atlases first so that all workers stay busy to the end
+  sboptimizer --dir "my_cool_mod" --largest-first --progress
+
+  # only warnings, errors and the final stats
+  sboptimizer --dir "my_cool_mod" --quiet
+
+  # the log as JSON lines for a log collector, with skipped files too
+  sboptimizer --dir "my_cool_mod" --log-json --log-level debug
+
+  # machine-readable results for CI
+  sboptimizer --dir "my_cool_mod" --report-json - > report.json
+
+  # record every processed file with the hash of unchanged ones, e.g. for an integrity check
+  sboptimizer --dir "my_cool_mod" --report-json report.json --include-noop
+
+  # only the totals of a huge run, without the megabytes of per-file records
+  sboptimizer --dir "my_cool_mod" --report-json report.json --summary-only
+
+  # live per-file events for a dashboard, one JSON object per line
+  sboptimizer --dir "my_cool_mod" --events events.ndjson & tail -f events.ndjson
+
+  # optimize files one by one, the log is in the same order on every run
+  sboptimizer --dir "my_cool_mod" --workers 1
+
+  # quick iteration: much faster run at the cost of bigger PNGs
+  sboptimizer --dir "my_cool_mod" --png-level speed
+
+  # do not rewrite files for a gain below 1% or 64 bytes
+  sboptimizer --dir "my_cool_mod" --min-savings-pct 1 --min-savings-bytes 64
+
+  # re-process every file even if it is unchanged since the previous run
+  sboptimizer --dir "my_cool_mod" --no-cache
+
+  # faster run without decoding optimized PNGs back for the pixel check
+  sboptimizer --dir "my_cool_mod" --verify=false
+
+  # show how the palette of a single image is built
+  sboptimizer --dump-palette "my_cool_mod/items/icon.png"
+`
 )
 
 func (c *Config) init() (err error) {
 
-	arg.MustParse(c)
+	p, err := arg.NewParser(arg.Config{}, c)
+
+	if err != nil {
+		return err
+	}
+
+	if err = p.Parse(os.Args[1:]); err != nil {
+
+		if err == arg.ErrHelp {
+			p.WriteHelp(os.Stdout)
+			os.Exit(0)
+		}
+
+		// NOTE go-arg сам по себе выводит только usage, без примеров
+		p.WriteUsage(os.Stderr)
+		fmt.Fprintf(os.Stderr, "error: %s\n\n%s\nRun with --help to see all options.\n", err, examples)
+
+		return fmt.Errorf("command line: %w", err)
+	}
 
 	return c.validate()
 }
 
 func (c *Config) validate() (err error) {
 
+	// NOTE go-arg принимает список через пробел (--ext png jpg), поддерживаем и привычное --ext png,jpg
+	var ext []string
+
+	for _, v := range c.Ext {
+		for _, e := range strings.Split(v, ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				ext = append(ext, e)
+			}
+		}
+	}
+
+	c.Ext = ext
+
+	if c.Effort < 0 || c.Effort > 3 {
+		return fmt.Errorf("--effort %d must be in range 0..3", c.Effort)
+	}
+
+	// NOTE отрицательное число воркеров не имеет смысла, считаем его "auto"
+	if c.Workers < 0 {
+		c.Workers = 0
+	}
+
+	if c.MinSize < 0 {
+		return fmt.Errorf("--min-size %d must not be negative", c.MinSize)
+	}
+
+	if c.ReportLimit < 0 {
+		return fmt.Errorf("--report-max-files %d must not be negative", c.ReportLimit)
+	}
+
+	if c.JPEGQuality < 1 || c.JPEGQuality > 100 {
+		return fmt.Errorf("--jpeg-quality %d must be in range 1..100", c.JPEGQuality)
+	}
+
+	// NOTE дальше суффикс идет как признак: пустой - копий не делать
+	if !c.Backup {
+		c.BackupSuffix = ""
+	} else if c.BackupSuffix == "" {
+		return fmt.Errorf("--backup-suffix must not be empty")
+	}
+
+	// NOTE --watch следит за всем --dir, список файлов ему противоречит
+	if c.Watch && c.FilesFrom != "" {
+		return fmt.Errorf("--watch can not be used with --files-from")
+	}
+
+	// NOTE план - это тоже список файлов, и он должен быть исполнен целиком как есть
+	if c.Apply != "" && (c.Plan != "" || c.FilesFrom != "" || c.Watch) {
+		return fmt.Errorf("--apply can not be used with --plan, --files-from or --watch")
+	}
+
+	if c.Plan != "" && c.Watch {
+		return fmt.Errorf("--plan can not be used with --watch")
+	}
+
+	// NOTE сервер не обходит --dir вовсе
+	if c.Serve != "" && (c.Watch || c.Plan != "" || c.Apply != "" || c.FilesFrom != "") {
+		return fmt.Errorf("--serve can not be used with --watch, --plan, --apply or --files-from")
+	}
+
 	p, err := filepath.Abs(c.Dir)
 
 	if err != nil {
@@ -60,6 +300,11 @@ func (c *Config) Description() string {
 	return description
 }
 
+// Epilogue impl arg.Epilogued
+func (c *Config) Epilogue() string {
+	return examples
+}
+
 //
 
 func New() (c *Config, err error) {
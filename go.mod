@@ -2,6 +2,13 @@ module github.com/Illirgway/sboptimizeassets
 
 go 1.20
 
-require github.com/alexflint/go-arg v1.5.1
+require (
+	github.com/alexflint/go-arg v1.5.1
+	github.com/fsnotify/fsnotify v1.8.0
+	golang.org/x/image v0.24.0
+)
 
-require github.com/alexflint/go-scalar v1.2.0 // indirect
+require (
+	github.com/alexflint/go-scalar v1.2.0 // indirect
+	golang.org/x/sys v0.13.0 // indirect
+)
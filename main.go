@@ -17,7 +17,12 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/Illirgway/sboptimizeassets/config"
 	"github.com/Illirgway/sboptimizeassets/service"
@@ -36,15 +41,140 @@ func main() {
 		log.Fatalln("Config error: ", err)
 	}
 
-	srv, err := service.NewAssetsOptimizer(cfg.Dir)
+	srv, err := service.NewAssetsOptimizer(cfg.Dir,
+		service.WithSettings(service.Settings{
+			ExtMap:        cfg.ExtMap,
+			Extensions:    cfg.Ext,
+			Exclude:       cfg.Exclude,
+			Gitignore:     cfg.Gitignore,
+			Strict:        cfg.Strict,
+			KeepGoing:     cfg.KeepGoing,
+			Responsive:    cfg.Responsive,
+			AllowWebP:     cfg.AllowWebP,
+			LenientDecode: cfg.LenientDecode,
+			Effort:        cfg.Effort,
+			NoVariants:    cfg.Effort == service.EffortFast,
+			LossyJPEG:     cfg.LossyJPEG,
+			JPEGQuality:   cfg.JPEGQuality,
+			PNGLevel:      cfg.PNGLevel,
+			Exhaustive:    cfg.Exhaustive,
+			NoVerify:      !cfg.Verify,
+			KeepMetadata:  cfg.KeepMetadata,
+			ConvertBMP:    cfg.ConvertBMP,
+			MinifyJSON:    cfg.MinifyJSON,
+			Backup:        cfg.BackupSuffix,
+			BackupStrict:  cfg.BackupStrict,
+			OutputDir:     cfg.OutputDir,
+			CASDir:        cfg.CASOut,
+			Plan:          cfg.Plan,
+			Apply:         cfg.Apply,
+			FilesFrom:     cfg.FilesFrom,
+			FollowLinks:   cfg.FollowLinks,
+			ReportJSON:    cfg.ReportJSON,
+			IncludeNoop:   cfg.IncludeNoop,
+			SummaryOnly:   cfg.SummaryOnly,
+			ReportLimit:   cfg.ReportLimit,
+			Events:        cfg.Events,
+			MinSavedPct:   cfg.MinSavedPct,
+			MinSavedBytes: cfg.MinSavedBytes,
+			Cache:         !cfg.NoCache,
+			Progress:      cfg.Progress,
+			LargestFirst:  cfg.LargestFirst,
+			Quiet:         cfg.Quiet,
+			LogLevel:      cfg.LogLevel,
+			LogJSON:       cfg.LogJSON,
+		}),
+		service.WithWorkers(cfg.Workers),
+		service.WithDryRun(cfg.DryRun),
+		service.WithMinSize(cfg.MinSize),
+	)
 
 	if err != nil {
 		log.Fatalln("Assets Optimizer forge error: ", err)
 	}
 
-	if err = srv.Run(); err != nil {
+	if cfg.DumpPalette != "" {
+
+		if err = srv.DumpPalette(cfg.DumpPalette); err != nil {
+			log.Fatalln("Assets Optimizer dump palette error: ", err)
+		}
+
+		return
+	}
+
+	if cfg.Classify {
+
+		if err = srv.Classify(); err != nil {
+			log.Fatalln("Assets Optimizer classify error: ", err)
+		}
+
+		return
+	}
+
+	if cfg.Audit {
+
+		if err = srv.Audit(); err != nil {
+			log.Fatalln("Assets Optimizer audit error: ", err)
+		}
+
+		return
+	}
+
+	if cfg.CompareTools {
+
+		if err = srv.Compare(); err != nil {
+			log.Fatalln("Assets Optimizer compare error: ", err)
+		}
+
+		return
+	}
+
+	// NOTE первый Ctrl-C (SIGINT) / SIGTERM дает дооптимизировать начатые ассеты, второй завершает процесс сразу,
+	//      убрав только временные файлы недописанных
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+
+		<-ctx.Done()
+
+		again := make(chan os.Signal, 1)
+		signal.Notify(again, os.Interrupt, syscall.SIGTERM)
+
+		stop()
+
+		<-again
+
+		log.Fatalf("Assets Optimizer killed, removed %d temp file(s)\n", service.RemoveTempFiles())
+	}()
+
+	if cfg.Serve != "" {
+
+		if err = srv.Serve(ctx, cfg.Serve); err != nil {
+			srv.PrintStat()
+			log.Fatalln("Assets Optimizer serve error: ", err)
+		}
+
+		srv.PrintStat()
+
+		return
+	}
+
+	if err = srv.RunContext(ctx); err != nil {
+
+		if errors.Is(err, context.Canceled) {
+			srv.PrintStat()
+		}
+
 		log.Fatalln("Assets Optimizer run error: ", err)
 	}
 
+	if cfg.Watch {
+		if err = srv.Watch(ctx); err != nil {
+			srv.PrintStat()
+			log.Fatalln("Assets Optimizer watch error: ", err)
+		}
+	}
+
 	srv.PrintStat()
 }
@@ -17,102 +17,1480 @@
 package service
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
 type stats struct {
-	n uint64
-	c uint
+	files    uint // processed successfully (optimized or NOOP)
+	n        uint64
+	c        uint
+	locked   uint
+	errors   uint
+	small    uint // skipped as smaller than min size
+	excluded uint // files skipped by exclude patterns or .gitignore (files of pruned dirs are not counted)
+	unlisted uint // --files-from entries skipped as missing, irregular or outside of the root dir
+	symlinks uint // symlinks skipped as not followed or broken, and paths already visited through another one
+	webp     uint // WebP siblings written (or would be written in dry run)
+	webpN    uint64
+	cached   uint // skipped as unchanged since the previous run
+	changed  uint // planned assets skipped as changed since the plan or optimized differently, see Settings.Apply
+	metadata uint64
+
+	// NOTE размеры до/после по всем успешно обработанным ассетам, NOOP входит в оба как есть (1:1),
+	//      упавшие и пропущенные не входят вовсе
+	origTotal uint64
+	optTotal  uint64
+}
+
+type AssetsOptimizer struct {
+	dir        string
+	fsys       fs.FS  // nil - dir is the path on the OS filesystem, see NewAssetsOptimizerFS
+	outputDir  string // "" - in-place
+	casDir     string // "" - no content-addressed output, see Settings.CASDir
+	filesFrom  string // "" - walk the whole dir
+	planPath   string // "" - no plan is written
+	applyPath  string // "" - walk the whole dir (or filesFrom)
+	extMap     map[string]string
+	registry   *Registry
+	extensions map[string]struct{} // nil - all registered
+	exclude    []excludePattern
+	gitignore  *gitignore // nil - .gitignore files are not respected
+	strict     bool
+	keepGoing  bool
+	responsive bool
+	allowWebP  bool
+	workers    int
+	minSize    int64
+	opts       OptimizeOptions
+	own        map[string]struct{} // files of the run itself, see ownFiles
+
+	cache *manifestCache // nil - disabled
+
+	events *eventStream // of the current run or watch, nil - no events
+
+	followSymlinks bool
+
+	showProgress bool
+	progress     *progress // of the current run, nil - disabled
+	largestFirst bool
+
+	reportPath string
+	eventsPath string
+	log        io.Writer // human readable log, stdout unless JSON report goes there
+	logLevel   logLevel  // messages below are dropped, PrintStat is always written
+	logJSON    bool      // NDJSON log records instead of text lines, see logRecord
+	started    time.Time // the first run, PrintStat covers everything since
+
+	includeNoop    bool // NOOP assets are recorded in the report too
+	reportLimit    int  // 0 - no limit
+	summaryOnly    bool // the report has no file records, set by the run too once it has more than reportLimit
+	recordsDropped bool // summaryOnly is set by the run
+
+	mu      sync.Mutex // stats, records and log of parallel run
+	stats   stats
+	byExt   map[string]*stats // the same stats per asset format (only processed and failed assets are counted)
+	records []reportRecord
+	plan    []planEntry
+	cas     map[string]string // files of casManifest
+}
+
+type Settings struct {
+	// Registry optimizers of asset formats, nil - all built-in ones configured by the rest of Settings (PNGLevel)
+	Registry *Registry
+	// ExtMap maps nonstandard file name suffix (".tex", ".png.bak") to known asset format ("png")
+	ExtMap map[string]string
+	// Extensions if not empty limits processed assets to the listed formats ("png", "jpg"), after ExtMap applied
+	Extensions []string
+	// Exclude glob patterns of paths relative to the root dir to skip, matched dirs are not walked at all,
+	// see excludePattern
+	Exclude []string
+	// Gitignore also skips paths ignored by .gitignore files of the root dir, its subdirs and parent dirs up to
+	// the git work tree, as Exclude does, see gitignore
+	Gitignore bool
+	// Strict aborts the run on asset locked by another process instead of skipping it
+	Strict bool
+	// KeepGoing reports and counts asset that failed to optimize and goes on instead of aborting the run
+	KeepGoing bool
+	// Responsive also emits downscaled @1x sidecar for every @2x/@3x/... asset (existing files are never touched)
+	Responsive bool
+	// AllowWebP also writes lossless foo.webp next to foo.png if it is smaller (existing files are never touched),
+	// the png itself is kept
+	AllowWebP bool
+	// LenientDecode see OptimizeOptions
+	LenientDecode bool
+	// Effort see OptimizeOptions, 0 means EffortDefault, EffortFast is set by NoVariants
+	Effort int
+	// NoVariants turns off the search of lossless variants (gray, paletted, ...), every asset is just re-encoded,
+	// i.e. EffortFast
+	NoVariants bool
+	// LossyJPEG registers JPEGOptimizer for .jpg and .jpeg assets, which re-encodes them with loss, so it is off
+	// by default
+	LossyJPEG bool
+	// JPEGQuality see OptimizeOptions
+	JPEGQuality int
+	// PNGLevel zlib level of every encoded PNG: "best" (default if empty), "default", "speed" or "none"
+	PNGLevel string
+	// Exhaustive makes PNG optimizer try variants it skips by heuristics, see WithExhaustive
+	Exhaustive bool
+	// DryRun see OptimizeOptions
+	DryRun bool
+	// NoVerify turns off the check of every optimized asset against its source (see OptimizeOptions.Verify),
+	// which is on by default
+	NoVerify bool
+	// KeepMetadata see OptimizeOptions
+	KeepMetadata bool
+	// ConvertBMP see OptimizeOptions
+	ConvertBMP bool
+	// MinifyJSON registers JSONOptimizer for .config, .object, .item and .frames assets (standalone and in paks),
+	// which strips their comments, so it is off by default
+	MinifyJSON bool
+	// FollowLinks walks symlinked dirs and optimizes symlinked files by rewriting their targets (wherever they
+	// are), otherwise symlinks are reported and skipped; every real dir and file is visited once, see visitedFiles
+	FollowLinks bool
+	// FilesFrom if not empty is the file (filesFromStdin for stdin) with newline separated list of files to process
+	// (relative to the root dir or absolute) instead of walking the whole root dir
+	FilesFrom string
+	// CASDir if not empty keeps the root dir untouched: every asset is stored in CASDir as <sha256 of its data><ext>
+	// (the original data for NOOP), identical results are stored once, and CASDir/manifest.json maps relative paths
+	// of assets to those names; only assets with FSOptimizer are optimized, the rest are stored as is. Must not
+	// overlap the root dir, the cache is not used
+	CASDir string
+	// Plan if not empty is the path the plan of the run is written to: every asset that would be optimized with its
+	// size, modification time and expected optimized size; implies DryRun
+	Plan string
+	// Apply if not empty is the path of the plan (see Plan) to execute instead of walking the root dir: only planned
+	// assets are optimized, an asset changed since the plan or optimized to other size than planned is warned and
+	// left as is
+	Apply string
+	// OutputDir if not empty keeps the root dir untouched: every optimized asset is written to the same relative
+	// path in OutputDir, assets that do not shrink are copied there as is; must not overlap the root dir
+	OutputDir string
+	// ReportJSON path of JSON report of the run, "-" for stdout (the log then goes to stderr), empty - no report
+	ReportJSON string
+	// IncludeNoop also records assets left as is in the JSON report, with sha256 of their unchanged data, otherwise
+	// it lists only optimized and failed assets (the summary counts all of them anyway)
+	IncludeNoop bool
+	// SummaryOnly writes only the summary to the JSON report, without per asset records
+	SummaryOnly bool
+	// ReportLimit turns on SummaryOnly if the JSON report would have more records, 0 - no limit
+	ReportLimit int
+	// Events path of NDJSON stream of asset events (start, then noop, saved or error with the fields of the report
+	// record), "-" for stdout (the log then goes to stderr), e.g. /dev/fd/3 for file descriptor; appended to
+	// as assets go, empty - no events
+	Events string
+	// Cache skips assets unchanged since the previous run according to manifest cache in the root dir
+	// or OutputDir (see cacheFileName), which is updated at the end of the run
+	Cache bool
+	// Log receives the human readable log of the run and the listings of Classify, Audit and DumpPalette,
+	// nil - stdout (stderr if ReportJSON or Events go to stdout)
+	Log io.Writer
+	// Quiet drops per asset reports and run banners from the log, leaving only warnings, errors and PrintStat,
+	// i.e. raises LogLevel to LogWarn
+	Quiet bool
+	// LogLevel messages of lower level (LogDebug, LogInfo, LogWarn, LogError) are dropped from the log, empty is
+	// LogInfo; PrintStat is always written
+	LogLevel string
+	// LogJSON writes the log as NDJSON records (time, level, msg and path, ext, orig, opt, saved, variant of asset)
+	// instead of text lines, the listings of Classify, Audit and DumpPalette stay text
+	LogJSON bool
+	// Progress counts assets before the run and shows processed N/M, saved bytes and ETA along with the log
+	Progress bool
+	// LargestFirst counts assets before the run (as Progress does) and optimizes them from the biggest to the
+	// smallest, so with several workers a huge asset is not left alone at the tail of the run
+	LargestFirst bool
+	// MinSize assets smaller than MinSize bytes are skipped without being read, 0 - no limit
+	MinSize int64
+	// Backup, BackupStrict, MinSavedPct, MinSavedBytes see OptimizeOptions
+	Backup        string
+	BackupStrict  bool
+	MinSavedPct   float64
+	MinSavedBytes int64
+	// Workers number of assets optimized concurrently, 1 keeps sequential deterministic output,
+	// 0 or negative means runtime.NumCPU()
+	Workers int
+}
+
+// Option sets one of Settings of NewAssetsOptimizer (NewAssetsOptimizerFS), options apply in order
+type Option func(s *Settings)
+
+// WithSettings sets every non-zero field of settings, the fields it leaves zero keep the values set by the options
+// before it
+func WithSettings(settings Settings) Option {
+	return func(s *Settings) {
+
+		// NOTE поля перебираются через reflect, чтобы новое поле Settings не нужно было добавлять еще и сюда
+		dst, src := reflect.ValueOf(s).Elem(), reflect.ValueOf(settings)
+
+		for i := 0; i < src.NumField(); i++ {
+			if f := src.Field(i); !f.IsZero() {
+				dst.Field(i).Set(f)
+			}
+		}
+	}
+}
+
+// WithWorkers see Settings.Workers
+func WithWorkers(n int) Option {
+	return func(s *Settings) {
+		s.Workers = n
+	}
+}
+
+// WithDryRun see Settings.DryRun
+func WithDryRun(dryRun bool) Option {
+	return func(s *Settings) {
+		s.DryRun = dryRun
+	}
+}
+
+// WithMinSize see Settings.MinSize
+func WithMinSize(size int64) Option {
+	return func(s *Settings) {
+		s.MinSize = size
+	}
+}
+
+// WithLogger see Settings.Log
+func WithLogger(w io.Writer) Option {
+	return func(s *Settings) {
+		s.Log = w
+	}
+}
+
+func applyOptions(opts []Option) (settings Settings) {
+
+	for _, opt := range opts {
+		opt(&settings)
+	}
+
+	return settings
+}
+
+// effort levels
+const (
+	EffortFast    = 0 // single re-encode of decoded asset
+	EffortDefault = 1 // compare all lossless variants (gray, paletted etc.)
+	EffortMax     = 3 // NOTE 2 and 3 also try every png row filter on the best variant, other extra searches are reserved
+)
+
+// OptimizeOptions are run-wide options passed to every AssetOptimizer.Optimize call
+type OptimizeOptions struct {
+	// LenientDecode tries to repair assets that strict decoder rejects (but whose data is recoverable)
+	LenientDecode bool
+	// Effort EffortFast .. EffortMax
+	Effort int
+	// JPEGQuality 1..100 of re-encoded jpeg, 0 means JPEGQualityDefault
+	JPEGQuality int
+	// DryRun reports what would be saved without writing anything
+	DryRun bool
+	// Verify decodes optimized png back and refuses to save it unless every pixel matches the source
+	Verify bool
+	// KeepMetadata keeps color space chunks (gAMA, cHRM, sRGB, iCCP) of optimized png and leaves tiff with ICC
+	// profile as is, all other metadata is always stripped
+	KeepMetadata bool
+	// ConvertBMP replaces bmp with optimized png of the same name, otherwise bmp is NOOP
+	ConvertBMP bool
+	// Backup suffix of the copy of the original made before the asset is rewritten in-place, "" - no backup
+	Backup string
+	// BackupStrict fails the asset whose backup already exists instead of keeping the existing backup
+	BackupStrict bool
+	// MinSavedPct asset saving less than MinSavedPct percent of its size is left as is (NOOP), 0 - any saving
+	MinSavedPct float64
+	// MinSavedBytes asset saving less than MinSavedBytes is left as is (NOOP), 0 - any saving
+	MinSavedBytes int64
+	// Output path the optimized asset is written to instead of replacing the source (which is then left as is),
+	// empty - in-place; unlike the rest of options it is set per asset, see Settings.OutputDir
+	Output string
+
+	// NOTE только внутри прогона AssetsOptimizer, для контейнеров (pak), чьи записи тоже оптимизируются
+	lookup  func(path string) AssetOptimizer // optimizer of the run for path (ext map, ext filter), nil - none
+	slots   workerSlots                      // of the run, nil - not limited
+	planned int64                            // size the asset must be optimized to (see Settings.Apply), 0 - any
+}
+
+// keepOriginal marks res as NOOP if its best variant is not smaller than the original, or saves less than the
+// thresholds of opts
+func (opts *OptimizeOptions) keepOriginal(res *OptimizeResult) bool {
+
+	n := res.Size - res.OptimizedSize
+
+	if n <= 0 {
+		res.NOOP = true
+		return true
+	}
+
+	if n >= opts.MinSavedBytes && float64(n)*100 >= opts.MinSavedPct*float64(res.Size) {
+		return false
+	}
+
+	reason := fmt.Sprintf("saves only %d bytes (%.2f%%)", n, float64(n)/float64(res.Size)*100)
+
+	if res.Reason != "" {
+		reason = res.Reason + ", " + reason
+	}
+
+	res.NOOP, res.Reason = true, reason
+
+	return true
+}
+
+// OptimizeResult describes single optimized asset
+type OptimizeResult struct {
+	// Size original asset size
+	Size int64
+	// OptimizedSize size of the best found variant, for NOOP 0 if nothing was encoded at all
+	OptimizedSize int64
+	// Variant name of the best found variant, e.g. "paletted", with extra notes (", de-interlaced")
+	Variant string
+	// NOOP asset is left as is
+	NOOP bool
+	// Metadata bytes of metadata (text, time, color profile, ... chunks) stripped from the asset
+	Metadata int64
+	// Reason why asset is left as is, may be empty
+	Reason string
+}
+
+// Saved returns number of saved bytes, 0 for NOOP and for asset rewritten without size gain (e.g. repaired)
+func (r *OptimizeResult) Saved() uint {
+
+	if r.NOOP || r.OptimizedSize >= r.Size {
+		return 0
+	}
+
+	return uint(r.Size - r.OptimizedSize)
+}
+
+// finalSize size of the asset after optimization, the original one for NOOP
+// (NOTE починенный файл пишется даже если стал больше, поэтому не Size - Saved())
+func (r *OptimizeResult) finalSize() int64 {
+
+	if r.NOOP {
+		return r.Size
+	}
+
+	return r.OptimizedSize
+}
+
+// AssetOptimizer optimizes asset in-place
+type AssetOptimizer interface {
+	Optimize(path string, opts *OptimizeOptions) (OptimizeResult, error)
+}
+
+// assetExt returns lowercased file extension without leading dot
+func assetExt(path string) string {
+
+	ext := filepath.Ext(path)
+
+	if ext == "" {
+		return ""
+	}
+
+	return strings.ToLower(ext[1:])
+}
+
+// resolveExt returns asset format for path, taking into account ext map overrides (the longest matched suffix wins)
+func (ao *AssetsOptimizer) resolveExt(path string) string {
+
+	if len(ao.extMap) > 0 {
+
+		var (
+			name = strings.ToLower(filepath.Base(path))
+			ext  string
+			n    int
+		)
+
+		for suffix, to := range ao.extMap {
+			if len(suffix) > n && strings.HasSuffix(name, suffix) {
+				ext, n = to, len(suffix)
+			}
+		}
+
+		if n > 0 {
+			return ext
+		}
+	}
+
+	return assetExt(path)
+}
+
+// optimizerFor returns optimizer registered for ext, or nil if there is none or ext is filtered out by Extensions
+func (ao *AssetsOptimizer) optimizerFor(ext string) AssetOptimizer {
+
+	if ao.extensions != nil {
+		if _, ok := ao.extensions[ext]; !ok {
+			return nil
+		}
+	}
+
+	return ao.registry.Lookup(ext)
+}
+
+// skipExcluded checks path against exclude patterns and .gitignore, excluded dir is pruned with filepath.SkipDir
+func (ao *AssetsOptimizer) skipExcluded(path string, d fs.DirEntry) (_ bool, err error) {
+
+	if len(ao.exclude) == 0 && ao.gitignore == nil {
+		return false, nil
+	}
+
+	rel, err := filepath.Rel(ao.dir, path)
+
+	if err != nil {
+		return false, err
+	}
+
+	if excluded, err := ao.isExcluded(rel, d.IsDir()); !excluded || err != nil {
+		return false, err
+	}
+
+	if d.IsDir() {
+		return true, filepath.SkipDir
+	}
+
+	ao.mu.Lock()
+	ao.stats.excluded++
+	ao.logSkip(path, "excluded")
+	ao.mu.Unlock()
+
+	return true, nil
+}
+
+// asset is a file some optimizer is registered for
+type asset struct {
+	path      string
+	ext       string
+	size      int64
+	optimizer AssetOptimizer
+	target    string // real file behind symlink path (see Settings.FollowLinks), "" - path itself
+	planned   int64  // optimized size expected by the plan (see Settings.Apply), 0 - no plan
+}
+
+// file is the path the asset is read from and rewritten at
+func (a *asset) file() string {
+
+	if a.target != "" {
+		return a.target
+	}
+
+	return a.path
+}
+
+// walkAssets walks dir and calls fn for every asset, skipping dirs, irregular and unknown files, symlinks are
+// skipped or followed, see walkTree; stops before the next entry once ctx is done
+func (ao *AssetsOptimizer) walkAssets(ctx context.Context, fn func(a asset) error) error {
+
+	// NOTE корень задан явно, поэтому если он сам симлинк, то его цель обходится всегда
+	real, err := filepath.EvalSymlinks(ao.dir)
+
+	if err != nil {
+		return fmt.Errorf("walk dir %q error: %w", ao.dir, err)
+	}
+
+	var visited visitedFiles
+
+	if ao.followSymlinks {
+		visited = make(visitedFiles)
+		fn = ao.visitOnce(visited, fn)
+	}
+
+	return ao.walkTree(ctx, ao.dir, real, visited, fn)
+}
+
+// walkTree walks real dir as if it were at path logical (they differ under followed symlinked dir), visited is nil
+// unless symlinks are followed
+func (ao *AssetsOptimizer) walkTree(ctx context.Context, logical, real string, visited visitedFiles,
+	fn func(a asset) error) error {
+
+	// NOTE WalkDir в отличие от Walk не делает Lstat каждой записи, тип берется прямо из чтения каталога,
+	//      а FileInfo (ради размера) запрашивается только у файлов, для которых есть оптимизатор
+	return filepath.WalkDir(real, func(realPath string, d fs.DirEntry, err error) error {
+
+		path := logical
+
+		if realPath != real {
+
+			rel, err := filepath.Rel(real, realPath)
+
+			if err != nil {
+				return err
+			}
+
+			path = filepath.Join(logical, rel)
+		}
+
+		if err != nil {
+			return fmt.Errorf("walk dir %q error: %w", path, err)
+		}
+
+		if err = ctx.Err(); err != nil {
+			return fmt.Errorf("run interrupted: %w", err)
+		}
+
+		if skip, err := ao.skipExcluded(path, d); skip || err != nil {
+			return err
+		}
+
+		if d.Type()&fs.ModeSymlink != 0 {
+			return ao.visitSymlink(ctx, path, visited, fn)
+		}
+
+		if d.IsDir() && visited != nil {
+			return ao.enterDir(visited, path, realPath, realPath == real, d)
+		}
+
+		// skip dirs and irregular files
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		return ao.visitFile(path, d, fn)
+	})
+}
+
+// visitFile calls fn for regular file path if it is an asset, skipping unknown, too small and cached ones
+func (ao *AssetsOptimizer) visitFile(path string, d fs.DirEntry, fn func(a asset) error) error {
+
+	ext := ao.resolveExt(path)
+
+	if ext == "" {
+		return nil
+	}
+
+	optimizer := ao.optimizerFor(ext)
+
+	if optimizer == nil {
+		return nil
+	}
+
+	if _, ok := ao.own[path]; ok {
+		ao.mu.Lock()
+		ao.logSkip(path, "written by the optimizer itself")
+		ao.mu.Unlock()
+		return nil
+	}
+
+	info, err := d.Info()
+
+	if err != nil {
+		return fmt.Errorf("walk dir %q error: %w", path, err)
+	}
+
+	// NOTE слишком маленькие файлы даже не открываем
+	if info.Size() < ao.minSize {
+		ao.mu.Lock()
+		ao.stats.small++
+		ao.logSkip(path, fmt.Sprintf("smaller than %d bytes", ao.minSize))
+		ao.mu.Unlock()
+		return nil
+	}
+
+	if ao.isCached(path, info) {
+		ao.mu.Lock()
+		ao.stats.cached++
+		ao.logSkip(path, "unchanged since the previous run")
+		ao.mu.Unlock()
+		return nil
+	}
+
+	return fn(asset{path: path, ext: ext, size: info.Size(), optimizer: optimizer})
+}
+
+// collectAssets is the pre-pass of progress: walks dir with walk and returns all found assets
+func (ao *AssetsOptimizer) collectAssets(ctx context.Context,
+	walk func(ctx context.Context, fn func(a asset) error) error) (assets []asset, err error) {
+
+	err = walk(ctx, func(a asset) error {
+		assets = append(assets, a)
+		return nil
+	})
+
+	return assets, err
+}
+
+// walkCollected is walkAssets over already collected assets
+func walkCollected(ctx context.Context, assets []asset, fn func(a asset) error) error {
+
+	for _, a := range assets {
+
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("run interrupted: %w", err)
+		}
+
+		if err := fn(a); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// optimizeAsset optimizes single asset, the whole report of the asset goes to w
+func (ao *AssetsOptimizer) optimizeAsset(w io.Writer, a asset) (err error) {
+
+	// NOTE слот держится все время оптимизации, даже если сам ассет ждет своих помощников (см. workerSlots)
+	ao.opts.slots.acquire()
+	defer ao.opts.slots.release()
+
+	rel, err := filepath.Rel(ao.dir, a.path)
+
+	if err != nil {
+		return err
+	}
+
+	// NOTE строка отчета ассета собирается по частям, поэтому в JSON логе вместо нее пишется одна запись (logResult)
+	info := ao.textLog(w, levelInfo)
+
+	fmt.Fprintf(info, "Optimize asset %q (%s)...", rel, a.ext)
+
+	ao.emitStart(rel, &a)
+
+	opts := ao.opts
+
+	if ao.outputDir != "" {
+		opts.Output = ao.outputFor(rel)
+	}
+
+	opts.planned = a.planned
+
+	var (
+		res      OptimizeResult
+		assetErr error
+	)
+
+	var casName string
+
+	if ao.fsys != nil {
+		res, assetErr = ao.optimizeFS(&a, &opts)
+	} else if ao.casDir != "" {
+		res, casName, assetErr = ao.optimizeCAS(&a, &opts)
+	} else {
+		// NOTE ассет за симлинком перезаписывается по месту цели, сам симлинк остается симлинком
+		res, assetErr = a.optimizer.Optimize(a.file(), &opts)
+	}
+
+	// NOTE NOOP до чтения файла (например, выключенная конвертация bmp) размер не знает, а он нужен и в отчете
+	//      строки, и в итогах
+	if assetErr == nil && res.NOOP && res.Size == 0 {
+		res.Size = a.size
+	}
+
+	// NOTE план составляется в dry run, так что файл еще не тронут
+	if assetErr == nil && !res.NOOP && ao.planPath != "" {
+		assetErr = ao.addPlanEntry(rel, &a, &res)
+	}
+
+	// NOTE зеркало должно быть полным, поэтому не сжавшийся ассет копируется в output dir как есть
+	if assetErr == nil && res.NOOP && opts.Output != "" && !opts.DryRun && ao.fsys == nil {
+		if err = mirrorAsset(a.path, opts.Output); err != nil {
+			assetErr = fmt.Errorf("copy to output dir error: %w", err)
+		}
+	}
+
+	if ao.progress != nil {
+		defer ao.progress.assetDone(res.Saved())
+	}
+
+	var rec reportRecord
+
+	if ao.reportPath != "" || ao.events != nil {
+		rec = newReportRecord(rel, a.ext, &res, assetErr)
+
+		// NOTE упавший оптимизатор мог не успеть прочитать файл
+		if rec.Size == 0 {
+			rec.Size, rec.OptimizedSize = a.size, a.size
+		}
+	}
+
+	if assetErr == nil {
+
+		printResult(info, &res)
+		ao.logResult(w, rel, a.ext, &res)
+
+		if casName != "" {
+			ao.addCASEntry(rel, casName)
+		}
+
+		if ro, ok := a.optimizer.(ResponsiveOptimizer); ok && ao.responsive {
+			// NOTE ошибка responsive @1x тоже относится к этому ассету, но сам он уже оптимизирован
+			if assetErr = ao.emitResponsive(w, ro, a.path); assetErr != nil {
+				rec.Error = assetErr.Error()
+			}
+		}
+
+		if we, ok := a.optimizer.(WebPEncoder); ok && ao.allowWebP && assetErr == nil {
+			if assetErr = ao.emitWebP(w, we, a.path, res.finalSize()); assetErr != nil {
+				rec.Error = assetErr.Error()
+			}
+		}
+
+		// NOTE ассет с упавшим sidecar считается только ошибкой (см. assetFailed), а не еще и обработанным, и
+		//      не кэшируется, чтобы следующий запуск создал sidecar заново
+		if assetErr == nil {
+			ao.remember(rel, a.path)
+			ao.countResult(a.ext, &res)
+		}
+	}
+
+	if ao.reportPath != "" && ao.reportedRecord(&rec) {
+
+		if rec.NOOP && rec.Error == "" {
+
+			// NOTE хэш нужен только для проверки целостности, ассет уже обработан, поэтому ошибка идет в запись
+			if rec.SHA256, err = ao.assetHash(&a); err != nil {
+				rec.Error = fmt.Sprintf("hash error: %s", err)
+			}
+		}
+
+		ao.addReportRecord(rec)
+	}
+
+	ao.emitResult(&rec)
+
+	if assetErr == nil {
+		return nil
+	}
+
+	ao.forget(rel)
+
+	if errors.Is(assetErr, errPlanMismatch) {
+		ao.logAssetf(w, levelWarn, &logAsset{Path: rel, Ext: a.ext, Error: assetErr.Error()}, "skip asset %q: %s\n",
+			rel, assetErr)
+		ao.mu.Lock()
+		ao.stats.changed++
+		ao.mu.Unlock()
+		return nil
+	}
+
+	if !ao.strict && errors.Is(assetErr, errAssetLocked) {
+		ao.logAssetf(w, levelWarn, &logAsset{Path: rel, Ext: a.ext, Error: assetErr.Error()}, "skip asset %q: %s\n",
+			rel, assetErr)
+		ao.mu.Lock()
+		ao.stats.locked++
+		ao.mu.Unlock()
+		return nil
+	}
+
+	return ao.assetFailed(w, rel, a.ext, assetErr)
+}
+
+// countResult adds successfully processed asset of format ext to the stats
+func (ao *AssetsOptimizer) countResult(ext string, res *OptimizeResult) {
+
+	ao.mu.Lock()
+	defer ao.mu.Unlock()
+
+	for _, s := range [...]*stats{&ao.stats, ao.extStats(ext)} {
+
+		s.files++
+
+		if n := res.Saved(); n > 0 {
+			s.c++
+			s.n += uint64(n)
+		}
+
+		s.metadata += uint64(res.Metadata)
+		s.origTotal += uint64(res.Size)
+		s.optTotal += uint64(res.finalSize())
+	}
+}
+
+// extStats returns stats of ext assets, must be called with ao.mu locked
+func (ao *AssetsOptimizer) extStats(ext string) *stats {
+
+	s, ok := ao.byExt[ext]
+
+	if !ok {
+		s = &stats{}
+		ao.byExt[ext] = s
+	}
+
+	return s
+}
+
+// printResult finishes "Optimize asset ..." report line
+func printResult(w io.Writer, res *OptimizeResult) {
+
+	if res.NOOP {
+
+		// NOTE OptimizedSize 0 - лучший вариант даже не кодировался (не поддерживается, нечего оптимизировать)
+		sizes := fmt.Sprintf("orig %d", res.Size)
+
+		if res.OptimizedSize > 0 {
+
+			// NOTE меньший, но ниже порога экономии (см. keepOriginal) вариант тоже NOOP
+			op := ">="
+
+			if res.OptimizedSize < res.Size {
+				op = "<"
+			}
+
+			sizes = fmt.Sprintf("best %d %s orig %d", res.OptimizedSize, op, res.Size)
+
+			if res.Variant != "" {
+				sizes += " as " + res.Variant
+			}
+		}
+
+		if res.Reason != "" {
+			fmt.Fprintf(w, " NOOP (%s; %s)\n", res.Reason, sizes)
+		} else {
+			fmt.Fprintf(w, " NOOP (%s)\n", sizes)
+		}
+
+		return
+	}
+
+	n := res.Saved()
+	pct := float64(n) / float64(res.Size) * 100
+
+	fmt.Fprintf(w, " SAVE AS %s : %d --> %d == %d bytes (%.2f%%)\n", res.Variant, res.Size, res.OptimizedSize, n, pct)
+}
+
+// assetFailed aborts the run with err, or in keep going mode only reports and counts failed asset
+func (ao *AssetsOptimizer) assetFailed(w io.Writer, rel, ext string, err error) error {
+
+	if !ao.keepGoing {
+		return err
+	}
+
+	ao.logAssetf(w, levelError, &logAsset{Path: rel, Ext: ext, Error: err.Error()}, "asset %q: %s\n", rel, err)
+
+	ao.mu.Lock()
+	ao.stats.errors++
+	ao.extStats(ext).errors++
+	ao.mu.Unlock()
+
+	return nil
+}
+
+func (ao *AssetsOptimizer) emitResponsive(w io.Writer, ro ResponsiveOptimizer, path string) (err error) {
+
+	dst, scale, ok := responsiveSidecar(path)
+
+	if !ok {
+		return nil
+	}
+
+	rel, err := filepath.Rel(ao.dir, dst)
+
+	if err != nil {
+		return err
+	}
+
+	out := ao.outputFor(rel)
+
+	// NOTE уже существующий @1x никогда не перезаписываем
+	if exists, err := assetExists(dst, out); err != nil || exists {
+
+		if exists {
+			ao.logf(w, levelInfo, "Responsive @1x %q already exists, skip\n", rel)
+		}
+
+		return err
+	}
+
+	if ao.opts.DryRun {
+		ao.logf(w, levelInfo, "Responsive @1x %q (1/%d) : not written (dry run)\n", rel, scale)
+		return nil
+	}
+
+	sz, err := ro.Downscale(path, out, scale)
+
+	if err != nil {
+		return fmt.Errorf("responsive @1x %q error: %w", rel, err)
+	}
+
+	ao.logf(w, levelInfo, "Responsive @1x %q (1/%d) : %d bytes\n", rel, scale, sz)
+
+	return nil
+}
+
+// emitWebP writes lossless WebP sibling of path if it is smaller than the (already optimized) asset of size bytes
+func (ao *AssetsOptimizer) emitWebP(w io.Writer, we WebPEncoder, path string, size int64) (err error) {
+
+	dst := webpSidecar(path)
+
+	rel, err := filepath.Rel(ao.dir, dst)
+
+	if err != nil {
+		return err
+	}
+
+	out := ao.outputFor(rel)
+
+	// NOTE как и у responsive, уже существующий файл никогда не перезаписываем
+	if exists, err := assetExists(dst, out); err != nil || exists {
+
+		if exists {
+			ao.logf(w, levelInfo, "WebP %q already exists, skip\n", rel)
+		}
+
+		return err
+	}
+
+	b, err := we.EncodeWebP(path, &ao.opts)
+
+	if err != nil {
+		return fmt.Errorf("webp %q error: %w", rel, err)
+	}
+
+	if b == nil {
+		ao.logf(w, levelInfo, "WebP %q : not written (16-bit precision would be lost)\n", rel)
+		return nil
+	}
+
+	sz := int64(b.Len())
+
+	if sz >= size {
+		ao.logf(w, levelInfo, "WebP %q : not written (%d bytes, not smaller than %d)\n", rel, sz, size)
+		return nil
+	}
+
+	if !ao.opts.DryRun {
+		if err = replaceFile(out, ".webptmp", b); err != nil {
+			return fmt.Errorf("webp %q error: %w", rel, err)
+		}
+	}
+
+	n := size - sz
+	ao.logf(w, levelInfo, "WebP %q : %d --> %d == %d bytes (%.2f%%)\n", rel, size, sz, n, float64(n)/float64(size)*100)
+
+	ao.mu.Lock()
+	ao.stats.webp++
+	ao.stats.webpN += uint64(n)
+	ao.mu.Unlock()
+
+	return nil
+}
+
+// outputFor returns where file rel (relative to the root dir) is written: the file itself or the same relative path
+// in the output dir
+func (ao *AssetsOptimizer) outputFor(rel string) string {
+
+	if ao.outputDir == "" {
+		return filepath.Join(ao.dir, rel)
+	}
+
+	return filepath.Join(ao.outputDir, rel)
+}
+
+// assetExists reports whether any of paths exists
+func assetExists(paths ...string) (_ bool, err error) {
+
+	for _, path := range paths {
+		if _, err = os.Lstat(path); err == nil {
+			return true, nil
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return false, err
+		}
+	}
+
+	return false, nil
+}
+
+// Run is RunContext without cancellation
+func (ao *AssetsOptimizer) Run() (err error) {
+	return ao.RunContext(context.Background())
+}
+
+// RunContext optimizes all assets of dir; once ctx is done no new asset is started, assets already being
+// optimized are finished (so no temp file is left behind) and the returned error wraps ctx.Err(),
+// stats and report cover everything done so far
+func (ao *AssetsOptimizer) RunContext(ctx context.Context) (err error) {
+
+	defer removeTempFilesOnPanic()
+
+	if err = ao.openEvents(); err != nil {
+		return err
+	}
+
+	defer func() {
+		if e := ao.closeEvents(); e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	startTS := time.Now()
+
+	if ao.started.IsZero() {
+		ao.started = startTS
+	}
+
+	ao.logf(ao.log, levelInfo, "Starting assets optimization of dir %q @ %s\n", ao.dir, time.Now())
+
+	if ao.opts.DryRun {
+		ao.logf(ao.log, levelInfo, "DRY RUN: no file is written, savings below are estimated\n")
+	}
+
+	walk := ao.walkAssets
+
+	if ao.applyPath != "" {
+		walk = ao.walkPlanned
+	} else if ao.filesFrom != "" {
+		walk = ao.walkListed
+	} else if ao.fsys != nil {
+		walk = ao.walkFS
+	}
+
+	if ao.showProgress || ao.largestFirst {
+
+		var assets []asset
+
+		if assets, err = ao.collectAssets(ctx, walk); err != nil {
+			return err
+		}
+
+		// NOTE равные по размеру идут в порядке обхода, так что с одним воркером порядок тоже детерминирован
+		if ao.largestFirst {
+			sort.SliceStable(assets, func(i, j int) bool {
+				return assets[i].size > assets[j].size
+			})
+		}
+
+		walk = func(ctx context.Context, fn func(a asset) error) error {
+			return walkCollected(ctx, assets, fn)
+		}
+
+		if ao.showProgress {
+
+			out := ao.log
+			ao.progress = newProgress(out, len(assets))
+			ao.log = ao.progress
+
+			defer func() {
+				ao.progress.finish()
+				ao.progress, ao.log = nil, out
+			}()
+		}
+	}
+
+	if ao.workers > 1 {
+		err = ao.runParallel(ctx, walk)
+	} else {
+		err = walk(ctx, func(a asset) error {
+			return ao.optimizeAsset(ao.log, a)
+		})
+	}
+
+	endTS := time.Now()
+
+	// NOTE кэш тоже сохраняется и для прерванного прогона, уже обработанное повторно не нужно
+	if e := ao.saveCache(); e != nil && err == nil {
+		err = e
+	}
+
+	// NOTE манифест, как и кэш, описывает все уже сохраненное, даже если прогон прерван
+	if ao.casDir != "" {
+		if e := ao.writeCASManifest(); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	// NOTE неполный план исполнять нельзя, поэтому в отличие от отчета он пишется только для завершенного прогона
+	if ao.planPath != "" && err == nil {
+		err = ao.writePlan()
+	}
+
+	// NOTE отчет пишется и для прерванного прогона, с ошибкой в summary
+	if ao.reportPath != "" {
+		if e := ao.writeReport(endTS.Sub(startTS), err); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	ao.logf(ao.log, levelInfo, "Finish assets optimization in %s @ %s\n", endTS.Sub(startTS), endTS)
+
+	return nil
 }
 
-type AssetsOptimizer struct {
-	dir   string
-	stats stats
+var (
+	errRunAborted = errors.New("run aborted")
+)
+
+// workerSlots limits goroutines optimizing at once over the whole run to the number of workers: every asset holds
+// a slot while it is optimized, and an asset made of many (pak) lends the idle ones to its entries
+type workerSlots chan struct{}
+
+func newWorkerSlots(n int) workerSlots {
+	return make(workerSlots, n)
 }
 
-type AssetOptimizer interface {
-	Optimize(path string) (uint, error)
+func (s workerSlots) acquire() {
+	s <- struct{}{}
 }
 
-var (
-	assetsRegistry = map[string]AssetOptimizer{} // сразу инитим
-)
+// tryAcquire takes a slot only if one is idle right now
+func (s workerSlots) tryAcquire() bool {
+
+	select {
+	case s <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s workerSlots) release() {
+	<-s
+}
+
+// runParallel optimizes assets by ao.workers goroutines, report of each asset is buffered and printed at once,
+// so lines of different assets never interleave (but their order is not deterministic)
+func (ao *AssetsOptimizer) runParallel(ctx context.Context,
+	walk func(ctx context.Context, fn func(a asset) error) error) (err error) {
+
+	var (
+		jobs   = make(chan asset)
+		failed = make(chan struct{})
+		once   sync.Once
+		wg     sync.WaitGroup
+		runErr error
+	)
+
+	// NOTE fail-fast как и в последовательном режиме: после первой ошибки новые ассеты не раздаются,
+	//      уже взятые в работу дорабатываются
+	fail := func(err error) {
+		once.Do(func() {
+			runErr = err
+			close(failed)
+		})
+	}
+
+	for i := 0; i < ao.workers; i++ {
+
+		wg.Add(1)
+
+		go func() {
+
+			defer wg.Done()
+			defer removeTempFilesOnPanic()
+
+			var b bytes.Buffer
+
+			for a := range jobs {
+
+				b.Reset()
+
+				err := ao.optimizeAsset(&b, a)
+
+				// NOTE строку прерванного ошибкой ассета надо завершить, иначе к ней приклеится отчет следующего
+				if err != nil && b.Len() > 0 && b.Bytes()[b.Len()-1] != '\n' {
+					b.WriteByte('\n')
+				}
+
+				ao.mu.Lock()
+				_, _ = b.WriteTo(ao.log)
+				ao.mu.Unlock()
+
+				if err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+
+	err = walk(ctx, func(a asset) error {
+		select {
+		case jobs <- a:
+			return nil
+		case <-failed:
+			return errRunAborted
+		case <-ctx.Done():
+			return fmt.Errorf("run interrupted: %w", ctx.Err())
+		}
+	})
+
+	close(jobs)
+	wg.Wait()
 
-func registryAssetOptimizer(ext string, o AssetOptimizer) {
-	assetsRegistry[ext] = o
+	if runErr != nil {
+		return runErr
+	}
+
+	return err
 }
 
-func (ao *AssetsOptimizer) walkerFn(path string, info fs.FileInfo, err error) error {
+// classifyFn walks like walkAssets, but only resolves optimizer for every file without calling it
+func (ao *AssetsOptimizer) classifyFn(path string, d fs.DirEntry, err error) error {
 
 	if err != nil {
 		return fmt.Errorf("walk dir %q error: %w", path, err)
 	}
 
-	// skip dirs and irregular files
-	if !info.Mode().IsRegular() {
+	if skip, err := ao.skipExcluded(path, d); skip || err != nil {
+		return err
+	}
+
+	if !d.Type().IsRegular() {
 		return nil
 	}
 
-	ext := filepath.Ext(path)
+	// NOTE размер печатается для каждого файла, так что здесь FileInfo нужен всегда
+	info, err := d.Info()
+
+	if err != nil {
+		return fmt.Errorf("walk dir %q error: %w", path, err)
+	}
+
+	rel, err := filepath.Rel(ao.dir, path)
+
+	if err != nil {
+		return err
+	}
+
+	ext, name := ao.resolveExt(path), "-"
+
+	if optimizer := ao.optimizerFor(ext); optimizer != nil {
+		name = fmt.Sprintf("%T", optimizer)
+		ao.stats.c++
+		ao.stats.n += uint64(info.Size())
+	}
 
 	if ext == "" {
-		return nil
+		ext = "-"
 	}
 
-	ext = strings.ToLower(ext[1:])
+	fmt.Fprintf(ao.log, "%s\t%s\t%d\t%s\n", ext, name, info.Size(), rel)
+
+	return nil
+}
 
-	if optimizer := assetsRegistry[ext]; optimizer != nil {
+// Classify walks dir and prints for each file its extension, optimizer that would process it and size,
+// without decoding or optimizing anything
+func (ao *AssetsOptimizer) Classify() (err error) {
 
-		var rel string
+	if ao.fsys != nil {
+		return fmt.Errorf("classify is %w", errFSSource)
+	}
 
-		if rel, err = filepath.Rel(ao.dir, path); err != nil {
-			return err
+	if err = filepath.WalkDir(ao.dir, ao.classifyFn); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(ao.log, "Totally optimizable files: %d, totally bytes: %d\n", ao.stats.c, ao.stats.n)
+
+	return nil
+}
+
+func (ao *AssetsOptimizer) PrintStat() {
+
+	// NOTE в JSON логе итоги - одна запись со сводкой как в JSON отчете
+	if ao.logJSON {
+
+		s := ao.summary(int(ao.stats.files+ao.stats.errors), time.Since(ao.started))
+
+		writeLogRecord(ao.log, &logRecord{Level: LogInfo, Msg: "summary", Summary: &s})
+		ao.printTimings()
+
+		return
+	}
+
+	fmt.Fprintf(ao.log, "Totally optimized files: %d, totally saved bytes: %d\n", ao.stats.c, ao.stats.n)
+
+	// NOTE NOOP ассеты входят в оба итога без изменений, т.е. процент - от всех обработанных байт
+	if ao.stats.origTotal > 0 {
+		saved := float64(int64(ao.stats.origTotal)-int64(ao.stats.optTotal)) * 100 / float64(ao.stats.origTotal)
+		fmt.Fprintf(ao.log, "Totally processed: before %s, after %s, saved %.1f%%\n",
+			formatBytes(ao.stats.origTotal), formatBytes(ao.stats.optTotal), saved)
+	}
+
+	// NOTE с одним форматом разбивка просто повторила бы итог
+	if len(ao.byExt) > 1 {
+		for _, ext := range sortedKeys(ao.byExt) {
+			fmt.Fprintf(ao.log, "  %s: %s\n", ext, ao.byExt[ext].formatExt())
 		}
+	}
+
+	if ao.stats.metadata > 0 {
+		fmt.Fprintf(ao.log, "Metadata bytes removed: %d\n", ao.stats.metadata)
+	}
 
-		fmt.Printf("Optimize asset %q (%s)...", rel, ext)
+	if ao.stats.locked > 0 {
+		fmt.Fprintf(ao.log, "Skipped locked files: %d\n", ao.stats.locked)
+	}
 
-		var n uint
+	if ao.stats.errors > 0 {
+		fmt.Fprintf(ao.log, "Failed files: %d\n", ao.stats.errors)
+	}
 
-		if n, err = optimizer.Optimize(path); err != nil {
-			return err
+	if ao.stats.small > 0 {
+		fmt.Fprintf(ao.log, "Skipped files smaller than %d bytes: %d\n", ao.minSize, ao.stats.small)
+	}
+
+	if ao.stats.excluded > 0 {
+		fmt.Fprintf(ao.log, "Skipped excluded files: %d\n", ao.stats.excluded)
+	}
+
+	if ao.stats.unlisted > 0 {
+		fmt.Fprintf(ao.log, "Skipped unusable listed entries: %d\n", ao.stats.unlisted)
+	}
+
+	if ao.stats.symlinks > 0 {
+		fmt.Fprintf(ao.log, "Skipped symlinks and paths already visited: %d\n", ao.stats.symlinks)
+	}
+
+	if ao.stats.cached > 0 {
+		fmt.Fprintf(ao.log, "Skipped files unchanged since the previous run: %d\n", ao.stats.cached)
+	}
+
+	if ao.stats.changed > 0 {
+		fmt.Fprintf(ao.log, "Skipped planned files changed since the plan: %d\n", ao.stats.changed)
+	}
+
+	if ao.stats.webp > 0 {
+		fmt.Fprintf(ao.log, "WebP files: %d, smaller than png by %d bytes\n", ao.stats.webp, ao.stats.webpN)
+	}
+
+	ao.printTimings()
+
+	if ao.opts.DryRun {
+		fmt.Fprintln(ao.log, "DRY RUN: nothing was written")
+	}
+}
+
+// formatExt is the per format line of PrintStat
+func (s *stats) formatExt() string {
+
+	line := fmt.Sprintf("%d files, optimized %d, saved %d bytes", s.files, s.c, s.n)
+
+	if s.origTotal > 0 {
+		line += fmt.Sprintf(" (%.1f%%)", float64(int64(s.origTotal)-int64(s.optTotal))*100/float64(s.origTotal))
+	}
+
+	if s.errors > 0 {
+		line += fmt.Sprintf(", failed %d", s.errors)
+	}
+
+	return line
+}
+
+func sortedKeys(m map[string]*stats) []string {
+
+	keys := make([]string, 0, len(m))
+
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+// formatBytes human readable size in binary units, e.g. "35.8 MiB"
+func formatBytes(n uint64) string {
+
+	const unit = 1024
+
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := uint64(unit), 0
+
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func normalizeExtMap(r *Registry, m map[string]string) (_ map[string]string, err error) {
+
+	if len(m) == 0 {
+		return nil, nil
+	}
+
+	extMap := make(map[string]string, len(m))
+
+	for suffix, to := range m {
+
+		suffix = strings.ToLower(suffix)
+		to = strings.ToLower(strings.TrimPrefix(to, "."))
+
+		if suffix == "" || suffix == "." {
+			return nil, fmt.Errorf("empty ext map suffix for %q", to)
 		}
 
-		if n > 0 {
-			ao.stats.c++
-			ao.stats.n += uint64(n)
+		if suffix[0] != '.' {
+			suffix = "." + suffix
 		}
+
+		if r.Lookup(to) == nil {
+			return nil, fmt.Errorf("ext map %q=%q: unknown asset format, known: %s", suffix, to,
+				strings.Join(r.Formats(), ", "))
+		}
+
+		extMap[suffix] = to
 	}
 
-	return nil
+	return extMap, nil
 }
 
-func (ao *AssetsOptimizer) Run() (err error) {
+func normalizeExtensions(r *Registry, list []string) (_ map[string]struct{}, err error) {
 
-	startTS := time.Now()
+	if len(list) == 0 {
+		return nil, nil
+	}
 
-	fmt.Printf("Starting assets optimization of dir %q @ %s\n", ao.dir, time.Now())
+	extensions := make(map[string]struct{}, len(list))
 
-	if err = filepath.Walk(ao.dir, ao.walkerFn); err != nil {
-		return err
-	}
+	for _, ext := range list {
 
-	endTS := time.Now()
+		ext = strings.ToLower(strings.TrimPrefix(ext, "."))
 
-	fmt.Printf("Finish assets optimization in %s @ %s\n", endTS.Sub(startTS), endTS)
+		if r.Lookup(ext) == nil {
+			return nil, fmt.Errorf("extension %q: unknown asset format, known: %s", ext, strings.Join(r.Formats(), ", "))
+		}
 
-	return nil
+		extensions[ext] = struct{}{}
+	}
+
+	return extensions, nil
 }
 
-func (ao *AssetsOptimizer) PrintStat() {
-	fmt.Printf("Totally optimized files: %d, totally saved bytes: %d\n", ao.stats.c, ao.stats.n)
+// normalizeOutputDir returns absolute output dir, "" stays "" (in-place)
+func normalizeOutputDir(dir, outputDir string) (_ string, err error) {
+
+	if outputDir == "" {
+		return "", nil
+	}
+
+	if outputDir, err = filepath.Abs(outputDir); err != nil {
+		return "", err
+	}
+
+	// NOTE вложенный output dir обходился бы вместе с исходниками, а root внутри output dir мог бы получить
+	//      результаты поверх своих же файлов
+	for _, pair := range [][2]string{{dir, outputDir}, {outputDir, dir}} {
+		if rel, err := filepath.Rel(pair[0], pair[1]); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return "", fmt.Errorf("output dir %q must not overlap the root dir %q", outputDir, dir)
+		}
+	}
+
+	return outputDir, nil
 }
 
-func NewAssetsOptimizer(root string) (_ *AssetsOptimizer, err error) {
+// NewAssetsOptimizer creates optimizer of assets under root dir, zero Settings (no options) optimize assets of
+// lossless formats in place with EffortDefault and verify, as the CLI does by default, but without cache
+func NewAssetsOptimizer(root string, opts ...Option) (_ *AssetsOptimizer, err error) {
 
 	dir, err := filepath.Abs(root)
 
@@ -124,7 +1502,249 @@ func NewAssetsOptimizer(root string) (_ *AssetsOptimizer, err error) {
 		return nil, err
 	}
 
-	return &AssetsOptimizer{
-		dir: dir,
-	}, nil
+	return newAssetsOptimizer(dir, nil, applyOptions(opts))
+}
+
+// newAssetsOptimizer creates optimizer of dir of fsys, nil fsys means the OS filesystem
+func newAssetsOptimizer(dir string, fsys fs.FS, settings Settings) (ao *AssetsOptimizer, err error) {
+
+	registry := settings.Registry
+
+	if registry == nil {
+		if registry, err = newDefaultRegistry(&settings); err != nil {
+			return nil, err
+		}
+	}
+
+	extMap, err := normalizeExtMap(registry, settings.ExtMap)
+
+	if err != nil {
+		return nil, err
+	}
+
+	extensions, err := normalizeExtensions(registry, settings.Extensions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	exclude, err := normalizeExclude(settings.Exclude)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var ignore *gitignore
+
+	if settings.Gitignore {
+		if ignore, err = newGitignore(dir); err != nil {
+			return nil, err
+		}
+	}
+
+	if settings.Effort < EffortFast || settings.Effort > EffortMax {
+		return nil, fmt.Errorf("effort %d is out of range %d..%d", settings.Effort, EffortFast, EffortMax)
+	}
+
+	// NOTE нулевые Settings должны оптимизировать так же, как CLI по умолчанию, поэтому EffortFast задается
+	//      только явным NoVariants, и дальше (в т.ч. в опциях кэша) effort всегда уже настоящий
+	if settings.NoVariants {
+
+		if settings.Effort > EffortFast {
+			return nil, fmt.Errorf("effort %d conflicts with no variants", settings.Effort)
+		}
+
+		settings.Effort = EffortFast
+
+	} else if settings.Effort == EffortFast {
+		settings.Effort = EffortDefault
+	}
+
+	if settings.JPEGQuality < 0 || settings.JPEGQuality > 100 {
+		return nil, fmt.Errorf("jpeg quality %d is out of range 1..100", settings.JPEGQuality)
+	}
+
+	if settings.MinSavedPct < 0 || settings.MinSavedPct > 100 {
+		return nil, fmt.Errorf("min savings %g%% is out of range 0..100", settings.MinSavedPct)
+	}
+
+	if strings.ContainsAny(settings.Backup, `/\`) {
+		return nil, fmt.Errorf("backup suffix %q must not contain path separators", settings.Backup)
+	}
+
+	if settings.MinSavedBytes < 0 {
+		return nil, fmt.Errorf("min savings %d bytes is negative", settings.MinSavedBytes)
+	}
+
+	if settings.ReportLimit < 0 {
+		return nil, fmt.Errorf("report limit %d is negative", settings.ReportLimit)
+	}
+
+	if settings.Plan != "" && settings.Apply != "" {
+		return nil, fmt.Errorf("plan and apply can not be used together")
+	}
+
+	// NOTE план - это список файлов сам по себе
+	if settings.Apply != "" && (settings.FilesFrom != "" || fsys != nil) {
+		return nil, fmt.Errorf("apply can not be used with files list or fs.FS source")
+	}
+
+	// NOTE CAS dir заменяет собой и запись по месту, и output dir, а sidecar файлы писались бы в корень
+	if settings.CASDir != "" && (settings.OutputDir != "" || fsys != nil || settings.Plan != "" ||
+		settings.Apply != "" || settings.Responsive || settings.AllowWebP) {
+		return nil, fmt.Errorf("CAS dir can not be used with output dir, fs.FS source, plan, apply, responsive or webp")
+	}
+
+	if settings.ReportJSON == reportStdout && settings.Events == reportStdout {
+		return nil, fmt.Errorf("JSON report and events can not both go to stdout")
+	}
+
+	// NOTE fs.FS с файловой системой ОС не пересекается
+	var outputDir string
+
+	if fsys == nil {
+		outputDir, err = normalizeOutputDir(dir, settings.OutputDir)
+	} else {
+		outputDir, err = filepath.Abs(settings.OutputDir)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	casDir, err := normalizeOutputDir(dir, settings.CASDir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	workers := settings.Workers
+
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	log := settings.Log
+
+	if log == nil {
+
+		log = os.Stdout
+
+		if settings.ReportJSON == reportStdout || settings.Events == reportStdout {
+			log = os.Stderr
+		}
+	}
+
+	logLevel, err := parseLogLevel(settings.LogLevel)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if settings.Quiet && logLevel < levelWarn {
+		logLevel = levelWarn
+	}
+
+	// NOTE с output dir корень не трогаем совсем, кэш живет рядом с результатами
+	cachePath := filepath.Join(dir, cacheFileName)
+
+	if outputDir != "" {
+		cachePath = filepath.Join(outputDir, cacheFileName)
+	}
+
+	var own map[string]struct{}
+
+	// NOTE у fs.FS свои пути, с файлами ОС они не пересекаются
+	if fsys == nil {
+		if own, err = ownFiles(settings.ReportJSON, settings.Events, settings.Plan, settings.Apply, cachePath); err != nil {
+			return nil, err
+		}
+	}
+
+	var (
+		cache     *manifestCache
+		cacheWarn error
+	)
+
+	// NOTE пропущенные по кэшу ассеты выпали бы из манифеста CAS dir, а корень не трогаем
+	if settings.Cache && casDir == "" {
+
+		// NOTE ассет, обработанный с другими настройками, мог бы сжаться сильнее, поэтому такой кэш не годится
+		options := fmt.Sprintf("effort=%d png-level=%s jpeg-quality=%d lenient-decode=%t keep-metadata=%t convert-bmp=%t"+
+			" min-savings-pct=%g min-savings-bytes=%d exhaustive=%t minify-json=%t lossy-jpeg=%t",
+			settings.Effort, settings.PNGLevel, settings.JPEGQuality, settings.LenientDecode, settings.KeepMetadata,
+			settings.ConvertBMP, settings.MinSavedPct, settings.MinSavedBytes, settings.Exhaustive, settings.MinifyJSON,
+			settings.LossyJPEG)
+
+		cache, cacheWarn = loadCache(cachePath, options)
+	}
+
+	ao = &AssetsOptimizer{
+		dir:       dir,
+		fsys:      fsys,
+		outputDir: outputDir,
+		casDir:    casDir,
+		cas:       make(map[string]string),
+		filesFrom: settings.FilesFrom,
+		planPath:  settings.Plan,
+		applyPath: settings.Apply,
+		byExt:     make(map[string]*stats),
+		extMap:    extMap,
+		registry:  registry,
+		cache:     cache,
+
+		followSymlinks: settings.FollowLinks,
+
+		showProgress: settings.Progress,
+		largestFirst: settings.LargestFirst,
+		logLevel:     logLevel,
+		logJSON:      settings.LogJSON,
+		extensions:   extensions,
+		exclude:      exclude,
+		own:          own,
+		gitignore:    ignore,
+		strict:       settings.Strict,
+		keepGoing:    settings.KeepGoing,
+		responsive:   settings.Responsive,
+		allowWebP:    settings.AllowWebP,
+		workers:      workers,
+		minSize:      settings.MinSize,
+		reportPath:   settings.ReportJSON,
+		eventsPath:   settings.Events,
+		log:          log,
+
+		includeNoop: settings.IncludeNoop,
+		reportLimit: settings.ReportLimit,
+		summaryOnly: settings.SummaryOnly,
+
+		opts: OptimizeOptions{
+			LenientDecode: settings.LenientDecode,
+			Effort:        settings.Effort,
+			JPEGQuality:   settings.JPEGQuality,
+			DryRun:        settings.DryRun || settings.Plan != "",
+			Verify:        !settings.NoVerify,
+			KeepMetadata:  settings.KeepMetadata,
+			ConvertBMP:    settings.ConvertBMP,
+
+			Backup:        settings.Backup,
+			BackupStrict:  settings.BackupStrict,
+			MinSavedPct:   settings.MinSavedPct,
+			MinSavedBytes: settings.MinSavedBytes,
+
+			slots: newWorkerSlots(workers),
+		},
+	}
+
+	ao.opts.lookup = ao.lookupAsset
+
+	if cacheWarn != nil {
+		ao.logf(log, levelWarn, "cache is ignored: %s\n", cacheWarn)
+	}
+
+	return ao, nil
+}
+
+// lookupAsset returns optimizer of the run for path (e.g. pak entry), nil if it is not processed
+func (ao *AssetsOptimizer) lookupAsset(path string) AssetOptimizer {
+	return ao.optimizerFor(ao.resolveExt(path))
 }
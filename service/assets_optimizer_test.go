@@ -0,0 +1,953 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testTree copies every png fixture (see pngFixtures) into n subdirs of a temp dir, adds a JSON asset to each of
+// them and returns the dir with rel path -> original data of every file
+func testTree(t testing.TB, n int) (dir string, files map[string][]byte) {
+
+	t.Helper()
+
+	dir, files = t.TempDir(), make(map[string][]byte)
+
+	fixtures := readPNGFixtures(t)
+
+	for i := 0; i < n; i++ {
+
+		sub := fmt.Sprintf("d%02d", i)
+
+		for name, data := range fixtures {
+			files[filepath.Join(sub, name+".png")] = data
+		}
+
+		files[filepath.Join(sub, "item.config")] = []byte("{\n  // comment\n  \"name\": \"item\",\n  \"list\": [1, 2, 3,],\n}\n")
+	}
+
+	for rel, data := range files {
+
+		path := filepath.Join(dir, rel)
+
+		if err := os.MkdirAll(filepath.Dir(path), 0o777); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(path, data, 0o666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir, files
+}
+
+// leftTempFiles returns temp files (.pngtmp, .tmp, ...) left in dir and the number of still tracked ones
+func leftTempFiles(t *testing.T, dir string) (left []string, tracked int) {
+
+	t.Helper()
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+
+		if err == nil && strings.HasSuffix(d.Name(), "tmp") {
+			left = append(left, path)
+		}
+
+		return err
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tempFiles.Lock()
+	tracked = len(tempFiles.paths)
+	tempFiles.Unlock()
+
+	return left, tracked
+}
+
+// TestRunParallel runs several workers over the tree with everything shared between them (stats, report, events,
+// cache, progress, temp files) turned on, go test -race ./service checks the locking
+func TestRunParallel(t *testing.T) {
+
+	dir, files := testTree(t, 6)
+	out := t.TempDir()
+
+	var log bytes.Buffer
+
+	settings := Settings{
+		MinifyJSON:  true,
+		Cache:       true,
+		Progress:    true,
+		KeepGoing:   true,
+		LogLevel:    LogDebug,
+		ReportJSON:  filepath.Join(out, "report.json"),
+		IncludeNoop: true,
+		Events:      filepath.Join(out, "events.ndjson"),
+		Log:         &log,
+	}
+
+	ao, err := NewAssetsOptimizer(dir, WithSettings(settings), WithWorkers(4))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ao.RunContext(context.Background()); err != nil {
+		t.Fatalf("run: %v\n%s", err, log.String())
+	}
+
+	ao.PrintStat()
+
+	if ao.stats.files != uint(len(files)) || ao.stats.errors != 0 {
+		t.Errorf("processed %d files with %d errors, want %d without errors", ao.stats.files, ao.stats.errors,
+			len(files))
+	}
+
+	var r report
+
+	if data, err := os.ReadFile(settings.ReportJSON); err != nil {
+		t.Fatal(err)
+	} else if err = json.Unmarshal(data, &r); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(r.Files) != len(files) || r.Summary.Files != len(files) {
+		t.Errorf("report has %d records, summary %d files, want %d", len(r.Files), r.Summary.Files, len(files))
+	}
+
+	if r.Summary.SavedBytes != ao.stats.n || r.Summary.Optimized != ao.stats.c {
+		t.Errorf("report summary %+v does not match stats %+v", r.Summary, ao.stats)
+	}
+
+	fp, err := os.Open(settings.Events)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := 0
+
+	for s := bufio.NewScanner(fp); s.Scan(); events++ {
+
+		var ev struct {
+			Event string `json:"event"`
+			Path  string `json:"path"`
+		}
+
+		if err = json.Unmarshal(s.Bytes(), &ev); err != nil || ev.Event == "" || files[ev.Path] == nil {
+			t.Fatalf("event %q: %v", s.Text(), err)
+		}
+	}
+
+	fp.Close()
+
+	if events != 2*len(files) {
+		t.Errorf("%d events, want %d (start and result of every file)", events, 2*len(files))
+	}
+
+	for rel, data := range files {
+		if filepath.Ext(rel) == ".png" {
+
+			got, err := os.ReadFile(filepath.Join(dir, rel))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			samePixels(t, rel, decodeTestPNG(t, data), decodeTestPNG(t, got))
+		}
+	}
+
+	if left, tracked := leftTempFiles(t, dir); len(left) > 0 || tracked > 0 {
+		t.Errorf("temp files left: %v, still tracked: %d", left, tracked)
+	}
+
+	// NOTE второй прогон с тем же кэшем не трогает ни одного файла
+	ao, err = NewAssetsOptimizer(dir, WithSettings(settings), WithWorkers(4))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ao.RunContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if ao.stats.cached != uint(len(files)) || ao.stats.files != 0 {
+		t.Errorf("second run: %d cached, %d processed, want all %d cached", ao.stats.cached, ao.stats.files,
+			len(files))
+	}
+}
+
+func TestWalkSymlinks(t *testing.T) {
+
+	dir := t.TempDir()
+
+	if err := os.MkdirAll(filepath.Join(dir, "a"), 0o777); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "a", "x.png"), readPNGFixtures(t)["gray"], 0o666); err != nil {
+		t.Fatal(err)
+	}
+
+	// NOTE цикл через предка, симлинк сам на себя, второй путь к каталогу и к файлу
+	for link, target := range map[string]string{
+		"a/loop": "..",
+		"a/self": "self",
+		"b":      "a",
+		"c.png":  "a/x.png",
+	} {
+		if err := os.Symlink(target, filepath.Join(dir, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, follow := range []bool{false, true} {
+		t.Run(fmt.Sprintf("follow %t", follow), func(t *testing.T) {
+
+			var log bytes.Buffer
+
+			ao, err := NewAssetsOptimizer(dir, WithSettings(Settings{FollowLinks: follow, Log: &log}))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var paths []string
+
+			err = ao.walkAssets(context.Background(), func(a asset) error {
+				paths = append(paths, a.path)
+				return nil
+			})
+
+			if err != nil {
+				t.Fatalf("walk: %v\n%s", err, log.String())
+			}
+
+			// every real file is visited once, by the first path in walk order
+			if want := filepath.Join(dir, "a", "x.png"); len(paths) != 1 || paths[0] != want {
+				t.Errorf("visited %v, want only %s", paths, want)
+			}
+
+			if ao.stats.symlinks != 4 {
+				t.Errorf("skipped %d symlinks, want 4\n%s", ao.stats.symlinks, log.String())
+			}
+
+			if follow {
+				for _, reason := range []string{"broken symlink", "symlinked dir is already walked",
+					"the same file is already visited"} {
+					if !strings.Contains(log.String(), reason) {
+						t.Errorf("no %q in log\n%s", reason, log.String())
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestExtMap(t *testing.T) {
+
+	for _, m := range []map[string]string{{"": "png"}, {".": "png"}, {".tex": "nope"}} {
+		if _, err := NewAssetsOptimizer(t.TempDir(), WithSettings(Settings{ExtMap: m})); err == nil {
+			t.Errorf("ext map %v: no error", m)
+		}
+	}
+
+	dir := t.TempDir()
+	data := readPNGFixtures(t)["gray"]
+
+	if err := os.WriteFile(filepath.Join(dir, "tile.tex"), data, 0o666); err != nil {
+		t.Fatal(err)
+	}
+
+	var log bytes.Buffer
+
+	ao, err := NewAssetsOptimizer(dir, WithSettings(Settings{
+		ExtMap: map[string]string{"tex": ".PNG", ".png.bak": "png", ".bak": "gif"},
+		Log:    &log,
+	}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path, ext string
+	}{
+		{"a.tex", "png"},
+		{"A.TEX", "png"},
+		{"dir.tex/a.json", "json"},
+		// the longest suffix wins
+		{"a.png.bak", "png"},
+		{"a.gif.bak", "gif"},
+		{"a.json.bak", "gif"},
+		{"a.png", "png"},
+		{"tex", ""},
+		{"a.txt", "txt"},
+	}
+
+	for _, tt := range tests {
+		if ext := ao.resolveExt(filepath.Join(dir, tt.path)); ext != tt.ext {
+			t.Errorf("%s: ext %q, want %q", tt.path, ext, tt.ext)
+		}
+	}
+
+	if err = ao.RunContext(context.Background()); err != nil {
+		t.Fatalf("run: %v\n%s", err, log.String())
+	}
+
+	if ao.stats.files != 1 || ao.stats.errors != 0 {
+		t.Errorf("processed %d files with %d errors, want the .tex one\n%s", ao.stats.files, ao.stats.errors,
+			log.String())
+	}
+
+	got, err := os.ReadFile(filepath.Join(dir, "tile.tex"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	samePixels(t, "tile.tex", decodeTestPNG(t, data), decodeTestPNG(t, got))
+}
+
+// skewedTree writes testTree of n subdirs and one big noisy png walked last, returns dir and the big one rel path
+func skewedTree(t testing.TB, n int) (dir, big string) {
+
+	t.Helper()
+
+	dir, _ = testTree(t, n)
+	big = filepath.Join("zz", "atlas.png")
+
+	r := testRand(3)
+	img := image.NewNRGBA(image.Rect(0, 0, 512, 512))
+
+	for i := range img.Pix {
+		img.Pix[i] = r.next() & 0xf0
+	}
+
+	var b bytes.Buffer
+
+	if err := png.Encode(&b, img); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "zz"), 0o777); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, big), b.Bytes(), 0o666); err != nil {
+		t.Fatal(err)
+	}
+
+	return dir, big
+}
+
+func TestLargestFirst(t *testing.T) {
+
+	dir, big := skewedTree(t, 1)
+
+	var log bytes.Buffer
+
+	ao, err := NewAssetsOptimizer(dir, WithSettings(Settings{LargestFirst: true, DryRun: true, Log: &log}),
+		WithWorkers(1))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ao.RunContext(context.Background()); err != nil {
+		t.Fatalf("run: %v\n%s", err, log.String())
+	}
+
+	var (
+		sizes []int64
+		first string
+	)
+
+	for _, line := range strings.Split(log.String(), "\n") {
+
+		var rel string
+
+		if _, err := fmt.Sscanf(line, "Optimize asset %q", &rel); err != nil {
+			continue
+		}
+
+		if first == "" {
+			first = rel
+		}
+
+		info, err := os.Stat(filepath.Join(dir, rel))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sizes = append(sizes, info.Size())
+	}
+
+	if first != big {
+		t.Errorf("the first asset is %q, want the biggest %q", first, big)
+	}
+
+	for i := 1; i < len(sizes); i++ {
+		if sizes[i] > sizes[i-1] {
+			t.Errorf("asset %d of %d bytes goes after %d bytes\n%s", i, sizes[i], sizes[i-1], log.String())
+			break
+		}
+	}
+}
+
+// BenchmarkRunLargestFirst compares wall time of a run over many small assets and one big asset walked last
+func BenchmarkRunLargestFirst(b *testing.B) {
+
+	dir, _ := skewedTree(b, 8)
+
+	for _, largestFirst := range []bool{false, true} {
+		b.Run(fmt.Sprintf("largest first %t", largestFirst), func(b *testing.B) {
+
+			for i := 0; i < b.N; i++ {
+
+				ao, err := NewAssetsOptimizer(dir, WithSettings(Settings{LargestFirst: largestFirst, DryRun: true,
+					Log: io.Discard}), WithWorkers(4))
+
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				if err = ao.RunContext(context.Background()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// readReport runs optimizer of dir with settings and returns its JSON report
+func readReport(t *testing.T, dir string, settings Settings) (r report) {
+
+	t.Helper()
+
+	var log bytes.Buffer
+
+	settings.ReportJSON, settings.Log = filepath.Join(t.TempDir(), "report.json"), &log
+
+	ao, err := NewAssetsOptimizer(dir, WithSettings(settings))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ao.RunContext(context.Background()); err != nil {
+		t.Fatalf("run: %v\n%s", err, log.String())
+	}
+
+	data, err := os.ReadFile(settings.ReportJSON)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = json.Unmarshal(data, &r); err != nil {
+		t.Fatal(err)
+	}
+
+	return r
+}
+
+func TestReportIncludeNoop(t *testing.T) {
+
+	dir, files := testTree(t, 1)
+
+	// the first run optimizes most of fixtures, the rest are NOOP and are not recorded
+	r := readReport(t, dir, Settings{MinifyJSON: true})
+
+	if r.Summary.Files != len(files) || len(r.Files) == 0 || len(r.Files) >= len(files) {
+		t.Errorf("first run: summary of %d files, %d records, want %d files and only optimized records",
+			r.Summary.Files, len(r.Files), len(files))
+	}
+
+	for _, rec := range r.Files {
+		if rec.NOOP || rec.SHA256 != "" {
+			t.Errorf("first run: record %+v of NOOP asset or with hash", rec)
+		}
+	}
+
+	// the second run is all NOOP
+	r = readReport(t, dir, Settings{MinifyJSON: true, IncludeNoop: true})
+
+	if r.Summary.Files != len(files) || len(r.Files) != len(files) {
+		t.Fatalf("second run: summary of %d files, %d records, want %d", r.Summary.Files, len(r.Files), len(files))
+	}
+
+	for _, rec := range r.Files {
+
+		data, err := os.ReadFile(filepath.Join(dir, rec.Path))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sum := sha256.Sum256(data)
+
+		if !rec.NOOP || rec.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Errorf("second run: record %+v, want NOOP with sha256 %x", rec, sum)
+		}
+	}
+}
+
+func TestReportSummaryOnly(t *testing.T) {
+
+	dir, files := testTree(t, 1)
+
+	tests := []struct {
+		summaryOnly bool
+		limit       int
+		want        bool
+	}{
+		{false, 0, false},
+		{true, 0, true},
+		{false, len(files), false},
+		{false, len(files) - 1, true},
+	}
+
+	for _, tt := range tests {
+
+		r := readReport(t, dir, Settings{MinifyJSON: true, DryRun: true, IncludeNoop: true,
+			SummaryOnly: tt.summaryOnly, ReportLimit: tt.limit})
+
+		if r.Summary.Files != len(files) || r.Summary.SummaryOnly != tt.want {
+			t.Errorf("summary only %t, limit %d: summary of %d files, summary only %t, want %d files, %t",
+				tt.summaryOnly, tt.limit, r.Summary.Files, r.Summary.SummaryOnly, len(files), tt.want)
+		}
+
+		// NOTE в отчете только со сводкой нет даже пустого списка файлов
+		if tt.want && r.Files != nil || !tt.want && len(r.Files) != len(files) {
+			t.Errorf("summary only %t, limit %d: %d records (nil %t)", tt.summaryOnly, tt.limit, len(r.Files),
+				r.Files == nil)
+		}
+	}
+}
+
+func TestSkipOwnFiles(t *testing.T) {
+
+	dir, files := testTree(t, 1)
+
+	var log bytes.Buffer
+
+	// NOTE с таким ext map отчет, события и кэш в корне выглядели бы как JSON ассеты
+	settings := Settings{
+		MinifyJSON: true,
+		ExtMap:     map[string]string{".json": "config", ".ndjson": "config"},
+		ReportJSON: filepath.Join(dir, "report.json"),
+		Events:     filepath.Join(dir, "events.ndjson"),
+		Cache:      true,
+		LogLevel:   LogDebug,
+		Log:        &log,
+	}
+
+	for run, want := range []uint{uint(len(files)), 0} {
+
+		log.Reset()
+
+		ao, err := NewAssetsOptimizer(dir, WithSettings(settings))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = ao.RunContext(context.Background()); err != nil {
+			t.Fatalf("run %d: %v\n%s", run, err, log.String())
+		}
+
+		// NOTE в первом прогоне отчета и кэша еще нет, только что открытый поток событий уже есть
+		own := []string{"events.ndjson"}
+
+		if run > 0 {
+			own = append(own, "report.json", cacheFileName)
+		}
+
+		if ao.stats.files != want || ao.stats.errors != 0 {
+			t.Errorf("run %d: processed %d files with %d errors, want %d\n%s", run, ao.stats.files, ao.stats.errors,
+				want, log.String())
+		}
+
+		for _, name := range own {
+			if !strings.Contains(log.String(), fmt.Sprintf("Skip %q: written by the optimizer itself", name)) {
+				t.Errorf("run %d: %s is not skipped\n%s", run, name, log.String())
+			}
+		}
+	}
+}
+
+// TestDefaultEffort checks that zero Settings search lossless variants as the CLI does by default, and only
+// NoVariants turns the search off
+func TestDefaultEffort(t *testing.T) {
+
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+
+	for i := 0; i < len(img.Pix); i += 4 {
+		level := uint8(i / 4 % 64 * 4)
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = level, level, level, 0xff
+	}
+
+	var src bytes.Buffer
+
+	if err := png.Encode(&src, img); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		opts   []Option
+		effort int
+		gray   bool
+	}{
+		{"no options", nil, EffortDefault, true},
+		{"settings without effort", []Option{WithSettings(Settings{KeepGoing: true})}, EffortDefault, true},
+		{"no variants", []Option{WithSettings(Settings{NoVariants: true})}, EffortFast, false},
+	}
+
+	for _, tt := range tests {
+
+		dir := t.TempDir()
+		path := filepath.Join(dir, "gray.png")
+
+		if err := os.WriteFile(path, src.Bytes(), 0o666); err != nil {
+			t.Fatal(err)
+		}
+
+		ao, err := NewAssetsOptimizer(dir, append(tt.opts, WithLogger(io.Discard))...)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ao.opts.Effort != tt.effort || !ao.opts.Verify {
+			t.Errorf("%s: effort %d, verify %t, want %d and verify", tt.name, ao.opts.Effort, ao.opts.Verify, tt.effort)
+		}
+
+		if err = ao.RunContext(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := os.ReadFile(path)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, gray := decodeTestPNG(t, got).(*image.Gray)
+
+		if gray != tt.gray {
+			t.Errorf("%s: optimized to %T, want gray %t", tt.name, decodeTestPNG(t, got), tt.gray)
+		}
+	}
+
+	if _, err := NewAssetsOptimizer(t.TempDir(), WithSettings(Settings{NoVariants: true, Effort: EffortMax})); err == nil {
+		t.Error("no variants with max effort: no error")
+	}
+}
+
+// downscaleFails is png optimizer whose Downscale of "bad" assets fails
+type downscaleFails struct {
+	*PNGOptimizer
+}
+
+func (o downscaleFails) Downscale(src, dst string, scale int) (uint, error) {
+
+	if strings.Contains(filepath.Base(src), "bad") {
+		return 0, errors.New("downscale failed")
+	}
+
+	return o.PNGOptimizer.Downscale(src, dst, scale)
+}
+
+// TestResponsive checks @1x sidecars: written downscaled, existing ones kept, and an asset whose sidecar fails is
+// counted as an error only
+func TestResponsive(t *testing.T) {
+
+	dir := t.TempDir()
+
+	srcs := map[string]*image.NRGBA{
+		"a@2x.png":    nColorsImage(16, 8, 64),
+		"odd@3x.png":  nColorsImage(7, 5, 35),
+		"kept@2x.png": nColorsImage(8, 8, 16),
+		"bad@2x.png":  nColorsImage(8, 8, 16),
+	}
+
+	for name, img := range srcs {
+
+		data, err := encodeStd(img)()
+
+		if err == nil {
+			err = os.WriteFile(filepath.Join(dir, name), data, 0o666)
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// NOTE сам kept.png тоже ассет и может быть оптимизирован, но не заменен на @1x от kept@2x.png (8x8 -> 4x4)
+	kept := nColorsImage(3, 3, 5)
+	data, err := encodeStd(kept)()
+
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, "kept.png"), data, 0o666)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registry := NewRegistry()
+	registry.Register(extPNG, downscaleFails{NewPNGOptimizer()})
+
+	var log bytes.Buffer
+
+	ao, err := NewAssetsOptimizer(dir, WithSettings(Settings{Responsive: true, KeepGoing: true, Registry: registry}),
+		WithLogger(&log))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ao.RunContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, scale := range map[string]int{"a.png": 2, "odd.png": 3} {
+
+		data, err := os.ReadFile(filepath.Join(dir, name))
+
+		if err != nil {
+			t.Fatalf("%s: %v\n%s", name, err, log.String())
+		}
+
+		src := srcs[strings.Replace(name, ".", fmt.Sprintf("@%dx.", scale), 1)]
+		samePixels(t, name, downscaleBox(src, scale), decodeTestPNG(t, data))
+	}
+
+	if data, err = os.ReadFile(filepath.Join(dir, "kept.png")); err != nil {
+		t.Fatal(err)
+	}
+
+	samePixels(t, "existing @1x", kept, decodeTestPNG(t, data))
+
+	if _, err = os.Stat(filepath.Join(dir, "bad.png")); err == nil {
+		t.Error("failed @1x is written")
+	}
+
+	// NOTE kept.png тоже ассет, отдельный от своего @2x
+	if ao.stats.files != 4 || ao.stats.errors != 1 {
+		t.Errorf("%d files with %d errors, want 4 files (a, odd, kept and kept.png) and 1 error\n%s", ao.stats.files,
+			ao.stats.errors, log.String())
+	}
+
+	if !strings.Contains(log.String(), "downscale failed") {
+		t.Errorf("sidecar error is not reported\n%s", log.String())
+	}
+}
+
+func TestDownscaleBox(t *testing.T) {
+
+	src := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+
+	// NOTE блок 2x2 с прозрачным пикселем: его RGB не должен подмешиваться, альфа усредняется
+	src.SetNRGBA(0, 0, color.NRGBA{200, 100, 0, 0xff})
+	src.SetNRGBA(1, 0, color.NRGBA{0, 0, 0xff, 0})
+	src.SetNRGBA(0, 1, color.NRGBA{100, 50, 0, 0xff})
+	src.SetNRGBA(1, 1, color.NRGBA{0, 0, 0, 0xff})
+
+	// NOTE неполный крайний блок 1x2, весь прозрачный
+	src.SetNRGBA(2, 0, color.NRGBA{10, 20, 30, 0})
+	src.SetNRGBA(2, 1, color.NRGBA{40, 50, 60, 0})
+
+	dst := downscaleBox(src, 2)
+
+	if dst.Bounds() != image.Rect(0, 0, 2, 1) {
+		t.Fatalf("bounds %v, want 2x1", dst.Bounds())
+	}
+
+	if c := dst.NRGBAAt(0, 0); c != (color.NRGBA{100, 50, 0, 191}) {
+		t.Errorf("(0, 0) %v, want {100 50 0 191}", c)
+	}
+
+	if c := dst.NRGBAAt(1, 0); c != (color.NRGBA{}) {
+		t.Errorf("(1, 0) %v, want transparent zero", c)
+	}
+}
+
+// TestWithSettings checks that WithSettings overrides only the fields it sets, in either order with other options
+func TestWithSettings(t *testing.T) {
+
+	var log bytes.Buffer
+
+	s := applyOptions([]Option{WithDryRun(true), WithWorkers(3), WithSettings(Settings{MinifyJSON: true, Workers: 2}),
+		WithMinSize(10)})
+
+	if !s.DryRun || s.Workers != 2 || !s.MinifyJSON || s.MinSize != 10 {
+		t.Errorf("dry run %t, workers %d, minify json %t, min size %d, want true, 2, true, 10", s.DryRun, s.Workers,
+			s.MinifyJSON, s.MinSize)
+	}
+
+	s = applyOptions([]Option{WithLogger(&log), WithSettings(Settings{ExtMap: map[string]string{"tex": "png"}}),
+		WithSettings(Settings{KeepGoing: true}), WithDryRun(false)})
+
+	if s.Log != &log || s.ExtMap["tex"] != "png" || !s.KeepGoing || s.DryRun {
+		t.Errorf("log %v, ext map %v, keep going %t, dry run %t", s.Log, s.ExtMap, s.KeepGoing, s.DryRun)
+	}
+
+	if s = applyOptions([]Option{WithSettings(Settings{})}); !reflect.DeepEqual(s, Settings{}) {
+		t.Errorf("zero settings: %+v", s)
+	}
+}
+
+func TestKeepOriginal(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		opts      OptimizeOptions
+		optimized int64 // of the 1000 bytes original
+		want      bool  // original is kept
+	}{
+		{"bigger", OptimizeOptions{}, 1001, true},
+		{"same size", OptimizeOptions{}, 1000, true},
+		{"any saving", OptimizeOptions{}, 999, false},
+		{"below bytes", OptimizeOptions{MinSavedBytes: 100}, 901, true},
+		{"at bytes", OptimizeOptions{MinSavedBytes: 100}, 900, false},
+		{"above bytes", OptimizeOptions{MinSavedBytes: 100}, 899, false},
+		{"below pct", OptimizeOptions{MinSavedPct: 2.5}, 976, true},
+		{"at pct", OptimizeOptions{MinSavedPct: 2.5}, 975, false},
+		{"above pct", OptimizeOptions{MinSavedPct: 2.5}, 974, false},
+		{"pct passes, bytes do not", OptimizeOptions{MinSavedPct: 1, MinSavedBytes: 50}, 951, true},
+		{"bytes pass, pct does not", OptimizeOptions{MinSavedPct: 5, MinSavedBytes: 10}, 951, true},
+		{"both at", OptimizeOptions{MinSavedPct: 5, MinSavedBytes: 50}, 950, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			res := OptimizeResult{Size: 1000, OptimizedSize: tt.optimized, Reason: "note"}
+
+			if got := tt.opts.keepOriginal(&res); got != tt.want || res.NOOP != tt.want {
+				t.Fatalf("kept %t, NOOP %t, want %t", got, res.NOOP, tt.want)
+			}
+
+			// NOTE причина порога дописывается к уже имеющейся
+			if tt.want && tt.optimized < 1000 && !strings.HasPrefix(res.Reason, "note, saves only") {
+				t.Errorf("reason %q", res.Reason)
+			}
+		})
+	}
+}
+
+func TestClassify(t *testing.T) {
+
+	dir := t.TempDir()
+
+	// NOTE Classify ничего не декодирует, так что содержимое файлов не важно, только их размер
+	files := map[string]string{
+		"a.png":         "png",
+		"B.PNG":         "upper",
+		"item.config":   "{}",
+		"sprite.tex":    "mapped",
+		"icon.min.tex":  "longest suffix",
+		"notes.txt":     "not an asset",
+		"README":        "no ext",
+		"sub/c.png":     "nested",
+		"vendor/v.png":  "excluded",
+		"sub/d.min.png": "excluded by name",
+		"sub/e.config~": "backup",
+	}
+
+	for rel, data := range files {
+
+		path := filepath.Join(dir, filepath.FromSlash(rel))
+
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(path, []byte(data), 0o666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var log bytes.Buffer
+
+	ao, err := NewAssetsOptimizer(dir, WithSettings(Settings{
+		MinifyJSON: true,
+		ExtMap:     map[string]string{".tex": "png", ".min.tex": "config"},
+		Exclude:    []string{"vendor", "*.min.png"},
+		Log:        &log,
+	}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ao.Classify(); err != nil {
+		t.Fatal(err)
+	}
+
+	line := func(ext, optimizer, rel string) string {
+		return fmt.Sprintf("%s\t%s\t%d\t%s\n", ext, optimizer, len(files[rel]), filepath.FromSlash(rel))
+	}
+
+	const (
+		png  = "*service.PNGOptimizer"
+		json = "*service.JSONOptimizer"
+	)
+
+	want := line("png", png, "B.PNG") +
+		line("-", "-", "README") +
+		line("png", png, "a.png") +
+		line("config", json, "icon.min.tex") +
+		line("config", json, "item.config") +
+		line("txt", "-", "notes.txt") +
+		line("png", png, "sprite.tex") +
+		line("png", png, "sub/c.png") +
+		line("config~", "-", "sub/e.config~") +
+		fmt.Sprintf("Totally optimizable files: 6, totally bytes: %d\n", len(files["B.PNG"])+len(files["a.png"])+
+			len(files["icon.min.tex"])+len(files["item.config"])+len(files["sprite.tex"])+len(files["sub/c.png"]))
+
+	if got := log.String(); got != want {
+		t.Errorf("classify:\n%s\nwant:\n%s", got, want)
+	}
+}
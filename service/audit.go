@@ -0,0 +1,237 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// auditHeaderLen is the part of png Audit reads: signature and IHDR chunk without CRC
+const auditHeaderLen = len(pngSignature) + 8 + pngIHDRLen
+
+var pngColorNames = map[uint8]string{
+	pngColorGray:      "gray",
+	pngColorRGB:       "rgb",
+	pngColorPaletted:  "paletted",
+	pngColorGrayAlpha: "gray+alpha",
+	pngColorRGBA:      "rgba",
+}
+
+// auditGroup is the tally of Audit of assets of single format or png color type
+type auditGroup struct {
+	files      uint
+	bytes      uint64
+	pixels     uint64 // png only
+	interlaced uint   // png only
+}
+
+// Audit walks dir and prints number and total size of assets of every format, and of png images of every color
+// type and bit depth read from their IHDR, without decoding or optimizing anything (unlike DryRun), to estimate
+// what a full run could gain; Exclude, Gitignore and Extensions apply, the cache does not
+func (ao *AssetsOptimizer) Audit() (err error) {
+
+	if ao.fsys != nil {
+		return fmt.Errorf("audit is %w", errFSSource)
+	}
+
+	var total auditGroup
+
+	byExt := make(map[string]*auditGroup)
+	byColor := make(map[string]*auditGroup)
+
+	err = filepath.WalkDir(ao.dir, func(path string, d fs.DirEntry, err error) error {
+
+		if err != nil {
+			return fmt.Errorf("walk dir %q error: %w", path, err)
+		}
+
+		if skip, err := ao.skipExcluded(path, d); skip || err != nil {
+			return err
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		ext := ao.resolveExt(path)
+
+		if ext == "" || ao.optimizerFor(ext) == nil {
+			return nil
+		}
+
+		info, err := d.Info()
+
+		if err != nil {
+			return fmt.Errorf("walk dir %q error: %w", path, err)
+		}
+
+		size := uint64(info.Size())
+
+		total.add(size)
+		auditGroupOf(byExt, ext).add(size)
+
+		if ext != extPNG {
+			return nil
+		}
+
+		h, err := readPNGHeaderFile(path)
+
+		if err != nil {
+			return err
+		}
+
+		key := "invalid header"
+
+		if h.width > 0 {
+
+			name, ok := pngColorNames[h.colorType]
+
+			if !ok {
+				name = fmt.Sprintf("color type %d", h.colorType)
+			}
+
+			key = fmt.Sprintf("%s %d-bit", name, h.bitDepth)
+		}
+
+		g := auditGroupOf(byColor, key)
+		g.add(size)
+		g.pixels += uint64(h.width) * uint64(h.height)
+
+		if h.isInterlaced() {
+			g.interlaced++
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(ao.log, "Audit of dir %q: %d files, %s\n", ao.dir, total.files, formatBytes(total.bytes))
+
+	for _, ext := range sortedAuditKeys(byExt) {
+
+		fmt.Fprintf(ao.log, "  %s: %d files, %s\n", ext, byExt[ext].files, formatBytes(byExt[ext].bytes))
+
+		if ext != extPNG {
+			continue
+		}
+
+		for _, key := range sortedAuditKeys(byColor) {
+
+			g := byColor[key]
+
+			fmt.Fprintf(ao.log, "    %s: %d files, %s", key, g.files, formatBytes(g.bytes))
+
+			if g.pixels > 0 {
+				fmt.Fprintf(ao.log, ", %s", formatPixels(g.pixels))
+			}
+
+			if g.interlaced > 0 {
+				fmt.Fprintf(ao.log, ", interlaced %d", g.interlaced)
+			}
+
+			fmt.Fprintln(ao.log)
+		}
+	}
+
+	return nil
+}
+
+func formatPixels(n uint64) string {
+
+	switch {
+	case n < 1e3:
+		return fmt.Sprintf("%d px", n)
+	case n < 1e6:
+		return fmt.Sprintf("%.1f Kpx", float64(n)/1e3)
+	default:
+		return fmt.Sprintf("%.1f Mpx", float64(n)/1e6)
+	}
+}
+
+func (g *auditGroup) add(size uint64) {
+	g.files++
+	g.bytes += size
+}
+
+func auditGroupOf(m map[string]*auditGroup, key string) *auditGroup {
+
+	g, ok := m[key]
+
+	if !ok {
+		g = &auditGroup{}
+		m[key] = g
+	}
+
+	return g
+}
+
+// sortedAuditKeys returns keys of m, the biggest groups first
+func sortedAuditKeys(m map[string]*auditGroup) []string {
+
+	keys := make([]string, 0, len(m))
+
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+
+		if m[keys[i]].bytes != m[keys[j]].bytes {
+			return m[keys[i]].bytes > m[keys[j]].bytes
+		}
+
+		return keys[i] < keys[j]
+	})
+
+	return keys
+}
+
+// readPNGHeaderFile reads only the beginning of png path up to IHDR, header of a file that is not a valid png
+// is zero (a valid one is never 0x0)
+func readPNGHeaderFile(path string) (h pngHeader, err error) {
+
+	fp, err := os.Open(path)
+
+	if err != nil {
+		return h, err
+	}
+
+	defer fp.Close()
+
+	var buf [auditHeaderLen]byte
+
+	// NOTE короткий файл не ошибка аудита, readPNGHeader просто не найдет в нем IHDR
+	n, err := io.ReadFull(fp, buf[:])
+
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return h, err
+	}
+
+	if h, err = readPNGHeader(buf[:n]); err != nil {
+		return pngHeader{}, nil
+	}
+
+	return h, nil
+}
@@ -0,0 +1,151 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestAudit(t *testing.T) {
+
+	gray, err := encodeStd(image.NewGray(image.Rect(0, 0, 4, 4)))()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paletted, err := encodeStd(image.NewPaletted(image.Rect(0, 0, 4, 4), color.Palette{color.Black, color.White}))()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rgba, err := encodeStd(image.NewNRGBA(image.Rect(0, 0, 2, 2)))()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// NOTE Audit читает только IHDR, так что битый CRC после правки interlace ему не мешает
+	interlaced := append([]byte(nil), gray...)
+	interlaced[len(pngSignature)+8+12] = 1
+
+	dir := t.TempDir()
+
+	files := map[string][]byte{
+		"gray.png":           gray,
+		"sub/interlaced.png": interlaced,
+		"paletted.png":       paletted,
+		"rgba.png":           rgba,
+		"bad.png":            []byte("not a png"),
+		"a.config":           []byte("{ \"a\": 1 }"),
+		"notes.txt":          []byte("not an asset"),
+		"vendor/v.png":       gray,
+	}
+
+	for rel, data := range files {
+
+		path := filepath.Join(dir, filepath.FromSlash(rel))
+
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(path, data, 0o666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var log bytes.Buffer
+
+	ao, err := NewAssetsOptimizer(dir, WithSettings(Settings{MinifyJSON: true, Exclude: []string{"vendor"}, Log: &log}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ao.Audit(); err != nil {
+		t.Fatal(err)
+	}
+
+	size := func(names ...string) string {
+
+		var n uint64
+
+		for _, name := range names {
+			n += uint64(len(files[name]))
+		}
+
+		return formatBytes(n)
+	}
+
+	want := []string{
+		fmt.Sprintf("Audit of dir %q: 6 files, %s", dir, size("gray.png", "sub/interlaced.png", "paletted.png",
+			"rgba.png", "bad.png", "a.config")),
+		fmt.Sprintf("  png: 5 files, %s", size("gray.png", "sub/interlaced.png", "paletted.png", "rgba.png",
+			"bad.png")),
+		fmt.Sprintf("    gray 8-bit: 2 files, %s, 32 px, interlaced 1", size("gray.png", "sub/interlaced.png")),
+		fmt.Sprintf("    paletted 1-bit: 1 files, %s, 16 px", size("paletted.png")),
+		fmt.Sprintf("    rgba 8-bit: 1 files, %s, 4 px", size("rgba.png")),
+		fmt.Sprintf("    invalid header: 1 files, %s", size("bad.png")),
+		fmt.Sprintf("  config: 1 files, %s", size("a.config")),
+	}
+
+	lines := strings.Split(strings.TrimSuffix(log.String(), "\n"), "\n")
+
+	if len(lines) != len(want) {
+		t.Fatalf("audit:\n%s\nwant:\n%s", log.String(), strings.Join(want, "\n"))
+	}
+
+	for _, w := range want {
+
+		found := false
+
+		for _, line := range lines {
+			found = found || line == w
+		}
+
+		if !found {
+			t.Errorf("no %q in audit:\n%s", w, log.String())
+		}
+	}
+
+	// NOTE аудит ничего не трогает
+	for rel, data := range files {
+		if got, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(rel))); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s is changed: %v", rel, err)
+		}
+	}
+
+	if ao, err = NewAssetsOptimizerFS(fstest.MapFS{"a.config": {Data: files["a.config"]}}, ".",
+		WithSettings(Settings{OutputDir: t.TempDir(), Log: &log})); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ao.Audit(); !errors.Is(err, errFSSource) {
+		t.Errorf("audit of fs.FS: %v, want %v", err, errFSSource)
+	}
+}
@@ -0,0 +1,196 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build avif
+
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// AVIF / HEIC have no decoder in go stdlib, and the pure go ones at hand need newer go, so this optimizer (built
+// with -tags avif only) runs decoder CLI from PATH: heif-dec (heif-convert before libheif 1.17) decodes both,
+// avifdec (libavif) decodes AVIF only; all of them take "input output.png"
+//
+// NOTE кодировать обратно в AVIF нечем, поэтому это не оптимизация по месту, а конвертация в png рядом
+
+const (
+	extAVIF = "avif"
+	extHEIC = "heic"
+	extHEIF = "heif"
+)
+
+var errAVIFNoDecoder = errors.New("no AVIF / HEIC decoder in PATH")
+
+type avifDecoder struct {
+	cmd  string
+	exts []string // nil - all formats of AVIFOptimizer
+}
+
+var avifDecoders = []avifDecoder{
+	{cmd: "heif-dec"},
+	{cmd: "heif-convert"},
+	{cmd: "avifdec", exts: []string{extAVIF}},
+}
+
+type AVIFOptimizer struct {
+	png *PNGOptimizer
+}
+
+// NewAVIFOptimizer creates optimizer converting avif / heic to png optimized by png
+func NewAVIFOptimizer(png *PNGOptimizer) *AVIFOptimizer {
+	return &AVIFOptimizer{png: png}
+}
+
+func registerAVIF(r *Registry, png *PNGOptimizer) {
+
+	avif := NewAVIFOptimizer(png)
+
+	r.Register(extAVIF, avif)
+	r.Register(extHEIC, avif)
+	r.Register(extHEIF, avif)
+}
+
+// Optimize writes optimized png next to avif / heic (foo.avif -> foo.png) unless it already exists, the source is
+// left as is; png is written even if it is bigger than the source, it is the only format the game loads
+func (o *AVIFOptimizer) Optimize(path string, opts *OptimizeOptions) (res OptimizeResult, err error) {
+
+	info, err := os.Stat(path)
+
+	if err != nil {
+		return res, fmt.Errorf("AVIFOptimizer optimize error: %w", err)
+	}
+
+	res.Size = info.Size()
+
+	dst := pngName(path)
+
+	// NOTE чужой png с тем же именем не трогаем
+	if _, err = os.Lstat(dst); err == nil {
+		res.NOOP, res.Reason = true, fmt.Sprintf("%s already exists", filepath.Base(dst))
+		return res, nil
+	}
+
+	img, err := decodeAVIF(path)
+
+	if errors.Is(err, errAVIFNoDecoder) {
+		res.NOOP, res.Reason = true, err.Error()
+		return res, nil
+	} else if err != nil {
+		return res, fmt.Errorf("AVIFOptimizer optimize error: %w", err)
+	}
+
+	opt, as, err := o.png.OptimizeImage(img)
+
+	if err == nil {
+		opt, as, err = o.png.refilter(opt, as, opts.Effort)
+	}
+
+	if err != nil {
+		return res, err
+	}
+
+	res.OptimizedSize = int64(opt.Len())
+	res.Variant = fmt.Sprintf("png %s, converted %s -> %s", as, filepath.Base(path), filepath.Base(dst))
+
+	if opts.Verify {
+		if err = o.png.verify(img, opt.Bytes()); err != nil {
+			return res, fmt.Errorf("AVIFOptimizer verify %s error: %w", as, err)
+		}
+	}
+
+	if opts.DryRun {
+		return res, nil
+	}
+
+	if opts.Output != "" {
+		dst = pngName(opts.Output)
+	}
+
+	// NOTE исходник не удаляется и не перезаписывается, поэтому и backup не нужен
+	return res, writeOutput(path, dst, ".pngtmp", opt)
+}
+
+// decodeAVIF decodes path by the first decoder of avifDecoders found in PATH through temp png
+func decodeAVIF(path string) (_ image.Image, err error) {
+
+	ext := assetExt(path)
+
+	var cmd string
+
+	for _, d := range avifDecoders {
+
+		if d.exts != nil && !containsString(d.exts, ext) {
+			continue
+		}
+
+		if cmd, err = exec.LookPath(d.cmd); err == nil {
+			break
+		}
+	}
+
+	if cmd == "" {
+		return nil, errAVIFNoDecoder
+	}
+
+	fp, err := os.CreateTemp("", "sboptimizer-*.png")
+
+	if err != nil {
+		return nil, err
+	}
+
+	tmpPath := fp.Name()
+	_ = fp.Close()
+
+	trackTempFile(tmpPath)
+
+	defer func() {
+		_ = os.Remove(tmpPath)
+		untrackTempFile(tmpPath)
+	}()
+
+	if out, err := exec.Command(cmd, path, tmpPath).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("%s error: %w: %s", filepath.Base(cmd), err, strings.TrimSpace(string(out)))
+	}
+
+	data, err := os.ReadFile(tmpPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return png.Decode(bytes.NewReader(data))
+}
+
+func containsString(list []string, s string) bool {
+
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
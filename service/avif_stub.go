@@ -0,0 +1,22 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build !avif
+
+package service
+
+// registerAVIF without -tags avif registers nothing, so avif / heic files are unknown and skipped
+func registerAVIF(r *Registry, png *PNGOptimizer) {}
@@ -0,0 +1,363 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/image/bmp"
+)
+
+// bmp is decoded with golang.org/x/image/bmp, except 1/4 bpp files and 32 bpp BITMAPINFOHEADER files with alpha in
+// the reserved byte: x/image/bmp does not decode the former and, like browsers, makes the latter opaque, while
+// editors do write the alpha there, so those two are decoded by own decodeBMPFallback
+// SEE https://learn.microsoft.com/en-us/windows/win32/gdi/bitmap-storage
+//     BITMAPFILEHEADER, BITMAPINFOHEADER, BITMAPV4HEADER, BITMAPV5HEADER
+//
+// NOTE поддерживаются только несжатые 1/4/8 (палитра), 24 и 32 (с альфой) бита на пиксель, т.е. то, что реально
+//      пишут редакторы; RLE, 16 бит, JPEG/PNG внутри BMP и т.п. оставляем как есть
+
+const (
+	extBMP = "bmp"
+
+	bmpFileHeaderLen = 14
+	bmpInfoHeaderLen = 40
+
+	bmpRGB       = 0 // BI_RGB
+	bmpBitfields = 3 // BI_BITFIELDS
+
+	bmpMaxSide = 1 << 15
+)
+
+var (
+	errBMPSignature   = errors.New("not a BMP file")
+	errBMPTruncated   = errors.New("truncated BMP file")
+	errBMPUnsupported = errors.New("unsupported BMP format")
+)
+
+type BMPOptimizer struct {
+	png *PNGOptimizer
+}
+
+// NewBMPOptimizer creates optimizer converting bmp to png optimized by png
+func NewBMPOptimizer(png *PNGOptimizer) *BMPOptimizer {
+	return &BMPOptimizer{png: png}
+}
+
+// Optimize converts bmp to optimized png next to it (foo.bmp -> foo.png) and removes the bmp,
+// only with opts.ConvertBMP since the asset changes its name
+func (o *BMPOptimizer) Optimize(path string, opts *OptimizeOptions) (res OptimizeResult, err error) {
+
+	if !opts.ConvertBMP {
+		res.NOOP, res.Reason = true, "conversion to png is off, see --convert-bmp"
+		return res, nil
+	}
+
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return res, fmt.Errorf("BMPOptimizer optimize error: %w", err)
+	}
+
+	res.Size = int64(len(data))
+
+	img, err := decodeBMP(data)
+
+	if errors.Is(err, errBMPUnsupported) {
+		res.NOOP, res.Reason = true, err.Error()
+		return res, nil
+	} else if err != nil {
+		return res, fmt.Errorf("BMPOptimizer optimize error: %w", err)
+	}
+
+	dst := pngName(path)
+
+	// NOTE чужой png с тем же именем не трогаем
+	if _, err = os.Lstat(dst); err == nil {
+		res.NOOP, res.Reason = true, fmt.Sprintf("%s already exists", filepath.Base(dst))
+		return res, nil
+	}
+
+	opt, as, err := o.png.OptimizeImage(img)
+
+	if err == nil {
+		opt, as, err = o.png.refilter(opt, as, opts.Effort)
+	}
+
+	if err != nil {
+		return res, err
+	}
+
+	res.OptimizedSize = int64(opt.Len())
+	res.Variant = fmt.Sprintf("png %s, converted %s -> %s", as, filepath.Base(path), filepath.Base(dst))
+
+	if opts.keepOriginal(&res) {
+		return res, nil
+	}
+
+	if opts.Verify {
+		if err = o.png.verify(img, opt.Bytes()); err != nil {
+			return res, fmt.Errorf("BMPOptimizer verify %s error: %w", as, err)
+		}
+	}
+
+	if opts.DryRun {
+		return res, nil
+	}
+
+	// NOTE с output dir png пишется туда, а исходный bmp остается как есть
+	if opts.Output != "" {
+		return res, writeOutput(path, pngName(opts.Output), ".pngtmp", opt)
+	}
+
+	// NOTE bmp удаляется, поэтому и его копия делается до того, как появится png
+	if err = backupAsset(path, opts); err != nil {
+		return res, err
+	}
+
+	// NOTE как и replaceAsset, сохраняем права и mtime исходника
+	if err = writeOutput(path, dst, ".pngtmp", opt); err != nil {
+		return res, err
+	}
+
+	// NOTE bmp удаляется только после того, как png уже на месте
+	if err = os.Remove(path); err != nil {
+		return res, fmt.Errorf("BMPOptimizer remove converted bmp error: %w", err)
+	}
+
+	return res, nil
+}
+
+// pngName replaces extension of path with .png
+func pngName(path string) string {
+	return path[:len(path)-len(filepath.Ext(path))] + "." + extPNG
+}
+
+type bmpHeader struct {
+	width, height int
+	topDown       bool
+	bpp           int
+	compression   uint32
+	colors        int // palette size
+	dibLen        int
+	pixOffset     int
+}
+
+// readBMPHeader reads and checks headers of data, x/image/bmp checks them once more for the files it decodes
+func readBMPHeader(data []byte) (h bmpHeader, err error) {
+
+	if len(data) < bmpFileHeaderLen+bmpInfoHeaderLen {
+		return h, errBMPTruncated
+	}
+
+	if data[0] != 'B' || data[1] != 'M' {
+		return h, errBMPSignature
+	}
+
+	le := binary.LittleEndian
+
+	h.pixOffset = int(le.Uint32(data[10:14]))
+
+	dib := data[bmpFileHeaderLen:]
+	h.dibLen = int(le.Uint32(dib[0:4]))
+
+	// NOTE BITMAPCOREHEADER (12) и OS/2 заголовки не поддерживаем
+	if h.dibLen < bmpInfoHeaderLen || len(dib) < h.dibLen {
+		return h, fmt.Errorf("%w: DIB header of %d bytes", errBMPUnsupported, h.dibLen)
+	}
+
+	w := int32(le.Uint32(dib[4:8]))
+	ht := int32(le.Uint32(dib[8:12]))
+
+	if ht < 0 {
+		h.topDown, ht = true, -ht
+	}
+
+	if w <= 0 || ht <= 0 || w > bmpMaxSide || ht > bmpMaxSide {
+		return h, fmt.Errorf("%w: size %dx%d", errBMPUnsupported, w, ht)
+	}
+
+	h.width, h.height = int(w), int(ht)
+
+	if planes := le.Uint16(dib[12:14]); planes != 1 {
+		return h, fmt.Errorf("%w: %d planes", errBMPUnsupported, planes)
+	}
+
+	h.bpp = int(le.Uint16(dib[14:16]))
+	h.compression = le.Uint32(dib[16:20])
+	h.colors = int(le.Uint32(dib[32:36]))
+
+	switch {
+	case h.bpp != 1 && h.bpp != 4 && h.bpp != 8 && h.bpp != 24 && h.bpp != 32:
+		return h, fmt.Errorf("%w: %d bpp", errBMPUnsupported, h.bpp)
+	case h.compression == bmpRGB:
+	case h.compression == bmpBitfields && h.bpp == 32:
+		// NOTE x/image/bmp принимает bitfields только с масками BGRA в V4+ заголовке
+	default:
+		return h, fmt.Errorf("%w: compression %d", errBMPUnsupported, h.compression)
+	}
+
+	if h.colors == 0 || h.colors > 1<<h.bpp {
+		h.colors = 1 << h.bpp
+	}
+
+	return h, nil
+}
+
+// decodeBMP decodes uncompressed bmp into *image.Paletted (1, 4, 8 bpp), *image.RGBA (24 bpp) or *image.NRGBA
+// (32 bpp)
+func decodeBMP(data []byte) (_ image.Image, err error) {
+
+	h, err := readBMPHeader(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if h.bpp < 8 || h.bpp == 32 && h.dibLen == bmpInfoHeaderLen && h.compression == bmpRGB {
+
+		img, err := decodeBMPFallback(data, h)
+
+		// NOTE nil - BGRX без альфы, его x/image/bmp декодирует так же
+		if err != nil || img != nil {
+			return img, err
+		}
+	}
+
+	img, err := bmp.Decode(bytes.NewReader(data))
+
+	if errors.Is(err, bmp.ErrUnsupported) {
+		return nil, fmt.Errorf("%w: %d bpp, compression %d, DIB header of %d bytes", errBMPUnsupported, h.bpp,
+			h.compression, h.dibLen)
+	} else if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, errBMPTruncated
+	}
+
+	return img, err
+}
+
+// decodeBMPFallback decodes 1/4 bpp bmp into *image.Paletted and 32 bpp BI_RGB bmp with alpha into *image.NRGBA,
+// nil for 32 bpp one without alpha (all the reserved bytes are 0)
+func decodeBMPFallback(data []byte, h bmpHeader) (_ image.Image, err error) {
+
+	// строки выровнены на 4 байта
+	stride := (h.width*h.bpp + 31) / 32 * 4
+
+	if h.pixOffset < 0 || h.pixOffset > len(data) || len(data)-h.pixOffset < stride*h.height {
+		return nil, errBMPTruncated
+	}
+
+	pix := data[h.pixOffset:]
+
+	// NOTE по умолчанию строки идут снизу вверх
+	row := func(y int) []byte {
+
+		if !h.topDown {
+			y = h.height - 1 - y
+		}
+
+		return pix[y*stride : (y+1)*stride]
+	}
+
+	rect := image.Rect(0, 0, h.width, h.height)
+
+	if h.bpp < 8 {
+
+		// палитра BGRX сразу после DIB заголовка
+		palOffset := bmpFileHeaderLen + h.dibLen
+
+		if palOffset+4*h.colors > h.pixOffset {
+			return nil, errBMPTruncated
+		}
+
+		palette := make(color.Palette, h.colors)
+
+		for i := range palette {
+			c := data[palOffset+4*i:]
+			palette[i] = color.RGBA{R: c[2], G: c[1], B: c[0], A: 0xff}
+		}
+
+		img := image.NewPaletted(rect, palette)
+
+		mask := byte(1<<h.bpp - 1)
+
+		for y := 0; y < h.height; y++ {
+
+			src := row(y)
+			dst := img.Pix[y*img.Stride : y*img.Stride+h.width]
+
+			for x := range dst {
+
+				bit := x * h.bpp
+				idx := src[bit/8] >> (8 - h.bpp - bit%8) & mask
+
+				if int(idx) >= len(palette) {
+					return nil, fmt.Errorf("BMP palette index %d out of range %d", idx, len(palette))
+				}
+
+				dst[x] = idx
+			}
+		}
+
+		return img, nil
+	}
+
+	// NOTE четвертый байт BI_RGB 32 bpp формально зарезервирован, но редакторы пишут туда альфу;
+	//      если он везде 0, то это BGRX и изображение непрозрачно
+	hasAlpha := false
+
+	for y := 0; y < h.height && !hasAlpha; y++ {
+
+		src := row(y)
+
+		for x := 0; x < h.width; x++ {
+			if src[4*x+3] != 0 {
+				hasAlpha = true
+				break
+			}
+		}
+	}
+
+	if !hasAlpha {
+		return nil, nil
+	}
+
+	img := image.NewNRGBA(rect)
+
+	for y := 0; y < h.height; y++ {
+
+		src := row(y)
+		dst := img.Pix[y*img.Stride : y*img.Stride+4*h.width]
+
+		for x := 0; x < h.width; x++ {
+
+			s, d := src[4*x:], dst[4*x:]
+
+			d[0], d[1], d[2], d[3] = s[2], s[1], s[0], s[3]
+		}
+	}
+
+	return img, nil
+}
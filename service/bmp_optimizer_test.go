@@ -0,0 +1,339 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/image/bmp"
+)
+
+// encodeTestBMP writes img (*image.Paletted for bpp <= 8, *image.NRGBA otherwise) as BI_RGB bmp with
+// BITMAPINFOHEADER, bottom-up unless topDown; 32 bpp keeps alpha in the reserved byte
+func encodeTestBMP(img image.Image, bpp int, topDown bool, compression uint32) []byte {
+
+	le := binary.LittleEndian
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	var palette color.Palette
+
+	if p, ok := img.(*image.Paletted); ok {
+		palette = p.Palette
+	}
+
+	stride := (w*bpp + 31) / 32 * 4
+	pixOffset := bmpFileHeaderLen + bmpInfoHeaderLen + 4*len(palette)
+
+	out := make([]byte, pixOffset, pixOffset+stride*h)
+
+	copy(out, "BM")
+	le.PutUint32(out[2:], uint32(pixOffset+stride*h))
+	le.PutUint32(out[10:], uint32(pixOffset))
+
+	dib := out[bmpFileHeaderLen:]
+
+	height := int32(h)
+
+	if topDown {
+		height = -height
+	}
+
+	le.PutUint32(dib[0:], bmpInfoHeaderLen)
+	le.PutUint32(dib[4:], uint32(w))
+	le.PutUint32(dib[8:], uint32(height))
+	le.PutUint16(dib[12:], 1)
+	le.PutUint16(dib[14:], uint16(bpp))
+	le.PutUint32(dib[16:], compression)
+	le.PutUint32(dib[32:], uint32(len(palette)))
+
+	for i, c := range palette {
+		r, g, b, _ := c.RGBA()
+		copy(dib[bmpInfoHeaderLen+4*i:], []byte{byte(b >> 8), byte(g >> 8), byte(r >> 8), 0})
+	}
+
+	rows := make([][]byte, h)
+
+	for y := range rows {
+
+		row := make([]byte, stride)
+
+		for x := 0; x < w; x++ {
+			switch p := img.(type) {
+			case *image.Paletted:
+				bit := x * bpp
+				row[bit/8] |= p.ColorIndexAt(x, y) << (8 - bpp - bit%8)
+			case *image.NRGBA:
+				c := p.NRGBAAt(x, y)
+				copy(row[x*bpp/8:], []byte{c.B, c.G, c.R, c.A}[:bpp/8])
+			}
+		}
+
+		rows[y] = row
+	}
+
+	for y := range rows {
+
+		if !topDown {
+			y = h - 1 - y
+		}
+
+		out = append(out, rows[y]...)
+	}
+
+	return out
+}
+
+// testBMPImage returns w x h image of bpp bmp: paletted of 1 << bpp colors or NRGBA, transparent if alpha
+func testBMPImage(w, h, bpp int, alpha bool) image.Image {
+
+	r := testRand(uint32(w*h + bpp))
+
+	if bpp <= 8 {
+
+		palette := make(color.Palette, 1<<bpp)
+
+		for i := range palette {
+			palette[i] = color.RGBA{uint8(i * 37), uint8(255 - i), uint8(i * 11), 0xff}
+		}
+
+		img := image.NewPaletted(image.Rect(0, 0, w, h), palette)
+
+		for i := range img.Pix {
+			img.Pix[i] = uint8(((i%w)*len(palette)/w + int(r.next()%2)) % len(palette))
+		}
+
+		return img
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+
+			a := uint8(0xff)
+
+			if alpha {
+				a = uint8(x * 255 / w)
+			}
+
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x * 8), uint8(y * 8), r.next(), a})
+		}
+	}
+
+	return img
+}
+
+func TestDecodeBMP(t *testing.T) {
+
+	tests := []struct {
+		bpp      int
+		alpha    bool
+		fallback bool // golang.org/x/image/bmp can not decode it, decodeBMPFallback does
+	}{
+		{1, false, true},
+		{4, false, true},
+		{8, false, false},
+		{24, false, false},
+		{32, false, false},
+		// NOTE x/image/bmp игнорирует альфу BITMAPINFOHEADER
+		{32, true, true},
+	}
+
+	for _, tt := range tests {
+		for _, topDown := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%d bpp alpha %t top-down %t", tt.bpp, tt.alpha, topDown), func(t *testing.T) {
+
+				// NOTE нечетная ширина, чтобы строки выравнивались на 4 байта
+				want := testBMPImage(13, 7, tt.bpp, tt.alpha)
+				data := encodeTestBMP(want, tt.bpp, topDown, bmpRGB)
+
+				// NOTE непрозрачные 32 bpp пишем как BGRX, с нулями в зарезервированном байте
+				if tt.bpp == 32 && !tt.alpha {
+					data = encodeTestBMP(transparentNRGBA(want.(*image.NRGBA)), tt.bpp, topDown, bmpRGB)
+				}
+
+				img, err := decodeBMP(data)
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				samePixels(t, "decodeBMP", want, img)
+
+				var fimg image.Image
+
+				if tt.bpp < 8 || tt.bpp == 32 {
+
+					h, err := readBMPHeader(data)
+
+					if err == nil {
+						fimg, err = decodeBMPFallback(data, h)
+					}
+
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				ximg, err := bmp.Decode(bytes.NewReader(data))
+
+				if !tt.fallback {
+
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					samePixels(t, "x/image/bmp", ximg, img)
+
+					if tt.bpp == 32 && fimg != nil {
+						t.Error("fallback decodes BGRX")
+					}
+
+					return
+				}
+
+				if fimg == nil {
+					t.Fatal("no fallback")
+				}
+
+				samePixels(t, "decodeBMPFallback", want, fimg)
+
+				// NOTE убеждаемся, что fallback все еще нужен
+				if tt.alpha {
+					if _, _, _, a := ximg.At(0, 0).RGBA(); err != nil || a != 0xffff {
+						t.Errorf("x/image/bmp keeps alpha %d, error %v", a, err)
+					}
+				} else if !errors.Is(err, bmp.ErrUnsupported) {
+					t.Errorf("x/image/bmp error %v, want %v", err, bmp.ErrUnsupported)
+				}
+			})
+		}
+	}
+
+	// NOTE обрезанные пиксели - ошибка и у fallback, и у x/image/bmp
+	for _, bpp := range []int{4, 8, 24, 32} {
+
+		data := encodeTestBMP(testBMPImage(13, 7, bpp, bpp == 32), bpp, false, bmpRGB)
+
+		if _, err := decodeBMP(data[:len(data)-3]); !errors.Is(err, errBMPTruncated) {
+			t.Errorf("%d bpp truncated: error %v, want %v", bpp, err, errBMPTruncated)
+		}
+	}
+}
+
+// transparentNRGBA returns copy of img with alpha 0
+func transparentNRGBA(img *image.NRGBA) *image.NRGBA {
+
+	dst := image.NewNRGBA(img.Rect)
+	copy(dst.Pix, img.Pix)
+
+	for i := 3; i < len(dst.Pix); i += 4 {
+		dst.Pix[i] = 0
+	}
+
+	return dst
+}
+
+func TestOptimizeBMP(t *testing.T) {
+
+	o := NewBMPOptimizer(NewPNGOptimizer())
+
+	tests := []struct {
+		name   string
+		data   []byte
+		opts   OptimizeOptions
+		reason string // NOOP
+	}{
+		{"8 bpp", encodeTestBMP(testBMPImage(32, 16, 8, false), 8, false, bmpRGB),
+			OptimizeOptions{ConvertBMP: true, Verify: true}, ""},
+		{"32 bpp alpha", encodeTestBMP(testBMPImage(32, 16, 32, true), 32, true, bmpRGB),
+			OptimizeOptions{ConvertBMP: true, Verify: true}, ""},
+		{"no convert", encodeTestBMP(testBMPImage(32, 16, 24, false), 24, false, bmpRGB),
+			OptimizeOptions{}, "conversion to png is off"},
+		// NOTE у RLE те же заголовки, отличается только compression
+		{"rle8", encodeTestBMP(testBMPImage(32, 16, 8, false), 8, false, 1),
+			OptimizeOptions{ConvertBMP: true}, "unsupported BMP format: compression 1"},
+		{"rle4", encodeTestBMP(testBMPImage(32, 16, 4, false), 4, false, 2),
+			OptimizeOptions{ConvertBMP: true}, "unsupported BMP format: compression 2"},
+		{"16 bpp", encodeTestBMP(testBMPImage(32, 16, 24, false), 16, false, bmpRGB),
+			OptimizeOptions{ConvertBMP: true}, "unsupported BMP format: 16 bpp"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			dir := t.TempDir()
+			path := filepath.Join(dir, "a.bmp")
+
+			if err := os.WriteFile(path, tt.data, 0o666); err != nil {
+				t.Fatal(err)
+			}
+
+			res, err := o.Optimize(path, &tt.opts)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.reason != "" {
+
+				if !res.NOOP || !strings.HasPrefix(res.Reason, tt.reason) {
+					t.Errorf("NOOP %t, reason %q, want NOOP %q", res.NOOP, res.Reason, tt.reason)
+				}
+
+				if _, err = os.Stat(path); err != nil {
+					t.Errorf("bmp is not kept: %v", err)
+				}
+
+				return
+			}
+
+			if res.NOOP {
+				t.Fatalf("NOOP: %s", res.Reason)
+			}
+
+			if _, err = os.Stat(path); err == nil {
+				t.Error("converted bmp is not removed")
+			}
+
+			data, err := os.ReadFile(filepath.Join(dir, "a.png"))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want, err := decodeBMP(tt.data)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			samePixels(t, res.Variant, want, decodeTestPNG(t, data))
+		})
+	}
+}
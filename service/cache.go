@@ -0,0 +1,167 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// cacheFileName manifest cache file in the root dir (in the output dir, if any)
+const cacheFileName = ".sboptimizer-cache.json"
+
+// cacheEntry state of the asset right after it was successfully processed (optimized or NOOP)
+type cacheEntry struct {
+	Size    int64 `json:"size"`
+	ModTime int64 `json:"mtime"` // unix nano
+}
+
+func fileEntry(info fs.FileInfo) cacheEntry {
+	return cacheEntry{Size: info.Size(), ModTime: info.ModTime().UnixNano()}
+}
+
+// manifestCache lets the next run skip assets unchanged since they were processed,
+// keyed by path relative to the root dir with forward slashes
+type manifestCache struct {
+	// Options settings the entries were processed with, cache made with other ones is dropped as a whole
+	Options string                `json:"options"`
+	Files   map[string]cacheEntry `json:"files"`
+
+	path string // where the cache is loaded from and saved to
+}
+
+// loadCache reads cache of path, missing or unreadable file or other options give empty cache
+func loadCache(path, options string) (c *manifestCache, warn error) {
+
+	c = &manifestCache{Options: options, Files: map[string]cacheEntry{}, path: path}
+
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+
+		if errors.Is(err, fs.ErrNotExist) {
+			return c, nil
+		}
+
+		return c, err
+	}
+
+	var stored manifestCache
+
+	// NOTE испорченный кэш не повод падать, просто все ассеты обработаются заново
+	if err = json.Unmarshal(data, &stored); err != nil {
+		return c, err
+	}
+
+	if stored.Options == options && stored.Files != nil {
+		c.Files = stored.Files
+	}
+
+	return c, nil
+}
+
+func cacheKey(rel string) string {
+	return filepath.ToSlash(rel)
+}
+
+// isCached reports whether asset path with info is the same as it was left by the previous run
+func (ao *AssetsOptimizer) isCached(path string, info fs.FileInfo) bool {
+
+	if ao.cache == nil {
+		return false
+	}
+
+	rel, err := filepath.Rel(ao.dir, path)
+
+	if err != nil {
+		return false
+	}
+
+	ao.mu.Lock()
+	e, ok := ao.cache.Files[cacheKey(rel)]
+	ao.mu.Unlock()
+
+	return ok && e == fileEntry(info)
+}
+
+// remember records current state of processed asset path, so the next run skips it
+//
+// NOTE запоминается состояние уже после перезаписи: размер меняется, а mtime replaceAsset сохраняет исходный,
+//
+//	иначе только что оптимизированный файл выглядел бы измененным и обрабатывался бы каждый раз заново
+func (ao *AssetsOptimizer) remember(rel, path string) {
+
+	if ao.cache == nil || ao.opts.DryRun {
+		return
+	}
+
+	info, err := os.Stat(path)
+
+	ao.mu.Lock()
+	defer ao.mu.Unlock()
+
+	if err != nil {
+		delete(ao.cache.Files, cacheKey(rel))
+		return
+	}
+
+	ao.cache.Files[cacheKey(rel)] = fileEntry(info)
+}
+
+// forget drops cache entry of asset that failed, so it is retried next time
+func (ao *AssetsOptimizer) forget(rel string) {
+
+	if ao.cache == nil {
+		return
+	}
+
+	ao.mu.Lock()
+	delete(ao.cache.Files, cacheKey(rel))
+	ao.mu.Unlock()
+}
+
+// saveCache atomically writes cache where it was loaded from, dry run writes nothing
+func (ao *AssetsOptimizer) saveCache() (err error) {
+
+	if ao.cache == nil || ao.opts.DryRun {
+		return nil
+	}
+
+	data, err := json.Marshal(ao.cache)
+
+	if err != nil {
+		return fmt.Errorf("encode cache error: %w", err)
+	}
+
+	path := ao.cache.path
+
+	// NOTE output dir появляется только с первым записанным ассетом, а их могло и не быть
+	if err = os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("write cache %q error: %w", path, err)
+	}
+
+	if err = replaceFile(path, ".tmp", bytes.NewBuffer(data)); err != nil {
+		return fmt.Errorf("write cache %q error: %w", path, err)
+	}
+
+	return nil
+}
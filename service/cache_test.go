@@ -0,0 +1,165 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+
+	dir, files := testTree(t, 1)
+	cachePath := filepath.Join(dir, cacheFileName)
+
+	// run optimizes dir once and returns the numbers of processed and cached assets
+	run := func(name string, settings Settings) (processed, cached uint, log string) {
+
+		t.Helper()
+
+		var buf bytes.Buffer
+
+		settings.Log = &buf
+
+		ao, err := NewAssetsOptimizer(dir, WithSettings(settings))
+
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if err = ao.RunContext(context.Background()); err != nil {
+			t.Fatalf("%s: %v\n%s", name, err, buf.String())
+		}
+
+		return ao.stats.files, ao.stats.cached, buf.String()
+	}
+
+	check := func(name string, settings Settings, processed, cached uint) string {
+
+		t.Helper()
+
+		p, c, log := run(name, settings)
+
+		if p != processed || c != cached {
+			t.Errorf("%s: %d processed, %d cached, want %d and %d\n%s", name, p, c, processed, cached, log)
+		}
+
+		return log
+	}
+
+	n := uint(len(files))
+	cache := Settings{Cache: true, MinifyJSON: true}
+
+	check("first run", cache, n, 0)
+
+	var stored manifestCache
+
+	if data, err := os.ReadFile(cachePath); err != nil {
+		t.Fatal(err)
+	} else if err = json.Unmarshal(data, &stored); err != nil || uint(len(stored.Files)) != n {
+		t.Fatalf("cache of %d files (%v), want %d", len(stored.Files), err, n)
+	}
+
+	check("unchanged", cache, 0, n)
+
+	// NOTE mtime изменился, размер тот же
+	item := filepath.Join(dir, "d00", "item.config")
+	info, err := os.Stat(item)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = os.Chtimes(item, time.Now(), info.ModTime().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	check("mtime changed", cache, 1, n-1)
+
+	// NOTE размер изменился, mtime тот же
+	info, err = os.Stat(item)
+
+	if err == nil {
+		err = os.WriteFile(item, []byte("{ \"name\": \"item\" }"), 0o666)
+	}
+
+	if err == nil {
+		err = os.Chtimes(item, time.Now(), info.ModTime())
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check("size changed", cache, 1, n-1)
+
+	// NOTE другие настройки - весь кэш сбрасывается, и запоминается уже с ними
+	other := cache
+	other.Effort = EffortMax
+
+	check("settings changed", other, n, 0)
+	check("settings changed, unchanged", other, 0, n)
+	check("settings changed back", cache, n, 0)
+
+	// NOTE --no-cache: все обрабатывается, а сам кэш не читается и не пишется
+	before, err := os.ReadFile(cachePath)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	noCache := cache
+	noCache.Cache = false
+
+	check("no cache", noCache, n, 0)
+
+	if after, err := os.ReadFile(cachePath); err != nil || !bytes.Equal(before, after) {
+		t.Errorf("no cache: cache file is changed (%v)", err)
+	}
+
+	check("no cache, cache still valid", cache, 0, n)
+
+	// NOTE испорченный кэш - только предупреждение, все ассеты обрабатываются заново, и кэш пишется заново
+	if err = os.WriteFile(cachePath, []byte(`{"options": "x", "files": {`), 0o666); err != nil {
+		t.Fatal(err)
+	}
+
+	if log := check("corrupt cache", cache, n, 0); !strings.Contains(log, "cache is ignored") {
+		t.Errorf("corrupt cache: no warning\n%s", log)
+	}
+
+	check("corrupt cache, rewritten", cache, 0, n)
+
+	// NOTE кэш с теми же настройками, но без files тоже не повод падать
+	noFiles, err := json.Marshal(map[string]string{"options": stored.Options})
+
+	if err == nil {
+		err = os.WriteFile(cachePath, noFiles, 0o666)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check("cache without files", cache, n, 0)
+}
@@ -0,0 +1,126 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// casManifestName manifest of the content-addressed output dir, see Settings.CASDir
+const casManifestName = "manifest.json"
+
+// casManifest maps paths of assets relative to the root dir (with forward slashes, see cacheKey) to the names of
+// their files in the content-addressed output dir
+type casManifest struct {
+	Dir   string            `json:"dir"`
+	Files map[string]string `json:"files"`
+}
+
+// optimizeCAS optimizes asset a in memory (see FSOptimizer) and stores the result (the original for NOOP)
+// in ao.casDir as <sha256><ext> unless it is already there, returns the name it is stored under
+func (ao *AssetsOptimizer) optimizeCAS(a *asset, opts *OptimizeOptions) (res OptimizeResult, name string, err error) {
+
+	var (
+		opt  *bytes.Buffer
+		file = a.file()
+	)
+
+	// NOTE fs.FS текущего каталога ассета, так доступна и цель симлинка вне корня
+	if fo, ok := a.optimizer.(FSOptimizer); ok {
+		if opt, res, err = fo.OptimizeFS(os.DirFS(filepath.Dir(file)), filepath.Base(file), opts); err != nil {
+			return res, "", err
+		}
+	} else {
+		res.NOOP, res.Reason = true, fmt.Sprintf("%T can't optimize in memory", a.optimizer)
+	}
+
+	if res.NOOP {
+
+		data, err := os.ReadFile(file)
+
+		if err != nil {
+			return res, "", fmt.Errorf("copy to CAS dir error: %w", err)
+		}
+
+		opt = bytes.NewBuffer(data)
+	}
+
+	sum := sha256.Sum256(opt.Bytes())
+	name = hex.EncodeToString(sum[:]) + strings.ToLower(filepath.Ext(a.path))
+
+	if opts.DryRun {
+		return res, name, nil
+	}
+
+	dst := filepath.Join(ao.casDir, name)
+
+	// NOTE имя - хэш содержимого, так что существующий файл уже тот же самый; два воркера с одинаковым
+	//      содержимым пишут каждый через свой tmp и атомарно переименовывают в одно и то же
+	if exists, err := assetExists(dst); err != nil || exists {
+		return res, name, err
+	}
+
+	if err = os.MkdirAll(ao.casDir, 0o755); err != nil {
+		return res, "", fmt.Errorf("write to CAS dir error: %w", err)
+	}
+
+	if err = replaceFile(dst, ".castmp", opt); err != nil {
+		return res, "", fmt.Errorf("write to CAS dir error: %w", err)
+	}
+
+	return res, name, nil
+}
+
+// addCASEntry records that asset rel is stored in the CAS dir as name
+func (ao *AssetsOptimizer) addCASEntry(rel, name string) {
+	ao.mu.Lock()
+	ao.cas[cacheKey(rel)] = name
+	ao.mu.Unlock()
+}
+
+// writeCASManifest writes manifest of the assets processed so far to the CAS dir (atomically)
+func (ao *AssetsOptimizer) writeCASManifest() (err error) {
+
+	if ao.opts.DryRun {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(&casManifest{Dir: ao.dir, Files: ao.cas}, "", "  ")
+
+	if err != nil {
+		return fmt.Errorf("encode CAS manifest error: %w", err)
+	}
+
+	path := filepath.Join(ao.casDir, casManifestName)
+
+	if err = os.MkdirAll(ao.casDir, 0o755); err != nil {
+		return fmt.Errorf("write CAS manifest %q error: %w", path, err)
+	}
+
+	if err = replaceFile(path, ".tmp", bytes.NewBuffer(append(data, '\n'))); err != nil {
+		return fmt.Errorf("write CAS manifest %q error: %w", path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,108 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCASOut(t *testing.T) {
+
+	// NOTE во всех подкаталогах одни и те же файлы, так что воркеры пишут одинаковые хэши наперегонки
+	dir, files := testTree(t, 4)
+	casDir := filepath.Join(t.TempDir(), "cas")
+
+	var log bytes.Buffer
+
+	ao, err := NewAssetsOptimizer(dir, WithSettings(Settings{MinifyJSON: true, CASDir: casDir, Cache: true,
+		Log: &log}), WithWorkers(4))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ao.RunContext(context.Background()); err != nil {
+		t.Fatalf("run: %v\n%s", err, log.String())
+	}
+
+	var m casManifest
+
+	if data, err := os.ReadFile(filepath.Join(casDir, casManifestName)); err != nil {
+		t.Fatal(err)
+	} else if err = json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Dir != dir || len(m.Files) != len(files) {
+		t.Fatalf("manifest of %q with %d files, want %q and %d", m.Dir, len(m.Files), dir, len(files))
+	}
+
+	names := make(map[string]struct{})
+
+	for rel, src := range files {
+
+		if got, err := os.ReadFile(filepath.Join(dir, rel)); err != nil || !bytes.Equal(got, src) {
+			t.Fatalf("%s is changed in the root dir (%v)", rel, err)
+		}
+
+		name := m.Files[filepath.ToSlash(rel)]
+		names[name] = struct{}{}
+
+		data, err := os.ReadFile(filepath.Join(casDir, name))
+
+		if err != nil {
+			t.Fatalf("%s: %v", rel, err)
+		}
+
+		sum := sha256.Sum256(data)
+
+		if want := hex.EncodeToString(sum[:]) + filepath.Ext(rel); name != want {
+			t.Errorf("%s is stored as %s, want %s", rel, name, want)
+		}
+
+		if len(data) > len(src) {
+			t.Errorf("%s: stored %d bytes of %d", rel, len(data), len(src))
+		}
+
+		if strings.HasSuffix(rel, ".png") {
+			samePixels(t, rel, decodeTestPNG(t, src), decodeTestPNG(t, data))
+		}
+	}
+
+	entries, err := os.ReadDir(casDir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every distinct result is stored once, next to the manifest, and nothing else is left there
+	if len(entries) != len(names)+1 || len(names) != len(files)/4 {
+		t.Errorf("%d files in CAS dir for %d names of %d files", len(entries), len(names), len(files))
+	}
+
+	if _, err = os.Stat(filepath.Join(dir, cacheFileName)); err == nil {
+		t.Errorf("cache is written to the root dir")
+	}
+}
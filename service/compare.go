@@ -0,0 +1,186 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// compareStrategy is one way of optimizing png Compare tries
+type compareStrategy struct {
+	name       string
+	effort     int
+	exhaustive bool
+}
+
+// compareStrategies are the png strategies of Compare, the cheapest first, so that it wins a tie
+var compareStrategies = [...]compareStrategy{
+	{"fast", EffortFast, false},
+	{"default", EffortDefault, false},
+	{"max", EffortMax, false},
+	{"exhaustive", EffortMax, true},
+}
+
+// compareTally is the total of one strategy over all compared files
+type compareTally struct {
+	saved uint64
+	wins  uint
+}
+
+// Compare walks dir and optimizes every png asset in memory with each of compareStrategies (Effort and Exhaustive
+// of the settings are ignored, the rest apply), printing a row per file with the size each strategy would leave it
+// with and the winner ("-" if none of them shrinks it), then how many bytes every strategy would save in total and
+// how often it won; nothing is written. Exclude, Gitignore and Extensions apply, the cache does not
+func (ao *AssetsOptimizer) Compare() (err error) {
+
+	if ao.fsys != nil {
+		return fmt.Errorf("compare is %w", errFSSource)
+	}
+
+	optimizer := ao.optimizerFor(extPNG)
+
+	if optimizer == nil {
+		return fmt.Errorf("compare error: no png optimizer")
+	}
+
+	base, ok := optimizer.(*PNGOptimizer)
+
+	if !ok {
+		return fmt.Errorf("compare needs built-in png optimizer, not %T", optimizer)
+	}
+
+	var (
+		optimizers [len(compareStrategies)]*PNGOptimizer
+		names      [len(compareStrategies)]string
+		tally      [len(compareStrategies)]compareTally
+		files      uint
+		failed     uint
+		total      uint64
+	)
+
+	for i, s := range compareStrategies {
+
+		opts := []PNGOption{WithPNGLevel(base.encoder.CompressionLevel)}
+
+		if s.exhaustive {
+			opts = append(opts, WithExhaustive())
+		}
+
+		optimizers[i], names[i] = NewPNGOptimizer(opts...), s.name
+	}
+
+	fmt.Fprintf(ao.log, "path\tsize\t%s\tbest\n", strings.Join(names[:], "\t"))
+
+	err = filepath.WalkDir(ao.dir, func(path string, d fs.DirEntry, err error) error {
+
+		if err != nil {
+			return fmt.Errorf("walk dir %q error: %w", path, err)
+		}
+
+		if skip, err := ao.skipExcluded(path, d); skip || err != nil {
+			return err
+		}
+
+		if !d.Type().IsRegular() || ao.resolveExt(path) != extPNG {
+			return nil
+		}
+
+		rel, err := filepath.Rel(ao.dir, path)
+
+		if err != nil {
+			return err
+		}
+
+		data, err := os.ReadFile(path)
+
+		if err != nil {
+			return fmt.Errorf("compare %q error: %w", path, err)
+		}
+
+		var (
+			sizes [len(compareStrategies)]int64
+			best  int
+		)
+
+		for i, s := range compareStrategies {
+
+			opts := ao.opts
+			opts.Effort = s.effort
+
+			_, res, err := optimizers[i].OptimizeBytes(data, &opts)
+
+			// NOTE ошибка одна на все стратегии (битый файл), так что файл просто не сравнивается
+			if err != nil {
+				failed++
+				fmt.Fprintf(ao.log, "%s\t%d\terror: %s\n", rel, len(data), err)
+				return nil
+			}
+
+			if sizes[i] = res.Size; !res.NOOP {
+				sizes[i] = res.OptimizedSize
+			}
+
+			if sizes[i] < sizes[best] {
+				best = i
+			}
+		}
+
+		files++
+		total += uint64(len(data))
+
+		fmt.Fprintf(ao.log, "%s\t%d", rel, len(data))
+
+		for i := range sizes {
+			tally[i].saved += uint64(int64(len(data)) - sizes[i])
+			fmt.Fprintf(ao.log, "\t%d", sizes[i])
+		}
+
+		// NOTE файл, который ни одна стратегия не уменьшила, ничьей победой не считается
+		if sizes[best] == int64(len(data)) {
+			fmt.Fprintln(ao.log, "\t-")
+			return nil
+		}
+
+		tally[best].wins++
+
+		fmt.Fprintf(ao.log, "\t%s\n", names[best])
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(ao.log, "Compared files: %d, totally bytes: %d", files, total)
+
+	if failed > 0 {
+		fmt.Fprintf(ao.log, ", failed: %d", failed)
+	}
+
+	fmt.Fprintln(ao.log)
+
+	for i := range tally {
+		fmt.Fprintf(ao.log, "  %s: saves %d bytes, best for %d files\n", names[i], tally[i].saved, tally[i].wins)
+	}
+
+	return nil
+}
@@ -0,0 +1,176 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCompare(t *testing.T) {
+
+	dir, files := testTree(t, 1)
+
+	files["bad.png"] = []byte("not a png")
+	files[filepath.Join("vendor", "v.png")] = files[filepath.Join("d00", "gray.png")]
+
+	for _, rel := range []string{"bad.png", filepath.Join("vendor", "v.png")} {
+
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, rel)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(filepath.Join(dir, rel), files[rel], 0o666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var log bytes.Buffer
+
+	ao, err := NewAssetsOptimizer(dir, WithSettings(Settings{MinifyJSON: true, Exclude: []string{"vendor"}, Log: &log}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ao.Compare(); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(log.String(), "\n"), "\n")
+
+	if lines[0] != "path\tsize\tfast\tdefault\tmax\texhaustive\tbest" {
+		t.Fatalf("header %q", lines[0])
+	}
+
+	var (
+		compared int
+		saved    [len(compareStrategies)]int64
+		wins     [len(compareStrategies)]int
+		checked  bool
+	)
+
+	o := NewPNGOptimizer()
+
+	for _, line := range lines[1:] {
+
+		if strings.HasPrefix(line, "Compared files: ") {
+			break
+		}
+
+		cols := strings.Split(line, "\t")
+		rel := cols[0]
+
+		if rel == "bad.png" {
+
+			if len(cols) != 3 || !strings.HasPrefix(cols[2], "error: ") {
+				t.Errorf("bad.png row %q", line)
+			}
+
+			continue
+		}
+
+		data, ok := files[rel]
+
+		if !ok || !strings.HasSuffix(rel, ".png") || strings.HasPrefix(rel, "vendor") {
+			t.Fatalf("unexpected row %q\n%s", line, log.String())
+		}
+
+		if len(cols) != 3+len(compareStrategies) || cols[1] != strconv.Itoa(len(data)) {
+			t.Fatalf("row %q", line)
+		}
+
+		var sizes [len(compareStrategies)]int64
+
+		bestIdx := -1
+
+		for i := range sizes {
+
+			if sizes[i], err = strconv.ParseInt(cols[2+i], 10, 64); err != nil || sizes[i] > int64(len(data)) {
+				t.Fatalf("%s: %s size %q (%v)", rel, compareStrategies[i].name, cols[2+i], err)
+			}
+
+			saved[i] += int64(len(data)) - sizes[i]
+
+			if sizes[i] < int64(len(data)) && (bestIdx < 0 || sizes[i] < sizes[bestIdx]) {
+				bestIdx = i
+			}
+		}
+
+		best := "-"
+
+		if bestIdx >= 0 {
+			best = compareStrategies[bestIdx].name
+			wins[bestIdx]++
+		}
+
+		// NOTE каждая следующая стратегия перебирает не меньше предыдущей (кроме fast, у которой перебора нет)
+		if sizes[2] > sizes[1] || sizes[3] > sizes[2] || cols[len(cols)-1] != best {
+			t.Errorf("row %q, want max <= default, exhaustive <= max and %s the best", line, best)
+		}
+
+		// NOTE та же стратегия отдельно дает тот же размер
+		if !checked {
+
+			_, res, err := o.OptimizeBytes(data, &OptimizeOptions{Effort: EffortDefault})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if want := res.OptimizedSize; res.NOOP && sizes[1] != int64(len(data)) || !res.NOOP && sizes[1] != want {
+				t.Errorf("%s: default %d, OptimizeBytes %d (NOOP %t)", rel, sizes[1], want, res.NOOP)
+			}
+
+			checked = true
+		}
+
+		compared++
+	}
+
+	summary := strings.Join(lines[len(lines)-1-len(compareStrategies):], "\n") + "\n"
+
+	wantSummary := fmt.Sprintf("Compared files: %d, totally bytes: %d, failed: 1\n", compared, func() (n int) {
+		for rel, data := range files {
+			if strings.HasSuffix(rel, ".png") && rel != "bad.png" && !strings.HasPrefix(rel, "vendor") {
+				n += len(data)
+			}
+		}
+		return n
+	}())
+
+	for i, s := range compareStrategies {
+		wantSummary += fmt.Sprintf("  %s: saves %d bytes, best for %d files\n", s.name, saved[i], wins[i])
+	}
+
+	if compared != len(pngFixtures()) || summary != wantSummary {
+		t.Errorf("compared %d of %d fixtures, summary:\n%s\nwant:\n%s", compared, len(pngFixtures()), summary,
+			wantSummary)
+	}
+
+	// NOTE ничего не записано
+	for rel, data := range files {
+		if got, err := os.ReadFile(filepath.Join(dir, rel)); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s is changed: %v", rel, err)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testdata/corpus is the regression gate of every variant and heuristic: see testdata/README.md to add a case
+const corpusDir = "testdata/corpus"
+
+// corpusImages are the generated part of the corpus, written to testdata/corpus by -update; files added by hand
+// live there too and are never rewritten
+func corpusImages() map[string]image.Image {
+
+	r := testRand(3)
+
+	// пиксель-арт: несколько цветов крупными "пикселями" на прозрачном фоне
+	pixelArt := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	colors := []color.NRGBA{{0x20, 0x20, 0x30, 0xff}, {0xc0, 0x40, 0x30, 0xff}, {0xf0, 0xd0, 0x60, 0xff},
+		{0x40, 0x90, 0x50, 0xff}, {0xff, 0xff, 0xff, 0xff}}
+
+	for y := 8; y < 56; y++ {
+		for x := 12; x < 52; x++ {
+			pixelArt.SetNRGBA(x, y, colors[(x/4*7+y/4*3)%len(colors)])
+		}
+	}
+
+	gradient := image.NewNRGBA(image.Rect(0, 0, 96, 64))
+
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 96; x++ {
+			gradient.SetNRGBA(x, y, color.NRGBA{uint8(x * 255 / 95), uint8(y * 4), uint8(255 - x*2), 0xff})
+		}
+	}
+
+	gradient1D := image.NewNRGBA(image.Rect(0, 0, 256, 1))
+
+	for x := 0; x < 256; x++ {
+		gradient1D.SetNRGBA(x, 0, color.NRGBA{uint8(x), uint8(x), uint8(x), 0xff})
+	}
+
+	// "фото": плавный фон с шумом во всех каналах
+	photo := image.NewRGBA(image.Rect(0, 0, 64, 64))
+
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			photo.SetRGBA(x, y, color.RGBA{uint8(x*3) + r.next()&15, uint8(y*3) + r.next()&15, uint8(x+y) + r.next()&15, 0xff})
+		}
+	}
+
+	// маска: черно-белая, но сохраненная как rgb
+	mask := image.NewRGBA(image.Rect(0, 0, 64, 64))
+
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			c := color.RGBA{A: 0xff}
+
+			if (x-32)*(x-32)+(y-32)*(y-32) < 24*24 {
+				c = color.RGBA{0xff, 0xff, 0xff, 0xff}
+			}
+
+			mask.SetRGBA(x, y, c)
+		}
+	}
+
+	// спрайт с мягкими краями: полупрозрачная альфа по контуру
+	sprite := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+
+			d := (x-32)*(x-32) + (y-32)*(y-32)
+
+			switch {
+			case d < 20*20:
+				sprite.SetNRGBA(x, y, color.NRGBA{0x30, uint8(0x80 + x), 0xd0, 0xff})
+			case d < 26*26:
+				sprite.SetNRGBA(x, y, color.NRGBA{0x30, uint8(0x80 + x), 0xd0, uint8(0xff - (d-400)/2)})
+			}
+		}
+	}
+
+	paletted := image.NewPaletted(image.Rect(0, 0, 64, 64), color.Palette{
+		color.NRGBA{0, 0, 0, 0}, color.NRGBA{0x10, 0x10, 0x10, 0xff}, color.NRGBA{0x80, 0x20, 0x20, 0xff},
+		color.NRGBA{0x20, 0x80, 0x20, 0xff}, color.NRGBA{0x20, 0x20, 0x80, 0x80},
+	})
+
+	for i := range paletted.Pix {
+		paletted.Pix[i] = uint8(i/64/8+i%64/8) % 5
+	}
+
+	gray := image.NewGray(image.Rect(0, 0, 64, 64))
+
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i%64*2+i/64) &^ 7
+	}
+
+	flat := image.NewRGBA(image.Rect(0, 0, 32, 32))
+
+	for i := 0; i < len(flat.Pix); i += 4 {
+		flat.Pix[i], flat.Pix[i+1], flat.Pix[i+2], flat.Pix[i+3] = 0x40, 0x50, 0x60, 0xff
+	}
+
+	return map[string]image.Image{
+		"pixel-art.png":       pixelArt,
+		"gradient.png":        gradient,
+		"gradient-1d.png":     gradient1D,
+		"photo.png":           photo,
+		"mask.png":            mask,
+		"sprite-soft.png":     sprite,
+		"paletted.png":        paletted,
+		"gray.png":            gray,
+		"empty-1x1.png":       image.NewNRGBA(image.Rect(0, 0, 1, 1)),
+		"opaque-flat-rgb.png": flat,
+	}
+}
+
+// corpusFiles returns path of every png of the corpus: testdata/corpus and the fixtures of png tests with their
+// golden outputs (optimized files must be optimized as well)
+func corpusFiles(t *testing.T) (paths []string) {
+
+	t.Helper()
+
+	if *update {
+		for name, img := range corpusImages() {
+
+			data, err := encodeStd(img)()
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err = os.WriteFile(filepath.Join(corpusDir, name), data, 0o666); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	readPNGFixtures(t)
+
+	for _, dir := range []string{corpusDir, pngTestdata} {
+
+		entries, err := os.ReadDir(dir)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, e := range entries {
+			if strings.HasSuffix(strings.ToLower(e.Name()), ".png") {
+				paths = append(paths, filepath.Join(dir, e.Name()))
+			}
+		}
+	}
+
+	if len(paths) == 0 {
+		t.Fatal("empty corpus")
+	}
+
+	return paths
+}
+
+// TestCorpusInvariants runs the whole Optimize pipeline (file in, file out) over the corpus at every effort and
+// with WithExhaustive: the result must never be bigger than the source and must decode to the same pixels
+func TestCorpusInvariants(t *testing.T) {
+
+	type mode struct {
+		name   string
+		o      func() *PNGOptimizer
+		effort int
+	}
+
+	modes := []mode{
+		{"fast", func() *PNGOptimizer { return NewPNGOptimizer() }, EffortFast},
+		{"default", func() *PNGOptimizer { return NewPNGOptimizer() }, EffortDefault},
+		{"max", func() *PNGOptimizer { return NewPNGOptimizer() }, EffortMax},
+		{"exhaustive", func() *PNGOptimizer { return NewPNGOptimizer(WithExhaustive()) }, EffortDefault},
+	}
+
+	for _, src := range corpusFiles(t) {
+
+		data, err := os.ReadFile(src)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := decodeTestPNG(t, data)
+
+		for _, m := range modes {
+
+			name := filepath.Base(src) + " " + m.name
+
+			t.Run(name, func(t *testing.T) {
+
+				path := filepath.Join(t.TempDir(), filepath.Base(src))
+
+				if err := os.WriteFile(path, data, 0o666); err != nil {
+					t.Fatal(err)
+				}
+
+				opts := OptimizeOptions{Effort: m.effort, Verify: true}
+
+				res, err := m.o().Optimize(path, &opts)
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				got, err := os.ReadFile(path)
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if len(got) > len(data) {
+					t.Errorf("grew %d -> %d bytes as %s", len(data), len(got), res.Variant)
+				}
+
+				if res.NOOP && len(got) != len(data) {
+					t.Errorf("NOOP changed the file %d -> %d bytes", len(data), len(got))
+				}
+
+				samePixels(t, name, want, decodeTestPNG(t, got))
+			})
+		}
+	}
+}
+
+// TestIdempotent optimizes every file of the corpus twice: the second run must be NOOP, i.e. the optimizer does
+// not churn on its own output
+func TestIdempotent(t *testing.T) {
+
+	maxOpts := OptimizeOptions{Effort: EffortMax, Verify: true}
+
+	for _, src := range corpusFiles(t) {
+		for _, m := range []struct {
+			o    *PNGOptimizer
+			opts *OptimizeOptions
+		}{
+			{NewPNGOptimizer(), &optimizeBytesOptions},
+			{NewPNGOptimizer(), &maxOpts},
+			{NewPNGOptimizer(WithExhaustive()), &optimizeBytesOptions},
+		} {
+
+			data, err := os.ReadFile(src)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			path := filepath.Join(t.TempDir(), filepath.Base(src))
+
+			if err = os.WriteFile(path, data, 0o666); err != nil {
+				t.Fatal(err)
+			}
+
+			first, err := m.o.Optimize(path, m.opts)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			second, err := m.o.Optimize(path, m.opts)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !second.NOOP {
+				t.Errorf("%s (effort %d, exhaustive %t): second run %s %d -> %d after first %s %d -> %d", src,
+					m.opts.Effort, m.o.exhaustive, second.Variant, second.Size, second.OptimizedSize, first.Variant,
+					first.Size, first.OptimizedSize)
+			}
+		}
+	}
+}
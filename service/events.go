@@ -0,0 +1,148 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	eventStart = "start"
+	eventNOOP  = "noop"
+	eventSaved = "saved"
+	eventError = "error"
+)
+
+// assetEvent is one line of the events stream (see Settings.Events): start of asset, or its result with fields of
+// the report record
+type assetEvent struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	Path  string    `json:"path"`
+	Ext   string    `json:"ext"`
+	Size  int64     `json:"size"`
+
+	*reportRecord // nil for start
+}
+
+// eventStream writes events as NDJSON, every event is written at once (no buffering) so that a consumer sees it
+// immediately; the first write error is kept and returned by close
+type eventStream struct {
+	mu  sync.Mutex
+	w   io.Writer
+	c   io.Closer // nil for stdout
+	err error
+}
+
+// openEvents opens ao.eventsPath for appending (stdout for "-"), so that the runs of a watch session and the runs
+// one after another go to the same stream
+func (ao *AssetsOptimizer) openEvents() (err error) {
+
+	if ao.eventsPath == "" {
+		return nil
+	}
+
+	if ao.eventsPath == reportStdout {
+		ao.events = &eventStream{w: os.Stdout}
+		return nil
+	}
+
+	fp, err := os.OpenFile(ao.eventsPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o666)
+
+	if err != nil {
+		return fmt.Errorf("open events %q error: %w", ao.eventsPath, err)
+	}
+
+	ao.events = &eventStream{w: fp, c: fp}
+
+	return nil
+}
+
+// closeEvents closes the stream opened by openEvents and returns the first error of writing to it
+func (ao *AssetsOptimizer) closeEvents() (err error) {
+
+	s := ao.events
+
+	if s == nil {
+		return nil
+	}
+
+	ao.events = nil
+
+	if s.c != nil {
+		if e := s.c.Close(); s.err == nil {
+			s.err = e
+		}
+	}
+
+	if s.err != nil {
+		return fmt.Errorf("write events %q error: %w", ao.eventsPath, s.err)
+	}
+
+	return nil
+}
+
+// emitStart writes start event of asset a at rel
+func (ao *AssetsOptimizer) emitStart(rel string, a *asset) {
+
+	if ao.events != nil {
+		ao.events.write(&assetEvent{Event: eventStart, Path: rel, Ext: a.ext, Size: a.size})
+	}
+}
+
+// emitResult writes result event of asset by its report record
+func (ao *AssetsOptimizer) emitResult(rec *reportRecord) {
+
+	if ao.events == nil {
+		return
+	}
+
+	ev := assetEvent{Event: eventNOOP, Path: rec.Path, Ext: rec.Ext, Size: rec.Size, reportRecord: rec}
+
+	if rec.Error != "" {
+		ev.Event = eventError
+	} else if rec.Saved > 0 {
+		ev.Event = eventSaved
+	}
+
+	ao.events.write(&ev)
+}
+
+func (s *eventStream) write(ev *assetEvent) {
+
+	ev.Time = time.Now()
+
+	b, err := json.Marshal(ev)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return
+	}
+
+	if err == nil {
+		_, err = s.w.Write(append(b, '\n'))
+	}
+
+	s.err = err
+}
@@ -0,0 +1,131 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEvents(t *testing.T) {
+
+	dir := t.TempDir()
+
+	files := map[string]string{
+		"a.config":   "{ \"a\": 1 }",
+		"bad.config": `{"a": 1`,
+		"min.config": `{"a":1}`,
+	}
+
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var log bytes.Buffer
+
+	events := filepath.Join(t.TempDir(), "events.ndjson")
+
+	settings := Settings{MinifyJSON: true, KeepGoing: true, Workers: 1, Events: events, Log: &log}
+
+	// NOTE второй прогон дописывает в тот же поток
+	for run := 0; run < 2; run++ {
+
+		ao, err := NewAssetsOptimizer(dir, WithSettings(settings))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = ao.RunContext(context.Background()); err != nil {
+			t.Fatalf("run %d: %v\n%s", run, err, log.String())
+		}
+	}
+
+	fp, err := os.Open(events)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer fp.Close()
+
+	want := []struct {
+		event, path string
+		size        int
+	}{
+		{eventStart, "a.config", 10}, {eventSaved, "a.config", 10},
+		{eventStart, "bad.config", 7}, {eventError, "bad.config", 7},
+		{eventStart, "min.config", 7}, {eventNOOP, "min.config", 7},
+		// NOTE во втором прогоне a.config уже минифицирован
+		{eventStart, "a.config", 7}, {eventNOOP, "a.config", 7},
+		{eventStart, "bad.config", 7}, {eventError, "bad.config", 7},
+		{eventStart, "min.config", 7}, {eventNOOP, "min.config", 7},
+	}
+
+	sc := bufio.NewScanner(fp)
+
+	var n int
+
+	for ; sc.Scan(); n++ {
+
+		line := sc.Bytes()
+
+		// NOTE строго один объект на строку
+		var ev map[string]any
+
+		dec := json.NewDecoder(bytes.NewReader(line))
+
+		if err = dec.Decode(&ev); err != nil || dec.More() {
+			t.Fatalf("line %d %q is not one JSON object: %v", n, line, err)
+		}
+
+		if n >= len(want) {
+			continue
+		}
+
+		if ev["event"] != want[n].event || ev["path"] != want[n].path {
+			t.Errorf("line %d: %v %v, want %s %s", n, ev["event"], ev["path"], want[n].event, want[n].path)
+		}
+
+		if _, ok := ev["time"].(string); !ok || ev["size"] != float64(want[n].size) {
+			t.Errorf("line %d: time %v, size %v", n, ev["time"], ev["size"])
+		}
+
+		// NOTE у результата поля записи отчета, у начала их нет
+		_, hasNOOP := ev["noop"]
+
+		if _, hasError := ev["error"]; hasNOOP == (want[n].event == eventStart) ||
+			hasError != (want[n].event == eventError) {
+			t.Errorf("line %d: %s", n, line)
+		}
+	}
+
+	if err = sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n != len(want) {
+		t.Errorf("%d events, want %d", n, len(want))
+	}
+}
@@ -0,0 +1,149 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// excludePattern is a filepath.Match glob over slash-separated path relative to the root dir:
+//   - pattern without "/" matches the name of file or dir at any depth ("*.min.png", "vendor")
+//   - pattern with "/" matches the whole relative path, "**" element matches zero or more path elements
+//     ("vendor/**/*.png", "**/backup/*")
+type excludePattern struct {
+	glob  string
+	parts []string // nil for name-only pattern
+}
+
+func normalizeExclude(list []string) (patterns []excludePattern, err error) {
+
+	for _, glob := range list {
+
+		glob = strings.Trim(strings.ReplaceAll(glob, "\\", "/"), "/")
+
+		if glob == "" {
+			return nil, fmt.Errorf("empty exclude pattern")
+		}
+
+		p := excludePattern{glob: glob}
+
+		if strings.Contains(glob, "/") {
+			p.parts = strings.Split(glob, "/")
+		}
+
+		// NOTE path.Match сообщает о кривом паттерне только при попытке сопоставления, проверяем сразу
+		for _, part := range append(p.parts, glob) {
+			if _, err = path.Match(part, ""); err != nil {
+				return nil, fmt.Errorf("exclude pattern %q: %w", glob, err)
+			}
+		}
+
+		patterns = append(patterns, p)
+	}
+
+	return patterns, nil
+}
+
+// match reports whether slash-separated rel path matches the pattern
+func (p *excludePattern) match(rel string) bool {
+
+	if p.parts == nil {
+		ok, _ := path.Match(p.glob, path.Base(rel))
+		return ok
+	}
+
+	return matchParts(p.parts, strings.Split(rel, "/"))
+}
+
+func matchParts(pattern, elems []string) bool {
+
+	for len(pattern) > 0 {
+
+		if pattern[0] == "**" {
+
+			for i := 0; i <= len(elems); i++ {
+				if matchParts(pattern[1:], elems[i:]) {
+					return true
+				}
+			}
+
+			return false
+		}
+
+		if len(elems) == 0 {
+			return false
+		}
+
+		if ok, _ := path.Match(pattern[0], elems[0]); !ok {
+			return false
+		}
+
+		pattern, elems = pattern[1:], elems[1:]
+	}
+
+	return len(elems) == 0
+}
+
+// isExcluded reports whether file or dir at rel (relative to the root dir, as returned by filepath.Rel)
+// matches any --exclude pattern or is ignored by .gitignore (see Settings.Gitignore), the root dir itself is never
+// excluded
+func (ao *AssetsOptimizer) isExcluded(rel string, isDir bool) (_ bool, err error) {
+
+	if rel == "." {
+		return false, nil
+	}
+
+	rel = strings.ReplaceAll(rel, "\\", "/")
+
+	for i := range ao.exclude {
+		if ao.exclude[i].match(rel) {
+			return true, nil
+		}
+	}
+
+	if ao.gitignore == nil {
+		return false, nil
+	}
+
+	return ao.gitignore.ignored(rel, isDir)
+}
+
+// ownFiles returns absolute paths of the files the run writes (or reads) itself: report, events, plan and cache,
+// "" and reportStdout are skipped; they are never optimized even if they lie in the root dir under a name of known
+// asset format (e.g. --ext-map .json=config)
+func ownFiles(paths ...string) (own map[string]struct{}, err error) {
+
+	own = make(map[string]struct{}, len(paths))
+
+	for _, p := range paths {
+
+		if p == "" || p == reportStdout {
+			continue
+		}
+
+		if p, err = filepath.Abs(p); err != nil {
+			return nil, err
+		}
+
+		own[p] = struct{}{}
+	}
+
+	return own, nil
+}
@@ -0,0 +1,158 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExcludePattern(t *testing.T) {
+
+	tests := []struct {
+		glob string
+		rel  string
+		want bool
+	}{
+		// name-only: any depth, files and dirs alike
+		{"*.min.png", "a.min.png", true},
+		{"*.min.png", "x/y/a.min.png", true},
+		{"*.min.png", "a.png", false},
+		{"vendor", "vendor", true},
+		{"vendor", "x/vendor", true},
+		{"vendor", "vendor.png", false},
+		{"a*", "ab/c.png", false},
+
+		// with "/": the whole path, "*" does not cross "/"
+		{"vendor/*", "vendor/a.png", true},
+		{"vendor/*", "vendor/sub", true},
+		{"vendor/*", "x/vendor/a.png", false},
+		{"*/c.png", "x/c.png", true},
+		{"*/c.png", "x/y/c.png", false},
+		{"x/*.png", "x/y.png/z", false},
+
+		// **
+		{"vendor/**/*.png", "vendor/a.png", true},
+		{"vendor/**/*.png", "vendor/x/y/a.png", true},
+		{"vendor/**/*.png", "vendor/x/a.json", false},
+		{"**/backup/*", "backup/a.png", true},
+		{"**/backup/*", "x/y/backup/a.png", true},
+		{"**/backup/*", "x/backup", false},
+		{"x/**", "x/a/b", true},
+
+		// separators: "\" is "/", leading and trailing ones are dropped
+		{`vendor\*.png`, "vendor/a.png", true},
+		{"/vendor/*.png", "vendor/a.png", true},
+		{"/vendor/", "x/vendor", true},
+	}
+
+	for _, tt := range tests {
+
+		p, err := normalizeExclude([]string{tt.glob})
+
+		if err != nil {
+			t.Fatalf("%s: %v", tt.glob, err)
+		}
+
+		if got := p[0].match(tt.rel); got != tt.want {
+			t.Errorf("%q match %q %t, want %t", tt.glob, tt.rel, got, tt.want)
+		}
+	}
+
+	for _, glob := range []string{"", "/", "[a", "x/[a/*.png"} {
+		if _, err := normalizeExclude([]string{glob}); err == nil {
+			t.Errorf("%q: no error", glob)
+		}
+	}
+}
+
+func TestExcludeRun(t *testing.T) {
+
+	const (
+		data     = "{ \"a\": 1 }"
+		minified = `{"a":1}`
+	)
+
+	dir := t.TempDir()
+
+	files := map[string]bool{ // rel path -> is excluded
+		"a.config":              false,
+		"skip.config":           true,
+		"vendor/a.config":       true,
+		"x/vendor/a.config":     true,
+		"vendor.config":         false,
+		"lib/a.config":          false,
+		"lib/gen/a.config":      true,
+		"lib/gen/deep/a.config": true,
+		"gen/a.config":          false,
+	}
+
+	for rel := range files {
+
+		path := filepath.Join(dir, filepath.FromSlash(rel))
+
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(path, []byte(data), 0o666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var log bytes.Buffer
+
+	ao, err := NewAssetsOptimizer(dir, WithSettings(Settings{
+		MinifyJSON: true,
+		Exclude:    []string{"skip.config", "vendor", `lib\gen`},
+		Log:        &log,
+	}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ao.RunContext(context.Background()); err != nil {
+		t.Fatalf("%v\n%s", err, log.String())
+	}
+
+	for rel, excluded := range files {
+
+		want := minified
+
+		if excluded {
+			want = data
+		}
+
+		if got, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(rel))); err != nil || string(got) != want {
+			t.Errorf("%s: %q (%v), want %q", rel, got, err, want)
+		}
+	}
+
+	// NOTE файлы пропущенных целиком каталогов не считаются
+	if ao.stats.files != 4 || ao.stats.excluded != 1 {
+		t.Errorf("processed %d, excluded %d, want 4 and 1\n%s", ao.stats.files, ao.stats.excluded, log.String())
+	}
+
+	// NOTE rel под Windows приходит с обратными слешами
+	if excluded, err := ao.isExcluded(`lib\gen`, true); err != nil || !excluded {
+		t.Errorf("backslash rel excluded %t (%v)", excluded, err)
+	}
+}
@@ -0,0 +1,175 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// filesFromStdin as Settings.FilesFrom reads the list from stdin
+const filesFromStdin = "-"
+
+// walkListed is walkAssets over the newline separated list of files ao.filesFrom instead of the whole dir,
+// listed entries that are missing, not regular files (symlinks to them unless followed) or outside of the root dir
+// are warned and skipped
+func (ao *AssetsOptimizer) walkListed(ctx context.Context, fn func(a asset) error) (err error) {
+
+	var r io.Reader = os.Stdin
+
+	if ao.filesFrom != filesFromStdin {
+
+		fp, err := os.Open(ao.filesFrom)
+
+		if err != nil {
+			return fmt.Errorf("files list error: %w", err)
+		}
+
+		defer fp.Close()
+
+		r = fp
+	}
+
+	// NOTE один и тот же файл, перечисленный дважды (в т.ч. разными путями), оптимизируем один раз
+	seen := make(map[string]struct{})
+
+	if ao.followSymlinks {
+		fn = ao.visitOnce(make(visitedFiles), fn)
+	}
+
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+
+		if err = ctx.Err(); err != nil {
+			return fmt.Errorf("run interrupted: %w", err)
+		}
+
+		// NOTE CRLF списков из Windows и хвостовые пробелы отрезаем, пробелы внутри имени остаются
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" {
+			continue
+		}
+
+		path := filepath.FromSlash(line)
+
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(ao.dir, path)
+		}
+
+		path = filepath.Clean(path)
+
+		if _, ok := seen[path]; ok {
+			continue
+		}
+
+		seen[path] = struct{}{}
+
+		if err = ao.visitListed(path, fn); err != nil {
+			return err
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		return fmt.Errorf("files list error: %w", err)
+	}
+
+	return nil
+}
+
+// visitListed checks listed path the way walkAssets would reach it and calls visitFile
+func (ao *AssetsOptimizer) visitListed(path string, fn func(a asset) error) (err error) {
+
+	rel, err := filepath.Rel(ao.dir, path)
+
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		ao.skipListed(path, "outside of the root dir")
+		return nil
+	}
+
+	// NOTE Lstat, как и WalkDir: симлинк не является обычным файлом
+	info, err := os.Lstat(path)
+
+	if err != nil {
+		ao.skipListed(path, err.Error())
+		return nil
+	}
+
+	target := ""
+
+	if info.Mode()&fs.ModeSymlink != 0 {
+
+		if !ao.followSymlinks {
+			ao.skipListed(path, "symlink is not followed, see --follow-symlinks")
+			return nil
+		}
+
+		if target, err = filepath.EvalSymlinks(path); err == nil {
+			info, err = os.Stat(target)
+		}
+
+		if err != nil {
+			ao.skipListed(path, err.Error())
+			return nil
+		}
+	}
+
+	if !info.Mode().IsRegular() {
+		ao.skipListed(path, "not a regular file")
+		return nil
+	}
+
+	// NOTE walkAssets не зашел бы в исключенный каталог, поэтому проверяем и всех предков
+	for r := filepath.Dir(rel); r != "."; r = filepath.Dir(r) {
+		if excluded, err := ao.isExcluded(r, true); err != nil {
+			return err
+		} else if excluded {
+			ao.mu.Lock()
+			ao.stats.excluded++
+			ao.logSkip(path, "excluded")
+			ao.mu.Unlock()
+			return nil
+		}
+	}
+
+	d := fs.FileInfoToDirEntry(info)
+
+	if skip, err := ao.skipExcluded(path, d); skip || err != nil {
+		return err
+	}
+
+	return ao.visitFile(path, d, func(a asset) error {
+		a.target = target
+		return fn(a)
+	})
+}
+
+func (ao *AssetsOptimizer) skipListed(path, reason string) {
+
+	ao.logf(ao.log, levelWarn, "skip listed %q: %s\n", path, reason)
+
+	ao.mu.Lock()
+	ao.stats.unlisted++
+	ao.mu.Unlock()
+}
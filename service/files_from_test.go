@@ -0,0 +1,127 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFilesFrom(t *testing.T) {
+
+	const (
+		data     = "{ \"a\": 1 }"
+		minified = `{"a":1}`
+	)
+
+	root, outside := t.TempDir(), t.TempDir()
+	dir := filepath.Join(root, "mod")
+
+	files := map[string]bool{ // path relative to root -> is optimized
+		"mod/a.config":        true,
+		"mod/sub/b.config":    true,
+		"mod/c.config":        true,
+		"mod/unlisted.config": false,
+		"outside.config":      false,
+		"mod/d/e.config":      false,
+	}
+
+	for rel := range files {
+
+		path := filepath.Join(root, filepath.FromSlash(rel))
+
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(path, []byte(data), 0o666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list := strings.Join([]string{
+		"a.config",
+		"",
+		"   ",
+		"sub/b.config  ",
+		"./a.config",                       // NOTE тот же файл другим путем
+		filepath.Join(dir, "c.config"),     // absolute
+		"../outside.config",                // outside
+		filepath.Join(outside, "x.config"), // outside, absolute
+		"missing.config",                   // missing
+		"d",                                // dir
+		"",
+	}, "\r\n")
+
+	listPath := filepath.Join(outside, "list.txt")
+
+	if err := os.WriteFile(listPath, []byte(list), 0o666); err != nil {
+		t.Fatal(err)
+	}
+
+	var log bytes.Buffer
+
+	ao, err := NewAssetsOptimizer(dir, WithSettings(Settings{MinifyJSON: true, FilesFrom: listPath, Log: &log}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ao.RunContext(context.Background()); err != nil {
+		t.Fatalf("%v\n%s", err, log.String())
+	}
+
+	for rel, optimized := range files {
+
+		want := data
+
+		if optimized {
+			want = minified
+		}
+
+		if got, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(rel))); err != nil || string(got) != want {
+			t.Errorf("%s: %q (%v), want %q", rel, got, err, want)
+		}
+	}
+
+	if ao.stats.files != 3 || ao.stats.unlisted != 4 || ao.stats.errors != 0 {
+		t.Errorf("processed %d, unusable %d, errors %d, want 3, 4, 0\n%s", ao.stats.files, ao.stats.unlisted,
+			ao.stats.errors, log.String())
+	}
+
+	for _, reason := range []string{"outside of the root dir", "not a regular file", "no such file"} {
+		if !strings.Contains(log.String(), reason) {
+			t.Errorf("no %q warning\n%s", reason, log.String())
+		}
+	}
+
+	// NOTE а вот отсутствующий сам список - ошибка прогона
+	ao, err = NewAssetsOptimizer(dir, WithSettings(Settings{MinifyJSON: true,
+		FilesFrom: filepath.Join(outside, "none.txt"), Log: &log}))
+
+	if err == nil {
+		err = ao.RunContext(context.Background())
+	}
+
+	if err == nil || !strings.Contains(err.Error(), "files list error") {
+		t.Errorf("missing list: %v", err)
+	}
+}
@@ -0,0 +1,361 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	lockedRenameRetries = 3
+	lockedRenameDelay   = 100 * time.Millisecond
+
+	tempCreateRetries = 10
+)
+
+var (
+	errAssetLocked  = errors.New("asset is locked by another process")
+	errBackupExists = errors.New("backup already exists")
+)
+
+// tempFiles are temp files being written right now (see replaceFile), so that a run killed by signal or panic can
+// remove them, see RemoveTempFiles
+var tempFiles = struct {
+	sync.Mutex
+	paths map[string]struct{}
+}{paths: make(map[string]struct{})}
+
+func trackTempFile(path string) {
+	tempFiles.Lock()
+	tempFiles.paths[path] = struct{}{}
+	tempFiles.Unlock()
+}
+
+func untrackTempFile(path string) {
+	tempFiles.Lock()
+	delete(tempFiles.paths, path)
+	tempFiles.Unlock()
+}
+
+// RemoveTempFiles removes every temp file still being written and returns their number, it is meant for shutdown
+// that does not wait for the assets in progress (their writes then fail or leave nothing behind)
+func RemoveTempFiles() (n int) {
+
+	tempFiles.Lock()
+	defer tempFiles.Unlock()
+
+	for path := range tempFiles.paths {
+
+		if os.Remove(path) == nil {
+			n++
+		}
+
+		delete(tempFiles.paths, path)
+	}
+
+	return n
+}
+
+// removeTempFilesOnPanic is deferred by every goroutine of the run: panic of any of them kills the whole process
+// without unwinding the others, so temp files of all goroutines are removed before the panic goes on
+func removeTempFilesOnPanic() {
+
+	if r := recover(); r != nil {
+		RemoveTempFiles()
+		panic(r)
+	}
+}
+
+// renameAsset is os.Rename with a few retries when dst is held open by another process (Windows only),
+// persistent lock is reported as errAssetLocked
+func renameAsset(src, dst string) (err error) {
+
+	for i := 0; ; i++ {
+
+		if err = os.Rename(src, dst); err == nil || !isLockedErr(err) {
+			return err
+		}
+
+		if i == lockedRenameRetries {
+			break
+		}
+
+		time.Sleep(lockedRenameDelay * time.Duration(i+1))
+	}
+
+	return fmt.Errorf("%w: %w", errAssetLocked, err)
+}
+
+// tempPath returns temp file name for path next to it (so that final rename stays on the same filesystem), unique
+// between goroutines and concurrent runs: path.<pid>-<random><tmpExt>
+func tempPath(path, tmpExt string) string {
+	return fmt.Sprintf("%s.%d-%08x%s", path, os.Getpid(), rand.Uint32(), tmpExt)
+}
+
+// createTemp creates new temp file for path (see tempPath) and tracks it, see trackTempFile
+func createTemp(path, tmpExt string) (tmpPath string, fp *os.File, err error) {
+
+	for i := 0; ; i++ {
+
+		tmpPath = tempPath(path, tmpExt)
+
+		// NOTE учитываем до создания, чтобы RemoveTempFiles не пропустил только что созданный файл
+		trackTempFile(tmpPath)
+
+		// NOTE не os.CreateTemp: он создает с 0600, а права восстанавливаются только у заменяемых ассетов
+		if fp, err = os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o666); err == nil {
+			return tmpPath, fp, nil
+		}
+
+		untrackTempFile(tmpPath)
+
+		if !errors.Is(err, fs.ErrExist) || i == tempCreateRetries {
+			return "", nil, err
+		}
+	}
+}
+
+func writeAsset(fp *os.File, b *bytes.Buffer) (err error) {
+
+	if _, err = b.WriteTo(fp); err != nil {
+		_ = fp.Close()
+		return err
+	}
+
+	return fp.Close()
+}
+
+// replaceAsset is replaceFile which keeps permissions and modification time of the replaced asset, so build tools
+// keyed on timestamps don't see optimized asset as changed
+func replaceAsset(path, tmpExt string, b *bytes.Buffer) (err error) {
+
+	// NOTE нового файла (например responsive @1x) еще нет, сохранять нечего
+	info, statErr := os.Stat(path)
+
+	if err = replaceFile(path, tmpExt, b); err != nil || statErr != nil {
+		return err
+	}
+
+	return keepFileInfo(path, info)
+}
+
+// saveAsset writes optimized b of asset path: over path itself (see replaceAsset) or, if opts.Output is set,
+// to opts.Output, then the source is left as is; tmpExt is suffix of the temp file
+func saveAsset(path, tmpExt string, b *bytes.Buffer, opts *OptimizeOptions) (err error) {
+
+	// NOTE последняя проверка перед заменой: исполняется только то, что было в плане
+	if opts.planned > 0 && int64(b.Len()) != opts.planned {
+		return fmt.Errorf("%w: %d bytes instead of %d", errPlanMismatch, b.Len(), opts.planned)
+	}
+
+	if opts.Output == "" {
+
+		if err = backupAsset(path, opts); err != nil {
+			return err
+		}
+
+		return replaceAsset(path, tmpExt, b)
+	}
+
+	return writeOutput(path, opts.Output, tmpExt, b)
+}
+
+// backupAsset copies path to path + opts.Backup before path is rewritten or removed in-place, an existing backup
+// (that is an even older original) is kept as is, or with opts.BackupStrict fails the asset
+func backupAsset(path string, opts *OptimizeOptions) (err error) {
+
+	if opts.Backup == "" {
+		return nil
+	}
+
+	dst := path + opts.Backup
+
+	if _, err = os.Lstat(dst); err == nil {
+
+		if opts.BackupStrict {
+			return fmt.Errorf("%w: %s", errBackupExists, dst)
+		}
+
+		return nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return mirrorAsset(path, dst)
+}
+
+// writeOutput writes b to dst (creating its parent dirs) with permissions and modification time of src
+//
+// NOTE tmp создается рядом с dst, так что mv атомарен в пределах файловой системы назначения
+func writeOutput(src, dst, tmpExt string, b *bytes.Buffer) (err error) {
+
+	info, err := os.Stat(src)
+
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+
+	if err = replaceFile(dst, tmpExt, b); err != nil {
+		return err
+	}
+
+	return keepFileInfo(dst, info)
+}
+
+// mirrorAsset copies src to dst as is (creating parent dirs of dst), through temp file as writeOutput does
+func mirrorAsset(src, dst string) (err error) {
+
+	info, err := os.Stat(src)
+
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+
+	tmpPath, fp, err := createTemp(dst, ".copytmp")
+
+	if err != nil {
+		return err
+	}
+
+	_ = fp.Close()
+
+	finished := false
+
+	defer func() {
+		if !finished || err != nil {
+			_ = os.Remove(tmpPath)
+		}
+
+		untrackTempFile(tmpPath)
+	}()
+
+	if err = copyAsset(src, tmpPath); err == nil {
+		err = renameAsset(tmpPath, dst)
+	}
+
+	finished = true
+
+	if err != nil {
+		return err
+	}
+
+	return keepFileInfo(dst, info)
+}
+
+// keepFileInfo sets permissions and modification time of path to the ones of info
+func keepFileInfo(path string, info fs.FileInfo) (err error) {
+
+	if err = os.Chmod(path, info.Mode().Perm()); err != nil {
+		return err
+	}
+
+	return os.Chtimes(path, time.Now(), info.ModTime())
+}
+
+// replaceFile writes b to unique temp file next to path (see tempPath, tmpExt is its suffix) and then atomically
+// moves it over path, the temp file never outlives failure (panic included, and a killed run removes it with
+// RemoveTempFiles)
+func replaceFile(path, tmpExt string, b *bytes.Buffer) (err error) {
+
+	tmpPath, fp, err := createTemp(path, tmpExt)
+
+	if err != nil {
+		return err
+	}
+
+	finished := false
+
+	defer func() {
+		if !finished || err != nil {
+			_ = os.Remove(tmpPath)
+		}
+
+		untrackTempFile(tmpPath)
+	}()
+
+	if err = writeAsset(fp, b); err == nil {
+		err = moveAsset(tmpPath, path)
+	}
+
+	finished = true
+
+	return err
+}
+
+// moveAsset renames src over dst, falls back to copy when they are on different devices
+func moveAsset(src, dst string) (err error) {
+
+	// mv
+	if err = renameAsset(src, dst); err != nil && isCrossDeviceErr(err) {
+
+		// NOTE tmp лежит рядом с path, так что это экзотика (bind mount, overlayfs), и здесь уже не атомарно
+		if err = copyAsset(src, dst); err != nil {
+			return err
+		}
+
+		_ = os.Remove(src)
+
+		return nil
+	}
+
+	return err
+}
+
+// copyAsset overwrites dst with content of src and syncs it to disk
+func copyAsset(src, dst string) (err error) {
+
+	in, err := os.Open(src)
+
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o666)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(out, in); err == nil {
+		err = out.Sync()
+	}
+
+	if e := out.Close(); err == nil {
+		err = e
+	}
+
+	return err
+}
@@ -0,0 +1,47 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build !windows
+
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"syscall"
+)
+
+// on *nix rename over an opened file always succeeds
+func isLockedErr(err error) bool {
+	return false
+}
+
+func isCrossDeviceErr(err error) bool {
+	return errors.Is(err, syscall.EXDEV)
+}
+
+// getFileID takes device and inode of path from its info
+func getFileID(path string, info fs.FileInfo) (id fileID, err error) {
+
+	st, ok := info.Sys().(*syscall.Stat_t)
+
+	if !ok {
+		return id, fmt.Errorf("no inode of %q", path)
+	}
+
+	return fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}, nil
+}
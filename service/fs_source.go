@@ -0,0 +1,167 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var errFSSource = errors.New("not supported for fs.FS source")
+
+// FSOptimizer optimizes asset read from fs.FS (see NewAssetsOptimizerFS) and returns the optimized data instead of
+// writing it anywhere, opt is nil for NOOP
+type FSOptimizer interface {
+	OptimizeFS(fsys fs.FS, path string, opts *OptimizeOptions) (opt *bytes.Buffer, res OptimizeResult, err error)
+}
+
+// NewAssetsOptimizerFS creates optimizer of assets under root of fsys (zip.Reader, embed.FS, os.DirFS, ...), which is
+// only read: every asset is optimized by FSOptimizer registered for its format and written to Settings.OutputDir
+// (required), NOOP assets and assets of other optimizers are copied there as is. Settings that need real files
+// (Cache, Responsive, AllowWebP, Gitignore, FollowLinks, FilesFrom) are not supported, as are Watch, Classify,
+// Audit and Compare
+func NewAssetsOptimizerFS(fsys fs.FS, root string, opts ...Option) (_ *AssetsOptimizer, err error) {
+
+	settings := applyOptions(opts)
+
+	if !fs.ValidPath(root) {
+		return nil, fmt.Errorf("invalid fs.FS root %q", root)
+	}
+
+	info, err := fs.Stat(fsys, root)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return nil, fmt.Errorf("fs.FS root %q is not a dir", root)
+	}
+
+	if settings.OutputDir == "" {
+		return nil, fmt.Errorf("fs.FS source needs output dir")
+	}
+
+	for _, s := range [...]struct {
+		on   bool
+		name string
+	}{
+		{settings.Cache, "cache"},
+		{settings.Responsive, "responsive"},
+		{settings.AllowWebP, "webp"},
+		{settings.Gitignore, "gitignore"},
+		{settings.FollowLinks, "following symlinks"},
+		{settings.FilesFrom != "", "files from list"},
+	} {
+		if s.on {
+			return nil, fmt.Errorf("%s is %w", s.name, errFSSource)
+		}
+	}
+
+	return newAssetsOptimizer(root, fsys, settings)
+}
+
+// walkFS is walkAssets of fs.FS source, symlinks and irregular files are skipped
+func (ao *AssetsOptimizer) walkFS(ctx context.Context, fn func(a asset) error) error {
+
+	return fs.WalkDir(ao.fsys, ao.dir, func(path string, d fs.DirEntry, err error) error {
+
+		if err != nil {
+			return fmt.Errorf("walk dir %q error: %w", path, err)
+		}
+
+		if err = ctx.Err(); err != nil {
+			return fmt.Errorf("run interrupted: %w", err)
+		}
+
+		if skip, err := ao.skipExcluded(path, d); skip || err != nil {
+			return err
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		return ao.visitFile(path, d, fn)
+	})
+}
+
+// optimizeFS optimizes asset a of fs.FS source and writes the result to opts.Output, asset that did not shrink
+// (or has no FSOptimizer) is copied there as is
+func (ao *AssetsOptimizer) optimizeFS(a *asset, opts *OptimizeOptions) (res OptimizeResult, err error) {
+
+	var opt *bytes.Buffer
+
+	if fo, ok := a.optimizer.(FSOptimizer); ok {
+		if opt, res, err = fo.OptimizeFS(ao.fsys, a.path, opts); err != nil {
+			return res, err
+		}
+	} else {
+		res.NOOP, res.Reason = true, fmt.Sprintf("%T can't read from fs.FS", a.optimizer)
+	}
+
+	if opts.DryRun {
+		return res, nil
+	}
+
+	info, err := fs.Stat(ao.fsys, a.path)
+
+	if err != nil {
+		return res, err
+	}
+
+	tmpExt := "." + a.ext + "tmp"
+
+	if res.NOOP {
+
+		data, err := fs.ReadFile(ao.fsys, a.path)
+
+		if err != nil {
+			return res, fmt.Errorf("copy to output dir error: %w", err)
+		}
+
+		opt, tmpExt = bytes.NewBuffer(data), ".copytmp"
+	}
+
+	return res, writeFSOutput(opts.Output, tmpExt, opt, info)
+}
+
+// writeFSOutput is writeOutput of asset of fs.FS source described by info
+func writeFSOutput(dst, tmpExt string, b *bytes.Buffer, info fs.FileInfo) (err error) {
+
+	if err = os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+
+	if err = replaceFile(dst, tmpExt, b); err != nil {
+		return err
+	}
+
+	// NOTE права в fs.FS условны (embed.FS - всегда 0444), поэтому у результата права по умолчанию,
+	//      а время изменения переносится, только если оно вообще есть
+	if info.ModTime().IsZero() {
+		return nil
+	}
+
+	return os.Chtimes(dst, time.Now(), info.ModTime())
+}
@@ -0,0 +1,181 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestOptimizeFSSource(t *testing.T) {
+
+	var (
+		name, png = "", []byte(nil)
+		mtime     = time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	)
+
+	for n, data := range readPNGFixtures(t) {
+		if name == "" || n < name {
+			name, png = n, data
+		}
+	}
+
+	fsys := fstest.MapFS{
+		"mod/a.config":             {Data: []byte("{ \"a\": 1 }"), ModTime: mtime},
+		"mod/sub/min.config":       {Data: []byte(`{"a":1}`)},
+		"mod/img/" + name + ".png": {Data: png},
+		"mod/notes.txt":            {Data: []byte("not an asset")},
+		"mod/vendor/v.config":      {Data: []byte("{ \"v\": 1 }")},
+		"mod/link.config":          {Data: []byte("a.config"), Mode: fs.ModeSymlink},
+		"outside.config":           {Data: []byte("{ \"o\": 1 }")},
+	}
+
+	out := t.TempDir()
+
+	var log bytes.Buffer
+
+	ao, err := NewAssetsOptimizerFS(fsys, "mod", WithSettings(Settings{
+		MinifyJSON: true,
+		OutputDir:  out,
+		Exclude:    []string{"vendor"},
+		Workers:    2,
+		Log:        &log,
+	}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ao.RunContext(context.Background()); err != nil {
+		t.Fatalf("%v\n%s", err, log.String())
+	}
+
+	// NOTE NOOP копируется как есть, не ассеты, исключенное и симлинки не попадают никуда
+	want := map[string]string{
+		"a.config":       `{"a":1}`,
+		"sub/min.config": `{"a":1}`,
+	}
+
+	var got []string
+
+	err = filepath.WalkDir(out, func(path string, d fs.DirEntry, err error) error {
+
+		if err == nil && !d.IsDir() {
+			rel, _ := filepath.Rel(out, path)
+			got = append(got, filepath.ToSlash(rel))
+		}
+
+		return err
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(got)
+
+	if wantFiles := []string{"a.config", "img/" + name + ".png", "sub/min.config"}; !reflect.DeepEqual(got, wantFiles) {
+		t.Fatalf("output files %v, want %v\n%s", got, wantFiles, log.String())
+	}
+
+	for rel, data := range want {
+		if b, err := os.ReadFile(filepath.Join(out, filepath.FromSlash(rel))); err != nil || string(b) != data {
+			t.Errorf("%s: %q (%v), want %q", rel, b, err, data)
+		}
+	}
+
+	if info, err := os.Stat(filepath.Join(out, "a.config")); err != nil || !info.ModTime().Equal(mtime) {
+		t.Errorf("a.config mtime is not kept: %v", err)
+	}
+
+	opt, err := os.ReadFile(filepath.Join(out, "img", name+".png"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(opt) > len(png) {
+		t.Errorf("png %d -> %d bytes", len(png), len(opt))
+	}
+
+	samePixels(t, name, decodeTestPNG(t, png), decodeTestPNG(t, opt))
+
+	if ao.stats.files != 3 || ao.stats.errors != 0 || ao.stats.excluded != 0 {
+		t.Errorf("processed %d, errors %d, excluded %d, want 3, 0, 0\n%s", ao.stats.files, ao.stats.errors,
+			ao.stats.excluded, log.String())
+	}
+}
+
+func TestNewAssetsOptimizerFS(t *testing.T) {
+
+	fsys := fstest.MapFS{
+		"mod/a.config": {Data: []byte("{}")},
+	}
+
+	out := t.TempDir()
+
+	tests := []struct {
+		name     string
+		root     string
+		settings Settings
+	}{
+		{"invalid root", "../mod", Settings{OutputDir: out}},
+		{"missing root", "none", Settings{OutputDir: out}},
+		{"root is a file", "mod/a.config", Settings{OutputDir: out}},
+		{"no output dir", "mod", Settings{}},
+		{"cache", "mod", Settings{OutputDir: out, Cache: true}},
+		{"responsive", "mod", Settings{OutputDir: out, Responsive: true}},
+		{"gitignore", "mod", Settings{OutputDir: out, Gitignore: true}},
+		{"files from", "mod", Settings{OutputDir: out, FilesFrom: "list.txt"}},
+	}
+
+	for _, tt := range tests {
+		if _, err := NewAssetsOptimizerFS(fsys, tt.root, WithSettings(tt.settings)); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+
+	if _, err := NewAssetsOptimizerFS(fsys, "mod", WithSettings(Settings{OutputDir: out, Cache: true})); !errors.Is(err,
+		errFSSource) {
+		t.Errorf("cache: %v, want %v", err, errFSSource)
+	}
+
+	// NOTE dry run ничего не пишет
+	ao, err := NewAssetsOptimizerFS(fsys, "mod", WithSettings(Settings{OutputDir: out, MinifyJSON: true, DryRun: true,
+		Log: &bytes.Buffer{}}))
+
+	if err == nil {
+		err = ao.RunContext(context.Background())
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if entries, err := os.ReadDir(out); err != nil || len(entries) > 0 {
+		t.Errorf("dry run wrote %d entries (%v)", len(entries), err)
+	}
+}
@@ -0,0 +1,338 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReplaceAssetOverDir(t *testing.T) {
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.png")
+
+	// NOTE каталог вместо ассета: rename поверх него не проходит даже у root
+	if err := os.MkdirAll(filepath.Join(path, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := replaceAsset(path, ".pngtmp", bytes.NewBufferString("png")); err == nil {
+		t.Fatal("no error for rename over a directory")
+	}
+
+	if left, tracked := leftTempFiles(t, dir); len(left) > 0 || tracked > 0 {
+		t.Errorf("temp files left %v, still tracked %d", left, tracked)
+	}
+
+	if info, err := os.Stat(path); err != nil || !info.IsDir() {
+		t.Errorf("directory is not kept: %v", err)
+	}
+}
+
+func TestReplaceAssetKeepsFileInfo(t *testing.T) {
+
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+
+	for _, mode := range []os.FileMode{0o600, 0o640, 0o644, 0o755} {
+		t.Run(mode.String(), func(t *testing.T) {
+
+			dir := t.TempDir()
+			path, out := filepath.Join(dir, "a.png"), filepath.Join(dir, "out", "a.png")
+
+			if err := os.WriteFile(path, []byte("original"), 0o666); err != nil {
+				t.Fatal(err)
+			}
+
+			// NOTE chmod отдельно, иначе права срежет umask
+			if err := os.Chmod(path, mode); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := os.Chtimes(path, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := writeOutput(path, out, ".pngtmp", bytes.NewBufferString("output")); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := replaceAsset(path, ".pngtmp", bytes.NewBufferString("optimized")); err != nil {
+				t.Fatal(err)
+			}
+
+			for p, want := range map[string]string{path: "optimized", out: "output"} {
+
+				data, err := os.ReadFile(p)
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				info, err := os.Stat(p)
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if string(data) != want || info.Mode().Perm() != mode || !info.ModTime().Equal(mtime) {
+					t.Errorf("%s: %q, mode %v, mtime %v, want %q, %v, %v", p, data, info.Mode().Perm(),
+						info.ModTime(), want, mode, mtime)
+				}
+			}
+
+			if left, tracked := leftTempFiles(t, dir); len(left) > 0 || tracked > 0 {
+				t.Errorf("temp files left %v, still tracked %d", left, tracked)
+			}
+		})
+	}
+
+	// новому файлу сохранять нечего
+	path := filepath.Join(t.TempDir(), "new.png")
+
+	if err := replaceAsset(path, ".pngtmp", bytes.NewBufferString("new")); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := os.ReadFile(path); err != nil || string(data) != "new" {
+		t.Errorf("new file %q, error %v", data, err)
+	}
+}
+
+func TestTempPath(t *testing.T) {
+
+	path := filepath.Join("dir", "a.png")
+	prefix := fmt.Sprintf("%s.%d-", path, os.Getpid())
+
+	seen := make(map[string]bool)
+
+	for i := 0; i < 100; i++ {
+
+		p := tempPath(path, ".pngtmp")
+
+		if !strings.HasPrefix(p, prefix) || !strings.HasSuffix(p, ".pngtmp") || filepath.Dir(p) != "dir" {
+			t.Fatalf("temp path %q, want %s<random>.pngtmp", p, prefix)
+		}
+
+		if seen[p] {
+			t.Fatalf("temp path %q repeats", p)
+		}
+
+		seen[p] = true
+	}
+}
+
+// TestReplaceFileConcurrent is several runs rewriting the same asset at once, each of them must succeed
+func TestReplaceFileConcurrent(t *testing.T) {
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.png")
+
+	const n = 16
+
+	var (
+		wg   sync.WaitGroup
+		errs [n]error
+	)
+
+	for i := 0; i < n; i++ {
+
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = replaceFile(path, ".pngtmp", bytes.NewBufferString(fmt.Sprintf("writer %02d", i)))
+		}(i)
+	}
+
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("writer %d: %v", i, err)
+		}
+	}
+
+	if data, err := os.ReadFile(path); err != nil || !strings.HasPrefix(string(data), "writer ") || len(data) != 9 {
+		t.Errorf("asset %q, error %v, want the whole content of one writer", data, err)
+	}
+
+	if left, tracked := leftTempFiles(t, dir); len(left) > 0 || tracked > 0 {
+		t.Errorf("temp files left %v, still tracked %d", left, tracked)
+	}
+}
+
+func TestRemoveTempFiles(t *testing.T) {
+
+	dir := t.TempDir()
+
+	var paths []string
+
+	for _, name := range []string{"a.png", "b.json"} {
+
+		tmpPath, fp, err := createTemp(filepath.Join(dir, name), ".tmp")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_ = fp.Close()
+
+		paths = append(paths, tmpPath)
+	}
+
+	// NOTE уже удаленный файл не считается
+	_ = os.Remove(paths[1])
+
+	if n := RemoveTempFiles(); n != 1 {
+		t.Errorf("removed %d, want 1", n)
+	}
+
+	if left, tracked := leftTempFiles(t, dir); len(left) > 0 || tracked > 0 {
+		t.Errorf("temp files left %v, still tracked %d", left, tracked)
+	}
+
+	if n := RemoveTempFiles(); n != 0 {
+		t.Errorf("second call removed %d, want 0", n)
+	}
+}
+
+func TestRemoveTempFilesOnPanic(t *testing.T) {
+
+	dir := t.TempDir()
+
+	// run is a goroutine of the run with a temp file in progress
+	run := func(fail bool) (recovered any) {
+
+		defer func() {
+			recovered = recover()
+		}()
+
+		defer removeTempFilesOnPanic()
+
+		_, fp, err := createTemp(filepath.Join(dir, "a.png"), ".pngtmp")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_ = fp.Close()
+
+		if fail {
+			panic("boom")
+		}
+
+		return nil
+	}
+
+	if r := run(false); r != nil {
+		t.Fatalf("recovered %v without panic", r)
+	}
+
+	// без паники временный файл остается за своим владельцем
+	if left, tracked := leftTempFiles(t, dir); len(left) != 1 || tracked != 1 {
+		t.Fatalf("temp files %v, tracked %d, want the file kept", left, tracked)
+	}
+
+	// panic goes on after temp files of all goroutines are removed
+	if r := run(true); r != "boom" {
+		t.Fatalf("recovered %v, want the panic to go on", r)
+	}
+
+	if left, tracked := leftTempFiles(t, dir); len(left) > 0 || tracked > 0 {
+		t.Errorf("temp files left %v, still tracked %d", left, tracked)
+	}
+}
+
+func TestBackupAsset(t *testing.T) {
+
+	const (
+		original  = "{ \"a\": 1 }"
+		minified  = `{"a":1}`
+		oldBackup = "even older original"
+	)
+
+	tests := []struct {
+		name     string
+		data     string // of the asset
+		backup   string // already existing backup, "" - none
+		strict   bool
+		want     string // asset after the run
+		wantBak  string // backup after the run, "" - none
+		wantFail bool
+	}{
+		{"replaced", original, "", false, minified, original, false},
+		{"existing backup is kept", original, oldBackup, false, minified, oldBackup, false},
+		// NOTE бэкап делается до замены: не сделан - ассет остается как был
+		{"strict existing backup", original, oldBackup, true, original, oldBackup, true},
+		{"strict", original, "", true, minified, original, false},
+		{"NOOP", minified, "", false, minified, "", false},
+	}
+
+	o := NewJSONOptimizer()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			dir := t.TempDir()
+			path := filepath.Join(dir, "a.config")
+
+			if err := os.WriteFile(path, []byte(tt.data), 0o666); err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.backup != "" {
+				if err := os.WriteFile(path+".bak", []byte(tt.backup), 0o666); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			_, err := o.Optimize(path, &OptimizeOptions{Backup: ".bak", BackupStrict: tt.strict})
+
+			if tt.wantFail != errors.Is(err, errBackupExists) || (!tt.wantFail && err != nil) {
+				t.Fatalf("error %v, want fail %t", err, tt.wantFail)
+			}
+
+			if got, err := os.ReadFile(path); err != nil || string(got) != tt.want {
+				t.Errorf("asset %q (%v), want %q", got, err, tt.want)
+			}
+
+			got, err := os.ReadFile(path + ".bak")
+
+			if tt.wantBak == "" {
+
+				if !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("backup %q (%v), want none", got, err)
+				}
+
+				return
+			}
+
+			if err != nil || string(got) != tt.wantBak {
+				t.Errorf("backup %q (%v), want %q", got, err, tt.wantBak)
+			}
+		})
+	}
+}
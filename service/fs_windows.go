@@ -0,0 +1,82 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build windows
+
+package service
+
+import (
+	"errors"
+	"io/fs"
+	"syscall"
+)
+
+// SEE https://learn.microsoft.com/en-us/windows/win32/debug/system-error-codes--0-499-
+const (
+	errnoAccessDenied     syscall.Errno = 5
+	errnoSharingViolation syscall.Errno = 32
+	errnoLockViolation    syscall.Errno = 33
+	errnoNotSameDevice    syscall.Errno = 17
+)
+
+// NOTE MoveFileEx поверх файла, открытого другим процессом без FILE_SHARE_DELETE, как правило
+// возвращает именно ERROR_ACCESS_DENIED, а не ERROR_SHARING_VIOLATION
+func isLockedErr(err error) bool {
+
+	var errno syscall.Errno
+
+	if !errors.As(err, &errno) {
+		return false
+	}
+
+	return errno == errnoSharingViolation || errno == errnoLockViolation || errno == errnoAccessDenied
+}
+
+func isCrossDeviceErr(err error) bool {
+
+	var errno syscall.Errno
+
+	return errors.As(err, &errno) && errno == errnoNotSameDevice
+}
+
+// getFileID opens path (FileInfo of os.Stat has no file index) and takes its volume serial number and file
+// index, the same as os.SameFile does
+func getFileID(path string, _ fs.FileInfo) (id fileID, err error) {
+
+	name, err := syscall.UTF16PtrFromString(path)
+
+	if err != nil {
+		return id, err
+	}
+
+	// NOTE FILE_FLAG_BACKUP_SEMANTICS нужен, чтобы открыть каталог
+	h, err := syscall.CreateFile(name, 0, syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE|syscall.FILE_SHARE_DELETE,
+		nil, syscall.OPEN_EXISTING, syscall.FILE_FLAG_BACKUP_SEMANTICS, 0)
+
+	if err != nil {
+		return id, err
+	}
+
+	defer syscall.CloseHandle(h)
+
+	var d syscall.ByHandleFileInformation
+
+	if err = syscall.GetFileInformationByHandle(h, &d); err != nil {
+		return id, err
+	}
+
+	return fileID{dev: uint64(d.VolumeSerialNumber), ino: uint64(d.FileIndexHigh)<<32 | uint64(d.FileIndexLow)}, nil
+}
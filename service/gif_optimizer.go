@@ -0,0 +1,367 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"io/fs"
+	"os"
+)
+
+const (
+	extGIF = "gif"
+)
+
+type GIFOptimizer struct{}
+
+func NewGIFOptimizer() *GIFOptimizer {
+	return &GIFOptimizer{}
+}
+
+// Optimize losslessly re-encodes (animated) gif: drops duplicate consecutive frames and unused palette entries
+//
+// NOTE цвета кадров не переквантуются, т.е. каждый кадр остается попиксельно тем же; loop count, задержки,
+// disposal и прозрачный индекс (элемент палитры с A = 0) переносятся gif.EncodeAll как есть
+func (o *GIFOptimizer) Optimize(path string, opts *OptimizeOptions) (res OptimizeResult, err error) {
+
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return res, fmt.Errorf("GIFOptimizer optimize error: %w", err)
+	}
+
+	opt, res, err := o.optimizeData(data, opts)
+
+	if err != nil || res.NOOP || opts.DryRun {
+		return res, err
+	}
+
+	// NOTE сперва сохраняем временный файл, потом его атомарно mv
+	if err = saveAsset(path, ".giftmp", opt, opts); err != nil {
+		return res, err
+	}
+
+	return res, nil
+}
+
+// OptimizeFS re-encodes gif path of fsys, see FSOptimizer
+func (o *GIFOptimizer) OptimizeFS(fsys fs.FS, path string, opts *OptimizeOptions) (opt *bytes.Buffer, res OptimizeResult,
+	err error) {
+
+	data, err := fs.ReadFile(fsys, path)
+
+	if err != nil {
+		return nil, res, fmt.Errorf("GIFOptimizer optimize error: %w", err)
+	}
+
+	return o.optimizeData(data, opts)
+}
+
+// optimizeData re-encodes gif data, opt is nil for NOOP
+func (o *GIFOptimizer) optimizeData(data []byte, opts *OptimizeOptions) (opt *bytes.Buffer, res OptimizeResult, err error) {
+
+	res.Size = int64(len(data))
+
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+
+	if err != nil {
+		return nil, res, fmt.Errorf("GIFOptimizer optimize error: %w", err)
+	}
+
+	// NOTE эталон снимается до слияния кадров, которое меняет g на месте
+	var timeline []gifFrame
+
+	if opts.Verify {
+		timeline = gifTimeline(g)
+	}
+
+	dropped := 0
+
+	if opts.Effort > EffortFast {
+		dropped = o.dropDuplicateFrames(g)
+	}
+
+	variants := make(variantsList, 0, 2)
+
+	{
+		b := bytes.NewBuffer(nil)
+
+		if err = gif.EncodeAll(b, g); err != nil {
+			return nil, res, fmt.Errorf("GIFOptimizer encode src error: %w", err)
+		}
+
+		variants = append(variants, variant{b, "src"})
+	}
+
+	if opts.Effort > EffortFast {
+		if compacted := o.compactFrames(g); compacted != nil {
+
+			b := bytes.NewBuffer(nil)
+
+			if err = gif.EncodeAll(b, compacted); err != nil {
+				return nil, res, fmt.Errorf("GIFOptimizer encode compacted error: %w", err)
+			}
+
+			variants = append(variants, variant{b, "compacted palettes"})
+		}
+	}
+
+	opt, as, err := variants.best()
+
+	if err != nil {
+		return nil, res, err
+	}
+
+	res.OptimizedSize = int64(opt.Len())
+	res.Variant = as
+
+	if dropped > 0 {
+		res.Variant = fmt.Sprintf("%s, dropped %d duplicate frame(s)", res.Variant, dropped)
+	}
+
+	if opts.keepOriginal(&res) {
+		return nil, res, nil
+	}
+
+	if opts.Verify {
+		if err = verifyGIF(timeline, g.LoopCount, opt.Bytes()); err != nil {
+			return nil, res, fmt.Errorf("GIFOptimizer verify %s error: %w", as, err)
+		}
+	}
+
+	return opt, res, nil
+}
+
+// dropDuplicateFrames merges every frame equal to the previous one into it (delays are summed), returns number of
+// dropped frames
+func (o *GIFOptimizer) dropDuplicateFrames(g *gif.GIF) (dropped int) {
+
+	if len(g.Image) < 2 {
+		return 0
+	}
+
+	n := 1
+
+	for i := 1; i < len(g.Image); i++ {
+
+		prev := n - 1
+
+		// NOTE повтор кадра визуально ничего не меняет только если предыдущий кадр остается на месте (не
+		//      стирается disposal-ом), тогда объединенный кадр получает disposal последнего из повторов;
+		//      кроме DisposalPrevious: повтор восстанавливает холст с предыдущим кадром, а объединенный кадр
+		//      восстановил бы холст до него
+		if o.keepsCanvas(g, prev) && !o.restoresPrevious(g, i) && samePalettedPixels(g.Image[prev], g.Image[i]) {
+
+			g.Delay[prev] += g.Delay[i]
+
+			if g.Disposal != nil {
+				g.Disposal[prev] = g.Disposal[i]
+			}
+
+			dropped++
+
+			continue
+		}
+
+		g.Image[n] = g.Image[i]
+		g.Delay[n] = g.Delay[i]
+
+		if g.Disposal != nil {
+			g.Disposal[n] = g.Disposal[i]
+		}
+
+		n++
+	}
+
+	g.Image = g.Image[:n]
+	g.Delay = g.Delay[:n]
+
+	if g.Disposal != nil {
+		g.Disposal = g.Disposal[:n]
+	}
+
+	return dropped
+}
+
+func (o *GIFOptimizer) keepsCanvas(g *gif.GIF, i int) bool {
+
+	if g.Disposal == nil {
+		return true
+	}
+
+	return g.Disposal[i] == 0 || g.Disposal[i] == gif.DisposalNone
+}
+
+func (o *GIFOptimizer) restoresPrevious(g *gif.GIF, i int) bool {
+	return g.Disposal != nil && g.Disposal[i] == gif.DisposalPrevious
+}
+
+// compactFrames returns copy of g with every frame palette compacted (see compactPaletted), nil if no frame changes
+func (o *GIFOptimizer) compactFrames(g *gif.GIF) *gif.GIF {
+
+	var (
+		frames  = make([]*image.Paletted, len(g.Image))
+		changed bool
+	)
+
+	for i, frame := range g.Image {
+
+		if compacted := compactPaletted(frame); compacted != nil {
+			frames[i] = compacted
+			changed = true
+		} else {
+			frames[i] = frame
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+
+	compacted := *g
+	compacted.Image = frames
+
+	return &compacted
+}
+
+// samePalettedPixels reports whether a and b have the same bounds and show the same color in each pixel
+// (palettes may differ), all fully transparent colors are the same
+func samePalettedPixels(a, b *image.Paletted) bool {
+
+	bounds := a.Bounds()
+
+	if bounds != b.Bounds() {
+		return false
+	}
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+
+			ar, ag, ab, aa := a.At(x, y).RGBA()
+			br, bg, bb, ba := b.At(x, y).RGBA()
+
+			if aa == 0 && ba == 0 {
+				continue
+			}
+
+			if ar != br || ag != bg || ab != bb || aa != ba {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// gifFrame is a canvas state shown by an animation: digest of its pixels and for how long it is shown
+type gifFrame struct {
+	digest [sha256.Size]byte
+	delay  int
+}
+
+// gifTimeline composites frames of g onto the logical screen the way a viewer does (disposal included) and returns
+// the shown canvases, consecutive equal ones merged with their delays summed
+//
+// NOTE фон (DisposalBackground) считается прозрачным, как и холст до первого кадра
+func gifTimeline(g *gif.GIF) (timeline []gifFrame) {
+
+	var (
+		canvas = image.NewNRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+		saved  *image.NRGBA
+	)
+
+	for i, frame := range g.Image {
+
+		disposal := byte(0)
+
+		if g.Disposal != nil {
+			disposal = g.Disposal[i]
+		}
+
+		if disposal == gif.DisposalPrevious {
+			saved = image.NewNRGBA(canvas.Rect)
+			copy(saved.Pix, canvas.Pix)
+		}
+
+		// NOTE у пикселя gif альфа либо 0, либо 255, поэтому Over просто пропускает прозрачные
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		f := gifFrame{digest: sha256.Sum256(canvas.Pix)}
+
+		if g.Delay != nil {
+			f.delay = g.Delay[i]
+		}
+
+		if n := len(timeline); n > 0 && timeline[n-1].digest == f.digest {
+			timeline[n-1].delay += f.delay
+		} else {
+			timeline = append(timeline, f)
+		}
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas, saved = saved, nil
+		}
+	}
+
+	return timeline
+}
+
+var (
+	errVerifyLoopCount = errors.New("optimized gif loop count differs from the source")
+)
+
+// verifyGIF decodes optimized gif data and compares its timeline (see gifTimeline) and loop count with the source
+func verifyGIF(timeline []gifFrame, loopCount int, data []byte) (err error) {
+
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+
+	if err != nil {
+		return err
+	}
+
+	if g.LoopCount != loopCount {
+		return errVerifyLoopCount
+	}
+
+	opt := gifTimeline(g)
+
+	if len(opt) != len(timeline) {
+		return fmt.Errorf("optimized gif shows %d distinct frames, the source %d", len(opt), len(timeline))
+	}
+
+	for i := range opt {
+
+		if opt[i].digest != timeline[i].digest {
+			return fmt.Errorf("frame %d differs from the source", i)
+		}
+
+		if opt[i].delay != timeline[i].delay {
+			return fmt.Errorf("frame %d is shown for %d, the source for %d", i, opt[i].delay, timeline[i].delay)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,245 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+)
+
+var testGIFPalette = color.Palette{
+	color.RGBA{},
+	color.RGBA{0xff, 0, 0, 0xff},
+	color.RGBA{0, 0xff, 0, 0xff},
+	color.RGBA{0, 0, 0xff, 0xff},
+}
+
+// testGIFFrame returns frame of r filled with palette index c
+func testGIFFrame(r image.Rectangle, c uint8) *image.Paletted {
+
+	img := image.NewPaletted(r, testGIFPalette)
+
+	for i := range img.Pix {
+		img.Pix[i] = c
+	}
+
+	return img
+}
+
+// testGIF returns 2x1 animation of frames with delays and disposal (nil - unspecified)
+func testGIF(frames []*image.Paletted, delays []int, disposal []byte) *gif.GIF {
+	return &gif.GIF{
+		Image:     frames,
+		Delay:     delays,
+		Disposal:  disposal,
+		LoopCount: 0,
+		Config:    image.Config{ColorModel: testGIFPalette, Width: 2, Height: 1},
+	}
+}
+
+func TestDropDuplicateFrames(t *testing.T) {
+
+	var (
+		full  = image.Rect(0, 0, 2, 1)
+		left  = image.Rect(0, 0, 1, 1)
+		right = image.Rect(1, 0, 2, 1)
+	)
+
+	tests := []struct {
+		name     string
+		g        *gif.GIF
+		dropped  int
+		delays   []int
+		disposal []byte
+	}{
+		{"duplicates merged, delays summed",
+			testGIF([]*image.Paletted{testGIFFrame(full, 1), testGIFFrame(full, 1), testGIFFrame(full, 1), testGIFFrame(full, 2)},
+				[]int{10, 20, 30, 5}, nil),
+			2, []int{60, 5}, nil},
+		{"frame disposed to background is not merged",
+			testGIF([]*image.Paletted{testGIFFrame(full, 1), testGIFFrame(full, 1)},
+				[]int{10, 20}, []byte{gif.DisposalBackground, gif.DisposalNone}),
+			0, []int{10, 20}, []byte{gif.DisposalBackground, gif.DisposalNone}},
+		{"duplicate disposed to background is merged",
+			testGIF([]*image.Paletted{testGIFFrame(full, 1), testGIFFrame(full, 1), testGIFFrame(full, 2)},
+				[]int{10, 20, 5}, []byte{gif.DisposalNone, gif.DisposalBackground, gif.DisposalNone}),
+			1, []int{30, 5}, []byte{gif.DisposalBackground, gif.DisposalNone}},
+		// NOTE объединенный кадр восстановил бы холст до первого повтора (синий слева), а не с ним (красный)
+		{"duplicate restoring previous is not merged",
+			testGIF([]*image.Paletted{testGIFFrame(full, 3), testGIFFrame(left, 1), testGIFFrame(left, 1), testGIFFrame(right, 2)},
+				[]int{10, 10, 10, 10}, []byte{gif.DisposalNone, gif.DisposalNone, gif.DisposalPrevious, gif.DisposalNone}),
+			0, []int{10, 10, 10, 10}, []byte{gif.DisposalNone, gif.DisposalNone, gif.DisposalPrevious, gif.DisposalNone}},
+		{"transparent pixels of any color are equal",
+			testGIF([]*image.Paletted{testGIFFrame(full, 0), testGIFFrame(full, 0)}, []int{10, 10}, nil),
+			1, []int{20}, nil},
+	}
+
+	o := NewGIFOptimizer()
+
+	for _, tt := range tests {
+
+		want := gifTimeline(tt.g)
+
+		if dropped := o.dropDuplicateFrames(tt.g); dropped != tt.dropped {
+			t.Errorf("%s: dropped %d frames, want %d", tt.name, dropped, tt.dropped)
+		}
+
+		if !equalInts(tt.g.Delay, tt.delays) || !bytes.Equal(tt.g.Disposal, tt.disposal) || len(tt.g.Image) != len(tt.delays) {
+			t.Errorf("%s: got %d frames, delays %v, disposal %v, want delays %v, disposal %v", tt.name, len(tt.g.Image),
+				tt.g.Delay, tt.g.Disposal, tt.delays, tt.disposal)
+		}
+
+		if got := gifTimeline(tt.g); !equalTimelines(got, want) {
+			t.Errorf("%s: shown frames changed: %v, want %v", tt.name, got, want)
+		}
+	}
+}
+
+func equalInts(a, b []int) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func equalTimelines(a, b []gifFrame) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestOptimizeGIF(t *testing.T) {
+
+	full := image.Rect(0, 0, 2, 1)
+
+	// NOTE левый пиксель кадров прозрачный, сквозь него видно предыдущий кадр
+	frame := func(c uint8) *image.Paletted {
+		img := testGIFFrame(full, c)
+		img.Pix[0] = 0
+		return img
+	}
+
+	for _, loopCount := range []int{0, 3, -1} {
+
+		g := testGIF([]*image.Paletted{frame(1), frame(1), frame(2), frame(2), frame(3)}, []int{10, 20, 30, 40, 50},
+			[]byte{gif.DisposalNone, gif.DisposalBackground, gif.DisposalNone, gif.DisposalNone, gif.DisposalBackground})
+		g.LoopCount = loopCount
+
+		src := bytes.NewBuffer(nil)
+
+		if err := gif.EncodeAll(src, g); err != nil {
+			t.Fatal(err)
+		}
+
+		opt, res, err := NewGIFOptimizer().optimizeData(src.Bytes(), &OptimizeOptions{Effort: EffortDefault, Verify: true})
+
+		if err != nil {
+			t.Fatalf("loop count %d: %v", loopCount, err)
+		}
+
+		if res.NOOP || opt == nil {
+			t.Fatalf("loop count %d: NOOP (%s), want 1 frame dropped", loopCount, res.Reason)
+		}
+
+		got, err := gif.DecodeAll(bytes.NewReader(opt.Bytes()))
+
+		if err != nil {
+			t.Fatalf("loop count %d: %v", loopCount, err)
+		}
+
+		if got.LoopCount != loopCount {
+			t.Errorf("loop count %d: got loop count %d", loopCount, got.LoopCount)
+		}
+
+		wantDelays := []int{30, 70, 50}
+		wantDisposal := []byte{gif.DisposalBackground, gif.DisposalNone, gif.DisposalBackground}
+
+		if !equalInts(got.Delay, wantDelays) || !bytes.Equal(got.Disposal, wantDisposal) {
+			t.Errorf("loop count %d: got delays %v, disposal %v, want %v, %v", loopCount, got.Delay, got.Disposal,
+				wantDelays, wantDisposal)
+		}
+
+		for i, img := range got.Image {
+			if _, _, _, a := img.At(0, 0).RGBA(); a != 0 {
+				t.Errorf("loop count %d: transparent pixel of frame %d got alpha %d", loopCount, i, a)
+			}
+		}
+	}
+}
+
+func TestVerifyGIF(t *testing.T) {
+
+	full := image.Rect(0, 0, 2, 1)
+
+	encode := func(g *gif.GIF) []byte {
+
+		b := bytes.NewBuffer(nil)
+
+		if err := gif.EncodeAll(b, g); err != nil {
+			t.Fatal(err)
+		}
+
+		return b.Bytes()
+	}
+
+	src := testGIF([]*image.Paletted{testGIFFrame(full, 1), testGIFFrame(full, 2)}, []int{10, 20}, nil)
+	timeline := gifTimeline(src)
+
+	if err := verifyGIF(timeline, src.LoopCount, encode(src)); err != nil {
+		t.Errorf("same gif: %v", err)
+	}
+
+	if err := verifyGIF(timeline, 3, encode(src)); !errors.Is(err, errVerifyLoopCount) {
+		t.Errorf("other loop count: got %v, want %v", err, errVerifyLoopCount)
+	}
+
+	tests := []struct {
+		name string
+		g    *gif.GIF
+	}{
+		{"other pixels", testGIF([]*image.Paletted{testGIFFrame(full, 1), testGIFFrame(full, 3)}, []int{10, 20}, nil)},
+		{"other delays", testGIF([]*image.Paletted{testGIFFrame(full, 1), testGIFFrame(full, 2)}, []int{10, 30}, nil)},
+		{"frame dropped", testGIF([]*image.Paletted{testGIFFrame(full, 1)}, []int{30}, nil)},
+	}
+
+	for _, tt := range tests {
+		if err := verifyGIF(timeline, src.LoopCount, encode(tt.g)); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
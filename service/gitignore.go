@@ -0,0 +1,258 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// gitignore matches paths against .gitignore files (see Settings.Gitignore): the ones of the root dir and every dir
+// under it, and of its parent dirs up to the git work tree (the nearest one with .git) the root dir is in, plus
+// .git/info/exclude of that work tree; core.excludesFile (the global one) is not read
+//
+// NOTE файлы правил читаются лениво при первом обращении к каталогу и дальше не перечитываются
+type gitignore struct {
+	root   string   // work tree, or the root dir itself if it is not in one
+	prefix []string // path elements of the root dir relative to root
+
+	mu    sync.Mutex
+	rules map[string][]gitignoreRule // by slash-separated dir relative to root, "" - root itself
+}
+
+// gitignoreRule is one pattern line of .gitignore relative to the dir of that file
+type gitignoreRule struct {
+	glob    string
+	parts   []string // nil for name-only pattern (without "/" except the trailing one)
+	negate  bool
+	dirOnly bool
+}
+
+func newGitignore(dir string) (g *gitignore, err error) {
+
+	abs, err := filepath.Abs(dir)
+
+	if err != nil {
+		return nil, fmt.Errorf("gitignore root dir %q error: %w", dir, err)
+	}
+
+	g = &gitignore{root: abs, rules: make(map[string][]gitignoreRule)}
+
+	for d := abs; ; {
+
+		if _, err = os.Lstat(filepath.Join(d, ".git")); err == nil {
+
+			rel, err := filepath.Rel(d, abs)
+
+			if err != nil {
+				return nil, fmt.Errorf("gitignore root dir %q error: %w", dir, err)
+			}
+
+			g.root = d
+
+			if rel != "." {
+				g.prefix = strings.Split(filepath.ToSlash(rel), "/")
+			}
+
+			break
+		}
+
+		parent := filepath.Dir(d)
+
+		if parent == d {
+			break
+		}
+
+		d = parent
+	}
+
+	return g, nil
+}
+
+// ignored reports whether file or dir at slash-separated rel (relative to the root dir) is ignored by itself or
+// by any of its parent dirs under the root dir
+func (g *gitignore) ignored(rel string, isDir bool) (_ bool, err error) {
+
+	elems := append(append([]string(nil), g.prefix...), strings.Split(rel, "/")...)
+
+	for i := len(g.prefix) + 1; i <= len(elems); i++ {
+
+		// NOTE git в свой каталог не заглядывает, и нам там делать нечего
+		if elems[i-1] == ".git" {
+			return true, nil
+		}
+
+		ignored, err := g.match(elems[:i], i < len(elems) || isDir)
+
+		if ignored || err != nil {
+			return ignored, err
+		}
+	}
+
+	return false, nil
+}
+
+// match applies rules of every dir above elems in order, so that rules of nearer dir and later lines win
+func (g *gitignore) match(elems []string, isDir bool) (ignored bool, err error) {
+
+	for i := 0; i < len(elems); i++ {
+
+		rules, err := g.dirRules(elems[:i])
+
+		if err != nil {
+			return false, err
+		}
+
+		for j := range rules {
+			if rules[j].match(elems[i:], isDir) {
+				ignored = !rules[j].negate
+			}
+		}
+	}
+
+	return ignored, nil
+}
+
+func (g *gitignore) dirRules(dir []string) (rules []gitignoreRule, err error) {
+
+	key := strings.Join(dir, "/")
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if rules, ok := g.rules[key]; ok {
+		return rules, nil
+	}
+
+	files := []string{filepath.Join(g.root, filepath.FromSlash(key), ".gitignore")}
+
+	// NOTE info/exclude слабее .gitignore корня, поэтому идет первым; .git бывает и файлом (worktree, submodule)
+	if key == "" {
+		if info, err := os.Stat(filepath.Join(g.root, ".git")); err == nil && info.IsDir() {
+			files = append([]string{filepath.Join(g.root, ".git", "info", "exclude")}, files...)
+		}
+	}
+
+	for _, file := range files {
+
+		data, err := os.ReadFile(file)
+
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("read %s error: %w", file, err)
+		}
+
+		rules = append(rules, parseGitignore(data)...)
+	}
+
+	g.rules[key] = rules
+
+	return rules, nil
+}
+
+// parseGitignore parses .gitignore content, invalid patterns are skipped like git does
+func parseGitignore(data []byte) (rules []gitignoreRule) {
+
+	sc := bufio.NewScanner(bytes.NewReader(data))
+
+	for sc.Scan() {
+
+		line := strings.TrimSuffix(sc.Text(), "\r")
+
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		// NOTE хвостовые пробелы отбрасываются, если не экранированы
+		for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+			line = line[:len(line)-1]
+		}
+
+		var r gitignoreRule
+
+		if line[0] == '!' {
+			r.negate, line = true, line[1:]
+		} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+			line = line[1:]
+		}
+
+		if strings.HasSuffix(line, "/") {
+			r.dirOnly, line = true, strings.TrimRight(line, "/")
+		}
+
+		// NOTE path.Match отрицает класс через ^, git принимает и !
+		line = strings.ReplaceAll(line, "[!", "[^")
+
+		if line == "" {
+			continue
+		}
+
+		if strings.Contains(line, "/") {
+			r.parts = strings.Split(strings.TrimPrefix(line, "/"), "/")
+		}
+
+		r.glob = line
+
+		valid := true
+
+		for _, part := range append(r.parts, line) {
+			if _, err := path.Match(part, ""); err != nil {
+				valid = false
+			}
+		}
+
+		if valid {
+			rules = append(rules, r)
+		}
+	}
+
+	return rules
+}
+
+// match reports whether elems (path relative to dir of the rule) matches the rule
+func (r *gitignoreRule) match(elems []string, isDir bool) bool {
+
+	if r.dirOnly && !isDir {
+		return false
+	}
+
+	if r.parts == nil {
+		ok, _ := path.Match(r.glob, elems[len(elems)-1])
+		return ok
+	}
+
+	// NOTE "dir/**" совпадает со всем внутри dir, но не с самим dir
+	if n := len(r.parts); r.parts[n-1] == "**" {
+
+		for i := 0; i < len(elems); i++ {
+			if matchParts(r.parts[:n-1], elems[:i]) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return matchParts(r.parts, elems)
+}
@@ -0,0 +1,143 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGitignore(t *testing.T) {
+
+	work := t.TempDir()
+
+	// NOTE корень прогона внутри work tree, правила work tree и его info/exclude действуют и на него
+	files := map[string]string{
+		".git/info/exclude": "*.tmp\n",
+		".gitignore":        "# comment\n*.bak\n!keep.bak\n/top.png\nbuild/\n\\#hash.png\ntrailing.png   \n[!ab]x.png\n",
+		"assets/.gitignore": "/only-here.png\ndocs/**\na/**/z.png\n**/deep/*.json\n!x.bak\n",
+		// NOTE и с CRLF
+		"assets/sub/.gitignore": "*.png\r\n!keep.png\r\n",
+	}
+
+	for name, data := range files {
+
+		path := filepath.Join(work, filepath.FromSlash(name))
+
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(path, []byte(data), 0o666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	g, err := newGitignore(filepath.Join(work, "assets"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		rel   string
+		isDir bool
+		want  bool
+	}{
+		{"a.png", false, false},
+		{"a.bak", false, true},
+		{"p/a.bak", false, true},
+		{"keep.bak", false, false},
+		{"a.tmp", false, true},
+		{"#hash.png", false, true},
+		{"trailing.png", false, true},
+		{"cx.png", false, true},
+		{"ax.png", false, false},
+		{".git", true, true},
+		{"p/.git/config", false, true},
+
+		// anchored
+		{"top.png", false, false},
+		{"only-here.png", false, true},
+		{"p/only-here.png", false, false},
+
+		// dir-only
+		{"build", true, true},
+		{"build", false, false},
+		{"p/build/a.png", false, true},
+		{"p/build/keep.bak", false, true}, // NOTE в исключенный каталог отрицание не возвращает
+
+		// **
+		{"docs", true, false},
+		{"docs/a.png", false, true},
+		{"docs/b/c.png", false, true},
+		{"a/z.png", false, true},
+		{"a/b/c/z.png", false, true},
+		{"b/a/z.png", false, false},
+		{"deep/x.json", false, true},
+		{"p/q/deep/x.json", false, true},
+		{"deep/x.png", false, false},
+
+		// nested
+		{"x.bak", false, false},
+		{"p/x.bak", false, false},
+		{"sub/a.png", false, true},
+		{"sub/p/a.png", false, true},
+		{"sub/keep.png", false, false},
+		{"sub/a.json", false, false},
+	}
+
+	for _, tt := range tests {
+
+		got, err := g.ignored(tt.rel, tt.isDir)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got != tt.want {
+			t.Errorf("%s (dir %t) ignored %t, want %t", tt.rel, tt.isDir, got, tt.want)
+		}
+	}
+}
+
+func TestGitignoreNoWorkTree(t *testing.T) {
+
+	dir := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(dir, ".gitignore"), []byte("/a.png\n"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := newGitignore(dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// NOTE без .git выше корнем правил становится сам корень прогона
+	if g.root != dir {
+		t.Skipf("%s is inside a git work tree %s", dir, g.root)
+	}
+
+	for rel, want := range map[string]bool{"a.png": true, "p/a.png": false} {
+		if got, err := g.ignored(rel, false); err != nil || got != want {
+			t.Errorf("%s ignored %t (%v), want %t", rel, got, err, want)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io/fs"
+	"os"
+)
+
+const (
+	extJPG  = "jpg"
+	extJPEG = "jpeg"
+
+	// JPEGQualityDefault is the highest quality of image/jpeg encoder
+	JPEGQualityDefault = 100
+)
+
+// JPEGOptimizer re-encodes jpeg with image/jpeg, which is lossy (and writes only 4:2:0 chroma), unlike every other
+// built-in optimizer; the default registry has it only with Settings.LossyJPEG
+type JPEGOptimizer struct{}
+
+func NewJPEGOptimizer() *JPEGOptimizer {
+	return &JPEGOptimizer{}
+}
+
+// Optimize re-encodes jpeg at opts.JPEGQuality and replaces the original only if the result is smaller
+//
+// NOTE в отличие от png любое перекодирование jpeg с потерями, поэтому исходник заменяется только тогда, когда
+// потери минимальны: качество по умолчанию 100 и та же субдискретизация цветности, что у оригинала
+func (o *JPEGOptimizer) Optimize(path string, opts *OptimizeOptions) (res OptimizeResult, err error) {
+
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return res, fmt.Errorf("JPEGOptimizer optimize error: %w", err)
+	}
+
+	opt, res, err := o.optimizeData(data, opts)
+
+	if err != nil || res.NOOP || opts.DryRun {
+		return res, err
+	}
+
+	// NOTE сперва сохраняем временный файл, потом его атомарно mv
+	if err = saveAsset(path, ".jpgtmp", opt, opts); err != nil {
+		return res, err
+	}
+
+	return res, nil
+}
+
+// OptimizeFS re-encodes jpeg path of fsys, see FSOptimizer
+func (o *JPEGOptimizer) OptimizeFS(fsys fs.FS, path string, opts *OptimizeOptions) (opt *bytes.Buffer, res OptimizeResult,
+	err error) {
+
+	data, err := fs.ReadFile(fsys, path)
+
+	if err != nil {
+		return nil, res, fmt.Errorf("JPEGOptimizer optimize error: %w", err)
+	}
+
+	return o.optimizeData(data, opts)
+}
+
+// optimizeData re-encodes jpeg data at opts.JPEGQuality, opt is nil for NOOP
+func (o *JPEGOptimizer) optimizeData(data []byte, opts *OptimizeOptions) (opt *bytes.Buffer, res OptimizeResult, err error) {
+
+	res.Size = int64(len(data))
+
+	info := readJPEGInfo(data)
+
+	// NOTE без Adobe APP14 неизвестно, CMYK это или YCCK и инвертированы ли каналы (Adobe пишет 255 - ink),
+	//      а угадывать - значит рисковать сдвигом цветов, такие файлы не трогаем
+	if info.components == 4 && !info.adobe {
+		res.NOOP, res.Reason = true, "ambiguous color transform: 4-component JPEG without Adobe APP14 marker"
+		return nil, res, nil
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(data))
+
+	if err != nil {
+		return nil, res, fmt.Errorf("JPEGOptimizer optimize error: %w", err)
+	}
+
+	var note string
+
+	// NOTE на текущий момент (go 1.20) jpeg.Encode пишет цветные изображения только как YCbCr 4:2:0, поэтому
+	//      4:4:4 / 4:2:2 / ... оригинал потеряет разрешение цветности, такие файлы не трогаем
+	// TODO ICC профиль (APP2) и EXIF при перекодировании тоже теряются
+	switch v := img.(type) {
+	case *image.Gray:
+	case *image.YCbCr:
+		if v.SubsampleRatio != image.YCbCrSubsampleRatio420 {
+			res.NOOP, res.Reason = true, fmt.Sprintf("chroma subsampling %s would be lost", v.SubsampleRatio)
+			return nil, res, nil
+		}
+	case *image.CMYK:
+		// NOTE CMYK jpeg.Encode не пишет, а image/jpeg уже учел Adobe APP14 (инверсию и YCCK),
+		//      так что остается наивный перевод в RGB без ICC профиля печати
+		img, note = cmykToRGB(v), ", converted "+info.colorModel()+" to RGB"
+	default:
+		res.NOOP, res.Reason = true, fmt.Sprintf("unsupported %T", v)
+		return nil, res, nil
+	}
+
+	quality := opts.JPEGQuality
+
+	if quality == 0 {
+		quality = JPEGQualityDefault
+	}
+
+	b := bytes.NewBuffer(make([]byte, 0, len(data)))
+
+	if err = jpeg.Encode(b, img, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, res, fmt.Errorf("JPEGOptimizer encode error: %w", err)
+	}
+
+	res.OptimizedSize = int64(b.Len())
+	res.Variant = fmt.Sprintf("q%d%s", quality, note)
+
+	if opts.keepOriginal(&res) {
+		return nil, res, nil
+	}
+
+	return b, res, nil
+}
+
+// cmykToRGB converts img with color.CMYKToRGB
+func cmykToRGB(img *image.CMYK) *image.RGBA {
+
+	bounds := img.Bounds()
+
+	rgba := image.NewRGBA(bounds)
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+
+		src := img.Pix[img.PixOffset(bounds.Min.X, y):][:4*bounds.Dx()]
+		dst := rgba.Pix[rgba.PixOffset(bounds.Min.X, y):][:4*bounds.Dx()]
+
+		for i := 0; i < len(src); i += 4 {
+			dst[i], dst[i+1], dst[i+2] = color.CMYKToRGB(src[i], src[i+1], src[i+2], src[i+3])
+			dst[i+3] = 0xff
+		}
+	}
+
+	return rgba
+}
+
+// jpegInfo is what image/jpeg does not tell about the color model of jpeg, see readJPEGInfo
+type jpegInfo struct {
+	components int   // of the frame, 0 if there is no SOF before SOS
+	adobe      bool  // APP14 Adobe marker is present
+	transform  uint8 // of APP14 Adobe: 0 - CMYK (or RGB), 1 - YCbCr, 2 - YCCK
+}
+
+func (i *jpegInfo) colorModel() string {
+
+	if i.transform == 2 {
+		return "YCCK"
+	}
+
+	return "CMYK"
+}
+
+// readJPEGInfo scans markers of data up to the first SOS, malformed data gives zero (or partial) info, since
+// jpeg.Decode reports it anyway
+//
+// SEE https://www.w3.org/Graphics/JPEG/itu-t81.pdf B.1.1.3 Marker assignments, Adobe TN 5116 (APP14)
+func readJPEGInfo(data []byte) (info jpegInfo) {
+
+	if len(data) < 2 || data[0] != 0xff || data[1] != 0xd8 {
+		return info
+	}
+
+	for p := 2; p+4 <= len(data); {
+
+		if data[p] != 0xff {
+			return info
+		}
+
+		marker := data[p+1]
+
+		// NOTE fill bytes 0xff перед маркером допустимы
+		if marker == 0xff {
+			p++
+			continue
+		}
+
+		n := int(binary.BigEndian.Uint16(data[p+2:]))
+
+		if n < 2 || p+2+n > len(data) {
+			return info
+		}
+
+		seg := data[p+4 : p+2+n]
+
+		switch {
+		// SOS: дальше энтропийные данные
+		case marker == 0xda:
+			return info
+		// APP14: "Adobe", version (2), flags0 (2), flags1 (2), transform
+		case marker == 0xee && len(seg) >= 12 && string(seg[:5]) == "Adobe":
+			info.adobe, info.transform = true, seg[11]
+		// SOFn, кроме DHT (c4), JPG (c8) и DAC (cc): precision, height (2), width (2), components
+		case marker >= 0xc0 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc && len(seg) >= 6:
+			info.components = int(seg[5])
+		}
+
+		p += 2 + n
+	}
+
+	return info
+}
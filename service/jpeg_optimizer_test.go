@@ -0,0 +1,232 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"strings"
+	"testing"
+)
+
+// testJPEGWriter writes huffman coded bits MSB first with 0xff byte stuffing
+type testJPEGWriter struct {
+	out   []byte
+	bits  uint32
+	nbits uint
+}
+
+func (w *testJPEGWriter) write(code uint32, n uint) {
+
+	for i := int(n) - 1; i >= 0; i-- {
+
+		w.bits = w.bits<<1 | code>>uint(i)&1
+
+		if w.nbits++; w.nbits == 8 {
+
+			if w.out = append(w.out, byte(w.bits)); byte(w.bits) == 0xff {
+				w.out = append(w.out, 0)
+			}
+
+			w.bits, w.nbits = 0, 0
+		}
+	}
+}
+
+// flush pads the last byte with 1 bits
+func (w *testJPEGWriter) flush() {
+	for w.nbits != 0 {
+		w.write(1, 1)
+	}
+}
+
+func jpegSegment(out []byte, marker byte, data []byte) []byte {
+
+	out = append(out, 0xff, marker, 0, 0)
+	binary.BigEndian.PutUint16(out[len(out)-2:], uint16(2+len(data)))
+
+	return append(out, data...)
+}
+
+// encodeTestJPEG writes baseline jpeg of 8x8 blocks (one row of them, 1x1 sampling of every component) each of
+// flat stored component values, with quantization of 1 and DC only; transform < 0 - no Adobe APP14 marker;
+// padding is a COM segment of that many bytes, which re-encode drops
+func encodeTestJPEG(blocks [][]uint8, transform int, padding int) []byte {
+
+	comps := len(blocks[0])
+
+	// standard luminance DC table (ITU T.81 K.3), AC table of the only EOB symbol
+	dcBits := []byte{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0}
+
+	var (
+		dcCodes [12]uint32
+		dcLens  [12]uint
+	)
+
+	for code, sym, n := uint32(0), 0, 0; n < 16; n++ {
+		for i := 0; i < int(dcBits[n]); i++ {
+			dcCodes[sym], dcLens[sym] = code, uint(n+1)
+			code++
+			sym++
+		}
+		code <<= 1
+	}
+
+	out := []byte{0xff, 0xd8}
+
+	if transform >= 0 {
+		out = jpegSegment(out, 0xee, []byte{'A', 'd', 'o', 'b', 'e', 0, 100, 0, 0, 0, 0, byte(transform)})
+	}
+
+	if padding > 0 {
+		out = jpegSegment(out, 0xfe, bytes.Repeat([]byte{'x'}, padding))
+	}
+
+	out = jpegSegment(out, 0xdb, append([]byte{0}, bytes.Repeat([]byte{1}, 64)...))
+
+	sof := []byte{8, 0, 8, 0, 0, byte(comps)}
+	binary.BigEndian.PutUint16(sof[3:], uint16(8*len(blocks)))
+
+	sos := []byte{byte(comps)}
+
+	for c := 0; c < comps; c++ {
+		sof = append(sof, byte(c+1), 0x11, 0)
+		sos = append(sos, byte(c+1), 0x00)
+	}
+
+	out = jpegSegment(out, 0xc0, sof)
+	out = jpegSegment(out, 0xc4, append(append([]byte{0x00}, dcBits...), 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11))
+	out = jpegSegment(out, 0xc4, append([]byte{0x10, 1}, append(make([]byte, 15), 0x00)...))
+	out = jpegSegment(out, 0xda, append(sos, 0, 63, 0))
+
+	w := &testJPEGWriter{}
+	pred := make([]int, comps)
+
+	for _, block := range blocks {
+		for c, v := range block {
+
+			// NOTE у блока только DC: значение каждого пикселя = DC / 8 + 128
+			dc := (int(v) - 128) * 8
+			diff := dc - pred[c]
+			pred[c] = dc
+
+			cat, abs := 0, diff
+
+			if abs < 0 {
+				abs = -abs
+			}
+
+			for abs>>cat != 0 {
+				cat++
+			}
+
+			w.write(dcCodes[cat], dcLens[cat])
+
+			if diff < 0 {
+				diff += 1<<cat - 1
+			}
+
+			w.write(uint32(diff), uint(cat))
+			w.write(0, 1) // EOB
+		}
+	}
+
+	w.flush()
+
+	return append(append(out, w.out...), 0xff, 0xd9)
+}
+
+func TestOptimizeCMYKJPEG(t *testing.T) {
+
+	// stored adobe CMYK is inverted ink: red (c, m, y, k = 0, 255, 255, 0) and mid gray (k = 128);
+	// YCCK stores CMY ink as YCbCr and inverted K
+	red, gray := color.RGBA{255, 0, 0, 255}, color.RGBA{127, 127, 127, 255}
+	rY, rCb, rCr := color.RGBToYCbCr(0, 255, 255)
+	gY, gCb, gCr := color.RGBToYCbCr(0, 0, 0)
+
+	tests := []struct {
+		name      string
+		blocks    [][]uint8
+		transform int
+		variant   string
+	}{
+		{"cmyk", [][]uint8{{255, 0, 0, 255}, {255, 255, 255, 127}}, 0, "q90, converted CMYK to RGB"},
+		{"ycck", [][]uint8{{rY, rCb, rCr, 255}, {gY, gCb, gCr, 127}}, 2, "q90, converted YCCK to RGB"},
+	}
+
+	for _, tt := range tests {
+
+		data := encodeTestJPEG(tt.blocks, tt.transform, 4096)
+
+		if img, err := jpeg.Decode(bytes.NewReader(data)); err != nil {
+			t.Fatalf("%s: decode fixture: %v", tt.name, err)
+		} else if _, ok := img.(*image.CMYK); !ok {
+			t.Fatalf("%s: fixture decoded as %T, want *image.CMYK", tt.name, img)
+		}
+
+		opt, res, err := NewJPEGOptimizer().optimizeData(data, &OptimizeOptions{JPEGQuality: 90})
+
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		if res.NOOP || opt == nil {
+			t.Fatalf("%s: NOOP: %s", tt.name, res.Reason)
+		}
+
+		if res.Variant != tt.variant {
+			t.Errorf("%s: variant %q, want %q", tt.name, res.Variant, tt.variant)
+		}
+
+		img, err := jpeg.Decode(opt)
+
+		if err != nil {
+			t.Fatalf("%s: decode result: %v", tt.name, err)
+		}
+
+		if _, ok := img.(*image.YCbCr); !ok {
+			t.Errorf("%s: result decoded as %T, want *image.YCbCr", tt.name, img)
+		}
+
+		for _, p := range []struct {
+			x    int
+			want color.RGBA
+		}{{3, red}, {12, gray}} {
+
+			r, g, b, _ := img.At(p.x, 4).RGBA()
+			got := [3]int{int(r >> 8), int(g >> 8), int(b >> 8)}
+
+			for i, w := range [3]int{int(p.want.R), int(p.want.G), int(p.want.B)} {
+				if d := got[i] - w; d < -6 || d > 6 {
+					t.Errorf("%s: pixel (%d, 4) = %v, want %v", tt.name, p.x, got, p.want)
+					break
+				}
+			}
+		}
+	}
+
+	data := encodeTestJPEG([][]uint8{{255, 0, 0, 255}}, -1, 4096)
+
+	if opt, res, err := NewJPEGOptimizer().optimizeData(data, &OptimizeOptions{JPEGQuality: 90}); err != nil {
+		t.Fatal(err)
+	} else if !res.NOOP || opt != nil || !strings.Contains(res.Reason, "ambiguous") {
+		t.Errorf("no APP14: NOOP %v, reason %q, want ambiguous NOOP", res.NOOP, res.Reason)
+	}
+}
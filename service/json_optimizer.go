@@ -0,0 +1,344 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+// StarBound JSON assets are parsed by its own lenient parser, which allows // and /* */ comments and trailing commas,
+// so they are minified by own scanner that copies every token as is (key order, duplicate keys, number and
+// string spelling are kept) and drops only whitespace, comments and trailing commas
+
+const (
+	extConfig = "config"
+	extObject = "object"
+	extItem   = "item"
+	extFrames = "frames"
+
+	jsonMaxDepth = 512
+)
+
+var (
+	errJSONSyntax = errors.New("JSON syntax error")
+)
+
+type JSONOptimizer struct{}
+
+func NewJSONOptimizer() *JSONOptimizer {
+	return &JSONOptimizer{}
+}
+
+// Optimize minifies StarBound JSON asset (comments and trailing commas allowed) in-place (or to opts.Output)
+func (o *JSONOptimizer) Optimize(path string, opts *OptimizeOptions) (res OptimizeResult, err error) {
+
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return res, fmt.Errorf("JSONOptimizer optimize error: %w", err)
+	}
+
+	opt, res, err := o.optimizeData(data, opts)
+
+	if err != nil || res.NOOP || opts.DryRun {
+		return res, err
+	}
+
+	if err = saveAsset(path, ".jsontmp", opt, opts); err != nil {
+		return res, err
+	}
+
+	return res, nil
+}
+
+// OptimizeFS minifies JSON asset path of fsys, see FSOptimizer
+func (o *JSONOptimizer) OptimizeFS(fsys fs.FS, path string, opts *OptimizeOptions) (opt *bytes.Buffer, res OptimizeResult,
+	err error) {
+
+	data, err := fs.ReadFile(fsys, path)
+
+	if err != nil {
+		return nil, res, fmt.Errorf("JSONOptimizer optimize error: %w", err)
+	}
+
+	return o.optimizeData(data, opts)
+}
+
+// OptimizeBytes minifies JSON data in memory, returns data itself (and res.NOOP) if it is already minimal,
+// see PNGOptimizer.OptimizeBytes for opts
+func (o *JSONOptimizer) OptimizeBytes(data []byte, opts *OptimizeOptions) (_ []byte, res OptimizeResult, err error) {
+
+	if opts == nil {
+		opts = &optimizeBytesOptions
+	}
+
+	opt, res, err := o.optimizeData(data, opts)
+
+	if err != nil {
+		return nil, res, err
+	}
+
+	if res.NOOP {
+		return data, res, nil
+	}
+
+	return opt.Bytes(), res, nil
+}
+
+// optimizeData minifies data, opt is nil for NOOP
+func (o *JSONOptimizer) optimizeData(data []byte, opts *OptimizeOptions) (opt *bytes.Buffer, res OptimizeResult, err error) {
+
+	res.Size = int64(len(data))
+
+	// NOTE пустые заглушки встречаются, игра читает их как null
+	if len(bytes.TrimSpace(data)) == 0 {
+		res.NOOP, res.Reason = true, "empty file"
+		return nil, res, nil
+	}
+
+	m := jsonMinifier{src: data, dst: bytes.NewBuffer(make([]byte, 0, len(data)))}
+
+	if err = m.minify(); err != nil {
+		return nil, res, fmt.Errorf("JSONOptimizer optimize error: %w", err)
+	}
+
+	opt = m.dst
+
+	res.OptimizedSize = int64(opt.Len())
+	res.Variant = "minified"
+
+	if m.comments > 0 {
+		res.Variant = fmt.Sprintf("minified, %d comments removed", m.comments)
+	}
+
+	if opts.keepOriginal(&res) {
+		return nil, res, nil
+	}
+
+	// NOTE без комментариев и висячих запятых результат должен быть строгим JSON, но парсер игры принимает и то,
+	//      чего не принимает json.Valid (например, табуляцию или управляющие символы прямо в строке), такой файл
+	//      не ошибка, а просто остается как есть
+	if opts.Verify && !json.Valid(opt.Bytes()) {
+		res.NOOP, res.Reason = true, "minified data is not strict JSON (e.g. a raw control character in a string)"
+		return nil, res, nil
+	}
+
+	return opt, res, nil
+}
+
+type jsonMinifier struct {
+	src      []byte
+	pos      int
+	dst      *bytes.Buffer
+	comments int
+}
+
+func (m *jsonMinifier) minify() (err error) {
+
+	// NOTE UTF-8 BOM игра пропускает так же, как пробелы
+	if bytes.HasPrefix(m.src, []byte("\xef\xbb\xbf")) {
+		m.pos = 3
+	}
+
+	if err = m.value(0); err != nil {
+		return err
+	}
+
+	if err = m.skipSpace(); err != nil {
+		return err
+	}
+
+	if m.pos != len(m.src) {
+		return m.syntaxError("data after the top level value")
+	}
+
+	return nil
+}
+
+func (m *jsonMinifier) syntaxError(msg string) error {
+	return fmt.Errorf("%w at offset %d: %s", errJSONSyntax, m.pos, msg)
+}
+
+// skipSpace skips whitespace and comments
+func (m *jsonMinifier) skipSpace() error {
+
+	for m.pos < len(m.src) {
+
+		switch c := m.src[m.pos]; {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			m.pos++
+		case c == '/' && m.pos+1 < len(m.src) && m.src[m.pos+1] == '/':
+
+			if i := bytes.IndexByte(m.src[m.pos:], '\n'); i < 0 {
+				m.pos = len(m.src)
+			} else {
+				m.pos += i + 1
+			}
+
+			m.comments++
+		case c == '/' && m.pos+1 < len(m.src) && m.src[m.pos+1] == '*':
+
+			i := bytes.Index(m.src[m.pos+2:], []byte("*/"))
+
+			if i < 0 {
+				return m.syntaxError("unterminated comment")
+			}
+
+			m.pos += 2 + i + 2
+			m.comments++
+		default:
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func (m *jsonMinifier) value(depth int) (err error) {
+
+	if depth > jsonMaxDepth {
+		return m.syntaxError("nested too deep")
+	}
+
+	if err = m.skipSpace(); err != nil {
+		return err
+	}
+
+	if m.pos == len(m.src) {
+		return m.syntaxError("unexpected end of data")
+	}
+
+	switch c := m.src[m.pos]; c {
+	case '{':
+		return m.container(depth, '}', true)
+	case '[':
+		return m.container(depth, ']', false)
+	case '"':
+		return m.str()
+	}
+
+	// литералы и числа копируются как есть, их вид проверит json.Valid результата
+	start := m.pos
+
+	for m.pos < len(m.src) && isJSONLiteralByte(m.src[m.pos]) {
+		m.pos++
+	}
+
+	if m.pos == start {
+		return m.syntaxError(fmt.Sprintf("unexpected %q", m.src[m.pos]))
+	}
+
+	m.dst.Write(m.src[start:m.pos])
+
+	return nil
+}
+
+func isJSONLiteralByte(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '+' || c == '.'
+}
+
+// container copies object (with "key": value members) or array up to the closing end, a trailing comma is dropped
+func (m *jsonMinifier) container(depth int, end byte, object bool) (err error) {
+
+	m.dst.WriteByte(m.src[m.pos])
+	m.pos++
+
+	for first := true; ; first = false {
+
+		if err = m.skipSpace(); err != nil {
+			return err
+		}
+
+		if m.pos < len(m.src) && m.src[m.pos] == end {
+			m.dst.WriteByte(end)
+			m.pos++
+			return nil
+		}
+
+		if !first {
+			m.dst.WriteByte(',')
+		}
+
+		if object {
+
+			if m.pos == len(m.src) || m.src[m.pos] != '"' {
+				return m.syntaxError("object key expected")
+			}
+
+			if err = m.str(); err != nil {
+				return err
+			}
+
+			if err = m.skipSpace(); err != nil {
+				return err
+			}
+
+			if m.pos == len(m.src) || m.src[m.pos] != ':' {
+				return m.syntaxError("':' expected")
+			}
+
+			m.dst.WriteByte(':')
+			m.pos++
+		}
+
+		if err = m.value(depth + 1); err != nil {
+			return err
+		}
+
+		if err = m.skipSpace(); err != nil {
+			return err
+		}
+
+		if m.pos == len(m.src) {
+			return m.syntaxError("unexpected end of data")
+		}
+
+		switch m.src[m.pos] {
+		case ',':
+			m.pos++
+		case end:
+		default:
+			return m.syntaxError(fmt.Sprintf("',' or %q expected", end))
+		}
+	}
+}
+
+// str copies string literal as is, escapes included
+func (m *jsonMinifier) str() error {
+
+	start := m.pos
+
+	for m.pos++; m.pos < len(m.src); m.pos++ {
+		switch m.src[m.pos] {
+		case '\\':
+			m.pos++
+		case '"':
+			m.pos++
+			m.dst.Write(m.src[start:m.pos])
+			return nil
+		}
+	}
+
+	m.pos = start
+
+	return m.syntaxError("unterminated string")
+}
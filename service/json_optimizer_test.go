@@ -0,0 +1,132 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOptimizeJSON(t *testing.T) {
+
+	tests := []struct {
+		name string
+		data string
+		want string // "" - NOOP
+	}{
+		{"whitespace", "{\n\t\"a\": 1,\r\n\t\"b\": [1, 2, 3]\n}\n", `{"a":1,"b":[1,2,3]}`},
+		{"line comment", "{\"a\": 1, // one\n\"b\": 2 // two\n}", `{"a":1,"b":2}`},
+		{"line comment at the end", "[1, 2] // no newline", `[1,2]`},
+		{"block comment", "{/* a */\"a\": /* one\n */ 1}", `{"a":1}`},
+		{"comment markers in strings", `{"url": "http://x/*y*/", "c": "/* not a comment */ // nor this"}`,
+			`{"url":"http://x/*y*/","c":"/* not a comment */ // nor this"}`},
+		{"escaped quotes", `{"a": "say \"hi\" // here", "b\\": "\\"}`, `{"a":"say \"hi\" // here","b\\":"\\"}`},
+		{"trailing commas", "{\"a\": [1, 2, ], \"b\": {\"c\": 3, },\n}", `{"a":[1,2],"b":{"c":3}}`},
+		{"trailing comma and comment", "[1, /* two */ 2, // end\n]", `[1,2]`},
+		{"bom", "\xef\xbb\xbf{ \"a\": 1 }", `{"a":1}`},
+		{"key order and duplicates", `{ "z": 1, "a": 2, "z": 3 }`, `{"z":1,"a":2,"z":3}`},
+		{"number and string spelling", `[ 1.50, 1e+2, -0, "é", "é" ]`, `[1.50,1e+2,-0,"é","é"]`},
+		{"minified", `{"a":1,"b":[1,2]}`, ""},
+		{"empty", " \n", ""},
+		// NOTE парсер игры это принимает, json.Valid - нет
+		{"raw tab in string", "{ \"a\": \"x\ty\" }", ""},
+	}
+
+	o := NewJSONOptimizer()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			got, res, err := o.OptimizeBytes([]byte(tt.data), &OptimizeOptions{Verify: true})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.want == "" {
+
+				if !res.NOOP || string(got) != tt.data {
+					t.Errorf("NOOP %t (%s), %q, want NOOP with the data as is", res.NOOP, res.Reason, got)
+				}
+
+				return
+			}
+
+			if res.NOOP || string(got) != tt.want {
+				t.Fatalf("NOOP %t (%s), %q, want %q", res.NOOP, res.Reason, got, tt.want)
+			}
+
+			if res.OptimizedSize != int64(len(tt.want)) || res.Size != int64(len(tt.data)) {
+				t.Errorf("sizes %d -> %d, want %d -> %d", res.Size, res.OptimizedSize, len(tt.data), len(tt.want))
+			}
+		})
+	}
+}
+
+func TestOptimizeJSONMalformed(t *testing.T) {
+
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"unterminated string", `{"a": "b}`},
+		{"unterminated comment", `{"a": 1 /* }`},
+		{"missing colon", `{"a" 1}`},
+		{"missing comma", `{"a": 1 "b": 2}`},
+		{"double comma", `[1,, 2]`},
+		{"leading comma", `[, 1]`},
+		{"lone comma", `[,]`},
+		{"unquoted key", `{a: 1}`},
+		{"unclosed", `{"a": [1, 2}`},
+		{"data after value", `{"a": 1} {}`},
+		{"no value", `// only a comment`},
+		{"single quotes", `['a']`},
+	}
+
+	o := NewJSONOptimizer()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			data := []byte(tt.data)
+
+			opt, res, err := o.optimizeData(data, &OptimizeOptions{Verify: true})
+
+			if !errors.Is(err, errJSONSyntax) || opt != nil || res.NOOP {
+				t.Fatalf("error %v, output %v, NOOP %t, want %v and no output", err, opt != nil, res.NOOP, errJSONSyntax)
+			}
+
+			// NOTE и на диске файл остается как был
+			path := filepath.Join(t.TempDir(), "a.config")
+
+			if err = os.WriteFile(path, data, 0o666); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err = o.Optimize(path, &OptimizeOptions{Verify: true}); !errors.Is(err, errJSONSyntax) {
+				t.Errorf("Optimize error %v, want %v", err, errJSONSyntax)
+			}
+
+			if got, err := os.ReadFile(path); err != nil || !bytes.Equal(got, []byte(tt.data)) {
+				t.Errorf("file is changed: %q, %v", got, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// log levels of Settings.LogLevel
+const (
+	LogDebug = "debug"
+	LogInfo  = "info"
+	LogWarn  = "warn"
+	LogError = "error"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota // skipped files besides symlinks (small, cached, excluded)
+	levelInfo                  // per asset reports and run banners
+	levelWarn
+	levelError
+)
+
+var (
+	logLevelNames = [...]string{LogDebug, LogInfo, LogWarn, LogError}
+	// NOTE префиксы текстового лога, в котором уровень виден только у предупреждений и ошибок
+	logLevelPrefixes = [...]string{"", "", "WARNING: ", "ERROR: "}
+)
+
+// parseLogLevel parses Settings.LogLevel, empty is info
+func parseLogLevel(name string) (level logLevel, err error) {
+
+	if name == "" {
+		return levelInfo, nil
+	}
+
+	for i, n := range logLevelNames {
+		if strings.EqualFold(name, n) {
+			return logLevel(i), nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown log level %q, must be one of %s", name, strings.Join(logLevelNames[:], ", "))
+}
+
+// logRecord is one line of JSON log (see Settings.LogJSON)
+type logRecord struct {
+	Time  time.Time `json:"time"`
+	Level string    `json:"level"`
+	Msg   string    `json:"msg"`
+
+	*logAsset // nil for messages not about single asset
+
+	Summary *reportSummary `json:"summary,omitempty"` // of PrintStat
+}
+
+// logAsset are the fields of the record of asset
+type logAsset struct {
+	Path    string `json:"path"`
+	Ext     string `json:"ext"`
+	Orig    int64  `json:"orig,omitempty"`
+	Opt     int64  `json:"opt,omitempty"`
+	Saved   uint   `json:"saved"`
+	Variant string `json:"variant,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// textLog returns w for text messages of level, io.Discard if level is filtered out or the log is JSON
+func (ao *AssetsOptimizer) textLog(w io.Writer, level logLevel) io.Writer {
+
+	if ao.logJSON || level < ao.logLevel {
+		return io.Discard
+	}
+
+	return w
+}
+
+// logf writes message of level to w, see logAssetf
+func (ao *AssetsOptimizer) logf(w io.Writer, level logLevel, format string, args ...any) {
+	ao.logAssetf(w, level, nil, format, args...)
+}
+
+// logAssetf writes message of level to w: in the text log as is (warnings and errors with their prefix), in
+// the JSON log as record with fields a of the asset the message is about (nil - none)
+func (ao *AssetsOptimizer) logAssetf(w io.Writer, level logLevel, a *logAsset, format string, args ...any) {
+
+	if level < ao.logLevel {
+		return
+	}
+
+	if !ao.logJSON {
+		fmt.Fprintf(w, logLevelPrefixes[level]+format, args...)
+		return
+	}
+
+	writeLogRecord(w, &logRecord{
+		Level:    logLevelNames[level],
+		Msg:      strings.TrimSuffix(fmt.Sprintf(format, args...), "\n"),
+		logAsset: a,
+	})
+}
+
+// logResult writes JSON record of the result of asset, the text log has it from printResult already
+func (ao *AssetsOptimizer) logResult(w io.Writer, rel, ext string, res *OptimizeResult) {
+
+	if !ao.logJSON || levelInfo < ao.logLevel {
+		return
+	}
+
+	r := logRecord{
+		Level: LogInfo,
+		Msg:   eventSaved,
+		logAsset: &logAsset{
+			Path:    rel,
+			Ext:     ext,
+			Orig:    res.Size,
+			Opt:     res.finalSize(),
+			Saved:   res.Saved(),
+			Variant: res.Variant,
+			Reason:  res.Reason,
+		},
+	}
+
+	if res.NOOP {
+		r.Msg = eventNOOP
+	}
+
+	writeLogRecord(w, &r)
+}
+
+// statf writes line of PrintStat, which is never filtered out
+func (ao *AssetsOptimizer) statf(format string, args ...any) {
+
+	if !ao.logJSON {
+		fmt.Fprintf(ao.log, format, args...)
+		return
+	}
+
+	writeLogRecord(ao.log, &logRecord{Level: LogInfo, Msg: strings.TrimSuffix(fmt.Sprintf(format, args...), "\n")})
+}
+
+// logSkip writes debug message about file path skipped for reason, must be called with ao.mu locked
+func (ao *AssetsOptimizer) logSkip(path, reason string) {
+
+	if levelDebug < ao.logLevel {
+		return
+	}
+
+	rel, err := filepath.Rel(ao.dir, path)
+
+	if err != nil {
+		rel = path
+	}
+
+	ao.logf(ao.log, levelDebug, "Skip %q: %s\n", rel, reason)
+}
+
+func writeLogRecord(w io.Writer, r *logRecord) {
+
+	r.Time = time.Now()
+
+	if b, err := json.Marshal(r); err == nil {
+		_, _ = w.Write(append(b, '\n'))
+	}
+}
@@ -0,0 +1,526 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// StarBound asset pak (SBAsset6), as written by asset_packer and read by the game
+// SEE source/base/StarPackedAssetSource.cpp of OpenStarbound
+//
+//	"SBAsset6", uint64 BE offset of the index, asset data...,
+//	"INDEX", metadata (VLQ count of string key + binary Json value), VLQ count of files,
+//	files: VLQ length + path, uint64 BE offset, uint64 BE size
+//
+// NOTE VLQ здесь старшими 7-битными группами вперед, бит 0x80 - продолжение; строка - VLQ длина + байты
+
+const (
+	extPAK = "pak"
+
+	pakSignature      = "SBAsset6"
+	pakIndexSignature = "INDEX"
+	pakHeaderLen      = len(pakSignature) + 8
+
+	pakMaxJSONDepth = 128
+)
+
+var (
+	errPakSignature   = errors.New("not a StarBound SBAsset6 pak")
+	errPakMalformed   = errors.New("malformed pak")
+	errPakUnsupported = errors.New("unsupported pak layout")
+)
+
+// BytesOptimizer optimizes asset data in memory, which is how PakOptimizer handles assets embedded into pak;
+// nil opts means the defaults of the optimizer
+type BytesOptimizer interface {
+	OptimizeBytes(data []byte, opts *OptimizeOptions) ([]byte, OptimizeResult, error)
+}
+
+type PakOptimizer struct {
+	registry *Registry
+}
+
+// NewPakOptimizer creates optimizer of StarBound paks, every embedded asset is optimized by BytesOptimizer
+// registered in registry for its extension (within a run - the one the run resolves for its path, so ext map and
+// ext filter apply), other entries are copied as is
+func NewPakOptimizer(registry *Registry) *PakOptimizer {
+	return &PakOptimizer{registry: registry}
+}
+
+type pakEntry struct {
+	path         string
+	offset, size uint64
+}
+
+type pakFile struct {
+	metadata []byte // serialized metadata map, copied as is
+	entries  []pakEntry
+}
+
+// Optimize rewrites pak with optimized embedded assets, index order and metadata are kept
+func (o *PakOptimizer) Optimize(path string, opts *OptimizeOptions) (res OptimizeResult, err error) {
+
+	// NOTE пак целиком в памяти, как и любой другой ассет: моды редко бывают больше сотни мегабайт
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return res, fmt.Errorf("PakOptimizer optimize error: %w", err)
+	}
+
+	opt, res, err := o.optimizeData(data, opts)
+
+	if err != nil || res.NOOP || opts.DryRun {
+		return res, err
+	}
+
+	if err = saveAsset(path, ".paktmp", opt, opts); err != nil {
+		return res, err
+	}
+
+	return res, nil
+}
+
+// OptimizeFS rewrites pak path of fsys, see FSOptimizer
+func (o *PakOptimizer) OptimizeFS(fsys fs.FS, path string, opts *OptimizeOptions) (opt *bytes.Buffer, res OptimizeResult,
+	err error) {
+
+	data, err := fs.ReadFile(fsys, path)
+
+	if err != nil {
+		return nil, res, fmt.Errorf("PakOptimizer optimize error: %w", err)
+	}
+
+	return o.optimizeData(data, opts)
+}
+
+// optimizeData rewrites pak data with its entries optimized, opt is nil for NOOP
+func (o *PakOptimizer) optimizeData(data []byte, opts *OptimizeOptions) (opt *bytes.Buffer, res OptimizeResult, err error) {
+
+	res.Size = int64(len(data))
+
+	p, err := parsePak(data)
+
+	// NOTE .pak без сигнатуры - чужой или не пак вовсе, и это не повод обрывать весь прогон без -k
+	if errors.Is(err, errPakSignature) || errors.Is(err, errPakUnsupported) {
+		res.NOOP, res.Reason = true, err.Error()
+		return nil, res, nil
+	} else if err != nil {
+		return nil, res, fmt.Errorf("PakOptimizer optimize error: %w", err)
+	}
+
+	// NOTE записи оптимизируются с настройками прогона, а вывод, копия и пороги экономии относятся к паку целиком
+	entryOpts := *opts
+	entryOpts.Output, entryOpts.Backup, entryOpts.MinSavedPct, entryOpts.MinSavedBytes = "", "", 0, 0
+
+	payloads, sum := o.optimizeEntries(data, p.entries, &entryOpts)
+
+	if sum.broken > 0 {
+		res.Reason = fmt.Sprintf("broken entries kept as is: %d", sum.broken)
+	}
+
+	if sum.optimized == 0 {
+		res.NOOP = true
+		return nil, res, nil
+	}
+
+	opt = p.encode(payloads)
+
+	res.OptimizedSize = int64(opt.Len())
+	res.Metadata = sum.metadata
+	res.Variant = fmt.Sprintf("pak, %d of %d entries optimized", sum.optimized, len(p.entries))
+
+	if opts.keepOriginal(&res) {
+		return nil, res, nil
+	}
+
+	// NOTE у NOOP причина печатается и так
+	if res.Reason != "" {
+		res.Variant += ", " + res.Reason
+	}
+
+	if opts.Verify {
+		if err = verifyPak(opt.Bytes(), &p, payloads); err != nil {
+			return nil, res, fmt.Errorf("PakOptimizer verify error: %w", err)
+		}
+	}
+
+	return opt, res, nil
+}
+
+type pakSummary struct {
+	optimized int
+	broken    int   // entries the optimizer of their format failed on
+	metadata  int64 // metadata bytes removed from optimized entries
+}
+
+// optimizeEntries returns payload of every entry: optimized one if it got smaller, the original otherwise
+func (o *PakOptimizer) optimizeEntries(data []byte, entries []pakEntry, opts *OptimizeOptions) (payloads [][]byte,
+	sum pakSummary) {
+
+	type result struct {
+		metadata int64
+		failed   bool
+	}
+
+	payloads = make([][]byte, len(entries))
+	results := make([]result, len(entries))
+
+	var next atomic.Int64
+
+	work := func() {
+
+		for i := int(next.Add(1) - 1); i < len(entries); i = int(next.Add(1) - 1) {
+
+			e := &entries[i]
+			payload := data[e.offset : e.offset+e.size]
+
+			payloads[i] = payload
+
+			bo, ok := o.entryOptimizer(e.path, opts).(BytesOptimizer)
+
+			if !ok {
+				continue
+			}
+
+			// NOTE битый (или пустой) файл внутри пака не повод бросать весь пак, он просто остается как есть
+			opt, r, err := bo.OptimizeBytes(payload, opts)
+
+			if err != nil {
+				results[i].failed = true
+				continue
+			}
+
+			if !r.NOOP && len(opt) < len(payload) {
+				payloads[i], results[i].metadata = opt, r.Metadata
+			}
+		}
+	}
+
+	// NOTE пак - один ассет для AssetsOptimizer, поэтому его записи берут себе в помощь только свободные слоты
+	//      воркеров прогона, и всего одновременно оптимизируется не больше -j ассетов и записей; вне прогона
+	//      (слотов нет) записи раздаются на все CPU
+	helpers := runtime.NumCPU() - 1
+
+	if opts.slots != nil {
+		for helpers = 0; helpers < len(entries)-1 && opts.slots.tryAcquire(); helpers++ {
+		}
+	}
+
+	var wg sync.WaitGroup
+
+	for ; helpers > 0; helpers-- {
+
+		wg.Add(1)
+
+		go func() {
+
+			defer wg.Done()
+			defer removeTempFilesOnPanic()
+
+			if opts.slots != nil {
+				defer opts.slots.release()
+			}
+
+			work()
+		}()
+	}
+
+	work()
+
+	wg.Wait()
+
+	for i := range results {
+
+		if results[i].failed {
+			sum.broken++
+		} else if len(payloads[i]) < int(entries[i].size) {
+			sum.optimized++
+			sum.metadata += results[i].metadata
+		}
+	}
+
+	return payloads, sum
+}
+
+// entryOptimizer returns optimizer of pak entry path: the one resolved by the run if any, see OptimizeOptions.lookup
+func (o *PakOptimizer) entryOptimizer(path string, opts *OptimizeOptions) AssetOptimizer {
+
+	if opts.lookup != nil {
+		return opts.lookup(path)
+	}
+
+	return o.registry.Lookup(assetExt(path))
+}
+
+func parsePak(data []byte) (p pakFile, err error) {
+
+	if len(data) < pakHeaderLen || string(data[:len(pakSignature)]) != pakSignature {
+		return p, errPakSignature
+	}
+
+	indexOffset := binary.BigEndian.Uint64(data[len(pakSignature):pakHeaderLen])
+
+	if indexOffset < uint64(pakHeaderLen) || indexOffset > uint64(len(data)) {
+		return p, fmt.Errorf("%w: index offset %d", errPakMalformed, indexOffset)
+	}
+
+	r := pakReader{data: data, pos: int(indexOffset)}
+
+	if sig := r.bytes(len(pakIndexSignature)); r.err == nil && string(sig) != pakIndexSignature {
+		return p, fmt.Errorf("%w: no index at %d", errPakMalformed, indexOffset)
+	}
+
+	start := r.pos
+
+	for n := r.length(); n > 0 && r.err == nil; n-- {
+		r.bytes(r.length())
+		r.skipJSON(0)
+	}
+
+	p.metadata = data[start:r.pos]
+
+	n := r.length()
+
+	p.entries = make([]pakEntry, 0, n)
+
+	for ; n > 0 && r.err == nil; n-- {
+		p.entries = append(p.entries, pakEntry{string(r.bytes(r.length())), r.u64(), r.u64()})
+	}
+
+	if r.err != nil {
+		return p, r.err
+	}
+
+	// NOTE хвост после индекса при перезаписи потерялся бы, такой пак не трогаем
+	if r.pos != len(data) {
+		return p, fmt.Errorf("%w: %d bytes after the index", errPakUnsupported, len(data)-r.pos)
+	}
+
+	for _, e := range p.entries {
+		if e.offset < uint64(pakHeaderLen) || e.offset > indexOffset || e.size > indexOffset-e.offset {
+			return p, fmt.Errorf("%w: entry %q out of the data", errPakMalformed, e.path)
+		}
+	}
+
+	return p, nil
+}
+
+// encode writes pak with payloads of p.entries, data goes in the order of the original offsets
+func (p *pakFile) encode(payloads [][]byte) *bytes.Buffer {
+
+	order := make([]int, len(p.entries))
+
+	for i := range order {
+		order[i] = i
+	}
+
+	sort.SliceStable(order, func(i, j int) bool {
+		return p.entries[order[i]].offset < p.entries[order[j]].offset
+	})
+
+	b := bytes.NewBuffer(nil)
+
+	b.WriteString(pakSignature)
+	b.Write(make([]byte, 8))
+
+	offsets := make([]uint64, len(p.entries))
+
+	for _, i := range order {
+		offsets[i] = uint64(b.Len())
+		b.Write(payloads[i])
+	}
+
+	binary.BigEndian.PutUint64(b.Bytes()[len(pakSignature):pakHeaderLen], uint64(b.Len()))
+
+	b.WriteString(pakIndexSignature)
+	b.Write(p.metadata)
+
+	writeVLQ(b, uint64(len(p.entries)))
+
+	var u64 [8]byte
+
+	for i, e := range p.entries {
+
+		writeVLQ(b, uint64(len(e.path)))
+		b.WriteString(e.path)
+
+		binary.BigEndian.PutUint64(u64[:], offsets[i])
+		b.Write(u64[:])
+
+		binary.BigEndian.PutUint64(u64[:], uint64(len(payloads[i])))
+		b.Write(u64[:])
+	}
+
+	return b
+}
+
+// verifyPak parses written pak back and checks it has the same index and metadata as p with payloads
+func verifyPak(data []byte, p *pakFile, payloads [][]byte) (err error) {
+
+	got, err := parsePak(data)
+
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(got.metadata, p.metadata) || len(got.entries) != len(p.entries) {
+		return errors.New("pak index mismatch")
+	}
+
+	for i, e := range got.entries {
+		if e.path != p.entries[i].path || !bytes.Equal(data[e.offset:e.offset+e.size], payloads[i]) {
+			return fmt.Errorf("pak entry %q mismatch", p.entries[i].path)
+		}
+	}
+
+	return nil
+}
+
+func writeVLQ(b *bytes.Buffer, v uint64) {
+
+	var buf [10]byte
+
+	i := len(buf) - 1
+	buf[i] = byte(v & 0x7f)
+
+	for v >>= 7; v > 0; v >>= 7 {
+		i--
+		buf[i] = byte(v&0x7f) | 0x80
+	}
+
+	b.Write(buf[i:])
+}
+
+// pakReader reads index of pak, the first error sticks and makes every next read return zero value
+type pakReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *pakReader) bytes(n int) []byte {
+
+	if r.err != nil {
+		return nil
+	}
+
+	if n < 0 || n > len(r.data)-r.pos {
+		r.err = fmt.Errorf("%w: truncated index", errPakMalformed)
+		return nil
+	}
+
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+
+	return b
+}
+
+func (r *pakReader) vlq() (v uint64) {
+
+	// NOTE uint64 - максимум 10 групп по 7 бит
+	for i := 0; i < 10; i++ {
+
+		b := r.bytes(1)
+
+		if b == nil {
+			return 0
+		}
+
+		v = v<<7 | uint64(b[0]&0x7f)
+
+		if b[0]&0x80 == 0 {
+			return v
+		}
+	}
+
+	r.err = fmt.Errorf("%w: too long VLQ", errPakMalformed)
+
+	return 0
+}
+
+// length reads VLQ length or count, which can't exceed the size of pak
+func (r *pakReader) length() int {
+
+	v := r.vlq()
+
+	if v > uint64(len(r.data)) {
+		r.err = fmt.Errorf("%w: length %d", errPakMalformed, v)
+		return 0
+	}
+
+	return int(v)
+}
+
+func (r *pakReader) u64() uint64 {
+
+	b := r.bytes(8)
+
+	if b == nil {
+		return 0
+	}
+
+	return binary.BigEndian.Uint64(b)
+}
+
+// skipJSON skips StarBound binary Json value: type byte (1 null, 2 double, 3 bool, 4 signed VLQ int, 5 string,
+// 6 array, 7 object) and its data
+func (r *pakReader) skipJSON(depth int) {
+
+	if depth > pakMaxJSONDepth {
+		r.err = fmt.Errorf("%w: metadata nested too deep", errPakMalformed)
+		return
+	}
+
+	t := r.bytes(1)
+
+	if t == nil {
+		return
+	}
+
+	switch t[0] {
+	case 1:
+	case 2:
+		r.bytes(8)
+	case 3:
+		r.bytes(1)
+	case 4:
+		r.vlq()
+	case 5:
+		r.bytes(r.length())
+	case 6:
+		for n := r.length(); n > 0 && r.err == nil; n-- {
+			r.skipJSON(depth + 1)
+		}
+	case 7:
+		for n := r.length(); n > 0 && r.err == nil; n-- {
+			r.bytes(r.length())
+			r.skipJSON(depth + 1)
+		}
+	default:
+		r.err = fmt.Errorf("%w: metadata value of type %d", errPakMalformed, t[0])
+	}
+}
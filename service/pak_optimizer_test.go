@@ -0,0 +1,326 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+type testPakEntry struct {
+	path string
+	data []byte
+}
+
+// testPakMetadata is metadata map of 3 keys with every binary Json type: string, nested object of int, double,
+// bool and null, array
+var testPakMetadata = func() []byte {
+
+	b := bytes.NewBuffer(nil)
+
+	str := func(s string) {
+		writeVLQ(b, uint64(len(s)))
+		b.WriteString(s)
+	}
+
+	writeVLQ(b, 3)
+
+	str("name")
+	b.WriteByte(5)
+	str("test mod")
+
+	str("info")
+	b.WriteByte(7)
+	writeVLQ(b, 4)
+	str("priority")
+	b.WriteByte(4)
+	writeVLQ(b, 300)
+	str("version")
+	b.WriteByte(2)
+	b.Write([]byte{0x3f, 0xf8, 0, 0, 0, 0, 0, 0})
+	str("hidden")
+	b.Write([]byte{3, 1})
+	str("link")
+	b.WriteByte(1)
+
+	str("includes")
+	b.WriteByte(6)
+	writeVLQ(b, 2)
+	b.WriteByte(5)
+	str("base")
+	b.WriteByte(5)
+	str("other")
+
+	return b.Bytes()
+}()
+
+// encodeTestPak writes SBAsset6 pak of entries with metadata, entry data goes in the reverse order of the index
+func encodeTestPak(metadata []byte, entries []testPakEntry) []byte {
+
+	b := bytes.NewBuffer(nil)
+
+	b.WriteString(pakSignature)
+	b.Write(make([]byte, 8))
+
+	offsets := make([]uint64, len(entries))
+
+	for i := len(entries) - 1; i >= 0; i-- {
+		offsets[i] = uint64(b.Len())
+		b.Write(entries[i].data)
+	}
+
+	binary.BigEndian.PutUint64(b.Bytes()[len(pakSignature):], uint64(b.Len()))
+
+	b.WriteString(pakIndexSignature)
+	b.Write(metadata)
+
+	writeVLQ(b, uint64(len(entries)))
+
+	for i, e := range entries {
+		writeVLQ(b, uint64(len(e.path)))
+		b.WriteString(e.path)
+		b.Write(binary.BigEndian.AppendUint64(nil, offsets[i]))
+		b.Write(binary.BigEndian.AppendUint64(nil, uint64(len(e.data))))
+	}
+
+	return b.Bytes()
+}
+
+func testPakOptimizer(t *testing.T) *PakOptimizer {
+
+	t.Helper()
+
+	r, err := newDefaultRegistry(&Settings{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewPakOptimizer(r)
+}
+
+func TestOptimizePak(t *testing.T) {
+
+	var src bytes.Buffer
+
+	if err := png.Encode(&src, grayNRGBA(32, 32, 16, 0xff)); err != nil {
+		t.Fatal(err)
+	}
+
+	// NOTE пустая запись первая в индексе, т.е. последняя в данных, у остальных смещения различны
+	entries := []testPakEntry{
+		{"/empty.png", nil},
+		{"/objects/gray.png", src.Bytes()},
+		{"/scripts/init.lua", []byte("function init() end\n")},
+		{"/broken.png", []byte("\x89PNG\r\n\x1a\nnot a png")},
+	}
+
+	data := encodeTestPak(testPakMetadata, entries)
+
+	o := testPakOptimizer(t)
+
+	opt, res, err := o.optimizeData(data, &OptimizeOptions{Effort: EffortDefault, Verify: true})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.NOOP || opt == nil || res.OptimizedSize >= res.Size {
+		t.Fatalf("NOOP %t (%s), %d -> %d bytes, want the png entry optimized", res.NOOP, res.Reason, res.Size,
+			res.OptimizedSize)
+	}
+
+	if !strings.Contains(res.Variant, "1 of 4 entries optimized") || !strings.Contains(res.Reason, "broken entries kept as is: 2") {
+		t.Errorf("variant %q, reason %q", res.Variant, res.Reason)
+	}
+
+	p, err := parsePak(opt.Bytes())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(p.metadata, testPakMetadata) {
+		t.Errorf("metadata changed: % x", p.metadata)
+	}
+
+	if len(p.entries) != len(entries) {
+		t.Fatalf("%d entries, want %d", len(p.entries), len(entries))
+	}
+
+	// NOTE данные записей идут подряд сразу за заголовком в исходном порядке смещений (обратном индексу)
+	next := uint64(pakHeaderLen)
+
+	for i := len(p.entries) - 1; i >= 0; i-- {
+
+		e := p.entries[i]
+
+		if e.path != entries[i].path || e.offset != next {
+			t.Errorf("entry %d: %q at %d, want %q at %d", i, e.path, e.offset, entries[i].path, next)
+		}
+
+		next = e.offset + e.size
+	}
+
+	payload := func(i int) []byte {
+		e := p.entries[i]
+		return opt.Bytes()[e.offset : e.offset+e.size]
+	}
+
+	for i := range entries {
+		if i != 1 && !bytes.Equal(payload(i), entries[i].data) {
+			t.Errorf("entry %q changed", entries[i].path)
+		}
+	}
+
+	if len(payload(1)) >= len(entries[1].data) {
+		t.Errorf("png entry %d -> %d bytes, want smaller", len(entries[1].data), len(payload(1)))
+	}
+
+	samePixels(t, entries[1].path, decodeTestPNG(t, entries[1].data), decodeTestPNG(t, payload(1)))
+
+	// NOTE повторный проход по уже оптимизированному паку ничего не меняет
+	if opt, res, err = o.optimizeData(opt.Bytes(), &OptimizeOptions{Effort: EffortDefault, Verify: true}); err != nil {
+		t.Fatal(err)
+	} else if !res.NOOP || opt != nil {
+		t.Errorf("second pass: NOOP %t, variant %q", res.NOOP, res.Variant)
+	}
+}
+
+func TestOptimizePakNOOP(t *testing.T) {
+
+	entries := []testPakEntry{
+		{"/scripts/init.lua", []byte("function init() end\n")},
+		{"/sfx/hit.ogg", []byte("OggS")},
+	}
+
+	valid := encodeTestPak(testPakMetadata, entries)
+
+	tests := []struct {
+		name   string
+		data   []byte
+		reason string
+	}{
+		{"nothing to optimize", valid, ""},
+		{"no entries", encodeTestPak([]byte{0}, nil), ""},
+		{"no signature", []byte("PK\x03\x04 zip archive renamed to .pak"), errPakSignature.Error()},
+		{"shorter than the header", valid[:pakHeaderLen-1], errPakSignature.Error()},
+		{"other version", append([]byte("SBAsset5"), valid[len(pakSignature):]...), errPakSignature.Error()},
+		{"data after the index", append(append([]byte{}, valid...), "junk"...), errPakUnsupported.Error()},
+	}
+
+	o := testPakOptimizer(t)
+
+	for _, tt := range tests {
+
+		opt, res, err := o.optimizeData(tt.data, &OptimizeOptions{Effort: EffortDefault, Verify: true})
+
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		if !res.NOOP || opt != nil || !strings.Contains(res.Reason, tt.reason) || res.Size != int64(len(tt.data)) {
+			t.Errorf("%s: NOOP %t, reason %q, size %d, want NOOP with reason %q", tt.name, res.NOOP, res.Reason,
+				res.Size, tt.reason)
+		}
+	}
+}
+
+func TestOptimizePakMalformed(t *testing.T) {
+
+	entries := []testPakEntry{
+		{"/scripts/init.lua", []byte("function init() end\n")},
+	}
+
+	valid := encodeTestPak(testPakMetadata, entries)
+	index := int(binary.BigEndian.Uint64(valid[len(pakSignature):]))
+
+	// edit returns copy of valid with fn applied
+	edit := func(fn func(b []byte) []byte) []byte {
+		return fn(append([]byte{}, valid...))
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"truncated index", valid[:len(valid)-3]},
+		{"truncated metadata", valid[:index+len(pakIndexSignature)+5]},
+		{"index offset past the end", edit(func(b []byte) []byte {
+			binary.BigEndian.PutUint64(b[len(pakSignature):], uint64(len(b)+1))
+			return b
+		})},
+		{"index offset into the header", edit(func(b []byte) []byte {
+			binary.BigEndian.PutUint64(b[len(pakSignature):], 3)
+			return b
+		})},
+		{"no index signature", edit(func(b []byte) []byte {
+			b[index] = 'X'
+			return b
+		})},
+		{"unknown metadata type", edit(func(b []byte) []byte {
+			// NOTE первое значение метаданных (тип строки) сразу за "INDEX", VLQ 3 и ключом "name"
+			b[index+len(pakIndexSignature)+1+1+len("name")] = 9
+			return b
+		})},
+		{"entry out of the data", edit(func(b []byte) []byte {
+			// NOTE размер единственной записи - последние 8 байт пака
+			binary.BigEndian.PutUint64(b[len(b)-8:], uint64(len(b)))
+			return b
+		})},
+		{"entry count beyond the pak", encodeTestPakIndex(t, func(b *bytes.Buffer) {
+			writeVLQ(b, 1<<40)
+		})},
+	}
+
+	o := testPakOptimizer(t)
+
+	for _, tt := range tests {
+
+		opt, res, err := o.optimizeData(tt.data, &OptimizeOptions{Effort: EffortDefault, Verify: true})
+
+		if !errors.Is(err, errPakMalformed) {
+			t.Errorf("%s: error %v, NOOP %t (%s), want %v", tt.name, err, res.NOOP, res.Reason, errPakMalformed)
+		}
+
+		if opt != nil {
+			t.Errorf("%s: got output", tt.name)
+		}
+	}
+}
+
+// encodeTestPakIndex writes pak without data, its index holds testPakMetadata and whatever files writes
+func encodeTestPakIndex(t *testing.T, files func(b *bytes.Buffer)) []byte {
+
+	t.Helper()
+
+	b := bytes.NewBuffer(nil)
+
+	b.WriteString(pakSignature)
+	b.Write(binary.BigEndian.AppendUint64(nil, uint64(pakHeaderLen)))
+	b.WriteString(pakIndexSignature)
+	b.Write(testPakMetadata)
+
+	files(b)
+
+	return b.Bytes()
+}
@@ -0,0 +1,50 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"fmt"
+	"io"
+)
+
+// PaletteDumper is implemented by optimizers which build palette for indexed-color variant of asset,
+// it prints that palette for debugging
+type PaletteDumper interface {
+	DumpPalette(path string, w io.Writer, opts *OptimizeOptions) error
+}
+
+// DumpPalette decodes single asset path and prints palette its optimizer would build, without optimizing anything
+func (ao *AssetsOptimizer) DumpPalette(path string) (err error) {
+
+	ext := ao.resolveExt(path)
+
+	optimizer := ao.registry.Lookup(ext)
+
+	if optimizer == nil {
+		return fmt.Errorf("no optimizer for asset %q (ext %q)", path, ext)
+	}
+
+	pd, ok := optimizer.(PaletteDumper)
+
+	if !ok {
+		return fmt.Errorf("optimizer %T of asset %q builds no palette", optimizer, path)
+	}
+
+	fmt.Fprintf(ao.log, "Palette of asset %q (%s):\n", path, ext)
+
+	return pd.DumpPalette(path, ao.log, &ao.opts)
+}
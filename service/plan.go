@@ -0,0 +1,161 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// errPlanMismatch asset is optimized to other size than the plan expects, see Settings.Apply
+var errPlanMismatch = errors.New("optimized differently than planned")
+
+// plan is what the run with Settings.Plan would do, the run with Settings.Apply does exactly that
+type plan struct {
+	Dir   string      `json:"dir"`
+	Files []planEntry `json:"files"`
+}
+
+// planEntry is single asset of the plan: its state when planned and the result expected
+type planEntry struct {
+	Path          string `json:"path"` // relative to the root dir with forward slashes, see cacheKey
+	Ext           string `json:"ext"`
+	Size          int64  `json:"size"`
+	ModTime       int64  `json:"mtime"` // unix nano
+	OptimizedSize int64  `json:"optimized_size"`
+	Variant       string `json:"variant"`
+}
+
+// addPlanEntry plans asset a (of path rel) to be optimized as res
+func (ao *AssetsOptimizer) addPlanEntry(rel string, a *asset, res *OptimizeResult) (err error) {
+
+	info, err := os.Stat(a.file())
+
+	if err != nil {
+		return fmt.Errorf("plan error: %w", err)
+	}
+
+	e := planEntry{
+		Path:          cacheKey(rel),
+		Ext:           a.ext,
+		Size:          info.Size(),
+		ModTime:       info.ModTime().UnixNano(),
+		OptimizedSize: res.OptimizedSize,
+		Variant:       res.Variant,
+	}
+
+	ao.mu.Lock()
+	ao.plan = append(ao.plan, e)
+	ao.mu.Unlock()
+
+	return nil
+}
+
+// writePlan writes the plan of the run to ao.planPath (atomically)
+func (ao *AssetsOptimizer) writePlan() (err error) {
+
+	// NOTE при параллельном обходе записи приходят в произвольном порядке
+	sort.Slice(ao.plan, func(i, j int) bool {
+		return ao.plan[i].Path < ao.plan[j].Path
+	})
+
+	p := plan{Dir: ao.dir, Files: ao.plan}
+
+	if p.Files == nil {
+		p.Files = []planEntry{}
+	}
+
+	b := bytes.NewBuffer(nil)
+	enc := json.NewEncoder(b)
+	enc.SetIndent("", "  ")
+
+	if err = enc.Encode(&p); err != nil {
+		return fmt.Errorf("encode plan error: %w", err)
+	}
+
+	if err = replaceFile(ao.planPath, ".tmp", b); err != nil {
+		return fmt.Errorf("write plan %q error: %w", ao.planPath, err)
+	}
+
+	return nil
+}
+
+// walkPlanned is walkAssets over the assets of ao.applyPath plan, an asset changed since it was planned is warned
+// and skipped, the rest are checked as listed files are (see visitListed)
+func (ao *AssetsOptimizer) walkPlanned(ctx context.Context, fn func(a asset) error) (err error) {
+
+	data, err := os.ReadFile(ao.applyPath)
+
+	if err != nil {
+		return fmt.Errorf("plan error: %w", err)
+	}
+
+	var p plan
+
+	if err = json.Unmarshal(data, &p); err != nil {
+		return fmt.Errorf("plan %q error: %w", ao.applyPath, err)
+	}
+
+	// NOTE пути плана относительные, с другим корнем они указали бы на другие файлы
+	if p.Dir != ao.dir {
+		return fmt.Errorf("plan %q is made for dir %q, not %q", ao.applyPath, p.Dir, ao.dir)
+	}
+
+	for i := range p.Files {
+
+		if err = ctx.Err(); err != nil {
+			return fmt.Errorf("run interrupted: %w", err)
+		}
+
+		e := &p.Files[i]
+		path := filepath.Join(ao.dir, filepath.FromSlash(e.Path))
+
+		if info, err := os.Stat(path); err != nil {
+			ao.skipPlanned(e.Path, err.Error())
+			continue
+		} else if info.Size() != e.Size || info.ModTime().UnixNano() != e.ModTime {
+			ao.skipPlanned(e.Path, "changed since the plan")
+			continue
+		}
+
+		err = ao.visitListed(path, func(a asset) error {
+			a.planned = e.OptimizedSize
+			return fn(a)
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (ao *AssetsOptimizer) skipPlanned(rel, reason string) {
+
+	ao.logf(ao.log, levelWarn, "skip planned %q: %s\n", rel, reason)
+
+	ao.mu.Lock()
+	ao.stats.changed++
+	ao.mu.Unlock()
+}
@@ -0,0 +1,144 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPlanApply(t *testing.T) {
+
+	dir, files := testTree(t, 1)
+	planPath := filepath.Join(t.TempDir(), "plan.json")
+
+	var log bytes.Buffer
+
+	run := func(settings Settings) (*AssetsOptimizer, error) {
+
+		t.Helper()
+
+		log.Reset()
+		settings.MinifyJSON, settings.Log = true, &log
+
+		ao, err := NewAssetsOptimizer(dir, WithSettings(settings))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return ao, ao.RunContext(context.Background())
+	}
+
+	if _, err := run(Settings{Plan: planPath}); err != nil {
+		t.Fatalf("plan: %v\n%s", err, log.String())
+	}
+
+	for rel, data := range files {
+		if got, err := os.ReadFile(filepath.Join(dir, rel)); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("plan: %s is changed (%v)", rel, err)
+		}
+	}
+
+	var p plan
+
+	if data, err := os.ReadFile(planPath); err != nil {
+		t.Fatal(err)
+	} else if err = json.Unmarshal(data, &p); err != nil {
+		t.Fatal(err)
+	}
+
+	if p.Dir != dir || len(p.Files) < 3 || len(p.Files) >= len(files) {
+		t.Fatalf("plan of %q with %d files, want %q and some of %d files", p.Dir, len(p.Files), dir, len(files))
+	}
+
+	// NOTE первый файл изменился после плана, второй теперь оптимизировался бы иначе
+	changed, mismatched := p.Files[0], p.Files[1]
+
+	if err := os.WriteFile(filepath.Join(dir, filepath.FromSlash(changed.Path)), []byte("{}"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Files[1].OptimizedSize++
+
+	if data, err := json.Marshal(&p); err != nil {
+		t.Fatal(err)
+	} else if err = os.WriteFile(planPath, data, 0o666); err != nil {
+		t.Fatal(err)
+	}
+
+	ao, err := run(Settings{Apply: planPath})
+
+	if err != nil {
+		t.Fatalf("apply: %v\n%s", err, log.String())
+	}
+
+	if ao.stats.changed != 2 || ao.stats.files != uint(len(p.Files)-2) {
+		t.Errorf("apply: %d skipped, %d processed, want 2 and %d\n%s", ao.stats.changed, ao.stats.files,
+			len(p.Files)-2, log.String())
+	}
+
+	for _, reason := range []string{changed.Path + "\": changed since the plan", errPlanMismatch.Error()} {
+		if !strings.Contains(log.String(), reason) {
+			t.Errorf("apply: no %q in log\n%s", reason, log.String())
+		}
+	}
+
+	planned := make(map[string]int64)
+
+	for _, e := range p.Files[2:] {
+		planned[e.Path] = e.OptimizedSize
+	}
+
+	for rel, data := range files {
+
+		got, err := os.ReadFile(filepath.Join(dir, rel))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want, ok := planned[filepath.ToSlash(rel)]
+
+		switch {
+		case filepath.ToSlash(rel) == changed.Path:
+			want = 2
+		case !ok:
+			want = int64(len(data))
+		}
+
+		if int64(len(got)) != want || filepath.ToSlash(rel) == mismatched.Path && !bytes.Equal(got, data) {
+			t.Errorf("apply: %s is %d bytes, want %d", rel, len(got), want)
+		}
+	}
+
+	// NOTE пути плана относительные, с другим корнем план не годится
+	ao, err = NewAssetsOptimizer(t.TempDir(), WithSettings(Settings{Apply: planPath, Log: &log}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ao.RunContext(context.Background()); err == nil || !strings.Contains(err.Error(), "is made for dir") {
+		t.Errorf("apply to other dir: error %v", err)
+	}
+}
@@ -0,0 +1,314 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// SEE https://repository.root-me.org/St%C3%A9ganographie/EN%20-%20PNG%20(Portable%20Network%20Graphics)%20Specification%20version%201.2.pdf
+//     $ 3.1 PNG file signature, $ 3.2 Chunk layout, $ 4.1.1 IHDR Image header
+
+const (
+	pngSignature = "\x89PNG\r\n\x1a\n"
+
+	pngChunkIHDR = "IHDR"
+	pngChunkIEND = "IEND"
+	pngChunkTRNS = "tRNS"
+
+	// color space chunks, SEE $ 4.2.2
+	pngChunkCHRM = "cHRM"
+	pngChunkGAMA = "gAMA"
+	pngChunkICCP = "iCCP"
+	pngChunkSRGB = "sRGB"
+
+	pngIHDRLen = 13
+
+	// length (4) + type (4) + crc (4)
+	pngChunkOverhead = 12
+
+	pngInterlaceAdam7 = 1
+)
+
+type pngHeader struct {
+	width     uint32
+	height    uint32
+	bitDepth  uint8
+	colorType uint8
+	interlace uint8
+}
+
+type pngChunk struct {
+	typ  string
+	data []byte
+	crc  uint32
+}
+
+var (
+	errPNGSignature = errors.New("not a PNG file")
+	errPNGNoIHDR    = errors.New("missing PNG IHDR chunk")
+	errPNGTruncated = errors.New("truncated PNG chunk")
+	errPNGNoIEND    = errors.New("missing PNG IEND chunk")
+	errPNGBadCRC    = errors.New("bad PNG chunk CRC")
+	errPNGCorrupt   = errors.New("truncated or corrupt PNG")
+)
+
+// readPNGHeader parses IHDR, which MUST be the first chunk right after file signature
+func readPNGHeader(data []byte) (h pngHeader, err error) {
+
+	if !bytes.HasPrefix(data, []byte(pngSignature)) {
+		return h, errPNGSignature
+	}
+
+	data = data[len(pngSignature):]
+
+	// length (4) + type (4) + IHDR data (13)
+	if len(data) < 8+pngIHDRLen || string(data[4:8]) != pngChunkIHDR || binary.BigEndian.Uint32(data[:4]) != pngIHDRLen {
+		return h, errPNGNoIHDR
+	}
+
+	data = data[8:]
+
+	// width (4), height (4), bit depth, color type, compression method, filter method, interlace method
+	h.width = binary.BigEndian.Uint32(data[0:4])
+	h.height = binary.BigEndian.Uint32(data[4:8])
+	h.bitDepth = data[8]
+	h.colorType = data[9]
+	h.interlace = data[12]
+
+	return h, nil
+}
+
+func (h *pngHeader) isInterlaced() bool {
+	return h.interlace == pngInterlaceAdam7
+}
+
+// readPNGChunks splits raw png into chunks (without any CRC check), returns everything up to and including IEND
+// (if any) and the bytes following it
+func readPNGChunks(data []byte) (chunks []pngChunk, tail []byte, err error) {
+
+	if !bytes.HasPrefix(data, []byte(pngSignature)) {
+		return nil, nil, errPNGSignature
+	}
+
+	data = data[len(pngSignature):]
+
+	for len(data) > 0 {
+
+		if len(data) < pngChunkOverhead {
+			return chunks, nil, errPNGTruncated
+		}
+
+		n := binary.BigEndian.Uint32(data[:4])
+
+		if uint64(n) > uint64(len(data)-pngChunkOverhead) {
+			return chunks, nil, errPNGTruncated
+		}
+
+		c := pngChunk{
+			typ:  string(data[4:8]),
+			data: data[8 : 8+n],
+			crc:  binary.BigEndian.Uint32(data[8+n : 12+n]),
+		}
+
+		chunks = append(chunks, c)
+		data = data[12+n:]
+
+		if c.typ == pngChunkIEND {
+			return chunks, data, nil
+		}
+	}
+
+	return chunks, nil, nil
+}
+
+func pngChunkCRC(typ string, data []byte) uint32 {
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(typ))
+	crc.Write(data)
+	return crc.Sum32()
+}
+
+func (c *pngChunk) validCRC() bool {
+	return pngChunkCRC(c.typ, c.data) == c.crc
+}
+
+// checkPNGChunks checks chunks read by readPNGChunks before the file is trusted to png.Decode: every chunk has
+// valid CRC and the last one is IEND, so partially downloaded or damaged file is rejected as a whole
+func checkPNGChunks(chunks []pngChunk) (err error) {
+
+	for i := range chunks {
+		if !chunks[i].validCRC() {
+			return fmt.Errorf("%w of %s", errPNGBadCRC, chunks[i].typ)
+		}
+	}
+
+	if len(chunks) == 0 || chunks[len(chunks)-1].typ != pngChunkIEND {
+		return errPNGNoIEND
+	}
+
+	return nil
+}
+
+// SEE $ 3.3 Chunk naming conventions: bit 5 of the first byte (lowercase) - ancillary chunk
+func (c *pngChunk) isAncillary() bool {
+	return c.typ[0]&0x20 != 0
+}
+
+func (c *pngChunk) isColorSpace() bool {
+
+	switch c.typ {
+	case pngChunkCHRM, pngChunkGAMA, pngChunkICCP, pngChunkSRGB:
+		return true
+	}
+
+	return false
+}
+
+// pngMetadata returns total size (with chunk overhead) of ancillary chunks png.Decode drops, that is all of them
+// except tRNS (it is a part of pixel data), and intact color space chunks among them
+func pngMetadata(chunks []pngChunk) (size int, colorSpace []pngChunk) {
+
+	for i := range chunks {
+
+		c := &chunks[i]
+
+		if !c.isAncillary() || c.typ == pngChunkTRNS {
+			continue
+		}
+
+		size += len(c.data) + pngChunkOverhead
+
+		if c.isColorSpace() && c.validCRC() {
+			colorSpace = append(colorSpace, *c)
+		}
+	}
+
+	return size, colorSpace
+}
+
+// injectPNGChunks returns png data with chunks inserted right after IHDR, which is valid place for any ancillary
+// chunk (color space ones MUST precede PLTE and IDAT)
+func injectPNGChunks(data []byte, chunks []pngChunk) *bytes.Buffer {
+
+	// signature + IHDR
+	n := len(pngSignature) + pngChunkOverhead + pngIHDRLen
+
+	b := bytes.NewBuffer(make([]byte, 0, len(data)+len(chunks)*pngChunkOverhead))
+	b.Write(data[:n])
+
+	for i := range chunks {
+		writePNGChunk(b, chunks[i].typ, chunks[i].data)
+	}
+
+	b.Write(data[n:])
+
+	return b
+}
+
+var (
+	errPNGMetadataLeft = errors.New("metadata chunk left in optimized PNG")
+)
+
+// checkPNGStripped makes sure optimized png data carries no ancillary chunk besides tRNS and kept ones
+func checkPNGStripped(data []byte, kept []pngChunk) (err error) {
+
+	chunks, _, err := readPNGChunks(data)
+
+	if err != nil {
+		return err
+	}
+
+	for i := range chunks {
+
+		c := &chunks[i]
+
+		if !c.isAncillary() || c.typ == pngChunkTRNS {
+			continue
+		}
+
+		found := false
+
+		for j := range kept {
+			if kept[j].typ == c.typ {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return fmt.Errorf("%w: %s", errPNGMetadataLeft, c.typ)
+		}
+	}
+
+	return nil
+}
+
+func writePNGChunk(b *bytes.Buffer, typ string, data []byte) {
+
+	var buf [4]byte
+
+	binary.BigEndian.PutUint32(buf[:], uint32(len(data)))
+	b.Write(buf[:])
+	b.WriteString(typ)
+	b.Write(data)
+	binary.BigEndian.PutUint32(buf[:], pngChunkCRC(typ, data))
+	b.Write(buf[:])
+}
+
+// repairPNG recovers png that strict decoder rejects: drops ancillary chunks with broken CRC (they are of no use
+// for pixel data anyway), recalculates CRC of critical chunks and tRNS (their content is still checked by
+// the decoder itself, e.g. IDAT by zlib adler32) and appends missing IEND;
+// returns number of repaired chunks, 0 means there is nothing to repair
+func repairPNG(data []byte) (_ []byte, repaired int, err error) {
+
+	chunks, _, err := readPNGChunks(data)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	b := bytes.NewBuffer(make([]byte, 0, len(data)))
+	b.WriteString(pngSignature)
+
+	for i := range chunks {
+
+		c := &chunks[i]
+
+		if !c.validCRC() {
+
+			repaired++
+
+			if c.isAncillary() && c.typ != pngChunkTRNS {
+				continue
+			}
+		}
+
+		writePNGChunk(b, c.typ, c.data)
+	}
+
+	if len(chunks) == 0 || chunks[len(chunks)-1].typ != pngChunkIEND {
+		repaired++
+		writePNGChunk(b, pngChunkIEND, nil)
+	}
+
+	return b.Bytes(), repaired, nil
+}
@@ -18,15 +18,21 @@ package service
 
 import (
 	"bytes"
+	"compress/zlib"
 	"errors"
 	"fmt"
 	"image"
 	"image/color"
 	"image/draw"
 	"image/png"
+	"io"
+	"io/fs"
 	"math"
 	"os"
 	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 // SEE https://repository.root-me.org/St%C3%A9ganographie/EN%20-%20PNG%20(Portable%20Network%20Graphics)%20Specification%20version%201.2.pdf
@@ -46,12 +52,55 @@ import (
 */
 
 type PNGOptimizer struct {
-	encoder png.Encoder
+	encoder    png.Encoder
+	buffers    pngBufferPool
+	exhaustive bool // see WithExhaustive
+
+	timings pngTimings
+
+	// onVariants if set (by tests) sees every list of variants compared by smallest
+	onVariants func(v variantsList)
+}
+
+// pngTimings see Timings, verify of optimized png counts as decode
+type pngTimings struct {
+	decode, encode, io durationCounter
+}
+
+// Timings implements TimingsReporter
+func (o *PNGOptimizer) Timings() Timings {
+	return Timings{Decode: o.timings.decode.load(), Encode: o.timings.encode.load(), IO: o.timings.io.load()}
+}
+
+// pngBufferPool implements png.EncoderBufferPool, every image is encoded up to several times (one per variant),
+// so zlib writer state is reused instead of being allocated for each Encode call
+// NOTE sync.Pool safe for concurrent use
+type pngBufferPool struct {
+	pool sync.Pool
+}
+
+func (p *pngBufferPool) Get() *png.EncoderBuffer {
+
+	if b, ok := p.pool.Get().(*png.EncoderBuffer); ok {
+		return b
+	}
+
+	return nil // png.Encoder allocates new one itself
+}
+
+func (p *pngBufferPool) Put(b *png.EncoderBuffer) {
+	p.pool.Put(b)
 }
 
 type pngImage struct {
-	size int64
-	img  image.Image
+	size     int64
+	header   pngHeader
+	img      image.Image
+	repaired int
+	trailing int // junk bytes after IEND
+	metadata int // bytes of ancillary chunks dropped by png.Decode, SEE pngMetadata
+	// colorSpace gAMA, cHRM, sRGB, iCCP chunks of the source to keep with OptimizeOptions.KeepMetadata
+	colorSpace []pngChunk
 }
 
 const (
@@ -59,92 +108,346 @@ const (
 )
 
 var (
-	pngOptimizer = PNGOptimizer{
-		encoder: png.Encoder{
-			CompressionLevel: png.BestCompression,
-			// TODO BufferPool:       nil,
-		},
+	pngLevels = map[string]png.CompressionLevel{
+		"best":    png.BestCompression,
+		"default": png.DefaultCompression,
+		"speed":   png.BestSpeed,
+		"none":    png.NoCompression,
 	}
 )
 
-func init() {
-	registryAssetOptimizer(extPNG, &pngOptimizer)
+// parsePNGLevel maps --png-level name to png.CompressionLevel, empty name is png.BestCompression
+func parsePNGLevel(name string) (_ png.CompressionLevel, err error) {
+
+	if name == "" {
+		return png.BestCompression, nil
+	}
+
+	level, ok := pngLevels[strings.ToLower(name)]
+
+	if !ok {
+		return 0, fmt.Errorf("unknown png level %q, must be one of best, default, speed, none", name)
+	}
+
+	return level, nil
+}
+
+// zlibLevel is the same mapping of png.CompressionLevel to zlib level as png.Encoder does for encodeRawPNG
+func (o *PNGOptimizer) zlibLevel() int {
+
+	switch o.encoder.CompressionLevel {
+	case png.NoCompression:
+		return zlib.NoCompression
+	case png.BestSpeed:
+		return zlib.BestSpeed
+	case png.BestCompression:
+		return zlib.BestCompression
+	default:
+		return zlib.DefaultCompression
+	}
 }
 
 // SEE gg.LoadPNG https://github.com/fogleman/gg/blob/master/util.go
-func (o *PNGOptimizer) loadPNG(path string) (_ *pngImage, err error) {
+func (o *PNGOptimizer) loadPNG(path string, lenient bool) (_ *pngImage, err error) {
 
-	file, err := os.Open(path)
+	// NOTE файл целиком читается в память, чтобы помимо декодирования можно было разобрать сырые чанки
+	data, err := o.readPNG(path)
 
 	if err != nil {
 		return nil, err
 	}
 
-	defer file.Close()
+	return o.decodePNG(data, lenient)
+}
+
+func (o *PNGOptimizer) readPNG(path string) (_ []byte, err error) {
+	defer o.timings.io.since(time.Now())
+	return os.ReadFile(path)
+}
+
+func (o *PNGOptimizer) decodePNG(data []byte, lenient bool) (_ *pngImage, err error) {
 
-	fi, err := file.Stat()
+	defer o.timings.decode.since(time.Now())
+
+	header, err := readPNGHeader(data)
 
 	if err != nil {
 		return nil, err
 	}
 
-	img, err := png.Decode(file)
+	// NOTE png.Decode игнорирует все, что идет после IEND, поэтому при перекодировании мусор в хвосте
+	//      отбрасывается сам собой, здесь его размер только подсчитывается для отчета
+	var (
+		trailing   int
+		metadata   int
+		colorSpace []pngChunk
+	)
+
+	// NOTE метаданные (tEXt, tIME, pHYs, iCCP, ...) png.Decode тоже отбрасывает, подсчитываем их так же
+	chunks, tail, err := readPNGChunks(data)
+
+	if err == nil {
+		trailing = len(tail)
+		metadata, colorSpace = pngMetadata(chunks)
+		err = checkPNGChunks(chunks)
+	}
+
+	var img image.Image
+
+	// NOTE недокачанный или битый файл до декодера не доходит: тот может упасть поздно и невнятно, а оригинал
+	//      еще можно докачать, так что его ни в коем случае нельзя заменить
+	if err == nil {
+		img, err = png.Decode(bytes.NewReader(data))
+	} else {
+		err = fmt.Errorf("%w: %w", errPNGCorrupt, err)
+	}
+
+	var repaired int
+
+	// NOTE починка только как fallback, валидные файлы всегда декодируются как есть
+	if err != nil && lenient {
+
+		var fixed []byte
+
+		if fixed, repaired, _ = repairPNG(data); repaired > 0 {
+			img, err = png.Decode(bytes.NewReader(fixed))
+		}
+	}
 
 	if err != nil {
 		return nil, err
 	}
 
 	return &pngImage{
-		size: fi.Size(),
-		img:  img,
+		size:       int64(len(data)),
+		header:     header,
+		img:        img,
+		repaired:   repaired,
+		trailing:   trailing,
+		metadata:   metadata,
+		colorSpace: colorSpace,
 	}, nil
 }
 
-func savePNG(path string, b *bytes.Buffer) (err error) {
+// NOTE сперва сохраняем временный файл, потом его атомарно mv
+func (o *PNGOptimizer) savePNG(path string, b *bytes.Buffer) (err error) {
+	defer o.timings.io.since(time.Now())
+	return replaceAsset(path, ".pngtmp", b)
+}
+
+// SEE https://github.com/aprimadi/imagecomp
+
+// Optimize optimizes png file path in-place (or writes it to opts.Output), see OptimizeBytes
+func (o *PNGOptimizer) Optimize(path string, opts *OptimizeOptions) (res OptimizeResult, err error) {
 
-	fp, err := os.Create(path)
+	data, err := o.readPNG(path)
 
 	if err != nil {
-		return err
+		return res, fmt.Errorf("PNGOptimizer optimize error: %w", err)
 	}
 
-	defer fp.Close()
+	opt, res, err := o.optimizeData(data, opts)
+
+	if err != nil || res.NOOP || opts.DryRun {
+		return res, err
+	}
+
+	start := time.Now()
+
+	err = saveAsset(path, ".pngtmp", opt, opts)
 
-	_, err = b.WriteTo(fp)
+	o.timings.io.since(start)
 
-	return err
+	if err != nil {
+		return res, err
+	}
+
+	return res, nil
 }
 
-// NOTE сперва сохраняем временный файл, потом его атомарно mv
-func (o *PNGOptimizer) savePNG(path string, b *bytes.Buffer) (err error) {
+// OptimizeFS optimizes png path of fsys as Optimize does, but returns the result, see FSOptimizer
+func (o *PNGOptimizer) OptimizeFS(fsys fs.FS, path string, opts *OptimizeOptions) (opt *bytes.Buffer, res OptimizeResult,
+	err error) {
 
-	dstPath := path + ".pngtmp"
+	start := time.Now()
 
-	if err = savePNG(dstPath, b); err != nil {
-		return err
+	data, err := fs.ReadFile(fsys, path)
+
+	o.timings.io.since(start)
+
+	if err != nil {
+		return nil, res, fmt.Errorf("PNGOptimizer optimize error: %w", err)
 	}
 
-	// mv
-	if err = os.Rename(dstPath, path); err != nil {
-		return err
+	return o.optimizeData(data, opts)
+}
+
+var (
+	// NOTE то же, что по умолчанию у CLI, за исключением починки битых файлов
+	optimizeBytesOptions = OptimizeOptions{
+		Effort: EffortDefault,
+		Verify: true,
 	}
+)
 
-	return nil
+// OptimizeBytes optimizes png data in memory with opts (Output, Backup and DryRun do not apply), nil opts - all
+// lossless variants and pixel check of the result; returns data itself (and res.NOOP) if nothing smaller was found
+func (o *PNGOptimizer) OptimizeBytes(data []byte, opts *OptimizeOptions) (_ []byte, res OptimizeResult, err error) {
+
+	if opts == nil {
+		opts = &optimizeBytesOptions
+	}
+
+	opt, res, err := o.optimizeData(data, opts)
+
+	if err != nil {
+		return nil, res, err
+	}
+
+	if res.NOOP {
+		return data, res, nil
+	}
+
+	return opt.Bytes(), res, nil
 }
 
-// SEE https://github.com/aprimadi/imagecomp
+// optimizeData decodes png data and encodes its best variant, opt is nil for NOOP
+func (o *PNGOptimizer) optimizeData(data []byte, opts *OptimizeOptions) (
+	opt *bytes.Buffer, res OptimizeResult, err error) {
 
-// TODO отчет о количестве сэкономленных байт
-func (o *PNGOptimizer) Optimize(path string) (_ uint, err error) {
+	// NOTE png.Decode отвергает нулевые размеры как битый файл, а пустые заглушки 0x0 / 1x0 в паках ассетов
+	//      встречаются, оптимизировать в них нечего
+	if h, err := readPNGHeader(data); err == nil && (h.width == 0 || h.height == 0) {
+		res.Size, res.NOOP = int64(len(data)), true
+		res.Reason = fmt.Sprintf("empty image %dx%d", h.width, h.height)
+		return nil, res, nil
+	}
 
 	// NOTE png.Decode весьма черезжопно работает с особыми случаями типа "RGA / Gray + tRNS transparent color",
 	//      считывая их все как NRGBA / NRGBA64
-	img, err := o.loadPNG(path)
+	img, err := o.decodePNG(data, opts.LenientDecode)
+
+	if err != nil {
+		return nil, res, fmt.Errorf("PNGOptimizer optimize error: %w", err)
+	}
+
+	var as string
+
+	start := time.Now()
+
+	// NOTE WithExhaustive перебирает все независимо от effort
+	if opts.Effort <= EffortFast && !o.exhaustive {
+		opt, as, err = o.encodeSrc(img.img)
+	} else if opt, as, err = o.OptimizeImage(img.img); err == nil {
+		opt, as, err = o.refilter(opt, as, opts.Effort)
+	}
+
+	o.timings.encode.since(start)
+
+	// check error
+	if err != nil {
+		return nil, res, err
+	}
+
+	var (
+		kept    []pngChunk
+		dropped = img.metadata
+	)
+
+	if opts.KeepMetadata && len(img.colorSpace) > 0 {
+		opt, kept = o.keepColorSpace(opt, img)
+	}
+
+	for i := range kept {
+		dropped -= len(kept[i].data) + pngChunkOverhead
+	}
+
+	res = OptimizeResult{
+		Size:          img.size,
+		OptimizedSize: int64(opt.Len()),
+		Variant:       as,
+	}
+
+	// NOTE починенный файл перезаписывается чистым в любом случае, даже если он не стал меньше
+	if img.repaired > 0 {
+		res.Variant = fmt.Sprintf("%s, repaired %d chunk(s)", res.Variant, img.repaired)
+	} else if opts.keepOriginal(&res) {
+		return nil, res, nil
+	}
+
+	// NOTE png.Encoder всегда пишет без interlace, т.е. любой из вариантов уже de-interlaced
+	if img.header.isInterlaced() {
+		res.Variant += ", de-interlaced"
+	}
+
+	if img.trailing > 0 {
+		res.Variant = fmt.Sprintf("%s, dropped %d trailing bytes", res.Variant, img.trailing)
+	}
+
+	if dropped > 0 {
+		res.Metadata = int64(dropped)
+		res.Variant = fmt.Sprintf("%s, stripped %d metadata bytes", res.Variant, dropped)
+	}
+
+	// NOTE encoder сам никаких метаданных не пишет, но гарантия дешевая
+	if err = checkPNGStripped(opt.Bytes(), kept); err != nil {
+		return nil, res, fmt.Errorf("PNGOptimizer %s error: %w", as, err)
+	}
+
+	// NOTE проверка до dry run, чтобы и он ловил сломанные варианты
+	if opts.Verify {
+
+		start = time.Now()
+		err = o.verify(img.img, opt.Bytes())
+		o.timings.decode.since(start)
+
+		if err != nil {
+			return nil, res, fmt.Errorf("PNGOptimizer verify %s error: %w", as, err)
+		}
+	}
+
+	return opt, res, nil
+}
+
+// keepColorSpace re-injects color space chunks of the source into optimized png opt
+//
+// NOTE iCCP профиль бывает только gray или только RGB под цветовой тип изображения (SEE $ 4.2.2.4),
+//
+//	поэтому если лучший вариант сменил gray на цветной (или наоборот), профиль уже не годится и отбрасывается
+func (o *PNGOptimizer) keepColorSpace(opt *bytes.Buffer, img *pngImage) (_ *bytes.Buffer, kept []pngChunk) {
+
+	h, err := readPNGHeader(opt.Bytes())
 
 	if err != nil {
-		return 0, fmt.Errorf("PNGOptimizer optimize error: %w", err)
+		return opt, nil
+	}
+
+	isGray := func(colorType uint8) bool {
+		return colorType&pngColorRGB == 0 // 0 - gray, 4 - gray + alpha
+	}
+
+	for i := range img.colorSpace {
+
+		c := img.colorSpace[i]
+
+		if c.typ == pngChunkICCP && isGray(h.colorType) != isGray(img.header.colorType) {
+			continue
+		}
+
+		kept = append(kept, c)
 	}
 
+	if len(kept) == 0 {
+		return opt, nil
+	}
+
+	return injectPNGChunks(opt.Bytes(), kept), kept
+}
+
+// OptimizeImage encodes every lossless variant of already decoded img (source color type, gray, paletted, ...)
+// and returns the smallest one with its name
+func (o *PNGOptimizer) OptimizeImage(img image.Image) (best *bytes.Buffer, as string, err error) {
+
 	/* список всех вариантов из png.Decode (go 1.20)
 	gray     *image.Gray // cbG1, cbG2, cbG4, cbG8
 	rgba     *image.RGBA // cbTC8
@@ -155,154 +458,627 @@ func (o *PNGOptimizer) Optimize(path string) (_ uint, err error) {
 	nrgba64  *image.NRGBA64 // cbTCA16; cbTC16 + useTransparent; cbGA16 + useTransparent; cbG16 + useTransparent
 	*/
 
-	var (
-		opt *bytes.Buffer
-		as  string
-	)
-
 	// SEE https://blog.sensecodons.com/2022/10/speed-up-png-encoding-in-go-with-nrgba.html
 	// SEE https://repository.root-me.org/St%C3%A9ganographie/EN%20-%20PNG%20(Portable%20Network%20Graphics)%20Specification%20version%201.2.pdf
 	//     $ 2.4: "PNG does not use premultiplied alpha."
 	//     $ 12.8 Non-premultiplied alpha
-	switch v := img.img.(type) {
+
+	if img.Bounds().Empty() {
+		return nil, "", errEmptyImage
+	}
+
+	variants, err := o.variants(img)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	return o.best(variants)
+}
+
+// variants returns every lossless variant of not empty img, the nested pipelines (e.g. 16-bit -> 8-bit) only add
+// their variants to the list, so WithExhaustive search of best runs once over all of them
+func (o *PNGOptimizer) variants(img image.Image) (_ variantsList, err error) {
+
+	switch v := img.(type) {
 	case *image.RGBA:
-		opt, as, err = o.optimizeRGBA(v)
+		return o.rgbaVariants(v)
 	case *image.NRGBA:
-		opt, as, err = o.optimizeNRGBA(v)
+		return o.nrgbaVariants(v)
 	case *image.Paletted:
-		opt, as, err = o.optimizePaletted(v)
+		return o.palettedVariants(v)
 	case *image.Gray:
-		opt, as, err = o.optimizeGray(v)
-	// TODO сделать оптимизации для gray16, rgba64, nrgba64
-	default:
-		opt = bytes.NewBuffer(nil)
+		return o.grayVariants(v)
+	case *image.Gray16:
+		return o.gray16Variants(v)
+	case *image.RGBA64:
+		return o.rgba64Variants(v)
+	case *image.NRGBA64:
+		return o.nrgba64Variants(v)
+	}
 
-		if err = o.encoder.Encode(opt, v); err != nil {
-			return 0, fmt.Errorf("error encode src: %w", err)
-		}
+	b, as, err := o.encodeSrc(img)
+
+	if err != nil {
+		return nil, err
 	}
 
-	// check error
+	return variantsList{{b, as}}, nil
+}
+
+// refilter re-encodes already chosen variant opt with row filters png.Encode does not try and returns the smallest
+// of them and opt itself
+func (o *PNGOptimizer) refilter(opt *bytes.Buffer, as string, effort int) (_ *bytes.Buffer, _ string, err error) {
+
+	if o.encoder.CompressionLevel == png.NoCompression {
+		return opt, as, nil
+	}
+
+	h, err := readPNGHeader(opt.Bytes())
+
 	if err != nil {
-		return 0, err
+		return nil, "", fmt.Errorf("error refilter %s: %w", as, err)
 	}
 
-	sz := int64(opt.Len())
-	delta := img.size - sz
+	rows, err := unfilterPNG(opt.Bytes())
 
-	if delta <= 0 { // img.size <= int64(opt.Len())
-		fmt.Println(" NOOP")
-		return 0, nil
+	if err != nil {
+		return nil, "", fmt.Errorf("error refilter %s: %w", as, err)
 	}
 
-	pct := float64(delta) / float64(img.size) * 100
+	// NOTE png.Encode фильтрует строки эвристикой минимальной суммы модулей (как libpng), а paletted и < 8 бит не
+	//      фильтрует вовсе, тогда как плоским спрайтам часто выгоднее ровно обратное, поэтому пробуется "другой"
+	//      режим: adaptive для paletted / < 8 бит и none для остальных, с effort > 1 еще и каждый фильтр отдельно
+	filters := []int{pngFilterNone}
 
-	fmt.Printf(" SAVE AS %s : %d --> %d == %d bytes (%.2f%%)\n", as, img.size, sz, delta, pct)
+	if h.colorType == pngColorPaletted || h.bitDepth < 8 {
+		filters[0] = pngFilterAdaptive
+	}
 
-	if err = o.savePNG(path, opt); err != nil {
-		return 0, err
+	if effort > EffortDefault || o.exhaustive {
+		filters = append(filters, pngFilterSub, pngFilterUp, pngFilterAverage, pngFilterPaeth)
+	}
+
+	jobs := make([]variantJob, 0, len(filters))
+
+	for _, filter := range filters {
+
+		filter := filter
+
+		jobs = append(jobs, variantJob{as + ", filter " + pngFilterNames[filter], func() (*bytes.Buffer, error) {
+			return rows.encode(filter, o.zlibLevel())
+		}})
+	}
+
+	variants, err := encodeVariants(jobs)
+
+	if err != nil {
+		return nil, "", fmt.Errorf("error refilter %s: %w", as, err)
 	}
 
-	return uint(delta), nil
+	// NOTE при равном размере остается исходный вариант
+	return o.smallest(append(variantsList{{opt, as}}, variants...))
 }
 
-func (o *PNGOptimizer) optimizeRGBA(src *image.RGBA) (_ *bytes.Buffer, as string, err error) {
-	// https://stackoverflow.com/a/58259978
-	b := src.Bounds()
-	img := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
-	draw.Draw(img, img.Bounds(), src, b.Min, draw.Src)
-	return o.optimizeNRGBA(img)
+var (
+	errEmptyImage   = errors.New("empty image can not be encoded as png")
+	errVerifyBounds = errors.New("optimized image size differs from the source")
+)
+
+// verify decodes optimized png data and compares it with src pixel by pixel
+func (o *PNGOptimizer) verify(src image.Image, data []byte) (err error) {
+
+	dst, err := png.Decode(bytes.NewReader(data))
+
+	if err != nil {
+		return err
+	}
+
+	return comparePixels(src, dst)
 }
 
-func (o *PNGOptimizer) optimizeNRGBA(src *image.NRGBA) (_ *bytes.Buffer, as string, err error) {
+// comparePixels checks that dst has the same size and exactly the same pixels as src
+func comparePixels(src, dst image.Image) (err error) {
 
-	variants := make(variantsList, 0, 4) // src + gray + paletted
+	sb, db := src.Bounds(), dst.Bounds()
 
-	// 0й вариант есть всегда - прямо сжатие src
-	{
-		b := bytes.NewBuffer(nil)
+	if sb.Dx() != db.Dx() || sb.Dy() != db.Dy() {
+		return errVerifyBounds
+	}
 
-		if err = o.encoder.Encode(b, src); err != nil {
-			return nil, "", fmt.Errorf("error encode src: %w", err)
-		}
+	for y := 0; y < sb.Dy(); y++ {
+		for x := 0; x < sb.Dx(); x++ {
 
-		variants = append(variants, variant{b, "src (nrgba/rgb)"})
+			sc, dc := exactNRGBA64(src.At(sb.Min.X+x, sb.Min.Y+y)), exactNRGBA64(dst.At(db.Min.X+x, db.Min.Y+y))
+
+			if sc != dc {
+				return fmt.Errorf("pixel (%d, %d) %v differs from the source %v", x, y, dc, sc)
+			}
+		}
 	}
 
-	nColors, hasTransparent, hasPartAlpha, isGray := o.countNRGBAColors(src)
+	return nil
+}
+
+// exactNRGBA64 widens c without any loss, all fully transparent colors are the same {0, 0, 0, 0}
+//
+// NOTE color.NRGBA64Model.Convert идет через premultiplied RGBA() и для полупрозрачных 8-bit цветов
+// неточен, поэтому известные png.Decode non-premultiplied типы расширяются напрямую
+func exactNRGBA64(c color.Color) (n color.NRGBA64) {
+
+	switch v := c.(type) {
+	case color.NRGBA:
+		n = color.NRGBA64{R: uint16(v.R) * 0x101, G: uint16(v.G) * 0x101, B: uint16(v.B) * 0x101, A: uint16(v.A) * 0x101}
+	case color.NRGBA64:
+		n = v
+	default:
+		// остальные (Gray, Gray16, RGBA, RGBA64 и цвета палитры без tRNS) у png.Decode всегда непрозрачны, а
+		// premultiplied RGBA, RGBA64 от tiff.Decode и так идут через RGBA() без потерь
+		n = color.NRGBA64Model.Convert(c).(color.NRGBA64)
+	}
 
-	hasAlpha := hasTransparent || hasPartAlpha
+	if n.A == 0 {
+		n = color.NRGBA64{}
+	}
 
-	if isGray && !hasAlpha {
+	return n
+}
 
-		b, gray := bytes.NewBuffer(nil), o.nrgba2gray(src)
+// encodeSrc just re-encodes decoded image as is
+func (o *PNGOptimizer) encodeSrc(src image.Image) (b *bytes.Buffer, as string, err error) {
 
-		if err = o.encoder.Encode(b, gray); err != nil {
-			return nil, "", fmt.Errorf("error encode gray: %w", err)
-		}
+	b = bytes.NewBuffer(nil)
 
-		variants = append(variants, variant{b, "gray"})
+	if err = o.encoder.Encode(b, src); err != nil {
+		return nil, "", fmt.Errorf("error encode src: %w", err)
 	}
 
-	// TODO? граничный случай с 0 цветов
+	return b, "src", nil
+}
 
-	// NOTE на текущий момент (go 1.20) голанг png.Encode умеет либо PLTE+tRNS, либо Alpha-channel (gray or rgb),
-	//      но НЕ умеет rga + tRNS, gray + tRNS, это упрощает алгоритм, но убивает оптимизацию очень маленьких
-	//		насыщенных цветом изображений (число цветов ~= числу пикселей), у которых есть 1 прозрачный альфа цвет
-	//      (transparent)
-	//      ПРИЧЕМ png.Decode при этом понимает такие особые случаи и умеет с ними работать, см. Optimize()
+// Downscale implements ResponsiveOptimizer: writes src downscaled by scale and optimized as usual png to dst
+func (o *PNGOptimizer) Downscale(src, dst string, scale int) (_ uint, err error) {
 
-	// TODO на самом деле должны сравнивать
+	img, err := o.loadPNG(src, false)
 
-	// Indexed-color images of up to 256 colors.
-	if nColors <= 256 {
+	if err != nil {
+		return 0, fmt.Errorf("PNGOptimizer downscale error: %w", err)
+	}
 
-		var b *bytes.Buffer
+	start := time.Now()
 
-		// SEE https://stackoverflow.com/questions/35850753/how-to-convert-image-rgba-image-image-to-image-paletted
-		if b, err = o.asPaletted(src, o.paletteFromNRGBA(src, nColors)); err != nil {
-			return nil, "", err
-		}
+	opt, _, err := o.OptimizeImage(downscaleBox(img.img, scale))
 
-		variants = append(variants, variant{b, "paletted"})
+	o.timings.encode.since(start)
+
+	if err != nil {
+		return 0, err
+	}
+
+	sz := uint(opt.Len())
+
+	if err = o.savePNG(dst, opt); err != nil {
+		return 0, err
 	}
 
-	return variants.best()
+	return sz, nil
 }
 
-// без учета серых изображений, есть 3 основных варианта сохранения цветных изображений как RGBA:
-// - альфа цвета нет вообще
-// - есть ровно 1 альфа цвет - полная прозрачность
-// - есть несколько (от 1 и больше) полупрозрачных цветов, что может включать в себя также полную прозрачность
-// для каждого из которых имеет смысл собственная особая обработка
-func (o *PNGOptimizer) countNRGBAColors(img *image.NRGBA) (n uint, hasTransparent, hasPartAlpha, isGray bool) {
+// EncodeWebP implements WebPEncoder: encodes path as lossless WebP, nil if the image has real 16-bit precision
+func (o *PNGOptimizer) EncodeWebP(path string, opts *OptimizeOptions) (_ *bytes.Buffer, err error) {
 
-	isGray = true
-	hasTransparent = false
-	hasPartAlpha = false
+	img, err := o.loadPNG(path, opts.LenientDecode)
 
-	// NOTE key as color.NRGBA concrete struct faster than key of color.Color abstract iface
-	// TODO key as uint64
-	colors := make(map[color.NRGBA]struct{})
+	if err != nil {
+		return nil, fmt.Errorf("PNGOptimizer webp error: %w", err)
+	}
 
-	bounds := img.Bounds()
+	var src *image.NRGBA
 
-	// SEE https://github.com/KEINOS/go-pallet/blob/main/pallet/pallet.go
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			c := img.NRGBAAt(x, y)
+	// NOTE VP8L хранит только 8-битные каналы, 16-битные изображения годятся лишь если сводятся к 8 битам без потерь
+	switch v := img.img.(type) {
+	case *image.NRGBA:
+		src = v
+	case *image.RGBA:
+		src = o.rgba2nrgba(v)
+	case *image.Paletted:
+		src = o.paletted2nrgba(v)
+	case *image.Gray:
+		src = image.NewNRGBA(image.Rect(0, 0, v.Rect.Dx(), v.Rect.Dy()))
+		draw.Draw(src, src.Bounds(), v, v.Rect.Min, draw.Src)
+	case *image.Gray16:
+		if gray := o.gray16to8(v); gray != nil {
+			src = image.NewNRGBA(gray.Rect)
+			draw.Draw(src, src.Bounds(), gray, image.Point{}, draw.Src)
+		}
+	case *image.NRGBA64:
+		src = o.nrgba64to8(v)
+	case *image.RGBA64:
+		// NOTE см. rgba64Variants, png.Decode отдает RGBA64 только для непрозрачного cbTC16
+		if v.Opaque() {
+			src = o.nrgba64to8(&image.NRGBA64{Pix: v.Pix, Stride: v.Stride, Rect: v.Rect})
+		}
+	}
 
-			// TODO для `c.A === 0` надо унифицировать цвет к {0, 0, 0, 0}, потому что визуально
-			//      это полная прозрачность для любых значений RGB
-			//  но для этого сперва надо проверить, правильно ли работают алгоритмы сохранения палитры в png save,
-			//  плюс преобразовывать в таком случае оригинал при сохранении в RGBA, подменяя все transparent цвета,
-			//  если они не соответствуют {0, 0, 0, 0}
+	if src == nil {
+		return nil, nil
+	}
 
-			colors[c] = struct{}{}
+	b, err := encodeWebPLossless(src)
 
-			// проверяем серость
-			// if r, g, b, _ := c.RGBA(); r != g || r != b || g != b {
-			if c.R != c.G || c.R != c.B || c.G != c.B {
+	if err != nil {
+		return nil, fmt.Errorf("PNGOptimizer webp error: %w", err)
+	}
+
+	return b, nil
+}
+
+// errNoPalette is DumpPalette error of image its paletted variant is not tried for
+var errNoPalette = errors.New("no palette is built")
+
+// DumpPalette implements PaletteDumper: prints palette of paletted variant of path, each entry with its frequency;
+// image with no paletted variant (16-bit, more than 256 colors) is errNoPalette
+func (o *PNGOptimizer) DumpPalette(path string, w io.Writer, opts *OptimizeOptions) (err error) {
+
+	img, err := o.loadPNG(path, opts.LenientDecode)
+
+	if err != nil {
+		return fmt.Errorf("PNGOptimizer dump palette error: %w", err)
+	}
+
+	var src *image.NRGBA
+
+	// NOTE те же преобразования, что и в Optimize
+	switch v := img.img.(type) {
+	case *image.RGBA:
+		src = o.rgba2nrgba(v)
+	case *image.NRGBA:
+		src = v
+	case *image.Paletted:
+		fmt.Fprintf(w, "source palette: %d entries\n", len(v.Palette))
+		src = o.paletted2nrgba(v)
+	case *image.Gray:
+		o.dumpGrayPalette(w, v)
+		return nil
+	default:
+		return fmt.Errorf("PNGOptimizer dump palette error: %w for %T", errNoPalette, v)
+	}
+
+	return o.dumpNRGBAPalette(w, src)
+}
+
+func (o *PNGOptimizer) dumpNRGBAPalette(w io.Writer, src *image.NRGBA) (err error) {
+
+	freqs, _, _, _ := o.countNRGBAColors(src)
+
+	if len(freqs) > 256 {
+		return fmt.Errorf("PNGOptimizer dump palette error: %w for %d colors, more than 256", errNoPalette, len(freqs))
+	}
+
+	rawPalette := o.nrgbaPaletteFreqs(freqs)
+
+	// NOTE png.Encode пишет tRNS до последнего непрозрачного элемента включительно
+	nTRNS := 0
+
+	for i := range rawPalette {
+		if rawPalette[i].c.A < math.MaxUint8 {
+			nTRNS = i + 1
+		}
+	}
+
+	fmt.Fprintf(w, "palette: %d entries, tRNS: %d entries\n", len(rawPalette), nTRNS)
+	fmt.Fprintln(w, "order: fully transparent (all A = 0 folded into one entry) first, then partially transparent,"+
+		" then opaque, the most frequent first within a group, so that tRNS is as short as possible")
+	fmt.Fprintln(w, " idx  RGBA       freq")
+
+	for i := range rawPalette {
+		c := rawPalette[i].c
+		fmt.Fprintf(w, "%4d  #%02x%02x%02x%02x  %d\n", i, c.R, c.G, c.B, c.A, rawPalette[i].freq)
+	}
+
+	return nil
+}
+
+func (o *PNGOptimizer) dumpGrayPalette(w io.Writer, src *image.Gray) {
+
+	levels, freqs := o.grayPaletteFreqs(src, o.countGrayColors(src))
+
+	fmt.Fprintf(w, "palette: %d entries, tRNS: 0 entries\n", len(levels))
+	fmt.Fprintln(w, "order: the most frequent first, equal frequency by brightness (deterministic output)")
+	fmt.Fprintln(w, " idx  Y     freq")
+
+	for i, y := range levels {
+		fmt.Fprintf(w, "%4d  #%02x   %d\n", i, y, freqs[y])
+	}
+}
+
+func (o *PNGOptimizer) rgbaVariants(src *image.RGBA) (_ variantsList, err error) {
+	return o.nrgbaVariants(o.rgba2nrgba(src))
+}
+
+func (o *PNGOptimizer) rgba2nrgba(src *image.RGBA) *image.NRGBA {
+
+	// NOTE png.Decode отдает *image.RGBA только для cbTC8, т.е. без альфы, а у полностью непрозрачного
+	//      изображения premultiplied и non-premultiplied представления побайтно совпадают, поэтому
+	//      NRGBA строится поверх того же Pix без копирования (дальше src только читается)
+	if src.Opaque() {
+		return &image.NRGBA{Pix: src.Pix, Stride: src.Stride, Rect: src.Rect}
+	}
+
+	// https://stackoverflow.com/a/58259978
+	b := src.Bounds()
+	img := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(img, img.Bounds(), src, b.Min, draw.Src)
+	return img
+}
+
+func (o *PNGOptimizer) rgba64Variants(src *image.RGBA64) (_ variantsList, err error) {
+
+	// NOTE аналогично rgbaVariants: png.Decode отдает *image.RGBA64 только для cbTC16 без альфы, а у непрозрачного
+	//      изображения раскладка Pix та же, что у NRGBA64
+	if src.Opaque() {
+		return o.nrgba64Variants(&image.NRGBA64{Pix: src.Pix, Stride: src.Stride, Rect: src.Rect})
+	}
+
+	// NOTE PNG хранит non-premultiplied альфу, поэтому сравнивать (и сводить к 8 битам) можно только после
+	//      того же обратного преобразования, которое сделал бы сам png.Encode
+	b := src.Bounds()
+	img := image.NewNRGBA64(image.Rect(0, 0, b.Dx(), b.Dy()))
+
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			img.SetNRGBA64(x-b.Min.X, y-b.Min.Y, color.NRGBA64Model.Convert(src.RGBA64At(x, y)).(color.NRGBA64))
+		}
+	}
+
+	return o.nrgba64Variants(img)
+}
+
+func (o *PNGOptimizer) nrgba64Variants(src *image.NRGBA64) (_ variantsList, err error) {
+
+	variants := make(variantsList, 0, 2)
+
+	{
+		b := bytes.NewBuffer(nil)
+
+		if err = o.encoder.Encode(b, src); err != nil {
+			return nil, fmt.Errorf("error encode src: %w", err)
+		}
+
+		variants = append(variants, variant{b, "src (nrgba64)"})
+	}
+
+	// 8-битные каналы, сохраненные как 16-битные, без потерь сводятся к NRGBA со всеми его вариантами (gray, paletted)
+	if nrgba := o.nrgba64to8(src); nrgba != nil {
+
+		list, err := o.nrgbaVariants(nrgba)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, v := range list {
+			variants = append(variants, variant{v.b, "8-bit " + v.as})
+		}
+	}
+
+	return variants, nil
+}
+
+// nrgba64to8 returns nil if any channel of visible pixel carries real 16-bit precision
+func (o *PNGOptimizer) nrgba64to8(img *image.NRGBA64) (nrgba *image.NRGBA) {
+
+	bounds := img.Bounds()
+
+	nrgba = image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+
+	// NOTE см. gray16to8, 4 канала по 2 байта big-endian; RGB полностью прозрачных пикселей не проверяется,
+	//      он визуально неразличим (см. countNRGBAColors)
+	for y := 0; y < bounds.Dy(); y++ {
+
+		row := img.Pix[y*img.Stride : y*img.Stride+bounds.Dx()*8]
+		dst := nrgba.Pix[y*nrgba.Stride : y*nrgba.Stride+bounds.Dx()*4]
+
+		for x := 0; x < len(dst); x += 4 {
+
+			px := row[2*x : 2*x+8]
+
+			if px[6] != px[7] {
+				return nil
+			}
+
+			if px[6] == 0 {
+				continue // fully transparent {0, 0, 0, 0}
+			}
+
+			if px[0] != px[1] || px[2] != px[3] || px[4] != px[5] {
+				return nil
+			}
+
+			dst[x], dst[x+1], dst[x+2], dst[x+3] = px[0], px[2], px[4], px[6]
+		}
+	}
+
+	return nrgba
+}
+
+// is1D single row or single column image (gradients, LUTs)
+func is1D(r image.Rectangle) bool {
+	return r.Dx() == 1 || r.Dy() == 1
+}
+
+func (o *PNGOptimizer) nrgbaVariants(src *image.NRGBA) (_ variantsList, err error) {
+
+	// NOTE частоты нужны только для палитры, но один проход по пикселям вместо двух
+	freqs, hasTransparent, hasPartAlpha, isGray := o.countNRGBAColors(src)
+	nColors := uint(len(freqs))
+
+	hasAlpha := hasTransparent || hasPartAlpha
+
+	bounds := src.Bounds()
+
+	// fast-path одномерных текстур: непрозрачный gray с > 16 уровнями всегда пишется как 8-bit gray, у paletted
+	// та же битность, те же (с точностью до перенумерации) данные плюс несжимаемый PLTE, а src (rgb) в 3 раза больше
+	if is1D(bounds) && isGray && !hasAlpha && nColors > 16 && !o.exhaustive {
+
+		var b *bytes.Buffer
+
+		if b, _, err = o.encodeSrc(o.nrgba2gray(src)); err != nil {
+			return nil, err
+		}
+
+		return variantsList{{b, "gray (1d)"}}, nil
+	}
+
+	// NOTE варианты независимы и каждый - полный png.Encode с BestCompression, поэтому кодируются параллельно,
+	//      порядок jobs задает приоритет при равном размере (см. encodeVariants)
+	jobs := make([]variantJob, 0, 5) // src + gray variants + paletted
+
+	// 0й вариант есть всегда - прямо сжатие src
+	jobs = append(jobs, variantJob{"src (nrgba/rgb)", func() (*bytes.Buffer, error) {
+
+		b := bytes.NewBuffer(nil)
+
+		if err := o.encoder.Encode(b, src); err != nil {
+			return nil, fmt.Errorf("error encode src: %w", err)
+		}
+
+		return b, nil
+	}})
+
+	if isGray && !hasAlpha {
+		jobs = append(jobs, variantJob{"gray", func() (*bytes.Buffer, error) {
+
+			b, gray := bytes.NewBuffer(nil), o.nrgba2gray(src)
+
+			if err := o.encoder.Encode(b, gray); err != nil {
+				return nil, fmt.Errorf("error encode gray: %w", err)
+			}
+
+			return b, nil
+		}})
+	}
+
+	// NOTE png.Encode пишет gray только 8-битным, а для черно-белого минимум - 1-bit gray без PLTE
+	if isGray && !hasAlpha && nColors <= 2 {
+		jobs = append(jobs, variantJob{"gray 1-bit", func() (*bytes.Buffer, error) {
+
+			b, err := o.encodeBilevelGray(o.nrgba2gray(src))
+
+			if err != nil {
+				return nil, fmt.Errorf("error encode gray 1-bit: %w", err)
+			}
+
+			return b, nil
+		}})
+	}
+
+	// NOTE на текущий момент (go 1.20) голанг png.Encode умеет либо PLTE+tRNS, либо Alpha-channel (gray or rgb),
+	//      но НЕ умеет rga + tRNS, gray + tRNS, что убивает оптимизацию очень маленьких насыщенных цветом
+	//      изображений (число цветов ~= числу пикселей), у которых есть 1 прозрачный альфа цвет (transparent),
+	//      поэтому gray + tRNS пишется собственным encodeRawPNG (SEE png_writer.go)
+	//      ПРИЧЕМ png.Decode при этом понимает такие особые случаи и возвращает их как NRGBA, а не Gray, поэтому
+	//      вариант живет здесь, а не в grayVariants
+	if isGray && hasTransparent && !hasPartAlpha {
+		// nil buffer - все 256 уровней серого заняты непрозрачными пикселями, прозрачному уровень не достается
+		jobs = append(jobs, variantJob{"gray+trns", func() (*bytes.Buffer, error) {
+
+			b, err := o.encodeGrayTRNS(src)
+
+			if err != nil {
+				return nil, fmt.Errorf("error encode gray+trns: %w", err)
+			}
+
+			return b, nil
+		}})
+	}
+
+	// NOTE png.Encode пишет альфа-канал только вместе с rgb (4 байта на пиксель), а у серого спрайта с мягкими
+	//      краями хватает gray + alpha (2 байта), который пишется собственным encodeRawPNG
+	if isGray && hasPartAlpha {
+		jobs = append(jobs, variantJob{"gray+alpha", func() (*bytes.Buffer, error) {
+
+			b, err := o.encodeGrayAlpha(src)
+
+			if err != nil {
+				return nil, fmt.Errorf("error encode gray+alpha: %w", err)
+			}
+
+			return b, nil
+		}})
+	}
+
+	// NOTE с > 256 цветами paletted невозможен, и единственный прозрачный цвет иначе заставляет писать
+	//      альфа-канал на каждый пиксель
+	if hasTransparent && !hasPartAlpha && (nColors > 256 || o.exhaustive) {
+		jobs = append(jobs, variantJob{"rgb+trns", func() (*bytes.Buffer, error) {
+
+			b, err := o.encodeRGBTRNS(src)
+
+			if err != nil {
+				return nil, fmt.Errorf("error encode rgb+trns: %w", err)
+			}
+
+			return b, nil
+		}})
+	}
+
+	// NOTE 0 цветов бывает только у пустого изображения, которое сюда не доходит (см. optimizeData и
+	//      OptimizeImage), так что палитра всегда хотя бы из одного цвета
+
+	// TODO на самом деле должны сравнивать
+
+	// NOTE у непрозрачной строки из уникальных цветов один только несжатый PLTE (3 байта на цвет) уже не меньше
+	//      сырых rgb данных src, так что paletted для нее заведомо проигрывает
+	uniqueRow := bounds.Dy() == 1 && !hasAlpha && nColors == uint(bounds.Dx())
+
+	// Indexed-color images of up to 256 colors.
+	if nColors <= 256 && (!uniqueRow || o.exhaustive) {
+		jobs = append(jobs, variantJob{"paletted", func() (*bytes.Buffer, error) {
+			// SEE https://stackoverflow.com/questions/35850753/how-to-convert-image-rgba-image-image-to-image-paletted
+			return o.asPaletted(src, o.paletteFromNRGBA(freqs))
+		}})
+	}
+
+	return encodeVariants(jobs)
+}
+
+// без учета серых изображений, есть 3 основных варианта сохранения цветных изображений как RGBA:
+// - альфа цвета нет вообще
+// - есть ровно 1 альфа цвет - полная прозрачность
+// - есть несколько (от 1 и больше) полупрозрачных цветов, что может включать в себя также полную прозрачность
+// для каждого из которых имеет смысл собственная особая обработка
+// countNRGBAColors makes the only pass over img pixels: frequency of every color (all fully transparent colors
+// are folded into {0, 0, 0, 0}) keyed by packNRGBA, number of colors is len(freqs)
+func (o *PNGOptimizer) countNRGBAColors(img *image.NRGBA) (freqs map[uint32]uint, hasTransparent, hasPartAlpha,
+	isGray bool) {
+
+	isGray = true
+	hasTransparent = false
+	hasPartAlpha = false
+
+	// NOTE ключ uint32 (SEE packNRGBA) хэшируется заметно быстрее структуры color.NRGBA,
+	//      а та в свою очередь быстрее абстрактного color.Color
+	freqs = make(map[uint32]uint)
+
+	bounds := img.Bounds()
+
+	// SEE https://github.com/KEINOS/go-pallet/blob/main/pallet/pallet.go
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := img.NRGBAAt(x, y)
+
+			// NOTE все полностью прозрачные цвета визуально неразличимы, поэтому сводятся к единственному
+			//      элементу палитры {0, 0, 0, 0}, иначе лишние "цвета" могут вытолкнуть изображение за предел
+			//      в 256 цветов; сами пиксели src при этом не меняются: asPaletted так же сводит любой прозрачный
+			//      цвет к {0, 0, 0, 0}
+			c = foldTransparent(c)
+
+			freqs[packNRGBA(c)]++
+
+			// проверяем серость
+			// if r, g, b, _ := c.RGBA(); r != g || r != b || g != b {
+			if c.R != c.G || c.R != c.B || c.G != c.B {
 				isGray = false
 			}
 
@@ -317,102 +1093,386 @@ func (o *PNGOptimizer) countNRGBAColors(img *image.NRGBA) (n uint, hasTransparen
 		}
 	}
 
-	return uint(len(colors)), hasTransparent, hasPartAlpha, isGray
+	return freqs, hasTransparent, hasPartAlpha, isGray
+}
+
+// packNRGBA packs c into map key as R << 24 | G << 16 | B << 8 | A, SEE unpackNRGBA
+func packNRGBA(c color.NRGBA) uint32 {
+	return uint32(c.R)<<24 | uint32(c.G)<<16 | uint32(c.B)<<8 | uint32(c.A)
+}
+
+// foldTransparent returns {0, 0, 0, 0} for any fully transparent c
+func foldTransparent(c color.NRGBA) color.NRGBA {
+
+	if c.A == 0 {
+		return color.NRGBA{}
+	}
+
+	return c
+}
+
+func unpackNRGBA(k uint32) color.NRGBA {
+	return color.NRGBA{R: uint8(k >> 24), G: uint8(k >> 16), B: uint8(k >> 8), A: uint8(k)}
+}
+
+// paletteFromNRGBA builds palette of colors counted by countNRGBAColors, SEE nrgbaPaletteFreqs
+func (o *PNGOptimizer) paletteFromNRGBA(freqs map[uint32]uint) (palette color.Palette) {
+
+	rawPalette := o.nrgbaPaletteFreqs(freqs)
+
+	// NRGA -> Color
+	palette = make(color.Palette, len(rawPalette))
+
+	for i := range rawPalette {
+		palette[i] = rawPalette[i].c
+	}
+
+	return palette
+}
+
+// nrgbaPaletteFreqs returns colors counted by countNRGBAColors in palette order along with their frequencies
+func (*PNGOptimizer) nrgbaPaletteFreqs(freqs map[uint32]uint) (rawPalette nrgbaPaletteSorter) {
+
+	// TODO вставка сортировкой, тогда не понадобится отдельная сортировка
+
+	// NOTE частота копируется в сам элемент, чтобы Less не лез в map на каждом сравнении
+	rawPalette = make(nrgbaPaletteSorter, 0, len(freqs))
+
+	for k, freq := range freqs {
+		rawPalette = append(rawPalette, nrgbaFreq{unpackNRGBA(k), freq})
+	}
+
+	sort.Sort(rawPalette)
+
+	return rawPalette
+}
+
+func (o *PNGOptimizer) nrgba2gray(img *image.NRGBA) (gray *image.Gray) {
+
+	bounds := img.Bounds()
+
+	gray = image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	// EMULATE draw.Draw(gray, gray.Bounds(), img, bounds.Min, draw.Src)
+	// избегаем преобразования через gray color model, потому что img точно gray, закодированный как NRGBA
+	// SEE https://stackoverflow.com/questions/41350255/convert-an-image-to-grayscale-in-go
+	// SEE https://rentafounder.com/convert-image-to-grayscale-golang/
+	// SEE https://stackoverflow.com/questions/42516203/converting-rgba-image-to-grayscale-golang
+	for sy, dy := bounds.Min.Y, 0; sy < bounds.Max.Y; sy++ {
+		for sx, dx := bounds.Min.X, 0; sx < bounds.Max.X; sx++ {
+			gray.SetGray(dx, dy, color.Gray{Y: img.NRGBAAt(sx, sy).R})
+			dx++
+		}
+		dy++
+	}
+
+	return gray
+}
+
+// encodeGrayTRNS writes gray img with fully transparent pixels as 8-bit gray + tRNS, transparent pixels get
+// the smallest level unused by opaque ones; returns nil buffer if there is no such level
+func (o *PNGOptimizer) encodeGrayTRNS(img *image.NRGBA) (_ *bytes.Buffer, err error) {
+
+	var used [256]bool
+
+	bounds := img.Bounds()
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if c := img.NRGBAAt(x, y); c.A != 0 {
+				used[c.R] = true
+			}
+		}
+	}
+
+	level := -1
+
+	for i := range used {
+		if !used[i] {
+			level = i
+			break
+		}
+	}
+
+	if level < 0 {
+		return nil, nil
+	}
+
+	gray := o.nrgba2gray(img)
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if img.NRGBAAt(x, y).A == 0 {
+				gray.SetGray(x-bounds.Min.X, y-bounds.Min.Y, color.Gray{Y: uint8(level)})
+			}
+		}
+	}
+
+	// SEE $ 4.2.1.1 tRNS: для gray - один 2-байтовый уровень
+	return encodeRawPNG(bounds.Dx(), bounds.Dy(), pngColorGray, 8, []byte{0, uint8(level)}, gray.Pix, gray.Stride, o.zlibLevel())
+}
+
+// encodeGrayAlpha writes gray img with alpha as 8-bit gray + alpha, fully transparent pixels become {0, 0}
+func (o *PNGOptimizer) encodeGrayAlpha(img *image.NRGBA) (_ *bytes.Buffer, err error) {
+
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	pix := make([]byte, 2*w*h)
+
+	for y := 0; y < h; y++ {
+
+		dst := pix[2*w*y : 2*w*(y+1)]
+
+		for x := 0; x < w; x++ {
+			if c := img.NRGBAAt(bounds.Min.X+x, bounds.Min.Y+y); c.A != 0 {
+				dst[2*x], dst[2*x+1] = c.R, c.A
+			}
+		}
+	}
+
+	return encodeRawPNG(w, h, pngColorGrayAlpha, 8, nil, pix, 2*w, o.zlibLevel())
+}
+
+// encodeBilevelGray writes black and white img as 1-bit gray, which is smaller than 1-bit paletted by PLTE,
+// returns nil buffer if img has any level but 0 and 255
+func (o *PNGOptimizer) encodeBilevelGray(img *image.Gray) (_ *bytes.Buffer, err error) {
+
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	stride := (w + 7) / 8
+	pix := make([]byte, stride*h)
+
+	for y := 0; y < h; y++ {
+
+		i := img.PixOffset(bounds.Min.X, bounds.Min.Y+y)
+		src := img.Pix[i : i+w]
+		dst := pix[y*stride : (y+1)*stride]
+
+		for x, c := range src {
+			switch c {
+			case 0:
+			case 0xff:
+				// старший бит - левый пиксель
+				dst[x/8] |= 0x80 >> (x % 8)
+			default:
+				return nil, nil
+			}
+		}
+	}
+
+	return encodeRawPNG(w, h, pngColorGray, 1, nil, pix, stride, o.zlibLevel())
+}
+
+// encodeRGBTRNS writes img with fully transparent pixels as 8-bit truecolor + tRNS, transparent pixels get
+// the smallest color unused by opaque ones (there are 2^24 colors, so it always exists for any sane image size)
+func (o *PNGOptimizer) encodeRGBTRNS(img *image.NRGBA) (_ *bytes.Buffer, err error) {
+
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	used := make(map[uint32]struct{})
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if c := img.NRGBAAt(x, y); c.A != 0 {
+				used[uint32(c.R)<<16|uint32(c.G)<<8|uint32(c.B)] = struct{}{}
+			}
+		}
+	}
+
+	var key uint32
+
+	for ; key < 1<<24; key++ {
+		if _, ok := used[key]; !ok {
+			break
+		}
+	}
+
+	if key == 1<<24 {
+		return nil, errors.New("no unused rgb color for tRNS")
+	}
+
+	t := [3]uint8{uint8(key >> 16), uint8(key >> 8), uint8(key)}
+
+	stride := w * 3
+	pix := make([]byte, stride*h)
+
+	for y := 0; y < h; y++ {
+
+		row := img.Pix[img.PixOffset(bounds.Min.X, bounds.Min.Y+y):][:w*4]
+		dst := pix[y*stride : (y+1)*stride]
+
+		for x := 0; x < w; x++ {
+
+			px := row[x*4 : x*4+4]
+
+			if px[3] == 0 {
+				copy(dst[x*3:], t[:])
+			} else {
+				copy(dst[x*3:], px[:3])
+			}
+		}
+	}
+
+	// SEE $ 4.2.1.1 tRNS: для rgb - три 2-байтовых уровня
+	return encodeRawPNG(w, h, pngColorRGB, 8, []byte{0, t[0], 0, t[1], 0, t[2]}, pix, stride, o.zlibLevel())
 }
 
-func (*PNGOptimizer) paletteFromNRGBA(img *image.NRGBA, hint uint) (palette color.Palette) {
+func (o *PNGOptimizer) palettedVariants(src *image.Paletted) (_ variantsList, err error) {
 
-	if hint == 0 {
-		hint = 256
-	}
+	variants := make(variantsList, 0, 4)
 
-	bounds := img.Bounds()
+	{
+		b := bytes.NewBuffer(nil)
 
-	colors := make(map[color.NRGBA]uint, hint)
+		if err = o.encoder.Encode(b, src); err != nil {
+			return nil, fmt.Errorf("error encode src: %w", err)
+		}
 
-	// SEE https://github.com/KEINOS/go-pallet/blob/main/pallet/pallet.go
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+		variants = append(variants, variant{b, "src (paletted)"})
+	}
 
-			c := img.NRGBAAt(x, y)
+	// исходный порядок палитры часто удачнее частотного (например, градиент), поэтому отдельно пробуется
+	// исходная палитра без неиспользуемых цветов
+	if compacted := compactPaletted(src); compacted != nil {
 
-			// TODO SEE TODO countNRGBAColors
+		b := bytes.NewBuffer(nil)
 
-			colors[c] = colors[c] + 1
+		if err = o.encoder.Encode(b, compacted); err != nil {
+			return nil, fmt.Errorf("error encode compacted: %w", err)
 		}
+
+		variants = append(variants, variant{b, "compacted palette"})
 	}
 
-	// TODO вставка сортировкой, тогда не понадобится отдельная сортировка
+	// NOTE исходная палитра бывает неудачной (лишние цвета, случайный порядок, раздутый tRNS), поэтому
+	//      изображение также прогоняется через полный NRGBA пайплайн со всеми его вариантами
+	{
+		list, err := o.nrgbaVariants(o.paletted2nrgba(src))
 
-	rawPalette := make([]color.NRGBA, 0, len(colors))
+		if err != nil {
+			return nil, err
+		}
 
-	for c := range colors {
-		rawPalette = append(rawPalette, c)
+		for _, v := range list {
+			variants = append(variants, variant{v.b, "nrgba " + v.as})
+		}
 	}
 
-	s := &nrgbaPaletteSorter{colors, rawPalette}
-
-	sort.Sort(s)
+	if o.isGrayPalette(src.Palette) {
 
-	// т.к. rawPalette по сути ptr to bakary, то после сортировки посредством nrgbaPaletteSorter сама rawPalette тоже будет отсортирована
+		b, gray := bytes.NewBuffer(nil), o.paletted2gray(src)
 
-	// NRGA -> Color
-	palette = make(color.Palette, len(rawPalette))
+		if err = o.encoder.Encode(b, gray); err != nil {
+			return nil, fmt.Errorf("error encode gray: %w", err)
+		}
 
-	for i := range rawPalette {
-		palette[i] = rawPalette[i]
+		variants = append(variants, variant{b, "gray"})
 	}
 
-	return palette
+	return variants, nil
 }
 
-func (o *PNGOptimizer) nrgba2gray(img *image.NRGBA) (gray *image.Gray) {
+// compactPaletted drops palette entries img never references and moves transparent entries to the front
+// (fully transparent first, then partially transparent, see nrgbaPaletteSorter) so that tRNS is as short as possible,
+// other entries keep their order, as well as image bounds; returns nil if there is nothing to drop or move
+func compactPaletted(img *image.Paletted) *image.Paletted {
+
+	var used [256]bool
 
 	bounds := img.Bounds()
 
-	gray = image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
-	// EMULATE draw.Draw(gray, gray.Bounds(), img, bounds.Min, draw.Src)
-	// избегаем преобразования через gray color model, потому что img точно gray, закодированный как NRGBA
-	// SEE https://stackoverflow.com/questions/41350255/convert-an-image-to-grayscale-in-go
-	// SEE https://rentafounder.com/convert-image-to-grayscale-golang/
-	// SEE https://stackoverflow.com/questions/42516203/converting-rgba-image-to-grayscale-golang
-	for sy, dy := bounds.Min.Y, 0; sy < bounds.Max.Y; sy++ {
-		for sx, dx := bounds.Min.X, 0; sx < bounds.Max.X; sx++ {
-			gray.SetGray(dx, dy, color.Gray{Y: img.NRGBAAt(sx, sy).R})
-			dx++
+	for y := 0; y < bounds.Dy(); y++ {
+
+		row := img.Pix[y*img.Stride : y*img.Stride+bounds.Dx()]
+
+		for _, idx := range row {
+			used[idx] = true
 		}
-		dy++
 	}
 
-	return gray
-}
+	// 0 - transparent, 1 - partially transparent, 2 - opaque
+	alphaClass := func(c color.Color) int {
 
-func (o *PNGOptimizer) optimizePaletted(src *image.Paletted) (_ *bytes.Buffer, as string, err error) {
+		_, _, _, a := c.RGBA()
 
-	variants := make(variantsList, 0, 2)
+		switch a {
+		case 0:
+			return 0
+		case math.MaxUint16:
+			return 2
+		}
 
-	{
-		b := bytes.NewBuffer(nil)
+		return 1
+	}
 
-		if err = o.encoder.Encode(b, src); err != nil {
-			return nil, "", fmt.Errorf("error encode src: %w", err)
+	var (
+		remap   [256]uint8
+		palette = make(color.Palette, 0, len(img.Palette))
+		moved   bool
+	)
+
+	for class := 0; class <= 2; class++ {
+		for i, c := range img.Palette {
+
+			if !used[i] || alphaClass(c) != class {
+				continue
+			}
+
+			if i != len(palette) {
+				moved = true
+			}
+
+			remap[i] = uint8(len(palette))
+			palette = append(palette, c)
 		}
+	}
 
-		variants = append(variants, variant{b, "src (paletted)"})
+	// NOTE пустая палитра бывает только у пустого изображения
+	if len(palette) == 0 || (!moved && len(palette) == len(img.Palette)) {
+		return nil
 	}
 
-	if o.isGrayPalette(src.Palette) {
+	compacted := image.NewPaletted(bounds, palette)
 
-		b, gray := bytes.NewBuffer(nil), o.paletted2gray(src)
+	for y := 0; y < bounds.Dy(); y++ {
 
-		if err = o.encoder.Encode(b, gray); err != nil {
-			return nil, "", fmt.Errorf("error encode gray: %w", err)
+		row := img.Pix[y*img.Stride : y*img.Stride+bounds.Dx()]
+		dst := compacted.Pix[y*compacted.Stride : y*compacted.Stride+bounds.Dx()]
+
+		for x, idx := range row {
+			dst[x] = remap[idx]
 		}
+	}
 
-		variants = append(variants, variant{b, "gray"})
+	return compacted
+}
+
+func (o *PNGOptimizer) paletted2nrgba(img *image.Paletted) (nrgba *image.NRGBA) {
+
+	// NOTE draw.Draw здесь не годится: он переводит цвета через premultiplied RGBA64 и обратно, что для почти
+	//      прозрачных цветов (A = 1..~16) теряет младшие биты RGB, а цвета палитры png.Decode и так NRGBA / RGBA(opaque)
+	lut := make([]color.NRGBA, len(img.Palette))
+
+	for i := range img.Palette {
+		lut[i] = color.NRGBAModel.Convert(img.Palette[i]).(color.NRGBA)
+	}
+
+	bounds := img.Bounds()
+
+	nrgba = image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+
+	for sy, dy := bounds.Min.Y, 0; sy < bounds.Max.Y; sy++ {
+		for sx, dx := bounds.Min.X, 0; sx < bounds.Max.X; sx++ {
+			// NOTE при индексе вне палитры png.Decode сам расширяет палитру до 256 цветов
+			nrgba.SetNRGBA(dx, dy, lut[img.ColorIndexAt(sx, sy)])
+			dx++
+		}
+		dy++
 	}
 
-	return variants.best()
+	return nrgba
 }
 
 func (o *PNGOptimizer) isGrayPalette(palette color.Palette) bool {
@@ -449,32 +1509,114 @@ func (o *PNGOptimizer) paletted2gray(img *image.Paletted) (gray *image.Gray) {
 	return gray
 }
 
-func (o *PNGOptimizer) optimizeGray(src *image.Gray) (_ *bytes.Buffer, as string, err error) {
+// grayPaletteMaxColors is the number of gray levels above which paletted variant of gray image is not tried
+// (unless WithExhaustive)
+const grayPaletteMaxColors = 200
 
-	variants := make(variantsList, 0, 2)
+func (o *PNGOptimizer) grayVariants(src *image.Gray) (_ variantsList, err error) {
+
+	variants := make(variantsList, 0, 3)
 
 	{
 		b := bytes.NewBuffer(nil)
 
 		if err = o.encoder.Encode(b, src); err != nil {
-			return nil, "", fmt.Errorf("error encode src: %w", err)
+			return nil, fmt.Errorf("error encode src: %w", err)
 		}
 
 		variants = append(variants, variant{b, "src (gray)"})
 	}
 
-	if nColors := o.countGrayColors(src); nColors <= 256 {
+	nColors := o.countGrayColors(src)
+
+	// NOTE png.Decode отдает 1-bit gray как *image.Gray, и без этого варианта он проигрывал бы исходнику на PLTE
+	if nColors <= 2 {
+
+		b, err := o.encodeBilevelGray(src)
+
+		if err != nil {
+			return nil, fmt.Errorf("error encode gray 1-bit: %w", err)
+		}
+
+		if b != nil {
+			variants = append(variants, variant{b, "gray 1-bit"})
+		}
+	}
+
+	// NOTE для одномерных изображений с > 16 уровнями paletted не выигрывает, см. nrgbaVariants;
+	//      замер на градиентах, спрайтах, "фото" и шуме 32..512px и на gray из PngSuite: выше grayPaletteMaxColors
+	//      уровней paletted кодируется в 3-10 раз дольше gray и выигрывает только на крупном равномерном шуме
+	//      и меньше 2% (220 уровней -1.9%, 240 -0.6%), на всем остальном проигрывает от 2% до 2-3 раз
+	if nColors <= 256 && (o.exhaustive || !(is1D(src.Bounds()) && nColors > 16) && nColors <= grayPaletteMaxColors) {
 
 		var b *bytes.Buffer
 
 		if b, err = o.asPaletted(src, o.paletteFromGray(src, nColors)); err != nil {
-			return nil, "", err
+			return nil, err
 		}
 
 		variants = append(variants, variant{b, "paletted"})
 	}
 
-	return variants.best()
+	return variants, nil
+}
+
+func (o *PNGOptimizer) gray16Variants(src *image.Gray16) (_ variantsList, err error) {
+
+	variants := make(variantsList, 0, 2)
+
+	{
+		b := bytes.NewBuffer(nil)
+
+		if err = o.encoder.Encode(b, src); err != nil {
+			return nil, fmt.Errorf("error encode src: %w", err)
+		}
+
+		variants = append(variants, variant{b, "src (gray16)"})
+	}
+
+	// 8-битный gray, сохраненный как 16-битный, без потерь сводится к обычному gray со всеми его вариантами
+	if gray := o.gray16to8(src); gray != nil {
+
+		list, err := o.grayVariants(gray)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, v := range list {
+			variants = append(variants, variant{v.b, "8-bit " + v.as})
+		}
+	}
+
+	return variants, nil
+}
+
+// gray16to8 returns nil if any sample carries real 16-bit precision
+func (o *PNGOptimizer) gray16to8(img *image.Gray16) (gray *image.Gray) {
+
+	bounds := img.Bounds()
+
+	gray = image.NewGray(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+
+	// NOTE расширение 8 -> 16 бит идет как v * 257 (v << 8 | v), т.е. у таких отсчетов старший и младший
+	//      байты равны, Pix хранит отсчеты big-endian
+	for y := 0; y < bounds.Dy(); y++ {
+
+		row := img.Pix[y*img.Stride : y*img.Stride+bounds.Dx()*2]
+		dst := gray.Pix[y*gray.Stride : y*gray.Stride+bounds.Dx()]
+
+		for x := range dst {
+
+			if row[2*x] != row[2*x+1] {
+				return nil
+			}
+
+			dst[x] = row[2*x]
+		}
+	}
+
+	return gray
 }
 
 func (o *PNGOptimizer) countGrayColors(img *image.Gray) uint {
@@ -496,13 +1638,27 @@ func (o *PNGOptimizer) countGrayColors(img *image.Gray) uint {
 
 func (o *PNGOptimizer) paletteFromGray(img *image.Gray, hint uint) (palette color.Palette) {
 
+	rawPalette, _ := o.grayPaletteFreqs(img, hint)
+
+	palette = make(color.Palette, len(rawPalette))
+
+	for i, c := range rawPalette {
+		palette[i] = color.Gray{Y: c}
+	}
+
+	return palette
+}
+
+// grayPaletteFreqs returns img gray levels in palette order and frequency of every level
+func (*PNGOptimizer) grayPaletteFreqs(img *image.Gray, hint uint) (rawPalette []uint8, colors map[uint8]uint) {
+
 	if hint == 0 {
 		hint = 256
 	}
 
 	bounds := img.Bounds()
 
-	colors := make(map[uint8]uint, hint)
+	colors = make(map[uint8]uint, hint)
 
 	// SEE https://github.com/KEINOS/go-pallet/blob/main/pallet/pallet.go
 	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
@@ -514,24 +1670,27 @@ func (o *PNGOptimizer) paletteFromGray(img *image.Gray, hint uint) (palette colo
 
 	//
 
-	rawPalette := make([]uint8, 0, len(colors))
+	rawPalette = make([]uint8, 0, len(colors))
 
 	for c := range colors {
 		rawPalette = append(rawPalette, c)
 	}
 
-	// упорядочиваем по частоте применения (от более частой к менее частой)
+	// упорядочиваем по частоте применения (от более частой к менее частой), при равной частоте - по яркости,
+	// чтобы порядок палитры (и итоговый файл) был детерминированным
 	sort.Slice(rawPalette, func(i, j int) bool {
-		return colors[rawPalette[i]]-colors[rawPalette[j]] > 0
-	})
 
-	palette = make(color.Palette, len(rawPalette))
+		ci, cj := rawPalette[i], rawPalette[j]
 
-	for i, c := range rawPalette {
-		palette[i] = color.Gray{Y: c}
-	}
+		// NOTE частоты uint, поэтому только прямое сравнение, разность переполняется
+		if fi, fj := colors[ci], colors[cj]; fi != fj {
+			return fi > fj
+		}
 
-	return palette
+		return ci < cj
+	})
+
+	return rawPalette, colors
 }
 
 func (o *PNGOptimizer) asPaletted(src image.Image, palette color.Palette) (b *bytes.Buffer, err error) {
@@ -539,10 +1698,51 @@ func (o *PNGOptimizer) asPaletted(src image.Image, palette color.Palette) (b *by
 	bounds := src.Bounds()
 
 	paletted := image.NewPaletted(image.Rect(0, 0, bounds.Dx(), bounds.Dy()), palette)
-	draw.Draw(paletted, paletted.Bounds(), src, bounds.Min, draw.Src)
+
+	// NOTE draw.Draw здесь не годится: он ищет ближайший цвет палитры в premultiplied RGBA64 по квадрату разности,
+	//      сдвинутому на 2 бита, и почти прозрачные цвета (A = 1), отличающиеся на 1 в premultiplied, для него
+	//      неразличимы; палитры paletteFromNRGBA / paletteFromGray построены из цветов самого src, поэтому
+	//      индекс ищется точно по NRGBA (все A == 0 сводятся к {0, 0, 0, 0}, как в countNRGBAColors), а
+	//      ближайший цвет - только для цветов вне палитры; альфа каждого элемента затем пишется png.Encode в tRNS
+	index := make(map[uint32]uint8, len(palette))
+
+	for i := len(palette) - 1; i >= 0; i-- {
+		index[packNRGBA(foldTransparent(color.NRGBAModel.Convert(palette[i]).(color.NRGBA)))] = uint8(i)
+	}
+
+	nrgba, _ := src.(*image.NRGBA)
+
+	for sy, dy := bounds.Min.Y, 0; sy < bounds.Max.Y; sy++ {
+
+		row := paletted.Pix[dy*paletted.Stride : dy*paletted.Stride+bounds.Dx()]
+
+		for sx, dx := bounds.Min.X, 0; sx < bounds.Max.X; sx++ {
+
+			var c color.NRGBA
+
+			if nrgba != nil {
+				c = nrgba.NRGBAAt(sx, sy)
+			} else {
+				c = color.NRGBAModel.Convert(src.At(sx, sy)).(color.NRGBA)
+			}
+
+			idx, ok := index[packNRGBA(foldTransparent(c))]
+
+			if !ok {
+				idx = uint8(palette.Index(c))
+			}
+
+			row[dx] = idx
+			dx++
+		}
+		dy++
+	}
 
 	b = bytes.NewBuffer(nil)
 
+	// NOTE битность png.Encode выбирает по длине палитры (<= 2 - cbP1, <= 4 - cbP2, <= 16 - cbP4, иначе cbP8),
+	//      а палитры paletteFromNRGBA / paletteFromGray содержат только реально использованные цвета,
+	//      т.е. битность всегда минимально возможная
 	if err = o.encoder.Encode(b, paletted); err != nil {
 		return nil, fmt.Errorf("error encode paletted: %w", err)
 	}
@@ -550,30 +1750,56 @@ func (o *PNGOptimizer) asPaletted(src image.Image, palette color.Palette) (b *by
 	return b, nil
 }
 
-/*
-func NewPNGOptimizer() *PNGOptimizer {
-	return &PNGOptimizer{encoder: png.Encoder{
+// PNGOption configures PNGOptimizer created by NewPNGOptimizer
+type PNGOption func(o *PNGOptimizer)
+
+// WithPNGLevel sets compression level of every encoded variant, png.BestCompression by default
+func WithPNGLevel(level png.CompressionLevel) PNGOption {
+	return func(o *PNGOptimizer) {
+		o.encoder.CompressionLevel = level
+	}
+}
+
+// WithExhaustive makes the optimizer try variants it skips by heuristics as (almost) never winning, each of them at
+// every bit depth and with every row filter (see best), for the smallest possible files at the cost of run time
+func WithExhaustive() PNGOption {
+	return func(o *PNGOptimizer) {
+		o.exhaustive = true
+	}
+}
+
+func NewPNGOptimizer(opts ...PNGOption) *PNGOptimizer {
+
+	o := &PNGOptimizer{encoder: png.Encoder{
 		CompressionLevel: png.BestCompression,
-		// TODO BufferPool:
 	}}
+
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	o.encoder.BufferPool = &o.buffers
+
+	return o
 }
-*/
 
-// implements sort.Interface
-type nrgbaPaletteSorter struct {
-	colors  map[color.NRGBA]uint // ptr
-	palette []color.NRGBA        // ptr
+type nrgbaFreq struct {
+	c    color.NRGBA
+	freq uint
 }
 
-func (ps *nrgbaPaletteSorter) Len() int {
-	return len(ps.palette)
+// implements sort.Interface
+type nrgbaPaletteSorter []nrgbaFreq
+
+func (ps nrgbaPaletteSorter) Len() int {
+	return len(ps)
 }
 
-func (ps *nrgbaPaletteSorter) Swap(i, j int) {
-	ps.palette[i], ps.palette[j] = ps.palette[j], ps.palette[i]
+func (ps nrgbaPaletteSorter) Swap(i, j int) {
+	ps[i], ps[j] = ps[j], ps[i]
 }
 
-func (ps *nrgbaPaletteSorter) Less(i, j int) bool {
+func (ps nrgbaPaletteSorter) Less(i, j int) bool {
 
 	// NOTE
 	// - прозрачный (transparent) всегда самый первый
@@ -586,11 +1812,12 @@ func (ps *nrgbaPaletteSorter) Less(i, j int) bool {
 	//     "tRNS can contain fewer values than there are palette entries. In this case, the alpha value for all
 	//     remaining palette entries is assumed to be 255. In the common case in which only palette index 0 need be
 	//     made transparent, only a one-byte tRNS chunk is needed."
-	ci, cj := ps.palette[i], ps.palette[j]
+	fi, fj := &ps[i], &ps[j]
+	ci, cj := fi.c, fj.c
 
 	// fast-path одинаковая альфа - сравнивается по частоте
 	if ci.A == cj.A {
-		return ps.colors[ci]-ps.colors[cj] > 0
+		return ps.byFreq(fi, fj)
 	}
 
 	// HERE ci.A != cj.A
@@ -612,13 +1839,39 @@ func (ps *nrgbaPaletteSorter) Less(i, j int) bool {
 
 	// 2 альфа либо 2 не-альфы - по их частотам вхождения
 	if (ci.A < math.MaxUint8 && cj.A < math.MaxUint8) || (ci.A == math.MaxUint8 && cj.A == math.MaxUint8) {
-		return ps.colors[ci]-ps.colors[cj] > 0
+		return ps.byFreq(fi, fj)
 	}
 
 	// все остальное консервативно false
 	return false
 }
 
+// byFreq более частый цвет раньше, при равной частоте - по значению цвета, чтобы порядок палитры (и итоговый файл)
+// не зависел от порядка обхода map
+func (nrgbaPaletteSorter) byFreq(fi, fj *nrgbaFreq) bool {
+
+	// NOTE частоты uint, поэтому только прямое сравнение, разность переполняется
+	if fi.freq != fj.freq {
+		return fi.freq > fj.freq
+	}
+
+	ci, cj := fi.c, fj.c
+
+	if ci.A != cj.A {
+		return ci.A < cj.A
+	}
+
+	if ci.R != cj.R {
+		return ci.R < cj.R
+	}
+
+	if ci.G != cj.G {
+		return ci.G < cj.G
+	}
+
+	return ci.B < cj.B
+}
+
 //
 
 type variant struct {
@@ -632,6 +1885,132 @@ var (
 	errNoVariants = errors.New("unexpected error: empty variants")
 )
 
+// variantJob encodes single variant, nil buffer without error means variant is not applicable
+type variantJob struct {
+	as     string
+	encode func() (*bytes.Buffer, error)
+}
+
+// encodeVariants runs all jobs concurrently and returns their variants in the jobs order, so best() still prefers
+// the earlier (simpler) one of equal size regardless of which goroutine finished first;
+// on error returns the first one in the jobs order
+//
+// NOTE png.Encoder только читается, а его BufferPool (pngBufferPool) поверх sync.Pool, так что общий encoder
+// безопасен для параллельных Encode, каждый из которых берет из пула свой EncoderBuffer
+func encodeVariants(jobs []variantJob) (_ variantsList, err error) {
+
+	type result struct {
+		b   *bytes.Buffer
+		err error
+	}
+
+	results := make([]result, len(jobs))
+
+	if len(jobs) == 1 {
+		results[0].b, results[0].err = jobs[0].encode()
+	} else {
+
+		var wg sync.WaitGroup
+
+		wg.Add(len(jobs))
+
+		for i := range jobs {
+			go func(i int) {
+				defer wg.Done()
+				defer removeTempFilesOnPanic()
+				results[i].b, results[i].err = jobs[i].encode()
+			}(i)
+		}
+
+		wg.Wait()
+	}
+
+	variants := make(variantsList, 0, len(jobs))
+
+	for i := range results {
+
+		if results[i].err != nil {
+			return nil, results[i].err
+		}
+
+		if results[i].b != nil {
+			variants = append(variants, variant{results[i].b, jobs[i].as})
+		}
+	}
+
+	return variants, nil
+}
+
+// best returns the smallest of variants, WithExhaustive also re-encodes every variant with every row filter and
+// at every bit depth it fits (see pngRows.withDepth) and returns the smallest of all of them
+func (o *PNGOptimizer) best(variants variantsList) (b *bytes.Buffer, as string, err error) {
+
+	if !o.exhaustive {
+		return o.smallest(variants)
+	}
+
+	all := variants
+
+	for _, v := range variants {
+
+		rows, err := unfilterPNG(v.b.Bytes())
+
+		if err != nil {
+			return nil, "", fmt.Errorf("error exhaust %s: %w", v.as, err)
+		}
+
+		list, names := []*pngRows{rows}, []string{v.as}
+
+		for _, depth := range []uint8{1, 2, 4, 8} {
+			if r := rows.withDepth(depth); r != nil {
+				list, names = append(list, r), append(names, fmt.Sprintf("%s, %d-bit", v.as, depth))
+			}
+		}
+
+		// NOTE глубины и фильтры одного варианта кодируются параллельно, но дальше идет только лучший из них,
+		//      так что одновременно живут буферы одного варианта (до 5 глубин x 6 фильтров), а не всех сразу
+		jobs := make([]variantJob, 0, len(list)*(pngFilters+1))
+
+		for i, r := range list {
+			for filter := pngFilterNone; filter <= pngFilterAdaptive; filter++ {
+
+				r, filter := r, filter
+
+				jobs = append(jobs, variantJob{names[i] + ", filter " + pngFilterNames[filter], func() (*bytes.Buffer, error) {
+					return r.encode(filter, o.zlibLevel())
+				}})
+			}
+		}
+
+		searched, err := encodeVariants(jobs)
+
+		if err != nil {
+			return nil, "", fmt.Errorf("error exhaust %s: %w", v.as, err)
+		}
+
+		best, as, err := o.smallest(searched)
+
+		if err != nil {
+			return nil, "", fmt.Errorf("error exhaust %s: %w", v.as, err)
+		}
+
+		all = append(all, variant{best, as})
+	}
+
+	// NOTE при равном размере остаются исходные варианты, они в начале списка
+	return o.smallest(all)
+}
+
+// smallest is variantsList.best also shown to onVariants
+func (o *PNGOptimizer) smallest(v variantsList) (b *bytes.Buffer, as string, err error) {
+
+	if o.onVariants != nil {
+		o.onVariants(v)
+	}
+
+	return v.best()
+}
+
 func (v variantsList) best() (b *bytes.Buffer, as string, err error) {
 
 	if len(v) == 0 {
@@ -0,0 +1,1994 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// go test ./service -update rewrites the fixtures and golden files of testdata
+var update = flag.Bool("update", false, "rewrite testdata fixtures and golden files")
+
+const (
+	pngTestdata     = "testdata/png"
+	pngGoldenSuffix = ".golden.png"
+	pngVariantsFile = "variants.golden"
+)
+
+// testRand is a tiny deterministic LCG, so that the fixtures are the same on every -update
+type testRand uint32
+
+func (r *testRand) next() uint8 {
+	*r = *r*1664525 + 1013904223
+	return uint8(*r >> 24)
+}
+
+// pngFixture is a source image of every color type png.Decode returns (and the special cases of NRGBA), built
+// in code and written to testdata/png/name.png by -update
+type pngFixture struct {
+	name   string
+	encode func() ([]byte, error)
+}
+
+func encodeStd(img image.Image) func() ([]byte, error) {
+	return func() ([]byte, error) {
+
+		var b bytes.Buffer
+
+		if err := png.Encode(&b, img); err != nil {
+			return nil, err
+		}
+
+		return b.Bytes(), nil
+	}
+}
+
+func encodeRaw(w, h int, colorType, depth uint8, trns, pix []byte, stride int) func() ([]byte, error) {
+	return func() ([]byte, error) {
+
+		b, err := encodeRawPNG(w, h, colorType, depth, trns, pix, stride, 6)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return b.Bytes(), nil
+	}
+}
+
+func pngFixtures() []pngFixture {
+
+	const w, h = 48, 32
+
+	r := testRand(1)
+
+	gray := image.NewGray(image.Rect(0, 0, w, h))
+
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i%w*5+i/w*3) ^ r.next()&3
+	}
+
+	// NOTE 8-bit gray + tRNS уровня 7, который png.Decode отдает как NRGBA
+	grayTRNS := make([]byte, w*h)
+
+	for i := range grayTRNS {
+		if grayTRNS[i] = uint8(i%w*4 + 16); i%7 == 0 {
+			grayTRNS[i] = 7
+		}
+	}
+
+	bilevel := make([]byte, (w+7)/8*h)
+
+	for i := range bilevel {
+		bilevel[i] = 0xf0 ^ uint8(i/((w+7)/8)%2)*0xff
+	}
+
+	// NOTE больше 256 цветов и один полностью прозрачный - paletted невозможен, остается rgb+trns
+	rgbTRNS := image.NewNRGBA(image.Rect(0, 0, w, h))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if (x+y)%5 == 0 {
+				rgbTRNS.SetNRGBA(x, y, color.NRGBA{R: r.next()}) // A 0, RGB must not matter
+			} else {
+				rgbTRNS.SetNRGBA(x, y, color.NRGBA{uint8(x * 5), uint8(y * 8), r.next(), 0xff})
+			}
+		}
+	}
+
+	grayAlpha := image.NewNRGBA(image.Rect(0, 0, w, h))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			l := uint8(x*5 + y)
+			grayAlpha.SetNRGBA(x, y, color.NRGBA{l, l, l, uint8(y*8) | r.next()&7})
+		}
+	}
+
+	pal := color.Palette{
+		color.NRGBA{0, 0, 0, 0}, color.NRGBA{0xff, 0, 0, 0x80}, color.NRGBA{0, 0xff, 0, 0xff},
+		color.NRGBA{0, 0, 0xff, 0xff}, color.NRGBA{0x80, 0x80, 0x80, 0xff}, color.NRGBA{0xff, 0xff, 0, 0x40},
+		// NOTE неиспользуемые и повторяющиеся цвета палитры, которые должны уйти при перестроении
+		color.NRGBA{0x12, 0x34, 0x56, 0xff}, color.NRGBA{0, 0xff, 0, 0xff},
+	}
+
+	paletted := image.NewPaletted(image.Rect(0, 0, w, h), pal)
+
+	for i := range paletted.Pix {
+		paletted.Pix[i] = []uint8{0, 1, 2, 3, 4, 5, 7}[int(r.next())%7]
+	}
+
+	nrgba := image.NewNRGBA(image.Rect(0, 0, w, h))
+
+	for i := range nrgba.Pix {
+		nrgba.Pix[i] = r.next()
+	}
+
+	// NOTE 8-битные каналы в 16-битном png сводятся к 8 битам без потерь
+	nrgba64 := image.NewNRGBA64(image.Rect(0, 0, w, h))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint16(x*5) * 0x101
+			nrgba64.SetNRGBA64(x, y, color.NRGBA64{v, uint16(y*8) * 0x101, 0x4040, 0xffff - uint16(x%3)*0x101})
+		}
+	}
+
+	gray16 := image.NewGray16(image.Rect(0, 0, w, h))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			gray16.SetGray16(x, y, color.Gray16{uint16(x*1300 + y*17)})
+		}
+	}
+
+	return []pngFixture{
+		{"gray", encodeStd(gray)},
+		{"gray-trns", encodeRaw(w, h, pngColorGray, 8, []byte{0, 7}, grayTRNS, w)},
+		{"gray-1bit", encodeRaw(w, h, pngColorGray, 1, nil, bilevel, (w+7)/8)},
+		{"rgb-trns", encodeStd(rgbTRNS)},
+		{"gray-alpha", encodeStd(grayAlpha)},
+		{"paletted", encodeStd(paletted)},
+		{"nrgba", encodeStd(nrgba)},
+		{"nrgba64-8bit", encodeStd(nrgba64)},
+		{"gray16", encodeStd(gray16)},
+	}
+}
+
+// readPNGFixtures returns name -> data of every fixture, rewriting testdata with -update
+func readPNGFixtures(t testing.TB) map[string][]byte {
+
+	t.Helper()
+
+	fixtures := make(map[string][]byte)
+
+	for _, f := range pngFixtures() {
+
+		path := filepath.Join(pngTestdata, f.name+".png")
+
+		if *update {
+
+			data, err := f.encode()
+
+			if err != nil {
+				t.Fatalf("encode fixture %s: %v", f.name, err)
+			}
+
+			if err = os.WriteFile(path, data, 0o666); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		data, err := os.ReadFile(path)
+
+		if err != nil {
+			t.Fatalf("%v (run go test ./service -update to generate)", err)
+		}
+
+		fixtures[f.name] = data
+	}
+
+	return fixtures
+}
+
+func decodeTestPNG(t testing.TB, data []byte) image.Image {
+
+	t.Helper()
+
+	img, err := png.Decode(bytes.NewReader(data))
+
+	if err != nil {
+		t.Fatalf("decode png: %v", err)
+	}
+
+	return img
+}
+
+// samePixels fails t unless got has the size of want and every its pixel is the same color (any fully transparent
+// colors are the same)
+func samePixels(t testing.TB, name string, want, got image.Image) {
+
+	t.Helper()
+
+	wb, gb := want.Bounds(), got.Bounds()
+
+	if wb.Dx() != gb.Dx() || wb.Dy() != gb.Dy() {
+		t.Fatalf("%s: size %dx%d, want %dx%d", name, gb.Dx(), gb.Dy(), wb.Dx(), wb.Dy())
+	}
+
+	for y := 0; y < wb.Dy(); y++ {
+		for x := 0; x < wb.Dx(); x++ {
+
+			wc, gc := exactNRGBA64(want.At(wb.Min.X+x, wb.Min.Y+y)), exactNRGBA64(got.At(gb.Min.X+x, gb.Min.Y+y))
+
+			if wc != gc {
+				t.Fatalf("%s: pixel (%d, %d) is %v, want %v", name, x, y, gc, wc)
+			}
+		}
+	}
+}
+
+// captureVariants collects every variant compared by o while fn runs
+func captureVariants(o *PNGOptimizer, fn func()) (variants variantsList) {
+
+	var mu sync.Mutex
+
+	o.onVariants = func(v variantsList) {
+		mu.Lock()
+		variants = append(variants, v...)
+		mu.Unlock()
+	}
+
+	defer func() {
+		o.onVariants = nil
+	}()
+
+	fn()
+
+	return variants
+}
+
+func TestPNGVariantsPixelIdentical(t *testing.T) {
+
+	fixtures := readPNGFixtures(t)
+
+	for _, f := range pngFixtures() {
+		for _, o := range []*PNGOptimizer{NewPNGOptimizer(), NewPNGOptimizer(WithExhaustive())} {
+
+			src := decodeTestPNG(t, fixtures[f.name])
+
+			var err error
+
+			variants := captureVariants(o, func() {
+
+				var (
+					b  *bytes.Buffer
+					as string
+				)
+
+				if b, as, err = o.OptimizeImage(src); err == nil {
+					_, _, err = o.refilter(b, as, EffortMax)
+				}
+			})
+
+			if err != nil {
+				t.Fatalf("%s: %v", f.name, err)
+			}
+
+			if len(variants) == 0 {
+				t.Fatalf("%s: no variants", f.name)
+			}
+
+			for _, v := range variants {
+				samePixels(t, f.name+" as "+v.as, src, decodeTestPNG(t, v.b.Bytes()))
+			}
+		}
+	}
+}
+
+func TestOptimizePNG(t *testing.T) {
+
+	fixtures := readPNGFixtures(t)
+	goldenVariants := filepath.Join(pngTestdata, pngVariantsFile)
+
+	var lines []string
+
+	for _, f := range pngFixtures() {
+
+		data := fixtures[f.name]
+		o := NewPNGOptimizer()
+
+		opt, res, err := o.OptimizeBytes(data, nil)
+
+		if err != nil {
+			t.Fatalf("%s: %v", f.name, err)
+		}
+
+		samePixels(t, f.name, decodeTestPNG(t, data), decodeTestPNG(t, opt))
+
+		// NOTE у NOOP OptimizedSize - размер лучшего (не меньшего) варианта, а отдаются сами данные
+		if res.NOOP && !bytes.Equal(opt, data) || len(opt) > len(data) {
+			t.Errorf("%s: optimized %d bytes of %d (noop %t)", f.name, len(opt), len(data), res.NOOP)
+		}
+
+		lines = append(lines, fmt.Sprintf("%s\t%s\t%d -> %d", f.name, res.Variant, len(data), len(opt)))
+
+		golden := filepath.Join(pngTestdata, f.name+pngGoldenSuffix)
+
+		if *update {
+			if err = os.WriteFile(golden, opt, 0o666); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		want, err := os.ReadFile(golden)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(opt, want) {
+			t.Errorf("%s: optimized png (%d bytes, %s) differs from %s (%d bytes)", f.name, len(opt), res.Variant,
+				golden, len(want))
+		}
+
+		// NOTE на диске тот же результат, что и в памяти, и без временных файлов рядом
+		dir := t.TempDir()
+		path := filepath.Join(dir, f.name+".png")
+
+		if err = os.WriteFile(path, data, 0o666); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = o.Optimize(path, &optimizeBytesOptions); err != nil {
+			t.Fatalf("%s: %v", f.name, err)
+		}
+
+		if got, err := os.ReadFile(path); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(got, want) {
+			t.Errorf("%s: optimized file differs from %s", f.name, golden)
+		}
+
+		if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+			t.Errorf("%s: %d files left in dir, want 1", f.name, len(entries))
+		}
+	}
+
+	sort.Strings(lines)
+	got := strings.Join(lines, "\n") + "\n"
+
+	if *update {
+		if err := os.WriteFile(goldenVariants, []byte(got), 0o666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want, err := os.ReadFile(goldenVariants)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != string(want) {
+		t.Errorf("variants differ from %s:\n%s\nwant:\n%s", goldenVariants, got, want)
+	}
+}
+
+func BenchmarkOptimizeNRGBA(b *testing.B) {
+
+	r := testRand(7)
+
+	// NOTE спрайт: половина прозрачна, остальное - немного цветов с мягкими краями
+	img := image.NewNRGBA(image.Rect(0, 0, 256, 256))
+
+	for y := 0; y < 256; y++ {
+		for x := 0; x < 256; x++ {
+			if (x-128)*(x-128)+(y-128)*(y-128) < 100*100 {
+				img.SetNRGBA(x, y, color.NRGBA{uint8(x / 32 * 32), uint8(y / 32 * 32), 0x80, 0xf0 | r.next()&0xf})
+			}
+		}
+	}
+
+	o := NewPNGOptimizer()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, _, err := o.OptimizeImage(img); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// grayTestImage returns w x h gray image of pix repeated row by row
+func grayTestImage(w, h int, pix ...uint8) *image.Gray {
+
+	img := image.NewGray(image.Rect(0, 0, w, h))
+
+	for i := range img.Pix {
+		img.Pix[i] = pix[i%len(pix)]
+	}
+
+	return img
+}
+
+func TestGrayPaletteFreqs(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		img     *image.Gray
+		palette []uint8
+		freqs   map[uint8]uint
+	}{
+		{"single level", grayTestImage(3, 2, 9), []uint8{9}, map[uint8]uint{9: 6}},
+		{"by frequency", grayTestImage(6, 1, 5, 200, 200, 7, 200, 7), []uint8{200, 7, 5},
+			map[uint8]uint{200: 3, 7: 2, 5: 1}},
+		// NOTE равная частота - по яркости, а не по порядку появления или обходу map
+		{"ties by brightness", grayTestImage(4, 1, 255, 0, 128, 64), []uint8{0, 64, 128, 255},
+			map[uint8]uint{0: 1, 64: 1, 128: 1, 255: 1}},
+		{"ties after frequency", grayTestImage(5, 1, 30, 10, 20, 10, 30), []uint8{10, 30, 20},
+			map[uint8]uint{10: 2, 20: 1, 30: 2}},
+		{"subimage", grayTestImage(4, 4, 1, 2, 3, 4).SubImage(image.Rect(1, 1, 3, 3)).(*image.Gray), []uint8{2, 3},
+			map[uint8]uint{2: 2, 3: 2}},
+	}
+
+	o := NewPNGOptimizer()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			palette, freqs := o.grayPaletteFreqs(tt.img, 0)
+
+			if !bytes.Equal(palette, tt.palette) {
+				t.Errorf("palette %v, want %v", palette, tt.palette)
+			}
+
+			if len(freqs) != len(tt.freqs) {
+				t.Errorf("freqs %v, want %v", freqs, tt.freqs)
+			}
+
+			for c, f := range tt.freqs {
+				if freqs[c] != f {
+					t.Errorf("freqs %v, want %v", freqs, tt.freqs)
+					break
+				}
+			}
+
+			// NOTE палитра paletteFromGray - те же уровни в том же порядке
+			p := o.paletteFromGray(tt.img, o.countGrayColors(tt.img))
+
+			if len(p) != len(tt.palette) {
+				t.Fatalf("paletteFromGray has %d colors, want %d", len(p), len(tt.palette))
+			}
+
+			for i, c := range p {
+				if c != (color.Gray{Y: tt.palette[i]}) {
+					t.Errorf("paletteFromGray[%d] = %v, want %v", i, c, tt.palette[i])
+				}
+			}
+		})
+	}
+}
+
+// variantNames returns names of the variants compared while fn runs
+func variantNames(o *PNGOptimizer, fn func()) (names []string) {
+
+	for _, v := range captureVariants(o, fn) {
+		names = append(names, v.as)
+	}
+
+	return names
+}
+
+func hasVariant(names []string, as string) bool {
+
+	for _, n := range names {
+		if n == as {
+			return true
+		}
+	}
+
+	return false
+}
+
+// grayLevelsImage returns w x h gray image using exactly n (2..256, at most w*h) levels
+func grayLevelsImage(w, h, n int) *image.Gray {
+
+	img := image.NewGray(image.Rect(0, 0, w, h))
+
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i % n * 255 / (n - 1))
+	}
+
+	return img
+}
+
+func TestOptimizeGrayPalettedCutoff(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		w, h, n    int
+		exhaustive bool
+		paletted   bool
+	}{
+		{"few levels", 32, 32, 16, false, true},
+		{"at cutoff", 32, 32, grayPaletteMaxColors, false, true},
+		{"above cutoff", 32, 32, grayPaletteMaxColors + 1, false, false},
+		{"above cutoff exhaustive", 32, 32, grayPaletteMaxColors + 1, true, true},
+		{"all levels", 32, 32, 256, false, false},
+		// NOTE одномерным текстурам с > 16 уровнями paletted не нужен, см. is1D
+		{"1d 16 levels", 64, 1, 16, false, true},
+		{"1d 17 levels", 64, 1, 17, false, false},
+		{"1d 17 levels exhaustive", 64, 1, 17, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			o := NewPNGOptimizer()
+
+			if tt.exhaustive {
+				o = NewPNGOptimizer(WithExhaustive())
+			}
+
+			img := grayLevelsImage(tt.w, tt.h, tt.n)
+
+			if n := o.countGrayColors(img); n != uint(tt.n) {
+				t.Fatalf("countGrayColors %d, want %d", n, tt.n)
+			}
+
+			var err error
+
+			names := variantNames(o, func() {
+				_, _, err = o.OptimizeImage(img)
+			})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := hasVariant(names, "paletted"); got != tt.paletted {
+				t.Errorf("paletted tried %t, want %t (variants %v)", got, tt.paletted, names)
+			}
+		})
+	}
+}
+
+func TestNRGBAPaletteByFreq(t *testing.T) {
+
+	c := func(r, g, b, a uint8) color.NRGBA {
+		return color.NRGBA{r, g, b, a}
+	}
+
+	tests := []struct {
+		name   string
+		fi, fj nrgbaFreq
+		less   bool
+	}{
+		{"more frequent first", nrgbaFreq{c(9, 9, 9, 255), 5}, nrgbaFreq{c(1, 1, 1, 255), 4}, true},
+		{"less frequent after", nrgbaFreq{c(1, 1, 1, 255), 4}, nrgbaFreq{c(9, 9, 9, 255), 5}, false},
+		// NOTE разность uint частот переполнилась бы в огромное "положительное" число
+		{"no underflow", nrgbaFreq{c(1, 1, 1, 255), 1}, nrgbaFreq{c(1, 1, 2, 255), ^uint(0)}, false},
+		{"no underflow reversed", nrgbaFreq{c(1, 1, 2, 255), ^uint(0)}, nrgbaFreq{c(1, 1, 1, 255), 1}, true},
+		{"tie by alpha", nrgbaFreq{c(9, 9, 9, 10), 3}, nrgbaFreq{c(1, 1, 1, 20), 3}, true},
+		{"tie by red", nrgbaFreq{c(1, 9, 9, 255), 3}, nrgbaFreq{c(2, 1, 1, 255), 3}, true},
+		{"tie by green", nrgbaFreq{c(1, 2, 9, 255), 3}, nrgbaFreq{c(1, 1, 1, 255), 3}, false},
+		{"tie by blue", nrgbaFreq{c(1, 1, 1, 255), 3}, nrgbaFreq{c(1, 1, 2, 255), 3}, true},
+		{"same color", nrgbaFreq{c(1, 1, 1, 255), 3}, nrgbaFreq{c(1, 1, 1, 255), 3}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := (nrgbaPaletteSorter{}).byFreq(&tt.fi, &tt.fj); got != tt.less {
+				t.Errorf("byFreq(%v, %v) = %t, want %t", tt.fi, tt.fj, got, tt.less)
+			}
+		})
+	}
+}
+
+func TestNRGBAPaletteOrder(t *testing.T) {
+
+	freqs := map[uint32]uint{
+		packNRGBA(color.NRGBA{10, 10, 10, 255}): 7,
+		packNRGBA(color.NRGBA{20, 20, 20, 255}): 7,
+		packNRGBA(color.NRGBA{30, 30, 30, 255}): 9,
+		packNRGBA(color.NRGBA{1, 2, 3, 128}):    1,
+		packNRGBA(color.NRGBA{4, 5, 6, 64}):     2,
+		packNRGBA(color.NRGBA{}):                1,
+	}
+
+	// NOTE прозрачный первым, затем полупрозрачные, затем непрозрачные, внутри - по частоте и значению
+	want := []color.NRGBA{{}, {4, 5, 6, 64}, {1, 2, 3, 128}, {30, 30, 30, 255}, {10, 10, 10, 255}, {20, 20, 20, 255}}
+
+	// NOTE порядок обхода map случаен, поэтому несколько попыток
+	for i := 0; i < 20; i++ {
+
+		got := NewPNGOptimizer().paletteFromNRGBA(freqs)
+
+		if len(got) != len(want) {
+			t.Fatalf("palette %v, want %v", got, want)
+		}
+
+		for j := range want {
+			if got[j] != want[j] {
+				t.Fatalf("palette %v, want %v", got, want)
+			}
+		}
+	}
+}
+
+func TestCountNRGBAColorsTransparent(t *testing.T) {
+
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 2))
+
+	// NOTE 4 прозрачных пикселя разного "цвета" и 4 непрозрачных двух цветов
+	for i, c := range []color.NRGBA{{1, 2, 3, 0}, {4, 5, 6, 0}, {0, 0, 0, 0}, {255, 255, 255, 0},
+		{9, 9, 9, 255}, {9, 9, 9, 255}, {9, 9, 9, 255}, {7, 8, 9, 255}} {
+		img.SetNRGBA(i%4, i/4, c)
+	}
+
+	freqs, hasTransparent, hasPartAlpha, isGray := NewPNGOptimizer().countNRGBAColors(img)
+
+	if len(freqs) != 3 || freqs[packNRGBA(color.NRGBA{})] != 4 {
+		t.Errorf("freqs %v, want all transparent pixels as one {0, 0, 0, 0} x 4", freqs)
+	}
+
+	if !hasTransparent || hasPartAlpha || isGray {
+		t.Errorf("hasTransparent %t, hasPartAlpha %t, isGray %t, want true, false, false", hasTransparent,
+			hasPartAlpha, isGray)
+	}
+
+	// NOTE в палитре сведенный прозрачный цвет один и первый, так что tRNS из одного байта
+	palette := NewPNGOptimizer().paletteFromNRGBA(freqs)
+
+	if len(palette) != 3 || palette[0] != (color.NRGBA{}) {
+		t.Errorf("palette %v, want 3 colors starting with {0, 0, 0, 0}", palette)
+	}
+
+	b, err := NewPNGOptimizer().asPaletted(img, palette)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	samePixels(t, "paletted", img, decodeTestPNG(t, b.Bytes()))
+}
+
+// TestNRGBAPalettedTransparentColors: 255 opaque colors and many different fully transparent ones are 256 colors,
+// so paletted variant is still tried
+func TestNRGBAPalettedTransparentColors(t *testing.T) {
+
+	img := image.NewNRGBA(image.Rect(0, 0, 32, 16))
+
+	for i := 0; i < 32*16; i++ {
+		if i < 255 {
+			img.SetNRGBA(i%32, i/32, color.NRGBA{uint8(i), uint8(i * 7), 0x40, 0xff})
+		} else {
+			img.SetNRGBA(i%32, i/32, color.NRGBA{uint8(i), uint8(i >> 8), 0x80, 0})
+		}
+	}
+
+	o := NewPNGOptimizer()
+
+	var (
+		b   *bytes.Buffer
+		err error
+	)
+
+	names := variantNames(o, func() {
+		b, _, err = o.OptimizeImage(img)
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !hasVariant(names, "paletted") {
+		t.Errorf("paletted variant is not tried, variants %v", names)
+	}
+
+	samePixels(t, "best", img, decodeTestPNG(t, b.Bytes()))
+}
+
+// checkRawPNG fails t unless b (nil if want is nil) is png of the color type and bit depth that decodes to want
+func checkRawPNG(t *testing.T, b *bytes.Buffer, want image.Image, colorType, depth uint8) {
+
+	t.Helper()
+
+	if want == nil {
+		if b != nil {
+			t.Fatalf("got %d bytes, want no variant", b.Len())
+		}
+		return
+	}
+
+	if b == nil {
+		t.Fatal("got no variant")
+	}
+
+	h, err := readPNGHeader(b.Bytes())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h.colorType != colorType || h.bitDepth != depth {
+		t.Errorf("color type %d, bit depth %d, want %d, %d", h.colorType, h.bitDepth, colorType, depth)
+	}
+
+	samePixels(t, "decoded", want, decodeTestPNG(t, b.Bytes()))
+}
+
+func TestEncodeBilevelGray(t *testing.T) {
+
+	checker := func(w, h int) *image.Gray {
+
+		img := image.NewGray(image.Rect(0, 0, w, h))
+
+		for i := range img.Pix {
+			if (i%w+i/w)%3 == 0 {
+				img.Pix[i] = 0xff
+			}
+		}
+
+		return img
+	}
+
+	tests := []struct {
+		name string
+		img  *image.Gray
+		ok   bool
+	}{
+		{"8 wide", checker(8, 3), true},
+		// NOTE ширина не кратна 8: хвост последнего байта строки - выравнивание
+		{"odd width", checker(13, 5), true},
+		{"1x1 black", grayTestImage(1, 1, 0), true},
+		{"1x1 white", grayTestImage(1, 1, 0xff), true},
+		{"all white", grayTestImage(17, 2, 0xff), true},
+		{"subimage", checker(20, 20).SubImage(image.Rect(3, 5, 14, 9)).(*image.Gray), true},
+		{"other level", grayTestImage(9, 1, 0, 0xff, 0x80), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			b, err := NewPNGOptimizer().encodeBilevelGray(tt.img)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var want image.Image
+
+			if tt.ok {
+				want = tt.img
+			}
+
+			checkRawPNG(t, b, want, pngColorGray, 1)
+		})
+	}
+}
+
+func TestEncodeGrayAlpha(t *testing.T) {
+
+	ramp := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			l := uint8(x * 16)
+			ramp.SetNRGBA(x, y, color.NRGBA{l, l, l, uint8(y*17) &^ 1})
+		}
+	}
+
+	// NOTE у полностью прозрачных RGB любой, в png он становится {0, 0}
+	junk := image.NewNRGBA(image.Rect(0, 0, 3, 1))
+	junk.SetNRGBA(0, 0, color.NRGBA{200, 200, 200, 0})
+	junk.SetNRGBA(1, 0, color.NRGBA{10, 10, 10, 1})
+	junk.SetNRGBA(2, 0, color.NRGBA{255, 255, 255, 255})
+
+	tests := []struct {
+		name string
+		img  *image.NRGBA
+	}{
+		{"ramp", ramp},
+		{"transparent junk", junk},
+		{"subimage", ramp.SubImage(image.Rect(5, 3, 12, 15)).(*image.NRGBA)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			b, err := NewPNGOptimizer().encodeGrayAlpha(tt.img)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			checkRawPNG(t, b, tt.img, pngColorGrayAlpha, 8)
+		})
+	}
+}
+
+func TestEncodeRGBTRNS(t *testing.T) {
+
+	img := image.NewNRGBA(image.Rect(0, 0, 20, 10))
+
+	// NOTE черный {0, 0, 0} занят непрозрачным пикселем, так что ключ tRNS должен быть другим
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 20; x++ {
+			switch {
+			case x == 0 && y == 0:
+				img.SetNRGBA(x, y, color.NRGBA{0, 0, 0, 255})
+			case (x+y)%4 == 0:
+				img.SetNRGBA(x, y, color.NRGBA{uint8(x), 0, 0, 0})
+			default:
+				img.SetNRGBA(x, y, color.NRGBA{uint8(x * 12), uint8(y * 25), uint8(x ^ y), 255})
+			}
+		}
+	}
+
+	tests := []struct {
+		name string
+		img  *image.NRGBA
+	}{
+		{"key taken", img},
+		{"subimage", img.SubImage(image.Rect(1, 2, 19, 9)).(*image.NRGBA)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			b, err := NewPNGOptimizer().encodeRGBTRNS(tt.img)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			checkRawPNG(t, b, tt.img, pngColorRGB, 8)
+		})
+	}
+}
+
+// nColorsImage returns w x h NRGBA image of exactly n colors (n <= w*h)
+func nColorsImage(w, h, n int) *image.NRGBA {
+
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+
+	for i := 0; i < w*h; i++ {
+		k := i % n
+		img.SetNRGBA(i%w, i/w, color.NRGBA{uint8(k), uint8(k * 3), uint8(255 - k), 0xff})
+	}
+
+	return img
+}
+
+func TestPalettedBitDepth(t *testing.T) {
+
+	tests := []struct {
+		colors int
+		depth  uint8
+	}{
+		{1, 1}, {2, 1}, {3, 2}, {4, 2}, {5, 4}, {16, 4}, {17, 8}, {256, 8},
+	}
+
+	o := NewPNGOptimizer()
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d colors", tt.colors), func(t *testing.T) {
+
+			img := nColorsImage(16, 16, tt.colors)
+			freqs, _, _, _ := o.countNRGBAColors(img)
+
+			b, err := o.asPaletted(img, o.paletteFromNRGBA(freqs))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			checkRawPNG(t, b, img, pngColorPaletted, tt.depth)
+		})
+	}
+}
+
+// grayNRGBA returns gray image (as NRGBA) of w x h pixels with n levels, alpha of every pixel is a
+func grayNRGBA(w, h, n int, a uint8) *image.NRGBA {
+
+	gray, nrgba := grayLevelsImage(w, h, n), image.NewNRGBA(image.Rect(0, 0, w, h))
+
+	for i, v := range gray.Pix {
+		copy(nrgba.Pix[4*i:], []uint8{v, v, v, a})
+	}
+
+	return nrgba
+}
+
+func TestOptimizeNRGBA1D(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		img        *image.NRGBA
+		exhaustive bool
+		as         string // "" - not the fast path
+		paletted   bool
+	}{
+		{"row", grayNRGBA(64, 1, 64, 0xff), false, "gray (1d)", false},
+		{"column", grayNRGBA(1, 64, 64, 0xff), false, "gray (1d)", false},
+		{"row exhaustive", grayNRGBA(64, 1, 64, 0xff), true, "", true},
+		{"row 16 levels", grayNRGBA(64, 1, 16, 0xff), false, "", true},
+		{"row alpha", grayNRGBA(64, 1, 64, 0x80), false, "", true},
+		{"2d", grayNRGBA(8, 8, 64, 0xff), false, "", true},
+		// NOTE у строки из уникальных непрозрачных цветов paletted не пробуется
+		{"unique colors row", nColorsImage(64, 1, 64), false, "", false},
+		{"unique colors row exhaustive", nColorsImage(64, 1, 64), true, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			o := NewPNGOptimizer()
+
+			if tt.exhaustive {
+				o = NewPNGOptimizer(WithExhaustive())
+			}
+
+			var (
+				b   *bytes.Buffer
+				as  string
+				err error
+			)
+
+			names := variantNames(o, func() {
+				b, as, err = o.OptimizeImage(tt.img)
+			})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.as != "" {
+
+				if as != tt.as || len(names) != 1 {
+					t.Fatalf("as %q with variants %v, want %q the only variant", as, names, tt.as)
+				}
+
+				checkRawPNG(t, b, tt.img, pngColorGray, 8)
+
+				return
+			}
+
+			if as == "gray (1d)" || len(names) == 0 {
+				t.Fatalf("as %q with variants %v, want the full pipeline", as, names)
+			}
+
+			if got := hasVariant(names, "paletted"); got != tt.paletted {
+				t.Errorf("paletted tried %t, want %t (variants %v)", got, tt.paletted, names)
+			}
+
+			samePixels(t, as, tt.img, decodeTestPNG(t, b.Bytes()))
+		})
+	}
+}
+
+func TestOptimizePalettedSource(t *testing.T) {
+
+	// NOTE неудачная исходная палитра: неиспользуемые и повторяющиеся цвета, прозрачный цвет в конце
+	palette := color.Palette{
+		color.NRGBA{0xff, 0, 0, 0xff},
+		color.NRGBA{0, 0xff, 0, 0xff},
+		color.NRGBA{0xff, 0, 0, 0xff},
+		color.NRGBA{0x12, 0x34, 0x56, 0xff},
+	}
+
+	for len(palette) < 255 {
+		palette = append(palette, color.NRGBA{uint8(len(palette)), 0x80, 0x80, 0xff})
+	}
+
+	palette = append(palette, color.NRGBA{0, 0, 0, 0})
+
+	src := image.NewPaletted(image.Rect(0, 0, 16, 16), palette)
+
+	for i := range src.Pix {
+		src.Pix[i] = []uint8{0, 1, 2, 255}[i%4]
+	}
+
+	o := NewPNGOptimizer()
+
+	var (
+		b, srcb *bytes.Buffer
+		err     error
+	)
+
+	variants := captureVariants(o, func() {
+		b, _, err = o.OptimizeImage(src)
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+
+	for _, v := range variants {
+		if names = append(names, v.as); v.as == "src (paletted)" {
+			srcb = v.b
+		}
+	}
+
+	for _, as := range []string{"src (paletted)", "compacted palette"} {
+		if !hasVariant(names, as) {
+			t.Errorf("variant %q is not tried, variants %v", as, names)
+		}
+	}
+
+	nrgba := false
+
+	for _, as := range names {
+		nrgba = nrgba || strings.HasPrefix(as, "nrgba ")
+	}
+
+	if !nrgba {
+		t.Errorf("nrgba pipeline is not tried, variants %v", names)
+	}
+
+	if srcb == nil || b.Len() >= srcb.Len() {
+		t.Errorf("best %d bytes is not smaller than the source palette", b.Len())
+	}
+
+	samePixels(t, "best", src, decodeTestPNG(t, b.Bytes()))
+
+	compacted := compactPaletted(src)
+
+	if compacted == nil {
+		t.Fatal("compactPaletted returned nil")
+	}
+
+	if len(compacted.Palette) != 4 || compacted.Palette[0] != palette[255] {
+		t.Errorf("compacted palette %v, want 4 colors with the transparent one first", compacted.Palette)
+	}
+
+	samePixels(t, "compacted", src, compacted)
+
+	// уже компактная палитра не трогается
+	if again := compactPaletted(compacted); again != nil {
+		t.Errorf("compactPaletted of a compact palette returned %d colors, want nil", len(again.Palette))
+	}
+}
+
+func TestPalettedPartialAlphaExact(t *testing.T) {
+
+	// glow: один оттенок с плавной альфой от центра, как у светящихся эффектов
+	glow := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+
+			d := (x-16)*(x-16) + (y-16)*(y-16)
+			a := 0
+
+			if d < 256 {
+				a = 255 - d
+			}
+
+			glow.SetNRGBA(x, y, color.NRGBA{0xff, 0xc0, 0x40, uint8(a)})
+		}
+	}
+
+	// NOTE почти прозрачные цвета, отличающиеся одним младшим битом RGB
+	faint := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+
+	for i := 0; i < 256; i++ {
+		faint.SetNRGBA(i%16, i/16, color.NRGBA{uint8(i), 0, 0, 1})
+	}
+
+	levels := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+
+	for i := 0; i < 256; i++ {
+		levels.SetNRGBA(i%16, i/16, color.NRGBA{0x10, 0x20, 0x30, uint8(i)})
+	}
+
+	tests := []struct {
+		name string
+		img  *image.NRGBA
+	}{
+		{"glow", glow},
+		{"faint", faint},
+		{"alpha levels", levels},
+	}
+
+	o := NewPNGOptimizer()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			freqs, _, hasPartAlpha, _ := o.countNRGBAColors(tt.img)
+
+			if !hasPartAlpha || len(freqs) > 256 {
+				t.Fatalf("%d colors, partial alpha %t: bad test image", len(freqs), hasPartAlpha)
+			}
+
+			b, err := o.asPaletted(tt.img, o.paletteFromNRGBA(freqs))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			samePixels(t, "paletted", tt.img, decodeTestPNG(t, b.Bytes()))
+		})
+	}
+}
+
+func TestOptimizeGray16(t *testing.T) {
+
+	promoted, real16 := image.NewGray16(image.Rect(0, 0, 64, 16)), image.NewGray16(image.Rect(0, 0, 64, 16))
+
+	for i := 0; i < 64*16; i++ {
+		v := uint16(i % 64 * 4)
+		promoted.SetGray16(i%64, i/64, color.Gray16{Y: v * 257})
+		real16.SetGray16(i%64, i/64, color.Gray16{Y: v*257 + uint16(i%2)})
+	}
+
+	tests := []struct {
+		name string
+		img  *image.Gray16
+		to8  bool
+	}{
+		{"8-bit promoted", promoted, true},
+		{"real 16-bit", real16, false},
+	}
+
+	o := NewPNGOptimizer()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			gray := o.gray16to8(tt.img)
+
+			if (gray != nil) != tt.to8 {
+				t.Fatalf("gray16to8 converted %t, want %t", gray != nil, tt.to8)
+			}
+
+			if gray != nil {
+				samePixels(t, "gray16to8", tt.img, gray)
+			}
+
+			var (
+				b   *bytes.Buffer
+				as  string
+				err error
+			)
+
+			names := variantNames(o, func() {
+				b, as, err = o.OptimizeImage(tt.img)
+			})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			to8 := false
+
+			for _, n := range names {
+				to8 = to8 || strings.HasPrefix(n, "8-bit ")
+			}
+
+			if to8 != tt.to8 {
+				t.Errorf("8-bit variant tried %t, want %t (variants %v)", to8, tt.to8, names)
+			}
+
+			if tt.to8 && !strings.HasPrefix(as, "8-bit ") {
+				t.Errorf("best is %q, want an 8-bit variant", as)
+			}
+
+			samePixels(t, as, tt.img, decodeTestPNG(t, b.Bytes()))
+		})
+	}
+}
+
+// rebuildPNG returns data with chunks replaced by edit (if not nil) and written with valid CRC
+func rebuildPNG(t testing.TB, data []byte, edit func(chunks []pngChunk) []pngChunk) []byte {
+
+	t.Helper()
+
+	chunks, _, err := readPNGChunks(data)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if edit != nil {
+		chunks = edit(chunks)
+	}
+
+	b := bytes.NewBufferString(pngSignature)
+
+	for _, c := range chunks {
+		writePNGChunk(b, c.typ, c.data)
+	}
+
+	return b.Bytes()
+}
+
+// withSize returns data with IHDR width and height patched
+func withSize(t testing.TB, data []byte, w, h uint32) []byte {
+
+	return rebuildPNG(t, data, func(chunks []pngChunk) []pngChunk {
+
+		ihdr := append([]byte(nil), chunks[0].data...)
+		binary.BigEndian.PutUint32(ihdr[0:4], w)
+		binary.BigEndian.PutUint32(ihdr[4:8], h)
+
+		chunks[0].data = ihdr
+
+		return chunks
+	})
+}
+
+func TestOptimizeEmptyPNG(t *testing.T) {
+
+	b, err := encodeRawPNG(1, 1, pngColorGray, 8, nil, []byte{0x80}, 1, 9)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		w, h uint32
+	}{
+		{0, 0}, {1, 0}, {0, 1}, {0, 64},
+	}
+
+	o := NewPNGOptimizer()
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%dx%d", tt.w, tt.h), func(t *testing.T) {
+
+			data := withSize(t, b.Bytes(), tt.w, tt.h)
+
+			opt, res, err := o.OptimizeBytes(data, nil)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !res.NOOP || !strings.HasPrefix(res.Reason, "empty image") || !bytes.Equal(opt, data) {
+				t.Errorf("NOOP %t, reason %q, want NOOP for an empty image with data unchanged", res.NOOP, res.Reason)
+			}
+		})
+	}
+
+	for _, img := range []image.Image{
+		image.NewNRGBA(image.Rect(0, 0, 0, 0)),
+		image.NewGray(image.Rect(0, 0, 16, 0)),
+		image.NewPaletted(image.Rect(0, 0, 0, 16), color.Palette{color.Black}),
+	} {
+		if _, _, err := o.OptimizeImage(img); err != errEmptyImage {
+			t.Errorf("OptimizeImage of %T %v: error %v, want %v", img, img.Bounds(), err, errEmptyImage)
+		}
+	}
+}
+
+// encodeInterlacedGray returns img as Adam7 interlaced 8-bit gray png, every row unfiltered
+func encodeInterlacedGray(t testing.TB, img *image.Gray) []byte {
+
+	t.Helper()
+
+	// x0, y0, dx, dy of the 7 passes, SEE $ 8.2
+	passes := [7][4]int{{0, 0, 8, 8}, {4, 0, 8, 8}, {0, 4, 4, 8}, {2, 0, 4, 4}, {0, 2, 2, 4}, {1, 0, 2, 2}, {0, 1, 1, 2}}
+
+	bounds := img.Bounds()
+
+	idat := bytes.NewBuffer(nil)
+	zw := zlib.NewWriter(idat)
+
+	for _, p := range passes {
+		for y := p[1]; y < bounds.Dy(); y += p[3] {
+
+			// NOTE у пустого прохода (ширина 0) строк нет вовсе, даже байта фильтра
+			if p[0] >= bounds.Dx() {
+				break
+			}
+
+			row := []byte{0}
+
+			for x := p[0]; x < bounds.Dx(); x += p[2] {
+				row = append(row, img.GrayAt(bounds.Min.X+x, bounds.Min.Y+y).Y)
+			}
+
+			zw.Write(row)
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var ihdr [pngIHDRLen]byte
+
+	binary.BigEndian.PutUint32(ihdr[0:4], uint32(bounds.Dx()))
+	binary.BigEndian.PutUint32(ihdr[4:8], uint32(bounds.Dy()))
+	ihdr[8], ihdr[9], ihdr[12] = 8, pngColorGray, pngInterlaceAdam7
+
+	b := bytes.NewBufferString(pngSignature)
+
+	writePNGChunk(b, pngChunkIHDR, ihdr[:])
+	writePNGChunk(b, pngChunkIDAT, idat.Bytes())
+	writePNGChunk(b, pngChunkIEND, nil)
+
+	return b.Bytes()
+}
+
+func TestOptimizeInterlacedPNG(t *testing.T) {
+
+	tests := []struct {
+		name string
+		img  *image.Gray
+	}{
+		{"1x1", grayTestImage(1, 1, 0x80)},
+		{"3x5", grayLevelsImage(3, 5, 15)},
+		{"gradient", grayLevelsImage(64, 64, 256)},
+		{"odd", grayLevelsImage(37, 19, 7)},
+	}
+
+	o := NewPNGOptimizer()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			data := encodeInterlacedGray(t, tt.img)
+
+			// NOTE сама фикстура проверяется стандартным декодером
+			samePixels(t, "fixture", tt.img, decodeTestPNG(t, data))
+
+			opt, res, err := o.OptimizeBytes(data, nil)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if res.NOOP || !strings.Contains(res.Variant, ", de-interlaced") {
+				t.Fatalf("NOOP %t, variant %q, want de-interlaced", res.NOOP, res.Variant)
+			}
+
+			h, err := readPNGHeader(opt)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if h.isInterlaced() {
+				t.Error("optimized png is still interlaced")
+			}
+
+			samePixels(t, res.Variant, tt.img, decodeTestPNG(t, opt))
+		})
+	}
+}
+
+// chunkedTestPNG returns 8-bit gray png of img with a tEXt chunk before IDAT, which is split in two
+func chunkedTestPNG(t testing.TB, img *image.Gray) []byte {
+
+	data, err := encodeStd(img)()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rebuildPNG(t, data, func(chunks []pngChunk) (out []pngChunk) {
+
+		for _, c := range chunks {
+			switch c.typ {
+			case pngChunkIDAT:
+				n := len(c.data) / 2
+				out = append(out, pngChunk{typ: c.typ, data: c.data[:n]}, pngChunk{typ: c.typ, data: c.data[n:]})
+			case pngChunkIHDR:
+				out = append(out, c, pngChunk{typ: "tEXt", data: []byte("Comment\x00made by hand")})
+			default:
+				out = append(out, c)
+			}
+		}
+
+		return out
+	})
+}
+
+func TestOptimizeTrailingBytes(t *testing.T) {
+
+	img := grayLevelsImage(32, 32, 200)
+	data := chunkedTestPNG(t, img)
+
+	o := NewPNGOptimizer()
+
+	for _, n := range []int{1, 12, 3000} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+
+			junk := bytes.Repeat([]byte{0xa5}, n)
+
+			opt, res, err := o.OptimizeBytes(append(append([]byte(nil), data...), junk...), nil)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if want := fmt.Sprintf(", dropped %d trailing bytes", n); !strings.Contains(res.Variant, want) {
+				t.Errorf("variant %q, want %q", res.Variant, want)
+			}
+
+			if _, tail, err := readPNGChunks(opt); err != nil || len(tail) > 0 {
+				t.Errorf("optimized png: %d bytes after IEND, error %v", len(tail), err)
+			}
+
+			samePixels(t, res.Variant, img, decodeTestPNG(t, opt))
+		})
+	}
+}
+
+// chunkOffset returns offset of the length field of the first typ chunk in data
+func chunkOffset(t testing.TB, data []byte, typ string) int {
+
+	t.Helper()
+
+	for off := len(pngSignature); off+pngChunkOverhead <= len(data); {
+
+		if string(data[off+4:off+8]) == typ {
+			return off
+		}
+
+		off += pngChunkOverhead + int(binary.BigEndian.Uint32(data[off:]))
+	}
+
+	t.Fatalf("no %s chunk", typ)
+
+	return 0
+}
+
+type damagedPNG struct {
+	name       string
+	data       []byte
+	repairable bool // by the lenient decoder
+}
+
+// damagedPNGs returns copies of data damaged in ways the lenient decoder can or (cut) can not repair
+func damagedPNGs(t testing.TB, data []byte) (damaged []damagedPNG) {
+
+	add := func(name string, repairable bool, edit func(b []byte) []byte) {
+		damaged = append(damaged, damagedPNG{name, edit(append([]byte(nil), data...)), repairable})
+	}
+
+	// NOTE последний байт CRC чанка
+	badCRC := func(typ string) func(b []byte) []byte {
+		return func(b []byte) []byte {
+			off := chunkOffset(t, b, typ)
+			b[off+pngChunkOverhead+int(binary.BigEndian.Uint32(b[off:]))-1] ^= 0xff
+			return b
+		}
+	}
+
+	add("tEXt bad crc", true, badCRC("tEXt"))
+	add("IDAT bad crc", true, badCRC(pngChunkIDAT))
+	add("IHDR bad crc", true, badCRC(pngChunkIHDR))
+	add("no IEND", true, func(b []byte) []byte {
+		return b[:chunkOffset(t, b, pngChunkIEND)]
+	})
+	add("cut in IDAT", false, func(b []byte) []byte {
+		return b[:chunkOffset(t, b, pngChunkIDAT)+pngChunkOverhead+3]
+	})
+
+	return damaged
+}
+
+func TestLenientDecode(t *testing.T) {
+
+	img := grayLevelsImage(32, 32, 200)
+
+	o := NewPNGOptimizer()
+
+	for _, tt := range damagedPNGs(t, chunkedTestPNG(t, img)) {
+		t.Run(tt.name, func(t *testing.T) {
+
+			if _, _, err := o.OptimizeBytes(tt.data, nil); !errors.Is(err, errPNGCorrupt) {
+				t.Errorf("strict: error %v, want %v", err, errPNGCorrupt)
+			}
+
+			opt, res, err := o.OptimizeBytes(tt.data, &OptimizeOptions{LenientDecode: true, Verify: true})
+
+			if !tt.repairable {
+
+				if err == nil {
+					t.Error("lenient: no error for a file cut in the middle of a chunk")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("lenient: %v", err)
+			}
+
+			if res.NOOP || !strings.Contains(res.Variant, ", repaired ") {
+				t.Errorf("lenient: NOOP %t, variant %q, want the file repaired", res.NOOP, res.Variant)
+			}
+
+			if chunks, _, err := readPNGChunks(opt); err != nil || checkPNGChunks(chunks) != nil {
+				t.Errorf("lenient: optimized png is not valid: %v", err)
+			}
+
+			samePixels(t, res.Variant, img, decodeTestPNG(t, opt))
+		})
+	}
+}
+
+func TestDecodeCorruptPNG(t *testing.T) {
+
+	data := chunkedTestPNG(t, grayLevelsImage(32, 32, 200))
+	damaged := make(map[string][]byte)
+
+	for _, d := range damagedPNGs(t, data) {
+		damaged[d.name] = d.data
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		err  error // nil - decoded
+	}{
+		{"valid", data, nil},
+		{"trailing junk", append(append([]byte(nil), data...), "junk"...), nil},
+		{"not png", []byte("GIF89a"), errPNGSignature},
+		{"signature only", []byte(pngSignature), errPNGNoIHDR},
+		{"tEXt bad crc", damaged["tEXt bad crc"], errPNGBadCRC},
+		{"IDAT bad crc", damaged["IDAT bad crc"], errPNGBadCRC},
+		{"no IEND", damaged["no IEND"], errPNGNoIEND},
+		{"cut in IDAT", damaged["cut in IDAT"], errPNGTruncated},
+	}
+
+	o := NewPNGOptimizer()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			img, err := o.decodePNG(tt.data, false)
+
+			if tt.err == nil {
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				samePixels(t, "decoded", decodeTestPNG(t, data), img.img)
+
+				return
+			}
+
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+
+			// NOTE кроме чужой сигнатуры и отсутствия IHDR, файл отвергается как битый целиком
+			if tt.err != errPNGSignature && tt.err != errPNGNoIHDR && !errors.Is(err, errPNGCorrupt) {
+				t.Errorf("error %v, want it wrapped in %v", err, errPNGCorrupt)
+			}
+		})
+	}
+
+	// файл, оборванный на любом байте, отвергается, а не декодируется частично
+	t.Run("every cut", func(t *testing.T) {
+		for n := 0; n < len(data); n++ {
+			if _, err := o.decodePNG(data[:n], false); err == nil {
+				t.Fatalf("no error for the file cut at %d of %d bytes", n, len(data))
+			}
+		}
+	})
+}
+
+// withPNGChunks returns data with chunks inserted right after IHDR
+func withPNGChunks(t testing.TB, data []byte, chunks ...pngChunk) []byte {
+	return rebuildPNG(t, data, func(c []pngChunk) []pngChunk {
+		return append(append(append([]pngChunk{}, c[:1]...), chunks...), c[1:]...)
+	})
+}
+
+func TestOptimizePNGMetadata(t *testing.T) {
+
+	var (
+		text   = pngChunk{typ: "tEXt", data: []byte("Software\x00paint")}
+		tim    = pngChunk{typ: "tIME", data: []byte{0x07, 0xe8, 1, 2, 3, 4, 5}}
+		phys   = pngChunk{typ: "pHYs", data: []byte{0, 0, 0x0b, 0x13, 0, 0, 0x0b, 0x13, 1}}
+		gama   = pngChunk{typ: pngChunkGAMA, data: []byte{0, 0, 0xb1, 0x8f}}
+		chrm   = pngChunk{typ: pngChunkCHRM, data: make([]byte, 32)}
+		srgb   = pngChunk{typ: pngChunkSRGB, data: []byte{0}}
+		iccp   = pngChunk{typ: pngChunkICCP, data: []byte("profile\x00\x00\x78\x9c\x03\x00\x00\x00\x00\x01")}
+		encode = func(img image.Image) []byte {
+			b, err := encodeStd(img)()
+			if err != nil {
+				t.Fatal(err)
+			}
+			return b
+		}
+	)
+
+	size := func(chunks ...pngChunk) (n int64) {
+		for _, c := range chunks {
+			n += int64(len(c.data) + pngChunkOverhead)
+		}
+		return n
+	}
+
+	all := []pngChunk{text, tim, phys, gama, chrm, srgb, iccp}
+
+	// NOTE 4 уровня вразброс дают paletted меньше 8-битного gray
+	noisy := image.NewGray(image.Rect(0, 0, 64, 64))
+	rnd := testRand(7)
+
+	for i := range noisy.Pix {
+		noisy.Pix[i] = rnd.next() % 4 * 85
+	}
+
+	tests := []struct {
+		name      string
+		data      []byte
+		keep      bool
+		colorType uint8
+		kept      []pngChunk
+	}{
+		{"stripped by default", withPNGChunks(t, encode(grayNRGBA(32, 32, 256, 0xff)), all...), false,
+			pngColorGray, nil},
+		{"color space kept, rgb profile of gray output dropped", withPNGChunks(t, encode(grayNRGBA(32, 32, 256, 0xff)), all...),
+			true, pngColorGray, []pngChunk{gama, chrm, srgb}},
+		{"gray profile of gray output kept", withPNGChunks(t, encode(grayLevelsImage(32, 32, 256)), all...), true,
+			pngColorGray, []pngChunk{gama, chrm, srgb, iccp}},
+		{"gray profile of paletted output dropped", withPNGChunks(t, encode(noisy), all...), true,
+			pngColorPaletted, []pngChunk{gama, chrm, srgb}},
+		{"rgb profile of rgb output kept", withPNGChunks(t, encode(nColorsImage(64, 64, 4096)), all...), true,
+			pngColorRGB, []pngChunk{gama, chrm, srgb, iccp}},
+	}
+
+	o := NewPNGOptimizer()
+
+	for _, tt := range tests {
+
+		opt, res, err := o.optimizeData(tt.data, &OptimizeOptions{Effort: EffortDefault, Verify: true, KeepMetadata: tt.keep})
+
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		if opt == nil {
+			t.Fatalf("%s: NOOP (%s)", tt.name, res.Reason)
+		}
+
+		h, err := readPNGHeader(opt.Bytes())
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if h.colorType != tt.colorType {
+			t.Fatalf("%s: optimized to color type %d (%s), want %d", tt.name, h.colorType, res.Variant, tt.colorType)
+		}
+
+		chunks, _, err := readPNGChunks(opt.Bytes())
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []pngChunk
+
+		for _, c := range chunks {
+			if c.isAncillary() && c.typ != pngChunkTRNS {
+				got = append(got, pngChunk{typ: c.typ, data: c.data})
+			}
+		}
+
+		if fmt.Sprint(got) != fmt.Sprint(tt.kept) {
+			t.Errorf("%s: ancillary chunks %v, want %v", tt.name, got, tt.kept)
+		}
+
+		if want := size(all...) - size(tt.kept...); res.Metadata != want {
+			t.Errorf("%s: reported %d metadata bytes, want %d", tt.name, res.Metadata, want)
+		}
+
+		if err = checkPNGStripped(opt.Bytes(), tt.kept); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+
+	// NOTE страховка на случай, если кодировщик когда-нибудь начнет писать метаданные сам
+	leaked := withPNGChunks(t, encode(grayLevelsImage(8, 8, 4)), text)
+
+	if err := checkPNGStripped(leaked, nil); !errors.Is(err, errPNGMetadataLeft) {
+		t.Errorf("tEXt left: got %v, want %v", err, errPNGMetadataLeft)
+	}
+
+	if err := checkPNGStripped(withPNGChunks(t, encode(grayLevelsImage(8, 8, 4)), srgb), []pngChunk{srgb}); err != nil {
+		t.Errorf("kept sRGB: %v", err)
+	}
+}
+
+// TestExhaustiveOnce checks that WithExhaustive searches every candidate once, the nested pipelines (16-bit -> 8-bit,
+// paletted -> nrgba) only add their candidates to the top level list
+func TestExhaustiveOnce(t *testing.T) {
+
+	gray := grayLevelsImage(16, 16, 8)
+	gray16 := image.NewGray16(gray.Rect)
+
+	for i, v := range gray.Pix {
+		gray16.Pix[2*i], gray16.Pix[2*i+1] = v, v
+	}
+
+	paletted := image.NewPaletted(gray.Rect, testTIFFPalette(8))
+
+	for i, v := range gray.Pix {
+		paletted.Pix[i] = v % 8
+	}
+
+	nrgba64 := image.NewNRGBA64(gray.Rect)
+
+	for i, v := range gray.Pix {
+		copy(nrgba64.Pix[8*i:], []uint8{v, v, 0, 0, 0x55, 0x55, 0xff, 0xff})
+	}
+
+	o := NewPNGOptimizer(WithExhaustive())
+
+	for _, img := range []image.Image{gray16, paletted, nrgba64} {
+
+		candidates, err := o.variants(img)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		searched := make(map[string]bool)
+
+		for _, name := range variantNames(o, func() { _, _, err = o.OptimizeImage(img) }) {
+			// NOTE "X, filter none" - начало поиска по X, "X, 4-bit, filter none" - тот же поиск на другой глубине
+			if strings.HasSuffix(name, ", filter none") && !exhaustDepthRe.MatchString(name) {
+				searched[name] = true
+			}
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(searched) != len(candidates) {
+			t.Errorf("%T: %d searches of %d candidates: %v", img, len(searched), len(candidates), searched)
+		}
+	}
+}
+
+var exhaustDepthRe = regexp.MustCompile(`, [1248]-bit, filter none$`)
+
+func TestDumpPalette(t *testing.T) {
+
+	const (
+		nrgbaHead = "order: fully transparent (all A = 0 folded into one entry) first, then partially transparent," +
+			" then opaque, the most frequent first within a group, so that tRNS is as short as possible\n" +
+			" idx  RGBA       freq\n"
+		grayHead = "order: the most frequent first, equal frequency by brightness (deterministic output)\n" +
+			" idx  Y     freq\n"
+	)
+
+	paletted := image.NewPaletted(image.Rect(0, 0, 3, 2), color.Palette{
+		color.NRGBA{0xff, 0, 0, 0xff}, color.NRGBA{}, color.NRGBA{0, 0, 0xff, 0x80},
+	})
+	copy(paletted.Pix, []uint8{0, 0, 1, 0, 1, 2})
+
+	gray := image.NewGray(image.Rect(0, 0, 2, 2))
+	copy(gray.Pix, []uint8{0x30, 0x10, 0x20, 0x10})
+
+	// NOTE nColorsImage больше 256 разных цветов не дает
+	many := image.NewNRGBA(image.Rect(0, 0, 16, 17))
+
+	for i := 0; i < 16*17; i++ {
+		many.SetNRGBA(i%16, i/16, color.NRGBA{uint8(i), uint8(i >> 8), 0, 0xff})
+	}
+
+	tests := []struct {
+		name string
+		img  image.Image
+		want string // "" - errNoPalette
+	}{
+		{"paletted", paletted, "source palette: 3 entries\npalette: 3 entries, tRNS: 2 entries\n" + nrgbaHead +
+			"   0  #00000000  2\n   1  #0000ff80  1\n   2  #ff0000ff  3\n"},
+		{"gray", gray, "palette: 3 entries, tRNS: 0 entries\n" + grayHead +
+			"   0  #10   2\n   1  #20   1\n   2  #30   1\n"},
+		{"nrgba", nColorsImage(16, 16, 256), ""},
+		{"more than 256 colors", many, ""},
+		{"gray16", image.NewGray16(image.Rect(0, 0, 2, 2)), ""},
+	}
+
+	dir := t.TempDir()
+
+	var log bytes.Buffer
+
+	ao, err := NewAssetsOptimizer(dir, WithSettings(Settings{MinifyJSON: true, Log: &log}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			data, err := encodeStd(tt.img)()
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			path := filepath.Join(dir, tt.name+".png")
+
+			if err = os.WriteFile(path, data, 0o666); err != nil {
+				t.Fatal(err)
+			}
+
+			log.Reset()
+
+			err = ao.DumpPalette(path)
+
+			if tt.name == "nrgba" {
+
+				// NOTE 256 цветов - еще палитра
+				if err != nil || !strings.Contains(log.String(), "palette: 256 entries, tRNS: 0 entries\n") {
+					t.Errorf("%v\n%s", err, log.String())
+				}
+
+				return
+			}
+
+			if tt.want == "" {
+
+				if !errors.Is(err, errNoPalette) {
+					t.Errorf("error %v, want %v", err, errNoPalette)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if want := fmt.Sprintf("Palette of asset %q (png):\n", path) + tt.want; log.String() != want {
+				t.Errorf("dump:\n%s\nwant:\n%s", log.String(), want)
+			}
+		})
+	}
+
+	// NOTE не png (или не картинка вовсе) - тоже ошибка
+	for name, data := range map[string][]byte{"item.config": []byte("{}"), "notes.txt": nil, "bad.png": []byte("x")} {
+
+		path := filepath.Join(dir, name)
+
+		if err = os.WriteFile(path, data, 0o666); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = ao.DumpPalette(path); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestPNGLevel(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		level  png.CompressionLevel
+		zlib   int
+		flevel byte // FLEVEL of zlib header, see RFC 1950 2.2
+	}{
+		{"", png.BestCompression, zlib.BestCompression, 3},
+		{"best", png.BestCompression, zlib.BestCompression, 3},
+		{"BEST", png.BestCompression, zlib.BestCompression, 3},
+		{"default", png.DefaultCompression, zlib.DefaultCompression, 2},
+		{"Speed", png.BestSpeed, zlib.BestSpeed, 0},
+		{"none", png.NoCompression, zlib.NoCompression, 0},
+	}
+
+	// NOTE почти шум, чтобы уровни давали разный размер
+	img := image.NewGray(image.Rect(0, 0, 64, 64))
+
+	for i := range img.Pix {
+		img.Pix[i] = uint8((i*i*7 + i*13) % 5 * 60)
+	}
+
+	dir := t.TempDir()
+
+	sizes := make(map[string]int)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			ao, err := NewAssetsOptimizer(dir, WithSettings(Settings{PNGLevel: tt.name}))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			o := ao.registry.Lookup(extPNG).(*PNGOptimizer)
+
+			if o.encoder.CompressionLevel != tt.level || o.zlibLevel() != tt.zlib {
+				t.Fatalf("level %d, zlib %d, want %d, %d", o.encoder.CompressionLevel, o.zlibLevel(), tt.level, tt.zlib)
+			}
+
+			b, as, err := o.OptimizeImage(img)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			chunks, _, err := readPNGChunks(b.Bytes())
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := range chunks {
+
+				if chunks[i].typ != "IDAT" {
+					continue
+				}
+
+				zh := chunks[i].data
+
+				if zh[1]>>6 != tt.flevel {
+					t.Errorf("%s: FLEVEL %d, want %d", as, zh[1]>>6, tt.flevel)
+				}
+
+				// NOTE без сжатия первый блок deflate - stored (BTYPE 00)
+				if stored := zh[2]&0b110 == 0; stored != (tt.level == png.NoCompression) {
+					t.Errorf("%s: stored block %t", as, stored)
+				}
+
+				break
+			}
+
+			sizes[strings.ToLower(tt.name)] = b.Len()
+		})
+	}
+
+	if !(sizes["best"] <= sizes["default"] && sizes["default"] <= sizes["speed"] && sizes["speed"] < sizes["none"]) {
+		t.Errorf("sizes %v, want best <= default <= speed < none", sizes)
+	}
+
+	// NOTE неизвестный уровень - ошибка конфигурации, до какого-либо прогона
+	for _, name := range []string{"fast", "9", "best "} {
+		if _, err := NewAssetsOptimizer(dir, WithSettings(Settings{PNGLevel: name})); err == nil ||
+			!strings.Contains(err.Error(), "unknown png level") {
+			t.Errorf("%q: error %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,473 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// own minimal PNG writer for the color types png.Encode can't write (gray + tRNS, rgb + tRNS, 1-bit gray,
+// gray + alpha),
+// only 8-bit samples or gray of lower bit depth, no interlace; and re-filter of already encoded png with row filters png.Encode doesn't choose
+// SEE $ 4.1.1 IHDR Image header, $ 4.2.1.1 tRNS, $ 6 Filter Algorithms
+
+const (
+	pngColorGray      = 0
+	pngColorRGB       = 2
+	pngColorPaletted  = 3
+	pngColorGrayAlpha = 4
+	pngColorRGBA      = 6
+
+	pngChunkIDAT = "IDAT"
+)
+
+const (
+	pngFilterNone = iota
+	pngFilterSub
+	pngFilterUp
+	pngFilterAverage
+	pngFilterPaeth
+
+	pngFilters
+
+	pngFilterAdaptive = pngFilters // per row choice of filterPNGRow
+)
+
+var pngFilterNames = [...]string{"none", "sub", "up", "average", "paeth", "adaptive"}
+
+// encodeRawPNG writes image of colorType and bit depth (8, or 1, 2, 4 for gray) with optional tRNS chunk,
+// pix holds height rows of stride bytes, each row starts with packed samples of width pixels,
+// level is zlib compression level
+func encodeRawPNG(width, height int, colorType, depth uint8, trns []byte, pix []byte, stride int,
+	level int) (b *bytes.Buffer, err error) {
+
+	// NOTE фильтры работают с байтами целого пикселя, а при битности < 8 этот байт один ($ 6.1)
+	bpp := 1
+
+	switch colorType {
+	case pngColorRGB:
+		bpp = 3
+	case pngColorGrayAlpha:
+		bpp = 2
+	}
+
+	b = bytes.NewBuffer(nil)
+	b.WriteString(pngSignature)
+
+	var ihdr [pngIHDRLen]byte
+
+	binary.BigEndian.PutUint32(ihdr[0:4], uint32(width))
+	binary.BigEndian.PutUint32(ihdr[4:8], uint32(height))
+	ihdr[8] = depth
+	ihdr[9] = colorType
+	// compression method, filter method, interlace method - all 0
+
+	writePNGChunk(b, pngChunkIHDR, ihdr[:])
+
+	if len(trns) > 0 {
+		writePNGChunk(b, pngChunkTRNS, trns)
+	}
+
+	idat := bytes.NewBuffer(nil)
+
+	zw, err := zlib.NewWriterLevel(idat, level)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		n    = (width*bpp*int(depth) + 7) / 8
+		prev = make([]byte, n) // строка над первой считается нулевой
+		rows [pngFilters][]byte
+	)
+
+	for i := range rows {
+		rows[i] = make([]byte, 1+n)
+		rows[i][0] = byte(i)
+	}
+
+	for y := 0; y < height; y++ {
+
+		cur := pix[y*stride : y*stride+n]
+
+		if _, err = zw.Write(filterPNGRow(&rows, cur, prev, bpp)); err != nil {
+			return nil, fmt.Errorf("zlib write error: %w", err)
+		}
+
+		prev = cur
+	}
+
+	if err = zw.Close(); err != nil {
+		return nil, fmt.Errorf("zlib close error: %w", err)
+	}
+
+	writePNGChunk(b, pngChunkIDAT, idat.Bytes())
+	writePNGChunk(b, pngChunkIEND, nil)
+
+	return b, nil
+}
+
+// filterPNGRow applies all filters to cur and returns the one (with leading filter type byte) with the minimal
+// sum of absolute values, that is the same heuristic libpng and png.Encode use
+func filterPNGRow(rows *[pngFilters][]byte, cur, prev []byte, bpp int) []byte {
+
+	for i := range cur {
+
+		var a, c byte
+
+		if i >= bpp {
+			a, c = cur[i-bpp], prev[i-bpp]
+		}
+
+		up := prev[i]
+
+		rows[pngFilterNone][1+i] = cur[i]
+		rows[pngFilterSub][1+i] = cur[i] - a
+		rows[pngFilterUp][1+i] = cur[i] - up
+		rows[pngFilterAverage][1+i] = cur[i] - byte((int(a)+int(up))/2)
+		rows[pngFilterPaeth][1+i] = cur[i] - paeth(a, up, c)
+	}
+
+	best, bestSum := 0, -1
+
+	for f := range rows {
+
+		sum := 0
+
+		for _, v := range rows[f][1:] {
+			if v < 128 {
+				sum += int(v)
+			} else {
+				sum += 256 - int(v)
+			}
+		}
+
+		if bestSum < 0 || sum < bestSum {
+			best, bestSum = f, sum
+		}
+	}
+
+	return rows[best]
+}
+
+// pngRows is unfiltered image data of non-interlaced png with the rest of its chunks, so the same image can be
+// re-encoded with different row filters
+type pngRows struct {
+	before, after []pngChunk // everything around IDAT chunks
+	pix           []byte     // height rows of rowLen bytes
+	rowLen        int
+	bpp           int // bytes per complete pixel, 1 for bit depths < 8
+}
+
+// unfilterPNG inflates IDAT of png data and undoes row filters, interlaced png is not supported
+func unfilterPNG(data []byte) (_ *pngRows, err error) {
+
+	h, err := readPNGHeader(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if h.isInterlaced() {
+		return nil, errors.New("interlaced png can not be refiltered")
+	}
+
+	chunks, _, err := readPNGChunks(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	r := &pngRows{}
+
+	idat := bytes.NewBuffer(nil)
+
+	for i := range chunks {
+		switch c := chunks[i]; {
+		case c.typ == pngChunkIDAT:
+			idat.Write(c.data)
+		case idat.Len() == 0:
+			r.before = append(r.before, c)
+		default:
+			r.after = append(r.after, c)
+		}
+	}
+
+	// SEE $ 4.1.1 IHDR Image header: samples per pixel of each color type
+	channels := map[uint8]int{0: 1, 2: 3, 3: 1, 4: 2, 6: 4}[h.colorType]
+
+	if channels == 0 {
+		return nil, fmt.Errorf("unknown png color type %d", h.colorType)
+	}
+
+	bits := channels * int(h.bitDepth)
+
+	r.rowLen = (int(h.width)*bits + 7) / 8
+	r.bpp = (bits + 7) / 8
+
+	zr, err := zlib.NewReader(idat)
+
+	if err != nil {
+		return nil, fmt.Errorf("zlib read error: %w", err)
+	}
+
+	height := int(h.height)
+	filtered := make([]byte, height*(1+r.rowLen))
+
+	if _, err = io.ReadFull(zr, filtered); err != nil {
+		return nil, fmt.Errorf("zlib read error: %w", err)
+	}
+
+	r.pix = make([]byte, height*r.rowLen)
+
+	prev := make([]byte, r.rowLen)
+
+	for y := 0; y < height; y++ {
+
+		src := filtered[y*(1+r.rowLen):]
+		cur := r.pix[y*r.rowLen : (y+1)*r.rowLen]
+
+		if err = unfilterPNGRow(src[0], cur, src[1:1+r.rowLen], prev, r.bpp); err != nil {
+			return nil, err
+		}
+
+		prev = cur
+	}
+
+	return r, nil
+}
+
+// encode writes the image back with filter (pngFilterNone ... pngFilterPaeth or pngFilterAdaptive) on every row
+func (r *pngRows) encode(filter int, level int) (b *bytes.Buffer, err error) {
+
+	idat := bytes.NewBuffer(nil)
+
+	zw, err := zlib.NewWriterLevel(idat, level)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		prev = make([]byte, r.rowLen)
+		rows [pngFilters][]byte
+	)
+
+	for i := range rows {
+		rows[i] = make([]byte, 1+r.rowLen)
+		rows[i][0] = byte(i)
+	}
+
+	height := len(r.pix) / r.rowLen
+
+	for y := 0; y < height; y++ {
+
+		cur := r.pix[y*r.rowLen : (y+1)*r.rowLen]
+
+		var row []byte
+
+		if filter == pngFilterAdaptive {
+			row = filterPNGRow(&rows, cur, prev, r.bpp)
+		} else {
+			row = rows[filter]
+			applyPNGFilter(filter, row[1:], cur, prev, r.bpp)
+		}
+
+		if _, err = zw.Write(row); err != nil {
+			return nil, fmt.Errorf("zlib write error: %w", err)
+		}
+
+		prev = cur
+	}
+
+	if err = zw.Close(); err != nil {
+		return nil, fmt.Errorf("zlib close error: %w", err)
+	}
+
+	b = bytes.NewBuffer(nil)
+	b.WriteString(pngSignature)
+
+	for i := range r.before {
+		writePNGChunk(b, r.before[i].typ, r.before[i].data)
+	}
+
+	writePNGChunk(b, pngChunkIDAT, idat.Bytes())
+
+	for i := range r.after {
+		writePNGChunk(b, r.after[i].typ, r.after[i].data)
+	}
+
+	return b, nil
+}
+
+// withDepth returns r repacked to bit depth (1, 2, 4 or 8) if r is gray or paletted of another depth <= 8 and every
+// sample fits the new one, nil otherwise; gray levels are rescaled (v * 17 for 4 -> 8 bit), so going down they must be
+// exact multiples, paletted indices are kept as is
+func (r *pngRows) withDepth(depth uint8) *pngRows {
+
+	if len(r.before) == 0 || r.before[0].typ != pngChunkIHDR || len(r.before[0].data) != pngIHDRLen {
+		return nil
+	}
+
+	ihdr := r.before[0].data
+
+	width, from, colorType := int(binary.BigEndian.Uint32(ihdr[0:4])), ihdr[8], ihdr[9]
+
+	if (colorType != pngColorGray && colorType != pngColorPaletted) || from > 8 || from == depth {
+		return nil
+	}
+
+	// NOTE tRNS у gray - уровень в масштабе исходной битности, пересчитывать его ради такой редкости незачем
+	if colorType == pngColorGray {
+		for i := range r.before {
+			if r.before[i].typ == pngChunkTRNS {
+				return nil
+			}
+		}
+	}
+
+	var (
+		height  = len(r.pix) / r.rowLen
+		rowLen  = (width*int(depth) + 7) / 8
+		pix     = make([]byte, height*rowLen)
+		maxFrom = 1<<from - 1
+		maxTo   = 1<<depth - 1
+	)
+
+	for y := 0; y < height; y++ {
+
+		src := r.pix[y*r.rowLen : (y+1)*r.rowLen]
+		dst := pix[y*rowLen : (y+1)*rowLen]
+
+		for x := 0; x < width; x++ {
+
+			bit := x * int(from)
+			v := int(src[bit/8]>>(8-int(from)-bit%8)) & maxFrom
+
+			if colorType == pngColorGray {
+
+				if v*maxTo%maxFrom != 0 {
+					return nil
+				}
+
+				v = v * maxTo / maxFrom
+			} else if v > maxTo {
+				return nil
+			}
+
+			bit = x * int(depth)
+			dst[bit/8] |= byte(v) << (8 - int(depth) - bit%8)
+		}
+	}
+
+	hdr := append([]byte(nil), ihdr...)
+	hdr[8] = depth
+
+	before := append([]pngChunk{{typ: pngChunkIHDR, data: hdr}}, r.before[1:]...)
+
+	return &pngRows{before: before, after: r.after, pix: pix, rowLen: rowLen, bpp: 1}
+}
+
+// applyPNGFilter writes cur filtered with the single filter to dst
+func applyPNGFilter(filter int, dst, cur, prev []byte, bpp int) {
+
+	for i := range cur {
+
+		var a, c byte
+
+		if i >= bpp {
+			a, c = cur[i-bpp], prev[i-bpp]
+		}
+
+		switch filter {
+		case pngFilterNone:
+			dst[i] = cur[i]
+		case pngFilterSub:
+			dst[i] = cur[i] - a
+		case pngFilterUp:
+			dst[i] = cur[i] - prev[i]
+		case pngFilterAverage:
+			dst[i] = cur[i] - byte((int(a)+int(prev[i]))/2)
+		case pngFilterPaeth:
+			dst[i] = cur[i] - paeth(a, prev[i], c)
+		}
+	}
+}
+
+// unfilterPNGRow reconstructs cur from src row filtered with filter and already reconstructed prev
+func unfilterPNGRow(filter byte, cur, src, prev []byte, bpp int) error {
+
+	if filter >= pngFilters {
+		return fmt.Errorf("unknown png row filter %d", filter)
+	}
+
+	for i := range cur {
+
+		var a, c byte
+
+		if i >= bpp {
+			a, c = cur[i-bpp], prev[i-bpp]
+		}
+
+		switch filter {
+		case pngFilterNone:
+			cur[i] = src[i]
+		case pngFilterSub:
+			cur[i] = src[i] + a
+		case pngFilterUp:
+			cur[i] = src[i] + prev[i]
+		case pngFilterAverage:
+			cur[i] = src[i] + byte((int(a)+int(prev[i]))/2)
+		case pngFilterPaeth:
+			cur[i] = src[i] + paeth(a, prev[i], c)
+		}
+	}
+
+	return nil
+}
+
+// SEE $ 6.6 Filter type 4: Paeth
+func paeth(a, b, c byte) byte {
+
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+
+	if pa <= pb && pa <= pc {
+		return a
+	}
+
+	if pb <= pc {
+		return b
+	}
+
+	return c
+}
+
+func abs(x int) int {
+
+	if x < 0 {
+		return -x
+	}
+
+	return x
+}
@@ -0,0 +1,208 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	progressRedrawPeriod = time.Second      // tty
+	progressPlainPeriod  = 10 * time.Second // not a tty, e.g. redirected to file or CI log
+)
+
+// progress tracks processed assets out of total and shows "processed N/M (P%), saved X, ETA T" line; on a tty
+// the line stays at the bottom and is redrawn in place under the usual per-asset log, otherwise it is printed
+// as a plain log line every progressPlainPeriod
+type progress struct {
+	total uint64
+	done  atomic.Uint64
+	saved atomic.Uint64
+	start time.Time
+
+	// NOTE progress сам является io.Writer лога на время прогона, иначе строки ассетов и строка прогресса
+	//      перемешивались бы
+	mu      sync.Mutex // out, shown, midLine
+	out     io.Writer
+	tty     bool
+	shown   int  // length of the progress line on the screen (tty only), 0 - none
+	midLine bool // the last log write did not end with newline, e.g. "Optimize asset ..." is still in work
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newProgress(out io.Writer, total int) *progress {
+
+	p := &progress{
+		total: uint64(total),
+		start: time.Now(),
+		out:   out,
+		tty:   isTerminal(out),
+		stop:  make(chan struct{}),
+	}
+
+	period := progressPlainPeriod
+
+	if p.tty {
+		period = progressRedrawPeriod
+	}
+
+	p.wg.Add(1)
+
+	go func() {
+
+		defer p.wg.Done()
+
+		t := time.NewTicker(period)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-t.C:
+				p.mu.Lock()
+				p.show()
+				p.mu.Unlock()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+
+	return p
+}
+
+// isTerminal reports whether w is a character device (console), without any terminal library
+func isTerminal(w io.Writer) bool {
+
+	f, ok := w.(*os.File)
+
+	if !ok {
+		return false
+	}
+
+	info, err := f.Stat()
+
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Write implements io.Writer: writes log data b above the progress line
+func (p *progress) Write(b []byte) (n int, err error) {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.clear()
+
+	n, err = p.out.Write(b)
+
+	if len(b) > 0 {
+		p.midLine = b[len(b)-1] != '\n'
+	}
+
+	if p.tty {
+		p.show()
+	}
+
+	return n, err
+}
+
+// assetDone counts processed asset (whatever its result) which saved bytes
+func (p *progress) assetDone(saved uint) {
+
+	p.done.Add(1)
+	p.saved.Add(uint64(saved))
+
+	if p.tty {
+		p.mu.Lock()
+		p.show()
+		p.mu.Unlock()
+	}
+}
+
+// finish stops updates and removes the progress line, the log goes on below without it
+func (p *progress) finish() {
+
+	close(p.stop)
+	p.wg.Wait()
+
+	p.mu.Lock()
+	p.clear()
+	p.mu.Unlock()
+}
+
+// NOTE show и clear вызываются только под p.mu
+
+func (p *progress) show() {
+
+	// NOTE строку "Optimize asset ..." без результата рвать нельзя
+	if p.midLine {
+		return
+	}
+
+	if p.tty {
+
+		line := p.line()
+
+		// NOTE новая строка может оказаться короче прежней, хвост прежней затирается пробелами
+		pad := p.shown - len(line)
+
+		if pad < 0 {
+			pad = 0
+		}
+
+		fmt.Fprintf(p.out, "\r%s%*s", line, pad, "")
+		p.shown = len(line) + pad
+	} else {
+		fmt.Fprintf(p.out, "Progress: %s\n", p.line())
+	}
+}
+
+// NOTE затираем пробелами, а не ESC [K: консоль Windows без включенного VT режима escape-коды не понимает
+func (p *progress) clear() {
+
+	if p.shown > 0 {
+		fmt.Fprintf(p.out, "\r%*s\r", p.shown, "")
+		p.shown = 0
+	}
+}
+
+func (p *progress) line() string {
+
+	done := p.done.Load()
+
+	var pct float64
+
+	if p.total > 0 {
+		pct = float64(done) / float64(p.total) * 100
+	}
+
+	s := fmt.Sprintf("processed %d/%d (%.0f%%), saved %s", done, p.total, pct, formatBytes(p.saved.Load()))
+
+	if done > 0 && done < p.total {
+		elapsed := time.Since(p.start)
+		eta := elapsed / time.Duration(done) * time.Duration(p.total-done)
+		s += ", ETA " + eta.Round(time.Second).String()
+	}
+
+	return s
+}
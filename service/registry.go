@@ -0,0 +1,123 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"sort"
+	"strings"
+)
+
+// Registry maps asset format (lowercased extension without dot: "png", "jpg") to its optimizer,
+// every AssetsOptimizer owns one, so differently configured optimizers may coexist in the same process
+type Registry struct {
+	optimizers map[string]AssetOptimizer
+}
+
+func NewRegistry() *Registry {
+	return &Registry{optimizers: make(map[string]AssetOptimizer)}
+}
+
+// Register sets o as optimizer of ext assets ("png", ".png" and "PNG" are the same), replacing the previous one
+// if any
+func (r *Registry) Register(ext string, o AssetOptimizer) {
+	r.optimizers[strings.ToLower(strings.TrimPrefix(ext, "."))] = o
+}
+
+// Lookup returns optimizer of ext assets, nil if there is none
+func (r *Registry) Lookup(ext string) AssetOptimizer {
+	return r.optimizers[ext]
+}
+
+// Formats returns sorted list of registered formats
+func (r *Registry) Formats() []string {
+
+	list := make([]string, 0, len(r.optimizers))
+
+	for ext := range r.optimizers {
+		list = append(list, ext)
+	}
+
+	sort.Strings(list)
+
+	return list
+}
+
+// RegisterOptimizer adds optimizer of ext assets (a format of your own, or a replacement of the built-in one)
+// to the registry of ao, see Registry.Register; it must be called before Run, not while running. Settings.Extensions
+// and ExtMap are checked by NewAssetsOptimizer already, so a format of your own they refer to must be registered
+// in Settings.Registry instead
+func (ao *AssetsOptimizer) RegisterOptimizer(ext string, o AssetOptimizer) {
+	ao.registry.Register(ext, o)
+}
+
+// RegisteredExtensions returns sorted list of asset formats ao knows, built-in and registered ones
+func (ao *AssetsOptimizer) RegisteredExtensions() []string {
+	return ao.registry.Formats()
+}
+
+// newDefaultRegistry registers all built-in optimizers configured by settings
+func newDefaultRegistry(settings *Settings) (_ *Registry, err error) {
+
+	pngLevel, err := parsePNGLevel(settings.PNGLevel)
+
+	if err != nil {
+		return nil, err
+	}
+
+	r := NewRegistry()
+
+	pngOpts := []PNGOption{WithPNGLevel(pngLevel)}
+
+	if settings.Exhaustive {
+		pngOpts = append(pngOpts, WithExhaustive())
+	}
+
+	png := NewPNGOptimizer(pngOpts...)
+	r.Register(extPNG, png)
+
+	// NOTE перекодирование jpeg с потерями, по умолчанию jpeg не трогаем
+	if settings.LossyJPEG {
+		jpeg := NewJPEGOptimizer()
+		r.Register(extJPG, jpeg)
+		r.Register(extJPEG, jpeg)
+	}
+
+	r.Register(extGIF, NewGIFOptimizer())
+
+	r.Register(extBMP, NewBMPOptimizer(png))
+
+	// NOTE только со сборкой -tags avif, см. avif_optimizer.go
+	registerAVIF(r, png)
+
+	tiff := NewTIFFOptimizer()
+	r.Register(extTIF, tiff)
+	r.Register(extTIFF, tiff)
+
+	// NOTE минификация выкидывает комментарии из исходников мода, поэтому только по явному запросу
+	if settings.MinifyJSON {
+		json := NewJSONOptimizer()
+		r.Register(extConfig, json)
+		r.Register(extObject, json)
+		r.Register(extItem, json)
+		r.Register(extFrames, json)
+	}
+
+	// NOTE ассеты внутри пака оптимизируются этим же реестром
+	r.Register(extPAK, NewPakOptimizer(r))
+
+	return r, nil
+}
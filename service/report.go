@@ -0,0 +1,267 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"time"
+)
+
+// reportStdout report path meaning "write report to stdout"
+const reportStdout = "-"
+
+type reportRecord struct {
+	Path          string `json:"path"`
+	Ext           string `json:"ext"`
+	Size          int64  `json:"size"`
+	OptimizedSize int64  `json:"optimized_size"`
+	Saved         uint   `json:"saved"`
+	Variant       string `json:"variant,omitempty"`
+	NOOP          bool   `json:"noop"`
+	Metadata      int64  `json:"metadata,omitempty"` // metadata bytes stripped
+	SHA256        string `json:"sha256,omitempty"`   // of the unchanged data of NOOP asset, see Settings.IncludeNoop
+	Error         string `json:"error,omitempty"`
+}
+
+type reportSummary struct {
+	Files      int                         `json:"files"`
+	Optimized  uint                        `json:"optimized"`
+	SavedBytes uint64                      `json:"saved_bytes"`
+	TotalSize  uint64                      `json:"total_size"`           // all processed assets before, see stats.origTotal
+	TotalFinal uint64                      `json:"total_optimized_size"` // and after
+	Locked     uint                        `json:"locked"`
+	Errors     uint                        `json:"errors"`
+	Small      uint                        `json:"small"`
+	Excluded   uint                        `json:"excluded"`
+	Cached     uint                        `json:"cached"`
+	Metadata   uint64                      `json:"metadata_bytes"`
+	ByExt      map[string]reportExtSummary `json:"by_ext"`
+	DryRun     bool                        `json:"dry_run"`
+	DurationMS int64                       `json:"duration_ms"`
+	Timings    map[string]reportTimings    `json:"timings,omitempty"` // of optimizers that report them, see timings
+	Error      string                      `json:"error,omitempty"`   // error the run was aborted with
+	// SummaryOnly the report has no file records, see Settings.SummaryOnly and Settings.ReportLimit
+	SummaryOnly bool `json:"summary_only,omitempty"`
+}
+
+// reportExtSummary is the part of summary of assets of single format
+type reportExtSummary struct {
+	Files      uint   `json:"files"`
+	Optimized  uint   `json:"optimized"`
+	SavedBytes uint64 `json:"saved_bytes"`
+	TotalSize  uint64 `json:"total_size"`
+	TotalFinal uint64 `json:"total_optimized_size"`
+	Errors     uint   `json:"errors"`
+}
+
+type report struct {
+	Files   []reportRecord `json:"files"`
+	Summary reportSummary  `json:"summary"`
+}
+
+// summaryReport is the report without file records
+type summaryReport struct {
+	Summary reportSummary `json:"summary"`
+}
+
+// newReportRecord fills record of asset from its result, the final size of NOOP asset is its original size
+func newReportRecord(rel, ext string, res *OptimizeResult, err error) (rec reportRecord) {
+
+	rec = reportRecord{
+		Path:          rel,
+		Ext:           ext,
+		Size:          res.Size,
+		OptimizedSize: res.OptimizedSize,
+		Saved:         res.Saved(),
+		Variant:       res.Variant,
+		NOOP:          res.NOOP,
+		Metadata:      res.Metadata,
+	}
+
+	if res.NOOP || err != nil {
+		rec.OptimizedSize = res.Size
+	}
+
+	if err != nil {
+		rec.Error = err.Error()
+	}
+
+	return rec
+}
+
+func (ao *AssetsOptimizer) addReportRecord(rec reportRecord) {
+
+	ao.mu.Lock()
+
+	// NOTE записи сверх лимита уже не нужны, отчет все равно будет только со сводкой, так что и в памяти их не держим
+	if ao.reportLimit > 0 && len(ao.records) >= ao.reportLimit {
+		ao.summaryOnly, ao.recordsDropped, ao.records = true, true, nil
+	}
+
+	if !ao.summaryOnly {
+		ao.records = append(ao.records, rec)
+	}
+
+	ao.mu.Unlock()
+}
+
+// reportedRecord reports whether rec goes to the report: optimized and failed assets always, NOOP ones only
+// with Settings.IncludeNoop, none of them if the report is summary only
+func (ao *AssetsOptimizer) reportedRecord(rec *reportRecord) bool {
+
+	ao.mu.Lock()
+	summaryOnly := ao.summaryOnly
+	ao.mu.Unlock()
+
+	return !summaryOnly && (!rec.NOOP || rec.Error != "" || ao.includeNoop)
+}
+
+// assetHash returns hex sha256 of the data of asset a
+func (ao *AssetsOptimizer) assetHash(a *asset) (_ string, err error) {
+
+	var fp fs.File
+
+	if ao.fsys != nil {
+		fp, err = ao.fsys.Open(a.path)
+	} else {
+		fp, err = os.Open(a.file())
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	defer fp.Close()
+
+	h := sha256.New()
+
+	if _, err = io.Copy(h, fp); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// summary returns summary of the stats of files assets taking d
+func (ao *AssetsOptimizer) summary(files int, d time.Duration) (s reportSummary) {
+
+	s = reportSummary{
+		Files:      files,
+		Optimized:  ao.stats.c,
+		SavedBytes: ao.stats.n,
+		TotalSize:  ao.stats.origTotal,
+		TotalFinal: ao.stats.optTotal,
+		Locked:     ao.stats.locked,
+		Errors:     ao.stats.errors,
+		Small:      ao.stats.small,
+		Excluded:   ao.stats.excluded,
+		Cached:     ao.stats.cached,
+		Metadata:   ao.stats.metadata,
+		ByExt:      make(map[string]reportExtSummary, len(ao.byExt)),
+		DryRun:     ao.opts.DryRun,
+		DurationMS: d.Milliseconds(),
+	}
+
+	for ext, es := range ao.byExt {
+		s.ByExt[ext] = reportExtSummary{
+			Files:      es.files,
+			Optimized:  es.c,
+			SavedBytes: es.n,
+			TotalSize:  es.origTotal,
+			TotalFinal: es.optTotal,
+			Errors:     es.errors,
+		}
+	}
+
+	if _, byExt := ao.timings(); len(byExt) > 0 {
+
+		s.Timings = make(map[string]reportTimings, len(byExt))
+
+		for ext, t := range byExt {
+			s.Timings[ext] = reportTimings{
+				DecodeMS: t.Decode.Milliseconds(),
+				EncodeMS: t.Encode.Milliseconds(),
+				IOMS:     t.IO.Milliseconds(),
+			}
+		}
+	}
+
+	return s
+}
+
+// writeReport writes JSON report of the run to ao.reportPath (atomically) or to stdout, runErr is the error the run
+// was aborted with, if any
+func (ao *AssetsOptimizer) writeReport(d time.Duration, runErr error) (err error) {
+
+	// NOTE при параллельном обходе записи приходят в произвольном порядке
+	sort.Slice(ao.records, func(i, j int) bool {
+		return ao.records[i].Path < ao.records[j].Path
+	})
+
+	r := report{
+		Files:   ao.records,
+		Summary: ao.summary(int(ao.stats.files+ao.stats.errors), d),
+	}
+
+	if r.Files == nil {
+		r.Files = []reportRecord{}
+	}
+
+	if runErr != nil {
+		r.Summary.Error = runErr.Error()
+	}
+
+	var v interface{} = &r
+
+	if ao.summaryOnly {
+
+		r.Summary.SummaryOnly = true
+		v = &summaryReport{Summary: r.Summary}
+
+		if ao.recordsDropped {
+			ao.logf(ao.log, levelWarn, "report has more than %d file records, only the summary is written\n",
+				ao.reportLimit)
+		}
+	}
+
+	b := bytes.NewBuffer(nil)
+	enc := json.NewEncoder(b)
+	enc.SetIndent("", "  ")
+
+	if err = enc.Encode(v); err != nil {
+		return fmt.Errorf("encode report error: %w", err)
+	}
+
+	if ao.reportPath == reportStdout {
+		_, err = b.WriteTo(os.Stdout)
+		return err
+	}
+
+	if err = replaceFile(ao.reportPath, ".tmp", b); err != nil {
+		return fmt.Errorf("write report %q error: %w", ao.reportPath, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,103 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"path/filepath"
+	"regexp"
+	"strconv"
+)
+
+// ResponsiveOptimizer is implemented by optimizers able to emit downscaled @1x variant of @Nx asset
+type ResponsiveOptimizer interface {
+	Downscale(src, dst string, scale int) (uint, error)
+}
+
+var (
+	// foo@2x.png, foo@3x.png
+	responsiveRe = regexp.MustCompile(`^(.+)@([2-9])x$`)
+)
+
+// responsiveSidecar returns @1x path for @Nx asset path
+func responsiveSidecar(path string) (dst string, scale int, ok bool) {
+
+	ext := filepath.Ext(path)
+	name := filepath.Base(path)
+	name = name[:len(name)-len(ext)]
+
+	m := responsiveRe.FindStringSubmatch(name)
+
+	if m == nil {
+		return "", 0, false
+	}
+
+	scale, _ = strconv.Atoi(m[2])
+
+	return filepath.Join(filepath.Dir(path), m[1]+ext), scale, true
+}
+
+// downscaleBox downscales src by integer factor with area averaging (box filter),
+// averaging is done in premultiplied space so transparent pixels don't bleed their RGB into the result
+func downscaleBox(src image.Image, scale int) *image.NRGBA {
+
+	b := src.Bounds()
+
+	// NOTE всегда работаем с NRGBA копией, чтобы не зависеть от конкретного типа src
+	nrgba := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(nrgba, nrgba.Bounds(), src, b.Min, draw.Src)
+
+	sw, sh := b.Dx(), b.Dy()
+	dw, dh := (sw+scale-1)/scale, (sh+scale-1)/scale
+
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+
+	for dy := 0; dy < dh; dy++ {
+		for dx := 0; dx < dw; dx++ {
+
+			var r, g, bl, a, n uint64
+
+			// NOTE крайние блоки могут быть неполными, если размер не кратен scale
+			for sy := dy * scale; sy < (dy+1)*scale && sy < sh; sy++ {
+				for sx := dx * scale; sx < (dx+1)*scale && sx < sw; sx++ {
+					c := nrgba.NRGBAAt(sx, sy)
+					ca := uint64(c.A)
+					r += uint64(c.R) * ca
+					g += uint64(c.G) * ca
+					bl += uint64(c.B) * ca
+					a += ca
+					n++
+				}
+			}
+
+			if a == 0 {
+				continue // fully transparent {0, 0, 0, 0}
+			}
+
+			dst.SetNRGBA(dx, dy, color.NRGBA{
+				R: uint8((r + a/2) / a),
+				G: uint8((g + a/2) / a),
+				B: uint8((bl + a/2) / a),
+				A: uint8((a + n/2) / n),
+			})
+		}
+	}
+
+	return dst
+}
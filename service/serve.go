@@ -0,0 +1,196 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// serveMaxBody limit of asset data of single request of Serve
+	serveMaxBody = 256 << 20
+	// serveShutdownTimeout how long Serve waits for requests in progress once its ctx is done
+	serveShutdownTimeout = time.Minute
+)
+
+// Serve serves optimization of asset data over HTTP at addr (e.g. ":8080") until ctx is done, the root dir is not
+// walked at all:
+//
+//	POST /optimize?ext=png with asset data as the body
+//
+// responds with optimized data (200, X-Original-Size, X-Optimized-Size and X-Variant headers), 204 with X-Reason
+// if the asset is left as is, 400 for unknown or filtered out format (see Settings.ExtMap and Extensions),
+// 415 for format that can not be optimized in memory (see BytesOptimizer), 422 if the data fails to optimize;
+// requests are optimized with the options of ao and at most ao.workers at once, and are counted in its stats.
+// No TLS or authentication, it is meant for internal use behind a proxy
+func (ao *AssetsOptimizer) Serve(ctx context.Context, addr string) (err error) {
+
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           ao.serveHandler(),
+		ReadHeaderTimeout: time.Minute,
+	}
+
+	done := make(chan error, 1)
+
+	// NOTE начатые запросы дорабатываются, как и начатые ассеты прерванного прогона
+	go func() {
+
+		<-ctx.Done()
+
+		sctx, cancel := context.WithTimeout(context.Background(), serveShutdownTimeout)
+		defer cancel()
+
+		done <- srv.Shutdown(sctx)
+	}()
+
+	ao.logf(ao.log, levelInfo, "Serving assets optimization at %q @ %s\n", addr, time.Now())
+
+	if err = srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("serve error: %w", err)
+	}
+
+	return <-done
+}
+
+func (ao *AssetsOptimizer) serveHandler() http.Handler {
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/optimize", ao.serveOptimize)
+
+	return mux
+}
+
+func (ao *AssetsOptimizer) serveOptimize(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// NOTE формат определяется так же, как по имени файла: с ext map и фильтром --ext
+	ext := strings.ToLower(strings.TrimPrefix(r.URL.Query().Get("ext"), "."))
+	name := "asset." + ext
+
+	if ext != "" {
+		ext = ao.resolveExt(name)
+	}
+
+	optimizer := ao.optimizerFor(ext)
+
+	if ext == "" || optimizer == nil {
+		http.Error(w, fmt.Sprintf("unknown asset format %q", ext), http.StatusBadRequest)
+		return
+	}
+
+	bo, ok := optimizer.(BytesOptimizer)
+
+	if !ok {
+		http.Error(w, fmt.Sprintf("asset format %q can not be optimized in memory", ext),
+			http.StatusUnsupportedMediaType)
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, serveMaxBody))
+
+	if err != nil {
+
+		code := http.StatusBadRequest
+
+		var tooLarge *http.MaxBytesError
+
+		if errors.As(err, &tooLarge) {
+			code = http.StatusRequestEntityTooLarge
+		}
+
+		http.Error(w, err.Error(), code)
+
+		return
+	}
+
+	// NOTE как и ассет прогона, запрос держит слот все время оптимизации
+	ao.opts.slots.acquire()
+
+	opts := ao.opts
+	opt, res, err := bo.OptimizeBytes(data, &opts)
+
+	ao.opts.slots.release()
+
+	// NOTE отчет запроса собирается целиком и пишется разом, как у параллельного прогона
+	var b bytes.Buffer
+
+	rel := "request from " + r.RemoteAddr
+	info := ao.textLog(&b, levelInfo)
+
+	fmt.Fprintf(info, "Optimize %s (%s)...", rel, ext)
+
+	if err != nil {
+
+		// NOTE строку запроса надо завершить, как и строку упавшего ассета у параллельного прогона
+		if b.Len() > 0 {
+			b.WriteByte('\n')
+		}
+
+		ao.logAssetf(&b, levelError, &logAsset{Path: rel, Ext: ext, Error: err.Error()}, "%s: %s\n", rel, err)
+		ao.writeLog(&b)
+
+		ao.mu.Lock()
+		ao.stats.errors++
+		ao.extStats(ext).errors++
+		ao.mu.Unlock()
+
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+
+		return
+	}
+
+	printResult(info, &res)
+	ao.logResult(&b, rel, ext, &res)
+	ao.writeLog(&b)
+
+	ao.countResult(ext, &res)
+
+	if res.NOOP {
+		w.Header().Set("X-Reason", res.Reason)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(opt)))
+	w.Header().Set("X-Original-Size", strconv.FormatInt(res.Size, 10))
+	w.Header().Set("X-Optimized-Size", strconv.FormatInt(res.OptimizedSize, 10))
+	w.Header().Set("X-Variant", res.Variant)
+
+	_, _ = w.Write(opt)
+}
+
+// writeLog writes buffered messages b to the log at once
+func (ao *AssetsOptimizer) writeLog(b *bytes.Buffer) {
+	ao.mu.Lock()
+	_, _ = b.WriteTo(ao.log)
+	ao.mu.Unlock()
+}
@@ -0,0 +1,111 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestServeOptimize(t *testing.T) {
+
+	var log bytes.Buffer
+
+	ao, err := NewAssetsOptimizer(t.TempDir(), WithSettings(Settings{ExtMap: map[string]string{".tex": "png"},
+		Log: &log}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(ao.serveHandler())
+	defer srv.Close()
+
+	src := readPNGFixtures(t)["paletted"]
+
+	post := func(ext string, body []byte) (*http.Response, []byte) {
+
+		t.Helper()
+
+		resp, err := http.Post(srv.URL+"/optimize?ext="+ext, "application/octet-stream", bytes.NewReader(body))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer resp.Body.Close()
+
+		data, err := io.ReadAll(resp.Body)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return resp, data
+	}
+
+	resp, opt := post("png", src)
+
+	if resp.StatusCode != http.StatusOK || len(opt) == 0 || len(opt) >= len(src) {
+		t.Fatalf("png: %s, %d bytes of %d: %s", resp.Status, len(opt), len(src), opt)
+	}
+
+	if n, _ := strconv.Atoi(resp.Header.Get("X-Optimized-Size")); n != len(opt) || resp.Header.Get("X-Variant") == "" {
+		t.Errorf("png: headers %v", resp.Header)
+	}
+
+	samePixels(t, "png", decodeTestPNG(t, src), decodeTestPNG(t, opt))
+
+	// the optimized data is left as is, also through ext map
+	if resp, data := post(".TEX", opt); resp.StatusCode != http.StatusNoContent || len(data) != 0 {
+		t.Errorf("optimized tex: %s, %d bytes", resp.Status, len(data))
+	}
+
+	tests := []struct {
+		ext  string
+		body []byte
+		code int
+	}{
+		{"", src, http.StatusBadRequest},
+		{"txt", src, http.StatusBadRequest},
+		{"gif", src, http.StatusUnsupportedMediaType},
+		{"png", src[:len(src)/2], http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		if resp, data := post(tt.ext, tt.body); resp.StatusCode != tt.code {
+			t.Errorf("ext %q: %s (%s), want %d", tt.ext, resp.Status, data, tt.code)
+		}
+	}
+
+	if resp, err := http.Get(srv.URL + "/optimize?ext=png"); err != nil {
+		t.Fatal(err)
+	} else if resp.Body.Close(); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET: %s", resp.Status)
+	}
+
+	ao.mu.Lock()
+	defer ao.mu.Unlock()
+
+	if ao.stats.files != 2 || ao.stats.c != 1 || ao.stats.errors != 1 {
+		t.Errorf("stats %+v, want 2 processed, 1 optimized, 1 failed\n%s", ao.stats, log.String())
+	}
+}
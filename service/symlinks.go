@@ -0,0 +1,162 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// fileID identifies file or dir regardless of the path it is reached by: device and inode on *nix, volume serial
+// number and file index on Windows (see getFileID)
+type fileID struct {
+	dev, ino uint64
+}
+
+// visitedFiles is the set of real dirs and asset files visited by the walk following symlinks, a dir or file
+// already in the set is not visited again whatever path it is reached by
+type visitedFiles map[fileID]struct{}
+
+// add adds id and reports whether it was not visited yet
+func (v visitedFiles) add(id fileID) bool {
+
+	// NOTE пути для обнаружения циклов не годятся: один и тот же каталог достижим бесконечным числом путей
+	//      (a/loop/loop/...), поэтому запоминается fileID каждого пройденного каталога, и каталог, уже бывший
+	//      в множестве, повторно не обходится - так обрывается любой цикл (симлинк на предка) и заодно не обходится
+	//      дважды каталог, на который ведут несколько симлинков; то же для файлов, чтобы цель двух симлинков
+	//      не оптимизировалась дважды (параллельно это коверкало бы файл)
+	if _, ok := v[id]; ok {
+		return false
+	}
+
+	v[id] = struct{}{}
+
+	return true
+}
+
+// visitSymlink follows symlink path into its target dir or file when visited is not nil (see walkTree),
+// otherwise reports and skips it
+func (ao *AssetsOptimizer) visitSymlink(ctx context.Context, path string, visited visitedFiles,
+	fn func(a asset) error) error {
+
+	if visited == nil {
+		ao.skipSymlink(path, "symlink is not followed, see --follow-symlinks")
+		return nil
+	}
+
+	// NOTE битый симлинк или цикл самих симлинков (a -> b -> a) не ошибка прогона, а просто непригодная запись
+	target, err := filepath.EvalSymlinks(path)
+
+	if err != nil {
+		ao.skipSymlink(path, "broken symlink: "+err.Error())
+		return nil
+	}
+
+	info, err := os.Stat(target)
+
+	if err != nil {
+		ao.skipSymlink(path, "broken symlink: "+err.Error())
+		return nil
+	}
+
+	switch {
+	case info.IsDir():
+		return ao.walkTree(ctx, path, target, visited, fn)
+	case info.Mode().IsRegular():
+		return ao.visitFile(path, fs.FileInfoToDirEntry(info), func(a asset) error {
+			a.target = target
+			return fn(a)
+		})
+	}
+
+	ao.skipSymlink(path, "symlink to neither a regular file nor a dir")
+
+	return nil
+}
+
+// enterDir adds dir (real path real, reached as path) to visited, dir already visited is skipped with
+// filepath.SkipDir; top is true for the target of followed symlink
+func (ao *AssetsOptimizer) enterDir(visited visitedFiles, path, real string, top bool, d fs.DirEntry) error {
+
+	info, err := d.Info()
+
+	if err != nil {
+		return fmt.Errorf("walk dir %q error: %w", path, err)
+	}
+
+	id, err := getFileID(real, info)
+
+	if err != nil {
+		return fmt.Errorf("walk dir %q error: %w", path, err)
+	}
+
+	if visited.add(id) {
+		return nil
+	}
+
+	if top {
+		ao.skipSymlink(path, "symlinked dir is already walked")
+	} else {
+		ao.skipSymlink(path, "the dir is already walked through a symlink")
+	}
+
+	return filepath.SkipDir
+}
+
+// visitOnce wraps fn of the walk following symlinks, so every real file is passed to fn once
+func (ao *AssetsOptimizer) visitOnce(visited visitedFiles, fn func(a asset) error) func(a asset) error {
+
+	return func(a asset) error {
+
+		info, err := os.Stat(a.file())
+
+		if err != nil {
+			return fmt.Errorf("walk dir %q error: %w", a.path, err)
+		}
+
+		id, err := getFileID(a.file(), info)
+
+		if err != nil {
+			return fmt.Errorf("walk dir %q error: %w", a.path, err)
+		}
+
+		if !visited.add(id) {
+			ao.skipSymlink(a.path, "the same file is already visited by another path")
+			return nil
+		}
+
+		return fn(a)
+	}
+}
+
+// skipSymlink reports path (a symlink, or a path already visited through one) skipped for reason
+func (ao *AssetsOptimizer) skipSymlink(path, reason string) {
+
+	rel, err := filepath.Rel(ao.dir, path)
+
+	if err != nil {
+		rel = path
+	}
+
+	ao.mu.Lock()
+	ao.logf(ao.log, levelInfo, "Skip %q: %s\n", rel, reason)
+	ao.stats.symlinks++
+	ao.mu.Unlock()
+}
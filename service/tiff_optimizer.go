@@ -0,0 +1,547 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io/fs"
+	"os"
+
+	"golang.org/x/image/tiff"
+)
+
+// tiff is decoded and re-encoded with golang.org/x/image/tiff, only the Deflate variant with horizontal predictor is
+// written by own writeTIFF: x/image/tiff applies the predictor with LZW compression only, which it can not encode
+// SEE https://www.itu.int/itudoc/itu-t/com16/tiff-fx/docs/tiff6.pdf
+//
+// NOTE x/image/tiff декодирует только первую страницу и пишет только свои теги, поэтому многостраничные файлы
+//      оставляем как есть, а метаданные (ICC профиль, разрешение, описание, EXIF) не переносятся, как и у png;
+//      с KeepMetadata файлы с ICC профилем тоже оставляем как есть
+
+const (
+	extTIF  = "tif"
+	extTIFF = "tiff"
+
+	tiffHeaderLen = 8
+	tiffEntryLen  = 12
+
+	tiffMaxPixels = 1 << 28
+)
+
+// tags
+const (
+	tiffImageWidth      = 256
+	tiffImageLength     = 257
+	tiffBitsPerSample   = 258
+	tiffCompression     = 259
+	tiffPhotometric     = 262
+	tiffStripOffsets    = 273
+	tiffSamplesPerPixel = 277
+	tiffRowsPerStrip    = 278
+	tiffStripByteCounts = 279
+	tiffXResolution     = 282
+	tiffYResolution     = 283
+	tiffResolutionUnit  = 296
+	tiffPredictor       = 317
+	tiffColorMap        = 320
+	tiffExtraSamples    = 338
+	tiffICCProfile      = 34675
+)
+
+// field types
+const (
+	tiffShort    = 3
+	tiffLong     = 4
+	tiffRational = 5
+)
+
+// photometric interpretations
+const (
+	tiffBlackIsZero = 1
+	tiffRGB         = 2
+	tiffPaletted    = 3
+)
+
+const (
+	tiffCompressionDeflate  = 8
+	tiffPredictorHorizontal = 2
+)
+
+var (
+	errTIFFSignature   = errors.New("not a TIFF file")
+	errTIFFMalformed   = errors.New("malformed TIFF file")
+	errTIFFUnsupported = errors.New("unsupported TIFF format")
+)
+
+type TIFFOptimizer struct{}
+
+func NewTIFFOptimizer() *TIFFOptimizer {
+	return &TIFFOptimizer{}
+}
+
+// Optimize losslessly re-encodes single-page tiff into one Deflate strip (with horizontal predictor where it
+// applies), keeps the smaller of the variants and the source
+func (o *TIFFOptimizer) Optimize(path string, opts *OptimizeOptions) (res OptimizeResult, err error) {
+
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return res, fmt.Errorf("TIFFOptimizer optimize error: %w", err)
+	}
+
+	opt, res, err := o.optimizeData(data, opts)
+
+	if err != nil || res.NOOP || opts.DryRun {
+		return res, err
+	}
+
+	// NOTE сперва сохраняем временный файл, потом его атомарно mv
+	if err = saveAsset(path, ".tifftmp", opt, opts); err != nil {
+		return res, err
+	}
+
+	return res, nil
+}
+
+// OptimizeFS re-encodes tiff path of fsys, see FSOptimizer
+func (o *TIFFOptimizer) OptimizeFS(fsys fs.FS, path string, opts *OptimizeOptions) (opt *bytes.Buffer, res OptimizeResult,
+	err error) {
+
+	data, err := fs.ReadFile(fsys, path)
+
+	if err != nil {
+		return nil, res, fmt.Errorf("TIFFOptimizer optimize error: %w", err)
+	}
+
+	return o.optimizeData(data, opts)
+}
+
+// optimizeData re-encodes tiff data, opt is nil for NOOP
+func (o *TIFFOptimizer) optimizeData(data []byte, opts *OptimizeOptions) (opt *bytes.Buffer, res OptimizeResult, err error) {
+
+	res.Size = int64(len(data))
+
+	src, err := o.decode(data, opts)
+
+	if errors.Is(err, errTIFFUnsupported) {
+		res.NOOP, res.Reason = true, err.Error()
+		return nil, res, nil
+	} else if err != nil {
+		return nil, res, fmt.Errorf("TIFFOptimizer optimize error: %w", err)
+	}
+
+	variants := make(variantsList, 0, 2)
+
+	_, predictable := tiffLayoutOf(src)
+
+	// NOTE на EffortFast только вариант с предиктором, он почти всегда меньше
+	if opts.Effort > EffortFast || !predictable {
+
+		b := bytes.NewBuffer(nil)
+
+		if err = tiff.Encode(b, src, &tiff.Options{Compression: tiff.Deflate}); err != nil {
+			return nil, res, fmt.Errorf("TIFFOptimizer encode deflate error: %w", err)
+		}
+
+		variants = append(variants, variant{b, "deflate"})
+	}
+
+	if predictable {
+
+		b, err := writeTIFF(src)
+
+		if err != nil {
+			return nil, res, fmt.Errorf("TIFFOptimizer encode deflate+predictor error: %w", err)
+		}
+
+		variants = append(variants, variant{b, "deflate+predictor"})
+	}
+
+	opt, as, err := variants.best()
+
+	if err != nil {
+		return nil, res, err
+	}
+
+	res.OptimizedSize = int64(opt.Len())
+	res.Variant = as
+
+	if opts.keepOriginal(&res) {
+		return nil, res, nil
+	}
+
+	if opts.Verify {
+		if err = verifyTIFF(src, opt.Bytes()); err != nil {
+			return nil, res, fmt.Errorf("TIFFOptimizer verify %s error: %w", as, err)
+		}
+	}
+
+	return opt, res, nil
+}
+
+// decode checks what x/image/tiff would silently lose and decodes data
+func (o *TIFFOptimizer) decode(data []byte, opts *OptimizeOptions) (img image.Image, err error) {
+
+	multiPage, icc, err := scanTIFF(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if multiPage {
+		return nil, fmt.Errorf("%w: multi-page", errTIFFUnsupported)
+	}
+
+	if icc && opts.KeepMetadata {
+		return nil, fmt.Errorf("%w: ICC profile would be lost", errTIFFUnsupported)
+	}
+
+	cfg, err := tiff.DecodeConfig(bytes.NewReader(data))
+
+	if err == nil && cfg.Width*cfg.Height > tiffMaxPixels {
+		return nil, fmt.Errorf("%w: image is too large", errTIFFUnsupported)
+	}
+
+	if err == nil {
+		img, err = tiff.Decode(bytes.NewReader(data))
+	}
+
+	var unsupported tiff.UnsupportedError
+
+	if errors.As(err, &unsupported) {
+		return nil, fmt.Errorf("%w: %s", errTIFFUnsupported, string(unsupported))
+	} else if err != nil {
+		return nil, err
+	}
+
+	return img, nil
+}
+
+// scanTIFF reads header and the first IFD of data: whether more IFDs (pages) follow and whether it has ICC profile
+func scanTIFF(data []byte) (multiPage, icc bool, err error) {
+
+	if len(data) < tiffHeaderLen {
+		return false, false, errTIFFSignature
+	}
+
+	var order binary.ByteOrder
+
+	switch string(data[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return false, false, errTIFFSignature
+	}
+
+	if magic := order.Uint16(data[2:]); magic == 43 {
+		return false, false, fmt.Errorf("%w: BigTIFF", errTIFFUnsupported)
+	} else if magic != 42 {
+		return false, false, errTIFFSignature
+	}
+
+	off := uint64(order.Uint32(data[4:]))
+
+	if off+2 > uint64(len(data)) {
+		return false, false, errTIFFMalformed
+	}
+
+	n := uint64(order.Uint16(data[off:]))
+	off += 2
+
+	if off+n*tiffEntryLen+4 > uint64(len(data)) {
+		return false, false, errTIFFMalformed
+	}
+
+	for i := uint64(0); i < n; i++ {
+		if order.Uint16(data[off+i*tiffEntryLen:]) == tiffICCProfile {
+			icc = true
+		}
+	}
+
+	return order.Uint32(data[off+n*tiffEntryLen:]) != 0, icc, nil
+}
+
+// verifyTIFF checks that data decodes to the same pixels as src
+func verifyTIFF(src image.Image, data []byte) (err error) {
+
+	dst, err := tiff.Decode(bytes.NewReader(data))
+
+	if err != nil {
+		return err
+	}
+
+	return comparePixels(src, dst)
+}
+
+// tiffLayout is how img samples are written by writeTIFF
+type tiffLayout struct {
+	pix         []uint8
+	stride      int
+	rowBytes    int // of pix
+	pixSamples  int // per pixel in pix
+	samples     int // per pixel written, the last one is alpha if extra != 0
+	bits        int // per sample, 8 or 16
+	photometric uint32
+	extra       uint32 // ExtraSamples: 1 - associated alpha, 2 - unassociated
+	palette     color.Palette
+}
+
+// tiffLayoutOf returns layout of img types decoded by x/image/tiff, ok false for others
+//
+// NOTE непрозрачные RGB(A) пишутся 3 сэмплами без альфы, как они и были в исходнике (x/image/tiff всегда пишет 4)
+func tiffLayoutOf(img image.Image) (l tiffLayout, ok bool) {
+
+	b := img.Bounds()
+	l.samples, l.bits, l.photometric = 1, 8, tiffBlackIsZero
+
+	switch m := img.(type) {
+	case *image.Gray:
+		l.pix, l.stride = m.Pix[m.PixOffset(b.Min.X, b.Min.Y):], m.Stride
+	case *image.Gray16:
+		l.pix, l.stride, l.bits = m.Pix[m.PixOffset(b.Min.X, b.Min.Y):], m.Stride, 16
+	case *image.Paletted:
+		l.pix, l.stride, l.photometric, l.palette = m.Pix[m.PixOffset(b.Min.X, b.Min.Y):], m.Stride, tiffPaletted, m.Palette
+	case *image.RGBA:
+		l.pix, l.stride, l.photometric, l.samples, l.extra = m.Pix[m.PixOffset(b.Min.X, b.Min.Y):], m.Stride, tiffRGB, 4, 1
+	case *image.NRGBA:
+		l.pix, l.stride, l.photometric, l.samples, l.extra = m.Pix[m.PixOffset(b.Min.X, b.Min.Y):], m.Stride, tiffRGB, 4, 2
+	case *image.RGBA64:
+		l.pix, l.stride, l.photometric, l.samples, l.bits, l.extra = m.Pix[m.PixOffset(b.Min.X, b.Min.Y):], m.Stride,
+			tiffRGB, 4, 16, 1
+	case *image.NRGBA64:
+		l.pix, l.stride, l.photometric, l.samples, l.bits, l.extra = m.Pix[m.PixOffset(b.Min.X, b.Min.Y):], m.Stride,
+			tiffRGB, 4, 16, 2
+	default:
+		return l, false
+	}
+
+	if len(l.palette) > 256 || b.Empty() {
+		return l, false
+	}
+
+	l.pixSamples = l.samples
+	l.rowBytes = b.Dx() * l.samples * l.bits / 8
+
+	if l.extra != 0 && tiffOpaque(l, b.Dy()) {
+		l.samples, l.extra = 3, 0
+	}
+
+	return l, true
+}
+
+// tiffOpaque reports whether all alpha samples of l are max
+func tiffOpaque(l tiffLayout, height int) bool {
+
+	size := l.bits / 8
+
+	for y := 0; y < height; y++ {
+
+		row := l.pix[y*l.stride : y*l.stride+l.rowBytes]
+
+		for i := 3 * size; i < len(row); i += 4 * size {
+			if row[i] != 0xff || (size == 2 && row[i+1] != 0xff) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// writeTIFF encodes img as little endian tiff with a single Deflate strip and horizontal predictor
+func writeTIFF(img image.Image) (_ *bytes.Buffer, err error) {
+
+	l, ok := tiffLayoutOf(img)
+
+	if !ok {
+		return nil, fmt.Errorf("%w: image type %T", errTIFFUnsupported, img)
+	}
+
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	size := l.bits / 8
+	rowBytes := width * l.samples * size
+
+	var strip bytes.Buffer
+
+	zw, err := zlib.NewWriterLevel(&strip, zlib.BestCompression)
+
+	if err != nil {
+		return nil, err
+	}
+
+	row := make([]byte, rowBytes)
+
+	for y := 0; y < height; y++ {
+
+		src := l.pix[y*l.stride : y*l.stride+l.rowBytes]
+
+		// NOTE выкидываем альфу непрозрачных, 16-bit сэмплы image.* хранятся big endian, а пишем little endian
+		for x := 0; x < width; x++ {
+			for s := 0; s < l.samples; s++ {
+				for k := 0; k < size; k++ {
+					row[(x*l.samples+s)*size+k] = src[(x*l.pixSamples+s)*size+size-1-k]
+				}
+			}
+		}
+
+		// horizontal differencing from the end of the row
+		for i := len(row)/size - 1; i >= l.samples; i-- {
+			if size == 1 {
+				row[i] -= row[i-l.samples]
+			} else {
+				v := binary.LittleEndian.Uint16(row[2*i:]) - binary.LittleEndian.Uint16(row[2*(i-l.samples):])
+				binary.LittleEndian.PutUint16(row[2*i:], v)
+			}
+		}
+
+		if _, err = zw.Write(row); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = zw.Close(); err != nil {
+		return nil, err
+	}
+
+	bits := make([]uint32, l.samples)
+
+	for i := range bits {
+		bits[i] = uint32(l.bits)
+	}
+
+	// NOTE IFD пишем сразу после strip-а, выровняв по слову, значения, не влезающие в 4 байта, - за ним
+	ifdOff := uint32(tiffHeaderLen+strip.Len()+1) &^ 1
+
+	entries := []tiffWriteEntry{
+		{tiffImageWidth, tiffLong, []uint32{uint32(width)}},
+		{tiffImageLength, tiffLong, []uint32{uint32(height)}},
+		{tiffBitsPerSample, tiffShort, bits},
+		{tiffCompression, tiffShort, []uint32{tiffCompressionDeflate}},
+		{tiffPhotometric, tiffShort, []uint32{l.photometric}},
+		{tiffStripOffsets, tiffLong, []uint32{tiffHeaderLen}},
+		{tiffSamplesPerPixel, tiffShort, []uint32{uint32(l.samples)}},
+		{tiffRowsPerStrip, tiffLong, []uint32{uint32(height)}},
+		{tiffStripByteCounts, tiffLong, []uint32{uint32(strip.Len())}},
+		// 72 dpi, as x/image/tiff writes
+		{tiffXResolution, tiffRational, []uint32{72, 1}},
+		{tiffYResolution, tiffRational, []uint32{72, 1}},
+		{tiffResolutionUnit, tiffShort, []uint32{2}},
+		{tiffPredictor, tiffShort, []uint32{tiffPredictorHorizontal}},
+	}
+
+	if l.palette != nil {
+
+		colorMap := make([]uint32, 3*256)
+
+		for i, c := range l.palette {
+			r, g, b, _ := c.RGBA()
+			colorMap[i], colorMap[256+i], colorMap[512+i] = r, g, b
+		}
+
+		entries = append(entries, tiffWriteEntry{tiffColorMap, tiffShort, colorMap})
+	}
+
+	if l.extra != 0 {
+		entries = append(entries, tiffWriteEntry{tiffExtraSamples, tiffShort, []uint32{l.extra}})
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, int(ifdOff)+2+len(entries)*tiffEntryLen+4+3*256*2+64))
+	le := binary.LittleEndian
+
+	out.WriteString("II*\x00")
+	_ = binary.Write(out, le, ifdOff)
+	out.Write(strip.Bytes())
+
+	if out.Len() < int(ifdOff) {
+		out.WriteByte(0)
+	}
+
+	ifd := make([]byte, 2+len(entries)*tiffEntryLen+4)
+	le.PutUint16(ifd, uint16(len(entries)))
+
+	var values []byte
+
+	valuesOff := ifdOff + uint32(len(ifd))
+
+	for i, e := range entries {
+
+		field := ifd[2+i*tiffEntryLen:]
+		v := e.bytes()
+
+		le.PutUint16(field[0:], e.tag)
+		le.PutUint16(field[2:], e.typ)
+		le.PutUint32(field[4:], e.count())
+
+		if len(v) <= 4 {
+			copy(field[8:12], v)
+		} else {
+			le.PutUint32(field[8:], valuesOff+uint32(len(values)))
+			values = append(values, v...)
+		}
+	}
+
+	out.Write(ifd)
+	out.Write(values)
+
+	return out, nil
+}
+
+type tiffWriteEntry struct {
+	tag    uint16
+	typ    uint16
+	values []uint32
+}
+
+func (e tiffWriteEntry) count() uint32 {
+
+	if e.typ == tiffRational {
+		return uint32(len(e.values) / 2)
+	}
+
+	return uint32(len(e.values))
+}
+
+// bytes returns values of e in little endian
+func (e tiffWriteEntry) bytes() []byte {
+
+	if e.typ == tiffShort {
+
+		b := make([]byte, 2*len(e.values))
+
+		for i, v := range e.values {
+			binary.LittleEndian.PutUint16(b[2*i:], uint16(v))
+		}
+
+		return b
+	}
+
+	b := make([]byte, 4*len(e.values))
+
+	for i, v := range e.values {
+		binary.LittleEndian.PutUint32(b[4*i:], v)
+	}
+
+	return b
+}
@@ -0,0 +1,463 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"sort"
+	"strings"
+	"testing"
+
+	"golang.org/x/image/tiff"
+)
+
+// NOTE x/image/tiff пишет всегда little endian и RGB всегда 4 сэмплами, поэтому такие фикстуры (MM, 3 сэмпла,
+//      ICC профиль, экзотический photometric) пишет testTIFF, все остальные - tiff.Encode
+
+type testTIFFOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+// testTIFF describes uncompressed single-strip tiff fixture, raw holds rows of samples in the byte order of the file
+type testTIFF struct {
+	order       testTIFFOrder
+	width       int
+	height      int
+	samples     int // per pixel: 1 - gray, 3 - rgb, 4 - rgba
+	bits        int // per sample
+	photometric uint32
+	raw         []byte
+	extra       []testTIFFField
+}
+
+type testTIFFField struct {
+	tag, typ uint16
+	values   []uint32
+}
+
+// encode writes f: header, strip, then IFD with its values
+func (f *testTIFF) encode() []byte {
+
+	out := []byte("II*\x00")
+
+	if f.order == testTIFFOrder(binary.BigEndian) {
+		out = []byte("MM\x00*")
+	}
+
+	out = append(out, 0, 0, 0, 0) // IFD offset, see below
+	out = append(out, f.raw...)
+
+	if len(out)&1 != 0 {
+		out = append(out, 0)
+	}
+
+	photometric := f.photometric
+
+	if photometric == 0 && f.samples >= 3 {
+		photometric = tiffRGB
+	} else if photometric == 0 {
+		photometric = tiffBlackIsZero
+	}
+
+	bits := make([]uint32, f.samples)
+
+	for i := range bits {
+		bits[i] = uint32(f.bits)
+	}
+
+	fields := []testTIFFField{
+		{tiffImageWidth, tiffLong, []uint32{uint32(f.width)}},
+		{tiffImageLength, tiffLong, []uint32{uint32(f.height)}},
+		{tiffBitsPerSample, tiffShort, bits},
+		{tiffCompression, tiffShort, []uint32{1}},
+		{tiffPhotometric, tiffShort, []uint32{photometric}},
+		{tiffStripOffsets, tiffLong, []uint32{tiffHeaderLen}},
+		{tiffSamplesPerPixel, tiffShort, []uint32{uint32(f.samples)}},
+		{tiffRowsPerStrip, tiffLong, []uint32{uint32(f.height)}},
+		{tiffStripByteCounts, tiffLong, []uint32{uint32(len(f.raw))}},
+	}
+
+	if f.samples == 4 {
+		fields = append(fields, testTIFFField{tiffExtraSamples, tiffShort, []uint32{2}})
+	}
+
+	fields = append(fields, f.extra...)
+	sort.Slice(fields, func(i, j int) bool { return fields[i].tag < fields[j].tag })
+
+	f.order.PutUint32(out[4:], uint32(len(out)))
+
+	ifd := len(out)
+	values := ifd + 2 + len(fields)*tiffEntryLen + 4
+
+	out = f.order.AppendUint16(out, uint16(len(fields)))
+	out = append(out, make([]byte, len(fields)*tiffEntryLen+4)...)
+
+	for i, fd := range fields {
+
+		var value []byte
+
+		for _, v := range fd.values {
+			switch fd.typ {
+			case tiffShort:
+				value = f.order.AppendUint16(value, uint16(v))
+			case tiffLong:
+				value = f.order.AppendUint32(value, v)
+			default:
+				value = append(value, byte(v))
+			}
+		}
+
+		entry := out[ifd+2+i*tiffEntryLen:]
+
+		f.order.PutUint16(entry[0:], fd.tag)
+		f.order.PutUint16(entry[2:], fd.typ)
+		f.order.PutUint32(entry[4:], uint32(len(fd.values)))
+
+		if len(value) <= 4 {
+			copy(entry[8:12], value)
+			continue
+		}
+
+		f.order.PutUint32(entry[8:], uint32(values))
+
+		out = append(out, value...)
+		values += len(value)
+	}
+
+	return out
+}
+
+// testTIFFRaw returns samples of a smooth image with a bit of noise
+func testTIFFRaw(order testTIFFOrder, width, height, samples, bits int) (raw []byte) {
+
+	r := testRand(uint32(width*height + samples*bits))
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			for s := 0; s < samples; s++ {
+
+				v := uint16(x*3+y*5+s*40) + uint16(r.next()%4)
+
+				if bits == 16 {
+					raw = order.AppendUint16(raw, v*257+uint16(r.next()%2))
+				} else {
+					raw = append(raw, byte(v))
+				}
+			}
+		}
+	}
+
+	return raw
+}
+
+// testTIFFImage fills img with a smooth image with a bit of noise, alpha a (the premultiplied types get it applied)
+func testTIFFImage(img image.Image, a uint8) image.Image {
+
+	b := img.Bounds()
+	r := testRand(uint32(b.Dx()*b.Dy()) + uint32(a))
+
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+
+			v := uint8(x*3+y*5) + r.next()%4
+			c := color.NRGBA{v, v + 40, v + 80, a}
+
+			switch m := img.(type) {
+			case *image.Gray:
+				m.SetGray(x, y, color.Gray{v})
+			case *image.Gray16:
+				m.SetGray16(x, y, color.Gray16{uint16(v)*257 + uint16(r.next()%2)})
+			case *image.Paletted:
+				m.SetColorIndex(x, y, v%uint8(len(m.Palette)))
+			case *image.NRGBA64:
+				m.SetNRGBA64(x, y, color.NRGBA64{uint16(c.R) * 257, uint16(c.G)*257 + 1, uint16(c.B) * 257, uint16(a) * 257})
+			case *image.RGBA64:
+				m.Set(x, y, color.NRGBA64{uint16(c.R) * 257, uint16(c.G)*257 + 1, uint16(c.B) * 257, uint16(a) * 257})
+			case interface{ Set(x, y int, c color.Color) }:
+				m.Set(x, y, c)
+			}
+		}
+	}
+
+	return img
+}
+
+// testTIFFEncode writes img with x/image/tiff
+func testTIFFEncode(t testing.TB, img image.Image, compression tiff.CompressionType) []byte {
+
+	t.Helper()
+
+	b := bytes.NewBuffer(nil)
+
+	if err := tiff.Encode(b, img, &tiff.Options{Compression: compression}); err != nil {
+		t.Fatal(err)
+	}
+
+	return b.Bytes()
+}
+
+// testTIFFPages appends a copy of the first IFD of little endian data as the second page
+func testTIFFPages(data []byte) []byte {
+
+	le := binary.LittleEndian
+	off := le.Uint32(data[4:])
+	n := uint32(le.Uint16(data[off:]))
+	next := off + 2 + n*tiffEntryLen
+
+	page := uint32(len(data))
+	data = append(data, data[off:next]...)
+	data = append(data, 0, 0, 0, 0)
+	le.PutUint32(data[next:], page)
+
+	return data
+}
+
+// testTIFFTag returns values of tag from the first IFD of little endian data written by writeTIFF, nil if none
+func testTIFFTag(data []byte, tag uint16) (values []uint32) {
+
+	le := binary.LittleEndian
+	off := le.Uint32(data[4:])
+
+	for i := uint32(0); i < uint32(le.Uint16(data[off:])); i++ {
+
+		entry := data[off+2+i*tiffEntryLen:]
+
+		if le.Uint16(entry) != tag {
+			continue
+		}
+
+		typ, count, value := le.Uint16(entry[2:]), le.Uint32(entry[4:]), entry[8:]
+
+		if typ == tiffShort && count > 2 || typ == tiffLong && count > 1 {
+			value = data[le.Uint32(entry[8:]):]
+		}
+
+		for k := uint32(0); k < count; k++ {
+			if typ == tiffShort {
+				values = append(values, uint32(le.Uint16(value[2*k:])))
+			} else {
+				values = append(values, le.Uint32(value[4*k:]))
+			}
+		}
+	}
+
+	return values
+}
+
+func testTIFFPalette(n int) (p color.Palette) {
+
+	for i := 0; i < n; i++ {
+		p = append(p, color.RGBA{uint8(i * 7), uint8(255 - i), uint8(i * 3), 0xff})
+	}
+
+	return p
+}
+
+func TestOptimizeTIFF(t *testing.T) {
+
+	le, be := testTIFFOrder(binary.LittleEndian), testTIFFOrder(binary.BigEndian)
+	rect := image.Rect(0, 0, 64, 48)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"gray", testTIFFEncode(t, testTIFFImage(image.NewGray(rect), 0xff), tiff.Uncompressed)},
+		{"gray deflate", testTIFFEncode(t, testTIFFImage(image.NewGray(rect), 0xff), tiff.Deflate)},
+		{"gray16", testTIFFEncode(t, testTIFFImage(image.NewGray16(rect), 0xff), tiff.Uncompressed)},
+		{"paletted", testTIFFEncode(t, testTIFFImage(image.NewPaletted(rect, testTIFFPalette(16)), 0xff),
+			tiff.Uncompressed)},
+		{"nrgba", testTIFFEncode(t, testTIFFImage(image.NewNRGBA(rect), 0x80), tiff.Uncompressed)},
+		{"nrgba opaque", testTIFFEncode(t, testTIFFImage(image.NewNRGBA(rect), 0xff), tiff.Uncompressed)},
+		{"rgba", testTIFFEncode(t, testTIFFImage(image.NewRGBA(rect), 0x80), tiff.Uncompressed)},
+		{"nrgba64", testTIFFEncode(t, testTIFFImage(image.NewNRGBA64(rect), 0x80), tiff.Uncompressed)},
+		{"rgba64 opaque", testTIFFEncode(t, testTIFFImage(image.NewRGBA64(rect), 0xff), tiff.Uncompressed)},
+		{"rgb", (&testTIFF{order: le, width: 64, height: 48, samples: 3, bits: 8,
+			raw: testTIFFRaw(le, 64, 48, 3, 8)}).encode()},
+		{"rgb16 mm", (&testTIFF{order: be, width: 32, height: 16, samples: 3, bits: 16,
+			raw: testTIFFRaw(be, 32, 16, 3, 16)}).encode()},
+		{"gray mm", (&testTIFF{order: be, width: 61, height: 17, samples: 1, bits: 8,
+			raw: testTIFFRaw(be, 61, 17, 1, 8)}).encode()},
+		// NOTE без --keep-metadata ICC профиль, как и у png, выкидывается
+		{"icc", (&testTIFF{order: le, width: 64, height: 48, samples: 3, bits: 8, raw: testTIFFRaw(le, 64, 48, 3, 8),
+			extra: []testTIFFField{{tiffICCProfile, 7, make([]uint32, 64)}}}).encode()},
+	}
+
+	o := NewTIFFOptimizer()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			want, err := tiff.Decode(bytes.NewReader(tt.data))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, effort := range []int{EffortFast, EffortDefault} {
+
+				opt, res, err := o.optimizeData(tt.data, &OptimizeOptions{Effort: effort, Verify: true})
+
+				if err != nil {
+					t.Fatalf("effort %d: %v", effort, err)
+				}
+
+				if res.NOOP {
+					t.Fatalf("effort %d: NOOP (%s) of %d bytes", effort, res.Reason, res.Size)
+				}
+
+				if effort == EffortFast && res.Variant != "deflate+predictor" {
+					t.Errorf("effort %d: variant %s, want deflate+predictor only", effort, res.Variant)
+				}
+
+				got, err := tiff.Decode(bytes.NewReader(opt.Bytes()))
+
+				if err != nil {
+					t.Fatalf("effort %d, %s: %v", effort, res.Variant, err)
+				}
+
+				samePixels(t, fmt.Sprintf("effort %d, %s", effort, res.Variant), want, got)
+			}
+		})
+	}
+}
+
+func TestOptimizeTIFFNOOP(t *testing.T) {
+
+	le := testTIFFOrder(binary.LittleEndian)
+	rgb := testTIFF{order: le, width: 64, height: 48, samples: 3, bits: 8, raw: testTIFFRaw(le, 64, 48, 3, 8)}
+
+	icc := rgb
+	icc.extra = []testTIFFField{{tiffICCProfile, 7, make([]uint32, 64)}}
+
+	cmyk := rgb
+	cmyk.samples, cmyk.photometric, cmyk.raw = 4, 5, testTIFFRaw(le, 64, 48, 4, 8)
+
+	bigTIFF := []byte("II+\x00\x08\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00")
+
+	tests := []struct {
+		name   string
+		data   []byte
+		keep   bool
+		reason string
+	}{
+		{"multi-page", testTIFFPages(testTIFFEncode(t, testTIFFImage(image.NewGray(image.Rect(0, 0, 64, 48)), 0xff),
+			tiff.Uncompressed)), false, "multi-page"},
+		{"icc with keep metadata", icc.encode(), true, "ICC profile"},
+		{"cmyk", cmyk.encode(), false, "color model"},
+		{"bigtiff", bigTIFF, false, "BigTIFF"},
+	}
+
+	o := NewTIFFOptimizer()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			opt, res, err := o.optimizeData(tt.data, &OptimizeOptions{Effort: EffortDefault, Verify: true,
+				KeepMetadata: tt.keep})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !res.NOOP || opt != nil || !strings.Contains(res.Reason, tt.reason) {
+				t.Fatalf("NOOP %v (%q), %v, want NOOP with %q", res.NOOP, res.Reason, opt != nil, tt.reason)
+			}
+		})
+	}
+
+	// NOTE а вот не tiff или битый tiff - ошибка
+	for _, data := range [][]byte{[]byte("II*"), []byte("GIF89a\x00\x00"), []byte("II*\x00\xff\x00\x00\x00")} {
+		if _, _, err := o.optimizeData(data, &OptimizeOptions{Effort: EffortDefault}); err == nil {
+			t.Errorf("%q: no error", data)
+		}
+	}
+}
+
+// TestWriteTIFF checks own predictor writer against x/image/tiff decoder
+func TestWriteTIFF(t *testing.T) {
+
+	rect := image.Rect(1, 2, 34, 19)
+
+	tests := []struct {
+		name    string
+		img     image.Image
+		samples int
+		bits    int
+		extra   uint32
+	}{
+		{"gray", testTIFFImage(image.NewGray(rect), 0xff), 1, 8, 0},
+		{"gray16", testTIFFImage(image.NewGray16(rect), 0xff), 1, 16, 0},
+		{"paletted", testTIFFImage(image.NewPaletted(rect, testTIFFPalette(200)), 0xff), 1, 8, 0},
+		{"rgba opaque", testTIFFImage(image.NewRGBA(rect), 0xff), 3, 8, 0},
+		{"rgba", testTIFFImage(image.NewRGBA(rect), 0x40), 4, 8, 1},
+		{"nrgba", testTIFFImage(image.NewNRGBA(rect), 0x40), 4, 8, 2},
+		{"rgba64 opaque", testTIFFImage(image.NewRGBA64(rect), 0xff), 3, 16, 0},
+		{"nrgba64", testTIFFImage(image.NewNRGBA64(rect), 0x40), 4, 16, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			b, err := writeTIFF(tt.img)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := tiff.Decode(bytes.NewReader(b.Bytes()))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			samePixels(t, tt.name, tt.img, got)
+
+			if err = verifyTIFF(tt.img, b.Bytes()); err != nil {
+				t.Error(err)
+			}
+
+			data := b.Bytes()
+
+			if v := testTIFFTag(data, tiffSamplesPerPixel); len(v) != 1 || int(v[0]) != tt.samples {
+				t.Errorf("samples per pixel %v, want %d", v, tt.samples)
+			}
+
+			if v := testTIFFTag(data, tiffBitsPerSample); len(v) != tt.samples || int(v[0]) != tt.bits {
+				t.Errorf("bits per sample %v, want %d x %d", v, tt.samples, tt.bits)
+			}
+
+			if v := testTIFFTag(data, tiffExtraSamples); tt.extra == 0 && v != nil || tt.extra != 0 &&
+				(len(v) != 1 || v[0] != tt.extra) {
+				t.Errorf("extra samples %v, want %d", v, tt.extra)
+			}
+
+			if v := testTIFFTag(data, tiffPredictor); len(v) != 1 || v[0] != tiffPredictorHorizontal {
+				t.Errorf("predictor %v", v)
+			}
+		})
+	}
+
+	if _, err := writeTIFF(image.NewCMYK(rect)); err == nil {
+		t.Error("cmyk: no error")
+	}
+}
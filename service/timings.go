@@ -0,0 +1,100 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Timings is time an optimizer spent in each stage of its assets, summed over all workers (so with -j N it may
+// exceed the wall time of the run)
+type Timings struct {
+	Decode time.Duration
+	Encode time.Duration
+	IO     time.Duration
+}
+
+func (t Timings) String() string {
+	return fmt.Sprintf("decode %.1fs, encode %.1fs, io %.1fs", t.Decode.Seconds(), t.Encode.Seconds(), t.IO.Seconds())
+}
+
+// TimingsReporter is implemented by optimizers which account where their time goes, see PrintStat
+type TimingsReporter interface {
+	Timings() Timings
+}
+
+// durationCounter accumulates durations of concurrent calls
+type durationCounter struct {
+	n atomic.Int64
+}
+
+// since adds time passed from start, meant for defer c.since(time.Now())
+func (c *durationCounter) since(start time.Time) {
+	c.n.Add(int64(time.Since(start)))
+}
+
+func (c *durationCounter) load() time.Duration {
+	return time.Duration(c.n.Load())
+}
+
+// reportTimings is Timings of the report summary, in milliseconds
+type reportTimings struct {
+	DecodeMS int64 `json:"decode_ms"`
+	EncodeMS int64 `json:"encode_ms"`
+	IOMS     int64 `json:"io_ms"`
+}
+
+// timings returns Timings of every optimizer that reports them and has spent any time at all, by the first of its
+// formats (once per optimizer registered for several formats), and these formats sorted
+func (ao *AssetsOptimizer) timings() (exts []string, byExt map[string]Timings) {
+
+	byExt = make(map[string]Timings)
+	seen := make(map[TimingsReporter]struct{})
+
+	for _, ext := range ao.registry.Formats() {
+
+		tr, ok := ao.registry.Lookup(ext).(TimingsReporter)
+
+		if !ok {
+			continue
+		}
+
+		if _, ok = seen[tr]; ok {
+			continue
+		}
+
+		seen[tr] = struct{}{}
+
+		if t := tr.Timings(); t.Decode+t.Encode+t.IO > 0 {
+			exts, byExt[ext] = append(exts, ext), t
+		}
+	}
+
+	return exts, byExt
+}
+
+// printTimings prints timings of optimizers, see timings
+func (ao *AssetsOptimizer) printTimings() {
+
+	exts, byExt := ao.timings()
+
+	for _, ext := range exts {
+		ao.statf("Time spent on %s: %s\n", ext, byExt[ext])
+	}
+}
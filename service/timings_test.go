@@ -0,0 +1,110 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTimings(t *testing.T) {
+
+	dir, _ := testTree(t, 1)
+
+	o := NewPNGOptimizer()
+
+	// NOTE один и тот же оптимизатор под двумя форматами считается один раз, по первому из них
+	registry := NewRegistry()
+	registry.Register(extPNG, o)
+	registry.Register("tex", o)
+	registry.Register("config", NewJSONOptimizer())
+
+	var log bytes.Buffer
+
+	reportPath := filepath.Join(t.TempDir(), "report.json")
+
+	ao, err := NewAssetsOptimizer(dir, WithSettings(Settings{Registry: registry, Workers: 2, ReportJSON: reportPath,
+		Log: &log}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ao.RunContext(context.Background()); err != nil {
+		t.Fatalf("%v\n%s", err, log.String())
+	}
+
+	tm := o.Timings()
+
+	if tm.Decode <= 0 || tm.Encode <= 0 || tm.IO <= 0 {
+		t.Fatalf("timings %+v, want every stage counted", tm)
+	}
+
+	data, err := os.ReadFile(reportPath)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var r report
+
+	if err = json.Unmarshal(data, &r); err != nil {
+		t.Fatal(err)
+	}
+
+	want := reportTimings{DecodeMS: tm.Decode.Milliseconds(), EncodeMS: tm.Encode.Milliseconds(),
+		IOMS: tm.IO.Milliseconds()}
+
+	if len(r.Summary.Timings) != 1 || r.Summary.Timings[extPNG] != want {
+		t.Errorf("report timings %+v, want only png %+v", r.Summary.Timings, want)
+	}
+
+	log.Reset()
+	ao.PrintStat()
+
+	if s := log.String(); !strings.Contains(s, "Time spent on png: "+tm.String()+"\n") ||
+		strings.Contains(s, "Time spent on tex") {
+		t.Errorf("stats:\n%s", s)
+	}
+
+	// NOTE без png в отчете нет и timings
+	registry = NewRegistry()
+	registry.Register("config", NewJSONOptimizer())
+	registry.Register(extPNG, NewPNGOptimizer())
+
+	if ao, err = NewAssetsOptimizer(dir, WithSettings(Settings{Registry: registry, Extensions: []string{"config"},
+		ReportJSON: reportPath, Log: &log})); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ao.RunContext(context.Background()); err != nil {
+		t.Fatalf("%v\n%s", err, log.String())
+	}
+
+	if ao.stats.files != 1 {
+		t.Errorf("processed %d, want only item.config", ao.stats.files)
+	}
+
+	if data, err = os.ReadFile(reportPath); err != nil || bytes.Contains(data, []byte(`"timings"`)) {
+		t.Errorf("report with unused png optimizer (%v):\n%s", err, data)
+	}
+}
@@ -0,0 +1,289 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce is the quiet period after the last change before changed files are optimized, editors write a
+// single save in several steps (truncate, write, rename of temp file)
+const watchDebounce = 300 * time.Millisecond
+
+// Watch watches the root dir after Run and optimizes created and changed assets until ctx is done, then saves the
+// cache and the report; stats accumulate over the whole session. An asset failed to optimize is reported and the
+// watch goes on (as with Settings.KeepGoing)
+func (ao *AssetsOptimizer) Watch(ctx context.Context) (err error) {
+
+	defer removeTempFilesOnPanic()
+
+	if ao.fsys != nil {
+		return fmt.Errorf("watch is %w", errFSSource)
+	}
+
+	w, err := fsnotify.NewWatcher()
+
+	if err != nil {
+		return fmt.Errorf("watch error: %w", err)
+	}
+
+	defer w.Close()
+
+	if err = ao.openEvents(); err != nil {
+		return err
+	}
+
+	defer func() {
+		if e := ao.closeEvents(); e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	// NOTE сохранение недописанного файла не повод заканчивать сессию
+	ao.keepGoing = true
+
+	startTS := time.Now()
+
+	if err = ao.watchTree(w, ao.dir, nil); err != nil {
+		return fmt.Errorf("watch error: %w", err)
+	}
+
+	ao.logf(ao.log, levelInfo, "Watching dir %q for changes, Ctrl-C to stop\n", ao.dir)
+
+	var (
+		pending = make(map[string]struct{})
+		// NOTE состояние ассетов после их оптимизации: событие от собственной перезаписи (rename временного файла
+		//      поверх ассета) находит файл ровно таким, и он не оптимизируется по кругу, а временные
+		//      *.pngtmp и т.п. не являются ассетами вовсе
+		own   = make(map[string]cacheEntry)
+		timer = time.NewTimer(watchDebounce)
+	)
+
+	timer.Stop()
+
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case ev, ok := <-w.Events:
+
+			if !ok {
+				break loop
+			}
+
+			if !ao.watchEvent(w, ev, pending) {
+				continue
+			}
+
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+
+			timer.Reset(watchDebounce)
+		case err, ok := <-w.Errors:
+
+			if !ok {
+				break loop
+			}
+
+			ao.logf(ao.log, levelWarn, "watch: %s\n", err)
+		case <-timer.C:
+
+			if err = ao.optimizeChanged(ctx, pending, own); err != nil {
+				break loop
+			}
+
+			pending = make(map[string]struct{})
+		}
+	}
+
+	if e := ao.saveCache(); e != nil && err == nil {
+		err = e
+	}
+
+	if ao.reportPath != "" {
+		if e := ao.writeReport(time.Since(startTS), err); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	// NOTE окончание ctx - штатный конец сессии
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+
+	return err
+}
+
+// watchTree adds every not excluded dir of root to w, assets already in root are added to pending if it is not nil
+// (root is a dir just created, its files may be written before it is watched)
+func (ao *AssetsOptimizer) watchTree(w *fsnotify.Watcher, root string, pending map[string]struct{}) error {
+
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+
+		if err != nil {
+			return err
+		}
+
+		if !d.IsDir() {
+
+			if pending != nil && d.Type().IsRegular() && ao.isWatched(path) {
+				pending[path] = struct{}{}
+			}
+
+			return nil
+		}
+
+		if rel, err := filepath.Rel(ao.dir, path); err == nil {
+			if excluded, err := ao.isExcluded(rel, true); err != nil {
+				return err
+			} else if excluded {
+				return filepath.SkipDir
+			}
+		}
+
+		return w.Add(path)
+	})
+}
+
+// watchEvent adds created or written asset of ev to pending and reports whether it did so, created dir is watched
+func (ao *AssetsOptimizer) watchEvent(w *fsnotify.Watcher, ev fsnotify.Event, pending map[string]struct{}) bool {
+
+	// NOTE rename поверх ассета приходит как Create, удаление и chmod не интересны
+	if !ev.Has(fsnotify.Create) && !ev.Has(fsnotify.Write) {
+		return false
+	}
+
+	info, err := os.Lstat(ev.Name)
+
+	if err != nil {
+		return false
+	}
+
+	if info.IsDir() {
+
+		n := len(pending)
+
+		if err = ao.watchTree(w, ev.Name, pending); err != nil {
+			ao.logf(ao.log, levelWarn, "watch dir %q: %s\n", ev.Name, err)
+		}
+
+		return len(pending) > n
+	}
+
+	if !info.Mode().IsRegular() || !ao.isWatched(ev.Name) {
+		return false
+	}
+
+	pending[ev.Name] = struct{}{}
+
+	return true
+}
+
+// isWatched reports whether path is a file of a format some optimizer is registered for
+func (ao *AssetsOptimizer) isWatched(path string) bool {
+
+	ext := ao.resolveExt(path)
+
+	return ext != "" && ao.optimizerFor(ext) != nil
+}
+
+// optimizeChanged optimizes pending assets the way Run does, skipping the ones left by own previous optimization
+// as they are (see own)
+func (ao *AssetsOptimizer) optimizeChanged(ctx context.Context, pending map[string]struct{},
+	own map[string]cacheEntry) (err error) {
+
+	paths := make([]string, 0, len(pending))
+
+	for path := range pending {
+		paths = append(paths, path)
+	}
+
+	sort.Strings(paths)
+
+	var assets []asset
+
+	for _, path := range paths {
+
+		info, err := os.Lstat(path)
+
+		// NOTE файл мог быть удален или заменен каталогом после события
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+
+		if e, ok := own[path]; ok && e == fileEntry(info) {
+			continue
+		}
+
+		d := fs.FileInfoToDirEntry(info)
+
+		if skip, err := ao.skipExcluded(path, d); skip || err != nil {
+			continue
+		}
+
+		if err = ao.visitFile(path, d, func(a asset) error {
+			assets = append(assets, a)
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	if len(assets) == 0 {
+		return nil
+	}
+
+	walk := func(ctx context.Context, fn func(a asset) error) error {
+		return walkCollected(ctx, assets, fn)
+	}
+
+	if ao.workers > 1 {
+		err = ao.runParallel(ctx, walk)
+	} else {
+		err = walk(ctx, func(a asset) error {
+			return ao.optimizeAsset(ao.log, a)
+		})
+	}
+
+	for _, a := range assets {
+		if info, e := os.Lstat(a.path); e == nil {
+			own[a.path] = fileEntry(info)
+		} else {
+			delete(own, a.path)
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return ao.saveCache()
+}
@@ -0,0 +1,160 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is bytes.Buffer safe to read while the watch writes its log
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+// waitFor polls cond until it is true, failing the test after a few seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(20 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+
+	const (
+		data     = "{ \"a\": 1 }"
+		minified = `{"a":1}`
+	)
+
+	dir := t.TempDir()
+
+	var log syncBuffer
+
+	ao, err := NewAssetsOptimizer(dir, WithSettings(Settings{MinifyJSON: true, Log: &log}))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+
+	go func() {
+		done <- ao.Watch(ctx)
+	}()
+
+	defer func() {
+
+		cancel()
+
+		if err := <-done; err != nil {
+			t.Errorf("watch: %v\n%s", err, log.String())
+		}
+	}()
+
+	waitFor(t, "the watch to start", func() bool {
+		return strings.Contains(log.String(), "Watching dir")
+	})
+
+	stats := func() (files, errors uint) {
+		ao.mu.Lock()
+		defer ao.mu.Unlock()
+		return ao.stats.files, ao.stats.errors
+	}
+
+	content := func(path string) string {
+		b, _ := os.ReadFile(path)
+		return string(b)
+	}
+
+	// NOTE сохранение в несколько шагов: недописанный файл - битый JSON, но до тишины он не оптимизируется
+	path := filepath.Join(dir, "a.config")
+
+	for _, step := range []string{"", `{ "a"`, data} {
+
+		if err = os.WriteFile(path, []byte(step), 0o666); err != nil {
+			t.Fatal(err)
+		}
+
+		time.Sleep(watchDebounce / 6)
+	}
+
+	waitFor(t, "a.config to be optimized", func() bool {
+		return content(path) == minified
+	})
+
+	// NOTE собственная перезапись a.config тоже событие, но по кругу ассет не оптимизируется
+	time.Sleep(3 * watchDebounce)
+
+	if files, errors := stats(); files != 1 || errors != 0 {
+		t.Fatalf("processed %d with %d errors, want the asset optimized once\n%s", files, errors, log.String())
+	}
+
+	// NOTE а его следующее изменение уже не свое
+	if err = os.WriteFile(path, []byte(data), 0o666); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "a.config to be optimized again", func() bool {
+		return content(path) == minified
+	})
+
+	// NOTE ассеты только что созданного каталога
+	sub := filepath.Join(dir, "sub")
+
+	if err = os.Mkdir(sub, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = os.WriteFile(filepath.Join(sub, "b.config"), []byte(data), 0o666); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "sub/b.config to be optimized", func() bool {
+		return content(filepath.Join(sub, "b.config")) == minified
+	})
+
+	time.Sleep(3 * watchDebounce)
+
+	if files, errors := stats(); files != 3 || errors != 0 {
+		t.Errorf("processed %d with %d errors, want 3 without errors\n%s", files, errors, log.String())
+	}
+}
@@ -0,0 +1,33 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"path/filepath"
+)
+
+// WebPEncoder is implemented by optimizers able to emit lossless WebP copy of the asset
+type WebPEncoder interface {
+	// EncodeWebP returns nil buffer if the asset can't be stored as WebP without loss
+	EncodeWebP(path string, opts *OptimizeOptions) (*bytes.Buffer, error)
+}
+
+// webpSidecar returns foo.webp path for foo.png
+func webpSidecar(path string) string {
+	return path[:len(path)-len(filepath.Ext(path))] + ".webp"
+}
@@ -0,0 +1,1117 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"math/bits"
+	"sort"
+)
+
+// own minimal lossless WebP (VP8L) encoder, go stdlib has no WebP at all and golang.org/x/image only decodes it
+// SEE https://developers.google.com/speed/webp/docs/webp_lossless_bitstream_specification (RFC 9649)
+//     $ 3 Transforms, $ 4 Image Data, $ 5 Entropy Code
+//
+// NOTE поддерживается только то, что дает выигрыш на спрайтах: color indexing (палитра с упаковкой пикселей),
+//      subtract green + predictor, LZ77 и color cache; без cross color transform и meta prefix codes
+
+const (
+	vp8lSignature = 0x2f
+
+	vp8lMaxSize = 1 << 14
+
+	vp8lTransformPredictor     = 0
+	vp8lTransformSubtractGreen = 2
+	vp8lTransformColorIndexing = 3
+
+	vp8lNumLiterals   = 256
+	vp8lNumLengths    = 24
+	vp8lNumDistances  = 40
+	vp8lNumCodeLength = 19
+	vp8lNumPredictors = 14
+
+	vp8lMaxCodeLength       = 15
+	vp8lMaxCLCodeLength     = 7
+	vp8lColorCacheMult      = 0x1e35a7bd
+	vp8lMaxColorCacheBits   = 10
+	vp8lNumShortDistances   = 120
+	vp8lMaxBackRefLength    = 4096
+	vp8lMinBackRefLength    = 3
+	vp8lMaxBackRefDistance  = 1<<20 - vp8lNumShortDistances
+	vp8lBackRefHashBits     = 16
+	vp8lBackRefChainLimit   = 64
+	vp8lPredictorSmallImage = 128 * 128
+)
+
+const (
+	vp8lGreen = iota
+	vp8lRed
+	vp8lBlue
+	vp8lAlpha
+	vp8lDist
+
+	vp8lNumCodes
+)
+
+var (
+	errWebPTooLarge = errors.New("image is too large for WebP")
+
+	// SEE $ 5.2.2 Decoding of Code Lengths
+	vp8lCodeLengthOrder = [vp8lNumCodeLength]uint8{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+	// SEE $ 4.2.2 LZ77 Backward Reference, (dy << 4) | (8 - dx)
+	vp8lDistanceMap = [vp8lNumShortDistances]uint8{
+		0x18, 0x07, 0x17, 0x19, 0x28, 0x06, 0x27, 0x29, 0x16, 0x1a,
+		0x26, 0x2a, 0x38, 0x05, 0x37, 0x39, 0x15, 0x1b, 0x36, 0x3a,
+		0x25, 0x2b, 0x48, 0x04, 0x47, 0x49, 0x14, 0x1c, 0x35, 0x3b,
+		0x46, 0x4a, 0x24, 0x2c, 0x58, 0x45, 0x4b, 0x34, 0x3c, 0x03,
+		0x57, 0x59, 0x13, 0x1d, 0x56, 0x5a, 0x23, 0x2d, 0x44, 0x4c,
+		0x55, 0x5b, 0x33, 0x3d, 0x68, 0x02, 0x67, 0x69, 0x12, 0x1e,
+		0x66, 0x6a, 0x22, 0x2e, 0x54, 0x5c, 0x43, 0x4d, 0x65, 0x6b,
+		0x32, 0x3e, 0x78, 0x01, 0x77, 0x79, 0x53, 0x5d, 0x11, 0x1f,
+		0x64, 0x6c, 0x42, 0x4e, 0x76, 0x7a, 0x21, 0x2f, 0x75, 0x7b,
+		0x31, 0x3f, 0x63, 0x6d, 0x52, 0x5e, 0x00, 0x74, 0x7c, 0x41,
+		0x4f, 0x10, 0x20, 0x62, 0x6e, 0x30, 0x73, 0x7d, 0x51, 0x5f,
+		0x40, 0x72, 0x7e, 0x61, 0x6f, 0x50, 0x71, 0x7f, 0x60, 0x70,
+	}
+)
+
+// encodeWebPLossless encodes img as lossless WebP, fully transparent pixels are stored as transparent black
+// (the same way paletted variants of png fold them); tries every supported transform set, the smallest one wins
+func encodeWebPLossless(img *image.NRGBA) (_ *bytes.Buffer, err error) {
+
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	if w < 1 || h < 1 || w > vp8lMaxSize || h > vp8lMaxSize {
+		return nil, errWebPTooLarge
+	}
+
+	argb, hasAlpha := vp8lARGB(img)
+
+	var best []byte
+
+	try := func(data []byte) {
+		if best == nil || len(data) < len(best) {
+			best = data
+		}
+	}
+
+	if palette := vp8lPalette(argb); palette != nil {
+		try(vp8lEncodePaletted(argb, w, h, hasAlpha, palette))
+	}
+
+	// NOTE у маленьких изображений каждый лишний блок предиктора заметен, поэтому пробуется и более крупный
+	try(vp8lEncodePredicted(argb, w, h, hasAlpha, 4))
+
+	if w*h <= vp8lPredictorSmallImage {
+		try(vp8lEncodePredicted(argb, w, h, hasAlpha, 3))
+	}
+
+	try(vp8lEncodePlain(argb, w, h, hasAlpha))
+
+	return webpContainer(best), nil
+}
+
+// vp8lARGB returns pixels of img as ARGB, fully transparent ones as transparent black
+func vp8lARGB(img *image.NRGBA) (argb []uint32, hasAlpha bool) {
+
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	argb = make([]uint32, w*h)
+
+	for y := 0; y < h; y++ {
+
+		row := img.Pix[img.PixOffset(bounds.Min.X, bounds.Min.Y+y):][:w*4]
+
+		for x := 0; x < w; x++ {
+
+			px := row[x*4 : x*4+4]
+
+			if px[3] != 0xff {
+				hasAlpha = true
+			}
+
+			if px[3] != 0 {
+				argb[y*w+x] = uint32(px[3])<<24 | uint32(px[0])<<16 | uint32(px[1])<<8 | uint32(px[2])
+			}
+		}
+	}
+
+	return argb, hasAlpha
+}
+
+// webpContainer wraps VP8L bitstream into RIFF
+func webpContainer(vp8l []byte) *bytes.Buffer {
+
+	// SEE https://developers.google.com/speed/webp/docs/riff_container "Simple File Format (Lossless)"
+	b := bytes.NewBuffer(make([]byte, 0, 20+len(vp8l)+1))
+
+	pad := len(vp8l) & 1
+
+	b.WriteString("RIFF")
+	_ = binary.Write(b, binary.LittleEndian, uint32(4+8+len(vp8l)+pad))
+	b.WriteString("WEBPVP8L")
+	_ = binary.Write(b, binary.LittleEndian, uint32(len(vp8l)))
+	b.Write(vp8l)
+
+	if pad != 0 {
+		b.WriteByte(0)
+	}
+
+	return b
+}
+
+// vp8lBitWriter packs values LSB first, SEE $ 2 Nomenclature ReadBits(n)
+type vp8lBitWriter struct {
+	buf   []byte
+	bits  uint64
+	nBits uint
+}
+
+func (bw *vp8lBitWriter) writeBits(v uint32, n uint) {
+
+	bw.bits |= uint64(v) << bw.nBits
+	bw.nBits += n
+
+	for bw.nBits >= 8 {
+		bw.buf = append(bw.buf, byte(bw.bits))
+		bw.bits >>= 8
+		bw.nBits -= 8
+	}
+}
+
+func (bw *vp8lBitWriter) len() int {
+	return len(bw.buf)*8 + int(bw.nBits)
+}
+
+func (bw *vp8lBitWriter) bytes() []byte {
+
+	if bw.nBits > 0 {
+		bw.buf = append(bw.buf, byte(bw.bits))
+		bw.bits, bw.nBits = 0, 0
+	}
+
+	return bw.buf
+}
+
+// vp8lHeader writes signature and image header, SEE $ 3.2 / 3.3
+func vp8lHeader(w, h int, hasAlpha bool) *vp8lBitWriter {
+
+	bw := &vp8lBitWriter{}
+
+	bw.writeBits(vp8lSignature, 8)
+	bw.writeBits(uint32(w-1), 14)
+	bw.writeBits(uint32(h-1), 14)
+
+	if hasAlpha {
+		bw.writeBits(1, 1)
+	} else {
+		bw.writeBits(0, 1)
+	}
+
+	bw.writeBits(0, 3) // version
+
+	return bw
+}
+
+func vp8lEncodePlain(argb []uint32, w, h int, hasAlpha bool) []byte {
+
+	bw := vp8lHeader(w, h, hasAlpha)
+
+	bw.writeBits(0, 1) // no transforms
+
+	vp8lWriteImage(bw, argb, w, true)
+
+	return bw.bytes()
+}
+
+// vp8lPalette returns sorted colors of argb if there are at most 256 of them
+func vp8lPalette(argb []uint32) (palette []uint32) {
+
+	seen := make(map[uint32]struct{}, 256)
+
+	for _, c := range argb {
+
+		if _, ok := seen[c]; ok {
+			continue
+		}
+
+		if len(seen) == 256 {
+			return nil
+		}
+
+		seen[c] = struct{}{}
+	}
+
+	palette = make([]uint32, 0, len(seen))
+
+	for c := range seen {
+		palette = append(palette, c)
+	}
+
+	sort.Slice(palette, func(i, j int) bool {
+		return palette[i] < palette[j]
+	})
+
+	return palette
+}
+
+// SEE $ 4.4 Color Indexing Transform
+func vp8lEncodePaletted(argb []uint32, w, h int, hasAlpha bool, palette []uint32) []byte {
+
+	bw := vp8lHeader(w, h, hasAlpha)
+
+	bw.writeBits(1, 1)
+	bw.writeBits(vp8lTransformColorIndexing, 2)
+	bw.writeBits(uint32(len(palette)-1), 8)
+
+	// NOTE палитра всегда пишется разностями соседних цветов (покомпонентно)
+	delta := make([]uint32, len(palette))
+
+	for i := range palette {
+		if i == 0 {
+			delta[i] = palette[i]
+		} else {
+			delta[i] = vp8lSub(palette[i], palette[i-1])
+		}
+	}
+
+	vp8lWriteImage(bw, delta, len(palette), false)
+
+	index := make(map[uint32]uint32, len(palette))
+
+	for i, c := range palette {
+		index[c] = uint32(i)
+	}
+
+	// pixel bundling: 2 colors - 8 pixels per byte, 4 - 4, 16 - 2
+	var xBits uint
+
+	switch {
+	case len(palette) <= 2:
+		xBits = 3
+	case len(palette) <= 4:
+		xBits = 2
+	case len(palette) <= 16:
+		xBits = 1
+	}
+
+	pw := (w + 1<<xBits - 1) >> xBits
+	bitsPerPixel := 8 >> xBits
+	packed := make([]uint32, pw*h)
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			packed[y*pw+x>>xBits] |= index[argb[y*w+x]] << (8 + uint(x&(1<<xBits-1)*bitsPerPixel))
+		}
+	}
+
+	bw.writeBits(0, 1) // no more transforms
+
+	vp8lWriteImage(bw, packed, pw, true)
+
+	return bw.bytes()
+}
+
+// SEE $ 4.1 Predictor Transform, $ 4.3 Subtract Green Transform
+func vp8lEncodePredicted(argb []uint32, w, h int, hasAlpha bool, blockBits uint) []byte {
+
+	bw := vp8lHeader(w, h, hasAlpha)
+
+	bw.writeBits(1, 1)
+	bw.writeBits(vp8lTransformSubtractGreen, 2)
+
+	src := make([]uint32, len(argb))
+
+	for i, c := range argb {
+		g := (c >> 8) & 0xff
+		src[i] = c&0xff00ff00 | ((c>>16)-g)&0xff<<16 | (c-g)&0xff
+	}
+
+	bw.writeBits(1, 1)
+	bw.writeBits(vp8lTransformPredictor, 2)
+	bw.writeBits(uint32(blockBits-2), 3)
+
+	tw, th := (w+1<<blockBits-1)>>blockBits, (h+1<<blockBits-1)>>blockBits
+	modes := make([]uint32, tw*th)
+	residuals := make([]uint32, len(src))
+
+	for ty := 0; ty < th; ty++ {
+		for tx := 0; tx < tw; tx++ {
+
+			x0, y0 := tx<<blockBits, ty<<blockBits
+			x1, y1 := x0+1<<blockBits, y0+1<<blockBits
+
+			if x1 > w {
+				x1 = w
+			}
+
+			if y1 > h {
+				y1 = h
+			}
+
+			bestMode, bestCost := 0, -1
+
+			for mode := 0; mode < vp8lNumPredictors; mode++ {
+
+				cost := 0
+
+				for y := y0; y < y1; y++ {
+					for x := x0; x < x1; x++ {
+						cost += vp8lResidualCost(vp8lSub(src[y*w+x], vp8lPredict(src, w, x, y, mode)))
+					}
+				}
+
+				if bestCost < 0 || cost < bestCost {
+					bestMode, bestCost = mode, cost
+				}
+			}
+
+			modes[ty*tw+tx] = uint32(bestMode) << 8
+
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					residuals[y*w+x] = vp8lSub(src[y*w+x], vp8lPredict(src, w, x, y, bestMode))
+				}
+			}
+		}
+	}
+
+	vp8lWriteImage(bw, modes, tw, false)
+
+	bw.writeBits(0, 1) // no more transforms
+
+	vp8lWriteImage(bw, residuals, w, true)
+
+	return bw.bytes()
+}
+
+// vp8lPredict returns prediction of pixel (x, y), the first row and column always use L and T
+func vp8lPredict(pix []uint32, w, x, y, mode int) uint32 {
+
+	i := y*w + x
+
+	switch {
+	case x == 0 && y == 0:
+		return 0xff000000
+	case y == 0:
+		return pix[i-1]
+	case x == 0:
+		return pix[i-w]
+	}
+
+	// NOTE TR крайнего правого пикселя - это первый пиксель текущей строки, ровно следующий в памяти за T
+	l, t, tl, tr := pix[i-1], pix[i-w], pix[i-w-1], pix[i-w+1]
+
+	switch mode {
+	case 0:
+		return 0xff000000
+	case 1:
+		return l
+	case 2:
+		return t
+	case 3:
+		return tr
+	case 4:
+		return tl
+	case 5:
+		return vp8lAverage2(vp8lAverage2(l, tr), t)
+	case 6:
+		return vp8lAverage2(l, tl)
+	case 7:
+		return vp8lAverage2(l, t)
+	case 8:
+		return vp8lAverage2(tl, t)
+	case 9:
+		return vp8lAverage2(t, tr)
+	case 10:
+		return vp8lAverage2(vp8lAverage2(l, tl), vp8lAverage2(t, tr))
+	case 11:
+		return vp8lSelect(l, t, tl)
+	case 12:
+		return vp8lClampAddSubtractFull(l, t, tl)
+	default:
+		return vp8lClampAddSubtractHalf(vp8lAverage2(l, t), tl)
+	}
+}
+
+func vp8lChannel(c uint32, shift uint) int {
+	return int(c >> shift & 0xff)
+}
+
+func vp8lAverage2(a, b uint32) uint32 {
+	return (a^b)&0xfefefefe>>1 + a&b
+}
+
+func vp8lSelect(l, t, tl uint32) uint32 {
+
+	var pl, pt int
+
+	for shift := uint(0); shift < 32; shift += 8 {
+		pl += abs(vp8lChannel(t, shift) - vp8lChannel(tl, shift))
+		pt += abs(vp8lChannel(l, shift) - vp8lChannel(tl, shift))
+	}
+
+	if pl < pt {
+		return l
+	}
+
+	return t
+}
+
+func vp8lClamp(v int) uint32 {
+
+	if v < 0 {
+		return 0
+	}
+
+	if v > 255 {
+		return 255
+	}
+
+	return uint32(v)
+}
+
+func vp8lClampAddSubtractFull(a, b, c uint32) (res uint32) {
+
+	for shift := uint(0); shift < 32; shift += 8 {
+		res |= vp8lClamp(vp8lChannel(a, shift)+vp8lChannel(b, shift)-vp8lChannel(c, shift)) << shift
+	}
+
+	return res
+}
+
+func vp8lClampAddSubtractHalf(a, b uint32) (res uint32) {
+
+	for shift := uint(0); shift < 32; shift += 8 {
+		ca := vp8lChannel(a, shift)
+		res |= vp8lClamp(ca+(ca-vp8lChannel(b, shift))/2) << shift
+	}
+
+	return res
+}
+
+// vp8lSub per channel a - b mod 256
+func vp8lSub(a, b uint32) uint32 {
+	return ((a|0x00ff00ff)-(b&0xff00ff00))&0xff00ff00 | ((a|0xff00ff00)-(b&0x00ff00ff))&0x00ff00ff
+}
+
+// vp8lResidualCost the same heuristic as png filters choice: sum of channels as signed bytes
+func vp8lResidualCost(r uint32) (cost int) {
+
+	for shift := uint(0); shift < 32; shift += 8 {
+		cost += abs(int(int8(r >> shift)))
+	}
+
+	return cost
+}
+
+// vp8lToken is either literal pixel or LZ77 backward reference
+type vp8lToken struct {
+	argb   uint32
+	length int // 0 - literal
+	dist   int // distance code (SEE vp8lDistanceCodes), not the distance itself
+}
+
+// vp8lDistanceCodes maps distances to their shortest 2D codes for image width w, SEE $ 4.2.2 Distance Mapping
+func vp8lDistanceCodes(w int) map[int]int {
+
+	codes := make(map[int]int, vp8lNumShortDistances)
+
+	for i := vp8lNumShortDistances - 1; i >= 0; i-- {
+
+		dy, dx := int(vp8lDistanceMap[i]>>4), 8-int(vp8lDistanceMap[i]&0xf)
+
+		if d := dy*w + dx; d >= 1 {
+			codes[d] = i + 1
+		}
+	}
+
+	return codes
+}
+
+// vp8lBackRefs greedy LZ77 with hash chains over pixels
+func vp8lBackRefs(argb []uint32, w int) (tokens []vp8lToken) {
+
+	n := len(argb)
+
+	head := make([]int32, 1<<vp8lBackRefHashBits)
+	prev := make([]int32, n)
+
+	for i := range head {
+		head[i] = -1
+	}
+
+	hash := func(i int) uint32 {
+		return (argb[i]*vp8lColorCacheMult ^ argb[i+1]*0x9e3779b1) >> (32 - vp8lBackRefHashBits)
+	}
+
+	insert := func(i int) {
+		if i+1 < n {
+			h := hash(i)
+			prev[i], head[h] = head[h], int32(i)
+		}
+	}
+
+	shortCodes := vp8lDistanceCodes(w)
+
+	for i := 0; i < n; {
+
+		bestLen, bestDist := 0, 0
+
+		if i+vp8lMinBackRefLength <= n {
+
+			maxLen := n - i
+
+			if maxLen > vp8lMaxBackRefLength {
+				maxLen = vp8lMaxBackRefLength
+			}
+
+			for j, chain := head[hash(i)], 0; j >= 0 && chain < vp8lBackRefChainLimit; j, chain = prev[j], chain+1 {
+
+				if i-int(j) > vp8lMaxBackRefDistance {
+					break
+				}
+
+				l := 0
+
+				for l < maxLen && argb[int(j)+l] == argb[i+l] {
+					l++
+				}
+
+				if l > bestLen {
+					bestLen, bestDist = l, i-int(j)
+
+					if l == maxLen {
+						break
+					}
+				}
+			}
+		}
+
+		if bestLen < vp8lMinBackRefLength {
+			tokens = append(tokens, vp8lToken{argb: argb[i]})
+			insert(i)
+			i++
+			continue
+		}
+
+		code, ok := shortCodes[bestDist]
+
+		if !ok {
+			code = bestDist + vp8lNumShortDistances
+		}
+
+		tokens = append(tokens, vp8lToken{length: bestLen, dist: code})
+
+		for k := 0; k < bestLen; k++ {
+			insert(i + k)
+		}
+
+		i += bestLen
+	}
+
+	return tokens
+}
+
+// vp8lPrefix splits LZ77 length or distance code v >= 1 into prefix symbol and extra bits, SEE $ 4.2.2
+func vp8lPrefix(v int) (sym int, extraBits uint, extra uint32) {
+
+	if v <= 4 {
+		return v - 1, 0, 0
+	}
+
+	d := v - 1
+	hb := bits.Len(uint(d)) - 1
+	second := (d >> (hb - 1)) & 1
+	extraBits = uint(hb - 1)
+
+	return 2*hb + second, extraBits, uint32(d) & (1<<extraBits - 1)
+}
+
+// vp8lSink receives symbols of entropy coded image, either to count them or to write them
+type vp8lSink interface {
+	symbol(code, sym int)
+	bits(v uint32, n uint)
+}
+
+// vp8lEmit replays tokens with color cache of ccBits (0 - no cache) into sink
+func vp8lEmit(tokens []vp8lToken, argb []uint32, ccBits uint, s vp8lSink) {
+
+	var cache []uint32
+
+	if ccBits > 0 {
+		cache = make([]uint32, 1<<ccBits)
+	}
+
+	shift := 32 - ccBits
+	p := 0
+
+	for _, t := range tokens {
+
+		if t.length == 0 {
+
+			c := t.argb
+
+			if cache != nil {
+
+				key := (c * vp8lColorCacheMult) >> shift
+
+				if cache[key] == c {
+					s.symbol(vp8lGreen, vp8lNumLiterals+vp8lNumLengths+int(key))
+					p++
+					continue
+				}
+
+				cache[key] = c
+			}
+
+			s.symbol(vp8lGreen, vp8lChannel(c, 8))
+			s.symbol(vp8lRed, vp8lChannel(c, 16))
+			s.symbol(vp8lBlue, vp8lChannel(c, 0))
+			s.symbol(vp8lAlpha, vp8lChannel(c, 24))
+			p++
+			continue
+		}
+
+		sym, n, extra := vp8lPrefix(t.length)
+		s.symbol(vp8lGreen, vp8lNumLiterals+sym)
+		s.bits(extra, n)
+
+		sym, n, extra = vp8lPrefix(t.dist)
+		s.symbol(vp8lDist, sym)
+		s.bits(extra, n)
+
+		if cache != nil {
+			for _, c := range argb[p : p+t.length] {
+				cache[(c*vp8lColorCacheMult)>>shift] = c
+			}
+		}
+
+		p += t.length
+	}
+}
+
+type vp8lHistogram struct {
+	freqs     [vp8lNumCodes][]uint32
+	extraBits int
+}
+
+func newVP8LHistogram(ccBits uint) *vp8lHistogram {
+
+	h := &vp8lHistogram{}
+
+	cacheSize := 0
+
+	if ccBits > 0 {
+		cacheSize = 1 << ccBits
+	}
+
+	h.freqs[vp8lGreen] = make([]uint32, vp8lNumLiterals+vp8lNumLengths+cacheSize)
+	h.freqs[vp8lRed] = make([]uint32, vp8lNumLiterals)
+	h.freqs[vp8lBlue] = make([]uint32, vp8lNumLiterals)
+	h.freqs[vp8lAlpha] = make([]uint32, vp8lNumLiterals)
+	h.freqs[vp8lDist] = make([]uint32, vp8lNumDistances)
+
+	return h
+}
+
+func (h *vp8lHistogram) symbol(code, sym int) {
+	h.freqs[code][sym]++
+}
+
+func (h *vp8lHistogram) bits(_ uint32, n uint) {
+	h.extraBits += int(n)
+}
+
+type vp8lWriterSink struct {
+	bw    *vp8lBitWriter
+	codes *[vp8lNumCodes]vp8lHuffmanCode
+}
+
+func (s *vp8lWriterSink) symbol(code, sym int) {
+	s.codes[code].write(s.bw, sym)
+}
+
+func (s *vp8lWriterSink) bits(v uint32, n uint) {
+	s.bw.writeBits(v, n)
+}
+
+// vp8lWriteImage writes entropy coded image (SEE $ 5.2), only the main (top level) image may use color cache
+// and has meta prefix codes flag
+func vp8lWriteImage(bw *vp8lBitWriter, argb []uint32, w int, topLevel bool) {
+
+	tokens := vp8lBackRefs(argb, w)
+
+	var (
+		bestBits  uint
+		bestCodes [vp8lNumCodes]vp8lHuffmanCode
+		bestCost  = -1
+	)
+
+	// NOTE размер с каждым color cache считается точно (заголовки кодов + данные), это дешево по сравнению с LZ77
+	for ccBits := uint(0); ccBits <= vp8lMaxColorCacheBits; ccBits++ {
+
+		if ccBits == 1 || (!topLevel && ccBits > 0) {
+			continue
+		}
+
+		h := newVP8LHistogram(ccBits)
+
+		vp8lEmit(tokens, argb, ccBits, h)
+
+		var (
+			codes  [vp8lNumCodes]vp8lHuffmanCode
+			header vp8lBitWriter
+		)
+
+		cost := h.extraBits
+
+		for i := range codes {
+
+			codes[i] = newVP8LHuffmanCode(h.freqs[i], vp8lMaxCodeLength)
+			codes[i].writeHeader(&header)
+
+			for sym, f := range h.freqs[i] {
+				if codes[i].single < 0 {
+					cost += int(f) * int(codes[i].lengths[sym])
+				}
+			}
+		}
+
+		cost += header.len()
+
+		if bestCost < 0 || cost < bestCost {
+			bestBits, bestCodes, bestCost = ccBits, codes, cost
+		}
+	}
+
+	if bestBits > 0 {
+		bw.writeBits(1, 1)
+		bw.writeBits(uint32(bestBits), 4)
+	} else {
+		bw.writeBits(0, 1)
+	}
+
+	if topLevel {
+		bw.writeBits(0, 1) // single prefix codes group
+	}
+
+	for i := range bestCodes {
+		bestCodes[i].writeHeader(bw)
+	}
+
+	vp8lEmit(tokens, argb, bestBits, &vp8lWriterSink{bw, &bestCodes})
+}
+
+// vp8lHuffmanCode canonical prefix code, SEE $ 5.2.2 Decoding of Code Lengths
+type vp8lHuffmanCode struct {
+	lengths []uint8
+	codes   []uint16 // bit reversed, ready to be written LSB first
+	used    []int    // used symbols in ascending order
+	single  int      // the only used symbol (written with 0 bits) or -1
+}
+
+func newVP8LHuffmanCode(freqs []uint32, maxLength int) (c vp8lHuffmanCode) {
+
+	c.lengths = vp8lCodeLengths(freqs, maxLength)
+	c.codes = make([]uint16, len(freqs))
+	c.single = -1
+
+	for sym, l := range c.lengths {
+		if l > 0 {
+			c.used = append(c.used, sym)
+		}
+	}
+
+	if len(c.used) <= 1 {
+
+		if len(c.used) == 1 {
+			c.single = c.used[0]
+		} else {
+			c.single = 0
+		}
+
+		return c
+	}
+
+	// SEE golang.org/x/image/vp8l codeLengthsToCodes, the same as deflate
+	var (
+		count [vp8lMaxCodeLength + 1]uint16
+		next  [vp8lMaxCodeLength + 1]uint16
+		code  uint16
+	)
+
+	for _, l := range c.lengths {
+		count[l]++
+	}
+
+	count[0] = 0
+
+	for l := 1; l <= vp8lMaxCodeLength; l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+
+	for sym, l := range c.lengths {
+		if l > 0 {
+			c.codes[sym] = bits.Reverse16(next[l]) >> (16 - l)
+			next[l]++
+		}
+	}
+
+	return c
+}
+
+func (c *vp8lHuffmanCode) write(bw *vp8lBitWriter, sym int) {
+	if c.single < 0 {
+		bw.writeBits(uint32(c.codes[sym]), uint(c.lengths[sym]))
+	}
+}
+
+// writeHeader writes the code in simple (1-2 symbols < 256) or normal form
+func (c *vp8lHuffmanCode) writeHeader(bw *vp8lBitWriter) {
+
+	if len(c.used) <= 2 && (len(c.used) == 0 || c.used[len(c.used)-1] < 256) {
+
+		syms := c.used
+
+		if len(syms) == 0 {
+			syms = []int{0}
+		}
+
+		bw.writeBits(1, 1) // simple
+		bw.writeBits(uint32(len(syms)-1), 1)
+
+		// NOTE первый символ получает код 0, второй - 1, что совпадает с каноническим кодом по возрастанию
+		if syms[0] < 2 {
+			bw.writeBits(0, 1)
+			bw.writeBits(uint32(syms[0]), 1)
+		} else {
+			bw.writeBits(1, 1)
+			bw.writeBits(uint32(syms[0]), 8)
+		}
+
+		if len(syms) == 2 {
+			bw.writeBits(uint32(syms[1]), 8)
+		}
+
+		return
+	}
+
+	bw.writeBits(0, 1) // normal
+
+	tokens := vp8lCodeLengthTokens(c.lengths)
+
+	freqs := make([]uint32, vp8lNumCodeLength)
+
+	for _, t := range tokens {
+		freqs[t.sym]++
+	}
+
+	clc := newVP8LHuffmanCode(freqs, vp8lMaxCLCodeLength)
+
+	n := vp8lNumCodeLength
+
+	for n > 4 && clc.lengths[vp8lCodeLengthOrder[n-1]] == 0 {
+		n--
+	}
+
+	bw.writeBits(uint32(n-4), 4)
+
+	for _, sym := range vp8lCodeLengthOrder[:n] {
+		bw.writeBits(uint32(clc.lengths[sym]), 3)
+	}
+
+	bw.writeBits(0, 1) // max_symbol is the alphabet size
+
+	for _, t := range tokens {
+		clc.write(bw, t.sym)
+		bw.writeBits(t.extra, t.extraBits)
+	}
+}
+
+type vp8lCodeLengthToken struct {
+	sym       int
+	extra     uint32
+	extraBits uint
+}
+
+// vp8lCodeLengthTokens RLE of code lengths: 16 - repeat previous non-zero 3..6 times, 17 - 3..10 zeros,
+// 18 - 11..138 zeros
+func vp8lCodeLengthTokens(lengths []uint8) (tokens []vp8lCodeLengthToken) {
+
+	prev := uint8(8) // SEE $ 5.2.2 "If code 16 is used before a nonzero value has been emitted, a value of 8 is repeated"
+
+	for i := 0; i < len(lengths); {
+
+		v, run := lengths[i], 1
+
+		for i+run < len(lengths) && lengths[i+run] == v {
+			run++
+		}
+
+		i += run
+
+		if v == 0 {
+
+			for run >= 11 {
+
+				r := run
+
+				if r > 138 {
+					r = 138
+				}
+
+				tokens = append(tokens, vp8lCodeLengthToken{18, uint32(r - 11), 7})
+				run -= r
+			}
+
+			if run >= 3 {
+				tokens = append(tokens, vp8lCodeLengthToken{17, uint32(run - 3), 3})
+				run = 0
+			}
+
+			for ; run > 0; run-- {
+				tokens = append(tokens, vp8lCodeLengthToken{sym: 0})
+			}
+
+			continue
+		}
+
+		if v != prev {
+			tokens = append(tokens, vp8lCodeLengthToken{sym: int(v)})
+			prev = v
+			run--
+		}
+
+		for run >= 3 {
+
+			r := run
+
+			if r > 6 {
+				r = 6
+			}
+
+			tokens = append(tokens, vp8lCodeLengthToken{16, uint32(r - 3), 2})
+			run -= r
+		}
+
+		for ; run > 0; run-- {
+			tokens = append(tokens, vp8lCodeLengthToken{sym: int(v)})
+		}
+	}
+
+	return tokens
+}
+
+// vp8lCodeLengths builds Huffman code lengths limited by maxLength: rarest symbols are made more frequent
+// until the tree is shallow enough
+func vp8lCodeLengths(freqs []uint32, maxLength int) (lengths []uint8) {
+
+	lengths = make([]uint8, len(freqs))
+
+	type node struct {
+		w           uint64
+		left, right int // -1 for leaf
+		sym         int
+	}
+
+	var used []int
+
+	for sym, f := range freqs {
+		if f > 0 {
+			used = append(used, sym)
+		}
+	}
+
+	if len(used) == 0 {
+		return lengths
+	}
+
+	if len(used) == 1 {
+		lengths[used[0]] = 1
+		return lengths
+	}
+
+	for floor := uint64(1); ; floor *= 2 {
+
+		nodes := make([]node, 0, 2*len(used)-1)
+
+		for _, sym := range used {
+
+			w := uint64(freqs[sym])
+
+			if w < floor {
+				w = floor
+			}
+
+			nodes = append(nodes, node{w, -1, -1, sym})
+		}
+
+		sort.SliceStable(nodes, func(i, j int) bool {
+			return nodes[i].w < nodes[j].w
+		})
+
+		// NOTE классический алгоритм двух очередей: листья уже отсортированы, внутренние узлы появляются
+		//      в порядке неубывания веса
+		leaf, inner := 0, len(used)
+
+		pop := func() int {
+			if leaf < len(used) && (inner >= len(nodes) || nodes[leaf].w <= nodes[inner].w) {
+				leaf++
+				return leaf - 1
+			}
+			inner++
+			return inner - 1
+		}
+
+		for len(nodes) < 2*len(used)-1 {
+			a := pop()
+			b := pop()
+			nodes = append(nodes, node{nodes[a].w + nodes[b].w, a, b, -1})
+		}
+
+		depth := make([]int, len(nodes))
+		maxDepth := 0
+
+		for i := len(nodes) - 1; i >= 0; i-- {
+
+			if nodes[i].left < 0 {
+				lengths[nodes[i].sym] = uint8(depth[i])
+
+				if depth[i] > maxDepth {
+					maxDepth = depth[i]
+				}
+
+				continue
+			}
+
+			depth[nodes[i].left] = depth[i] + 1
+			depth[nodes[i].right] = depth[i] + 1
+		}
+
+		if maxDepth <= maxLength {
+			return lengths
+		}
+	}
+}
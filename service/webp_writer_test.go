@@ -0,0 +1,171 @@
+//
+//  Copyright (C) 2024 Illirgway
+//
+//  This program is free software: you can redistribute it and/or modify
+//  it under the terms of the GNU General Public License as published by
+//  the Free Software Foundation, either version 3 of the License, or
+//  (at your option) any later version.
+//
+//  This program is distributed in the hope that it will be useful,
+//  but WITHOUT ANY WARRANTY; without even the implied warranty of
+//  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//  GNU General Public License for more details.
+//
+//  You should have received a copy of the GNU General Public License
+//  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+// webpTestImage returns w x h image of n colors (0 - any) and with alpha of every pixel by alpha(x, y)
+func webpTestImage(w, h, n int, alpha func(x, y int) uint8) *image.NRGBA {
+
+	r := testRand(uint32(w*h + n))
+
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+
+			c := color.NRGBA{uint8(x * 4), uint8(y * 4), r.next(), alpha(x, y)}
+
+			if n > 0 {
+				k := int(r.next()) % n
+				c.R, c.G, c.B = uint8(k*53), uint8(k*17), uint8(255-k)
+			}
+
+			img.SetNRGBA(x, y, c)
+		}
+	}
+
+	return img
+}
+
+func TestEncodeWebPLossless(t *testing.T) {
+
+	opaque := func(x, y int) uint8 { return 0xff }
+	holes := func(x, y int) uint8 { return uint8((x + y) % 3 * 0x7f) }
+
+	// NOTE повторяющийся узор для LZ77 и color cache
+	tiles := image.NewNRGBA(image.Rect(0, 0, 96, 40))
+
+	for y := 0; y < 40; y++ {
+		for x := 0; x < 96; x++ {
+			tiles.SetNRGBA(x, y, color.NRGBA{uint8(x % 12 * 20), uint8(y % 5 * 50), uint8((x / 12) ^ y), 0xff})
+		}
+	}
+
+	tests := []struct {
+		name string
+		img  *image.NRGBA
+	}{
+		{"1x1", webpTestImage(1, 1, 0, opaque)},
+		{"2 colors", webpTestImage(37, 11, 2, opaque)},
+		{"4 colors", webpTestImage(37, 11, 4, holes)},
+		{"16 colors", webpTestImage(37, 11, 16, opaque)},
+		{"256 colors", webpTestImage(64, 64, 256, opaque)},
+		{"noise", webpTestImage(33, 17, 0, opaque)},
+		{"noise alpha", webpTestImage(33, 17, 0, holes)},
+		{"gradient alpha", webpTestImage(64, 48, 0, func(x, y int) uint8 { return uint8(x * 4) })},
+		{"tiles", tiles},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			b, err := encodeWebPLossless(tt.img)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			img, err := webp.Decode(bytes.NewReader(b.Bytes()))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			samePixels(t, "webp", tt.img, img)
+
+			// NOTE побеждает только один набор преобразований, так что каждый проверяется и отдельно
+			argb, hasAlpha := vp8lARGB(tt.img)
+			w, h := tt.img.Rect.Dx(), tt.img.Rect.Dy()
+
+			variants := map[string][]byte{
+				"plain":       vp8lEncodePlain(argb, w, h, hasAlpha),
+				"predicted 3": vp8lEncodePredicted(argb, w, h, hasAlpha, 3),
+				"predicted 4": vp8lEncodePredicted(argb, w, h, hasAlpha, 4),
+			}
+
+			if palette := vp8lPalette(argb); palette != nil {
+				variants["paletted"] = vp8lEncodePaletted(argb, w, h, hasAlpha, palette)
+			}
+
+			for as, data := range variants {
+
+				img, err := webp.Decode(bytes.NewReader(webpContainer(data).Bytes()))
+
+				if err != nil {
+					t.Fatalf("%s: %v", as, err)
+				}
+
+				samePixels(t, as, tt.img, img)
+			}
+		})
+	}
+}
+
+func TestPNGEncodeWebP(t *testing.T) {
+
+	dir := t.TempDir()
+
+	o := NewPNGOptimizer()
+
+	for name, data := range readPNGFixtures(t) {
+		t.Run(name, func(t *testing.T) {
+
+			path := filepath.Join(dir, name+".png")
+
+			if err := os.WriteFile(path, data, 0o666); err != nil {
+				t.Fatal(err)
+			}
+
+			b, err := o.EncodeWebP(path, &OptimizeOptions{})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			src := decodeTestPNG(t, data)
+
+			// NOTE VP8L 8-битный, настоящие 16 бит в него не помещаются
+			if b == nil {
+
+				if gray16, ok := src.(*image.Gray16); !ok || o.gray16to8(gray16) != nil {
+					t.Fatalf("no webp of %T", src)
+				}
+
+				return
+			}
+
+			img, err := webp.Decode(bytes.NewReader(b.Bytes()))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			samePixels(t, fmt.Sprintf("webp of %T", src), src, img)
+		})
+	}
+}